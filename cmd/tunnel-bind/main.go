@@ -0,0 +1,72 @@
+//go:build !windows
+
+// Command tunnel-bind binds a local port below 1024 for tunneld, which runs
+// unprivileged, and hands the listening socket over to it. Give it the
+// capability to bind these ports, or make it setuid root:
+//
+//	sudo setcap cap_net_bind_service=+ep "$(command -v tunnel-bind)"
+//
+// tunneld runs it with the address to bind and one end of a socket pair as
+// file descriptor 3. It binds nothing else and exits once the socket is sent.
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Ports below this one need privileges to be bound
+const privilegedPorts = 1024
+
+func main() {
+	if len(os.Args) != 2 {
+		fail("usage: tunnel-bind <address>:<port>")
+	}
+	if err := bind(os.Args[1]); err != nil {
+		fail("%v", err)
+	}
+}
+
+// bind listens on addr and sends the socket over file descriptor 3
+func bind(addr string) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port >= privilegedPorts {
+		return fmt.Errorf("refusing to bind port %s: only ports below %d are handled", portStr, privilegedPorts)
+	}
+
+	conn, err := net.FileConn(os.NewFile(3, "tunneld"))
+	if err != nil {
+		return fmt.Errorf("file descriptor 3 is not the socket of tunneld: %w", err)
+	}
+	defer conn.Close()
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("file descriptor 3 is not the socket of tunneld")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, _, err = unixConn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
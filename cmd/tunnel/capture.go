@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var captureCmd = &cobra.Command{
+	Use:   "capture <machine> <port>",
+	Short: "Record the traffic going through a tunnel",
+	Long: `Record the traffic forwarded by a tunnel for a limited time, to debug
+protocol issues without setting up a sniffer. The daemon records the
+connections, including those already open, until --duration elapses or
+Ctrl+C is pressed.
+
+With --out, the traffic is written as a pcap file which Wireshark and
+tcpdump can read. Otherwise a hexdump is printed. Only the first --max-bytes
+of each connection and direction are recorded.
+
+Examples:
+  tunnel capture server1 8080 --out dump.pcap
+  tunnel capture server1 5432 --duration 10s --max-bytes 256`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, localPort := parseTunnelArgs(args)
+		out, _ := cmd.Flags().GetString("out")
+		duration, _ := cmd.Flags().GetDuration("duration")
+		maxBytes, _ := cmd.Flags().GetInt("max-bytes")
+		if duration <= 0 {
+			fail(exitUsage, "Invalid --duration: must be positive")
+		}
+		if maxBytes < 0 {
+			fail(exitUsage, "Invalid --max-bytes: must be positive, or 0 for no limit")
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		// Ctrl+C ends the capture early, keeping what was recorded
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		client := pb.NewTunnelServiceClient(conn)
+		stream, err := client.CaptureTraffic(ctx, &pb.CaptureTrafficRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+			DurationMs: int32(duration / time.Millisecond),
+			MaxBytes:   int32(maxBytes),
+		})
+		if err != nil {
+			failRPC("Failed to capture traffic", err)
+		}
+
+		write := printCaptureRecord
+		if out != "" {
+			file, err := os.Create(out)
+			if err != nil {
+				fail(exitError, "Failed to create %s: %v", out, err)
+			}
+			defer file.Close()
+
+			pcap, err := newPcapWriter(file)
+			if err != nil {
+				fail(exitError, "Failed to write %s: %v", out, err)
+			}
+			write = pcap.write
+		}
+
+		notify("%s Capturing %s:%d for %s, press Ctrl+C to stop\n", infoColor("ℹ"), host, port, formatDuration(duration))
+
+		connections := make(map[uint64]bool)
+		var total int
+		for {
+			r, err := stream.Recv()
+			if err == io.EOF || ctx.Err() != nil {
+				break
+			}
+			if err != nil {
+				failRPC("Capture failed", err)
+			}
+
+			connections[r.ConnectionId] = true
+			total += len(r.Data)
+			if err := write(r); err != nil {
+				fail(exitError, "Failed to write %s: %v", out, err)
+			}
+		}
+
+		summary := fmt.Sprintf("Captured %d connection(s), %s", len(connections), formatBytes(uint64(total)))
+		if out != "" {
+			summary += " to " + out
+		}
+		fmt.Fprintf(os.Stderr, "%s %s\n", successColor("✓"), summary)
+	},
+}
+
+// printCaptureRecord prints a captured record as a hexdump
+func printCaptureRecord(r *pb.CaptureRecord) error {
+	ts := time.UnixMicro(r.TimestampUs).Format("15:04:05.000")
+	id := infoColor(fmt.Sprintf("#%d", r.ConnectionId))
+
+	switch r.Kind {
+	case pb.CaptureKind_CAPTURE_OPENED:
+		fmt.Printf("%s %s %s from %s\n", ts, id, successColor("opened"), r.ClientAddress)
+	case pb.CaptureKind_CAPTURE_CLOSED:
+		fmt.Printf("%s %s %s\n", ts, id, errorColor("closed"))
+	default:
+		direction := "↑"
+		if !r.Upload {
+			direction = "↓"
+		}
+		fmt.Printf("%s %s %s %d bytes\n", ts, id, direction, len(r.Data))
+		for _, line := range strings.SplitAfter(hex.Dump(r.Data), "\n") {
+			if line != "" {
+				fmt.Print("  " + line)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/spf13/cobra"
+)
+
+// completeSSHHosts suggests host names from ~/.ssh/config and known_hosts
+// for the first argument
+func completeSSHHosts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return filterPrefix(sshHosts(), toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeHostPorts suggests host names for the first argument, and then the
+// port groups of the user config
+func completeHostPorts(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return completeSSHHosts(cmd, args, toComplete)
+	}
+
+	config, err := userconfig.Load()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), true)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var groups []string
+	for _, name := range config.GroupNames() {
+		groups = append(groups, "@"+name)
+	}
+	return filterPrefix(groups, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeActiveTunnels suggests hosts and then remote ports of the tunnels
+// currently managed by the daemon, as local:remote when several local ports
+// forward the same remote port
+func completeActiveTunnels(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 1 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	tunnels, err := activeTunnels()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), true)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return filterPrefix(tunnelSuggestions(tunnels, args), toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeCloseTargets suggests, on top of the hosts and ports of
+// completeActiveTunnels, the IDs and :local_port of the active tunnels for
+// the first argument, described by what they forward
+func completeCloseTargets(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return completeActiveTunnels(cmd, args, toComplete)
+	}
+
+	tunnels, err := activeTunnels()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), true)
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	suggestions := tunnelSuggestions(tunnels, args)
+	var targets []string
+	for _, t := range tunnels {
+		forward := fmt.Sprintf("%s:%d -> localhost:%d", t.Host, t.RemotePort, t.LocalPort)
+		targets = append(targets, t.Id+"\t"+forward, fmt.Sprintf(":%d\t%s", t.LocalPort, forward))
+	}
+	sort.Strings(targets)
+	suggestions = append(suggestions, targets...)
+
+	return filterPrefix(suggestions, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// tunnelSuggestions returns the hosts of the tunnels without args, and the
+// remote ports of the tunnels to the host of args[0] otherwise
+func tunnelSuggestions(tunnels []*pb.ListTunnelsResponse_TunnelInfo, args []string) []string {
+	forwards := make(map[string]int)
+	for _, t := range tunnels {
+		forwards[fmt.Sprintf("%s:%d", t.Host, t.RemotePort)]++
+	}
+
+	seen := make(map[string]bool)
+	var suggestions []string
+	for _, t := range tunnels {
+		var suggestion string
+		if len(args) == 0 {
+			suggestion = t.Host
+		} else if t.Host == args[0] {
+			suggestion = strconv.Itoa(int(t.RemotePort))
+			if forwards[fmt.Sprintf("%s:%d", t.Host, t.RemotePort)] > 1 {
+				suggestion = fmt.Sprintf("%d:%d", t.LocalPort, t.RemotePort)
+			}
+		}
+		if suggestion != "" && !seen[suggestion] {
+			seen[suggestion] = true
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	sort.Strings(suggestions)
+	return suggestions
+}
+
+func activeTunnels() ([]*pb.ListTunnelsResponse_TunnelInfo, error) {
+	conn, err := dialDaemon()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := pb.NewTunnelServiceClient(conn).ListTunnels(ctx, &pb.ListTunnelsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tunnels, nil
+}
+
+func filterPrefix(values []string, prefix string) []string {
+	var filtered []string
+	for _, v := range values {
+		if strings.HasPrefix(v, prefix) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// sshHosts returns the sorted, de-duplicated host names found in the user's
+// ssh config and known_hosts files
+func sshHosts() []string {
+	sshDir := filepath.Join(userconfig.Home(), ".ssh")
+
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(host string) {
+		if host == "" || seen[host] {
+			return
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+
+	for _, host := range sshConfigHosts(filepath.Join(sshDir, "config")) {
+		add(host)
+	}
+	for _, host := range knownHosts(filepath.Join(sshDir, "known_hosts")) {
+		add(host)
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// sshConfigHosts parses the Host directives of an ssh config file, skipping
+// patterns since they cannot be connected to directly
+func sshConfigHosts(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, "=", " ", 1))
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "Host") {
+			continue
+		}
+		for _, host := range fields[1:] {
+			if strings.ContainsAny(host, "*?!") {
+				continue
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// knownHosts parses the host names of a known_hosts file, skipping hashed
+// entries which cannot be reversed
+func knownHosts(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// Skip @cert-authority and @revoked markers
+		patterns := fields[0]
+		if strings.HasPrefix(patterns, "@") {
+			if len(fields) < 2 {
+				continue
+			}
+			patterns = fields[1]
+		}
+
+		for _, host := range strings.Split(patterns, ",") {
+			if strings.HasPrefix(host, "|") || strings.ContainsAny(host, "*?!") {
+				continue
+			}
+			// Non-default ports are written as [host]:port
+			if strings.HasPrefix(host, "[") {
+				if end := strings.Index(host, "]"); end > 0 {
+					host = host[1:end]
+				}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// tunnelsFile describes a set of tunnels, for example:
+//
+//	hosts:
+//	  server1:
+//	    ports:
+//	      - 8080
+//	      - 9090:80
+type tunnelsFile struct {
+	Hosts map[string]struct {
+		Ports []string `yaml:"ports"`
+	} `yaml:"hosts"`
+}
+
+// loadTunnelsFile reads and validates the tunnels declared in path
+func loadTunnelsFile(path string) ([]*pb.TunnelSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tunnelsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	hosts := make([]string, 0, len(file.Hosts))
+	for host := range file.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var specs []*pb.TunnelSpec
+	for _, host := range hosts {
+		for _, ports := range file.Hosts[host].Ports {
+			pair, err := parsePortMapping(ports)
+			if err != nil {
+				return nil, fmt.Errorf("%s: host %s: %v", path, host, err)
+			}
+			specs = append(specs, &pb.TunnelSpec{
+				Host:       host,
+				LocalPort:  int32(pair.local),
+				RemotePort: int32(pair.remote),
+			})
+		}
+	}
+	return specs, nil
+}
+
+var upCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Create the tunnels declared in a file",
+	Long: `Create the tunnels declared in a YAML file, leaving the ones which already
+exist untouched. Use --prune to also close active tunnels which are not declared.
+
+Example tunnels.yaml:
+  hosts:
+    server1:
+      ports:
+        - 8080
+        - 9090:80`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("file")
+		prune, _ := cmd.Flags().GetBool("prune")
+
+		specs, err := loadTunnelsFile(path)
+		if err != nil {
+			fail(exitUsage, "Failed to load tunnels: %v", err)
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.ApplyTunnels(context.Background(), &pb.ApplyTunnelsRequest{
+			Tunnels: specs,
+			Prune:   prune,
+		})
+		if err != nil {
+			failRPC("Failed to apply tunnels", err)
+		}
+
+		if structuredOutput() {
+			var results []applyOutput
+			for _, r := range resp.Results {
+				result := applyOutput{
+					Host:       r.Tunnel.Host,
+					LocalPort:  r.Tunnel.LocalPort,
+					RemotePort: r.Tunnel.RemotePort,
+					Action:     r.Action,
+					Error:      r.Error,
+					Hint:       r.Hint,
+				}
+				if r.Reason != pb.ErrorReason_ERROR_REASON_UNSPECIFIED {
+					result.Reason = r.Reason.String()
+				}
+				results = append(results, result)
+			}
+			printStructured(results)
+		} else {
+			for _, r := range resp.Results {
+				displayApplyResult(r)
+			}
+		}
+
+		if !resp.Success {
+			for _, r := range resp.Results {
+				if r.Error != "" {
+					os.Exit(resultExitCode(r.Reason, r.Error))
+				}
+			}
+			os.Exit(exitError)
+		}
+	},
+}
+
+func displayApplyResult(r *pb.ApplyTunnelsResponse_Result) {
+	t := r.Tunnel
+	switch r.Action {
+	case "created":
+		notify("%s %s:%d -> localhost:%d\n", successColor("✓ Tunnel created:"), t.Host, t.RemotePort, t.LocalPort)
+	case "unchanged":
+		notify("%s %s:%d -> localhost:%d\n", infoColor("= Tunnel unchanged:"), t.Host, t.RemotePort, t.LocalPort)
+	case "pruned":
+		notify("%s %s:%d\n", successColor("✓ Tunnel pruned:"), t.Host, t.RemotePort)
+	default:
+		fmt.Fprintf(os.Stderr, "%s Failed to reconcile tunnel %s:%d: %s\n", errorColor("✗"), t.Host, t.RemotePort, r.Error)
+		if r.Hint != "" {
+			fmt.Fprintf(os.Stderr, "  %s\n", formatHint(r.Hint))
+		}
+	}
+}
+
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Close the tunnels declared in a file",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("file")
+
+		specs, err := loadTunnelsFile(path)
+		if err != nil {
+			fail(exitUsage, "Failed to load tunnels: %v", err)
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		var results []closeOutput
+		exitCode := 0
+		for _, spec := range specs {
+			result := closeOutput{Host: spec.Host, LocalPort: int(spec.LocalPort), RemotePort: int(spec.RemotePort)}
+
+			_, err := client.CloseTunnel(context.Background(), &pb.CloseTunnelRequest{
+				Host:       spec.Host,
+				RemotePort: spec.RemotePort,
+				LocalPort:  spec.LocalPort,
+			})
+			if err != nil {
+				result.Error = rpcMessage(err)
+				exitCode = rpcExitCode(err)
+			} else {
+				result.Success = true
+			}
+			results = append(results, result)
+
+			if structuredOutput() {
+				continue
+			}
+			if result.Success {
+				notify("%s %s:%d\n", successColor("✓ Tunnel closed:"), spec.Host, spec.RemotePort)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s Failed to close tunnel %s:%d: %s\n", errorColor("✗"), spec.Host, spec.RemotePort, result.Error)
+			}
+		}
+
+		if structuredOutput() {
+			printStructured(results)
+		}
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	},
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+)
+
+// expandPortGroups replaces the @group arguments with the port mappings of
+// the groups of the user config
+func expandPortGroups(args []string) ([]string, error) {
+	var config *userconfig.Config
+	var expanded []string
+	for _, arg := range args {
+		name, ok := strings.CutPrefix(arg, "@")
+		if !ok {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		if config == nil {
+			var err error
+			if config, err = userconfig.Load(); err != nil {
+				return nil, err
+			}
+		}
+		group, ok := config.Groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown port group %q, define it under groups in %s", name, userconfig.Path())
+		}
+		if len(group) == 0 {
+			return nil, fmt.Errorf("port group %q is empty", name)
+		}
+		expanded = append(expanded, group...)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var connectionsCmd = &cobra.Command{
+	Use:     "connections <machine> <port> | <id>",
+	Aliases: []string{"conns"},
+	Short:   "List the connections going through a tunnel",
+	Long: `List the connections in progress through a tunnel: where they come from, where they go on the machine, their age, transfer and current bandwidth.
+The tunnel is given by its machine and remote port, or by its ID as shown by
+"tunnel list".`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		host, port, localPort := resolveTunnelArgs(client, args)
+		resp, err := client.ListConnections(context.Background(), &pb.ListConnectionsRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+		})
+		if err != nil {
+			failRPC("Failed to list connections", err)
+		}
+
+		if structuredOutput() {
+			out := connectionsOutput{Connections: make([]connectionOutput, 0, len(resp.Connections))}
+			for _, c := range resp.Connections {
+				out.Connections = append(out.Connections, newConnectionOutput(c))
+			}
+			printStructured(out)
+			return
+		}
+
+		if len(resp.Connections) == 0 {
+			notify("%s No active connections\n", infoColor("ℹ"))
+			return
+		}
+
+		displayConnections(resp.Connections)
+	},
+}
+
+const connectionRow = "%-6s %-22s %-22s %8s %21s %12s %12s"
+
+func displayConnections(conns []*pb.GetTunnelStatusResponse_ConnectionInfo) {
+	fmt.Println(headerColor(fmt.Sprintf(connectionRow, "ID", "SOURCE", "DESTINATION", "AGE", "TRANSFER ↑/↓", "UP", "DOWN")))
+	for _, c := range conns {
+		fmt.Printf(connectionRow+"\n",
+			fmt.Sprintf("#%d", c.Id),
+			c.SourceAddress,
+			c.Destination,
+			formatDuration(time.Since(time.Unix(c.StartedAt, 0))),
+			formatBytes(c.BytesSent)+" / "+formatBytes(c.BytesReceived),
+			formatBytes(uint64(c.BandwidthUp))+"/s",
+			formatBytes(uint64(c.BandwidthDown))+"/s",
+		)
+	}
+}
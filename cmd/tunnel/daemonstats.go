@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var daemonStatsCmd = &cobra.Command{
+	Use:   "daemon-stats",
+	Short: "Show the counters of the daemon since it started",
+	Long: `Show the uptime of the daemon, how many tunnels it created and closed,
+the traffic and reconnections of all the tunnels since it started, and its
+goroutines and memory, to spot leaks.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		stats, err := client.GetDaemonStats(context.Background(), &pb.GetDaemonStatsRequest{})
+		if err != nil {
+			failRPC("Failed to get daemon stats", err)
+		}
+
+		if structuredOutput() {
+			printStructured(newDaemonStatsOutput(stats))
+			return
+		}
+
+		fmt.Printf("%s %s, up %s (since %s)\n",
+			headerColor("Daemon:"),
+			stats.Version,
+			formatDuration(time.Duration(stats.UptimeMs)*time.Millisecond),
+			time.Unix(stats.StartedAt, 0).Format(time.DateTime),
+		)
+		fmt.Printf("  %s %d active, %d created, %d closed\n",
+			infoColor("Tunnels:"), stats.ActiveTunnels, stats.TunnelsCreated, stats.TunnelsClosed)
+		fmt.Printf("  %s %d\n", infoColor("Connections:"), stats.TotalConns)
+		fmt.Printf("  %s %s (↑) / %s (↓)\n",
+			infoColor("Traffic:"), formatBytes(stats.BytesSent), formatBytes(stats.BytesReceived))
+		fmt.Printf("  %s %d succeeded, %d failed attempt(s)\n",
+			infoColor("Reconnects:"), stats.Reconnects, stats.ReconnectFailures)
+		fmt.Printf("  %s %d\n", infoColor("Goroutines:"), stats.Goroutines)
+		fmt.Printf("  %s %s\n", infoColor("Heap:"), formatBytes(stats.HeapBytes))
+	},
+}
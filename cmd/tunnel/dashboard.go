@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/fatih/color"
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var dashboardCmd = &cobra.Command{
+	Use:     "dashboard",
+	Aliases: []string{"ui"},
+	Short:   "Interactive dashboard of active tunnels",
+	Long: `Full-screen dashboard showing active tunnels with live statistics.
+
+Keys:
+  ↑/k ↓/j   select a tunnel
+  s         cycle the sort column
+  r         reverse the sort order
+  enter     inspect the selected tunnel
+  p         pause or resume the selected tunnel
+  x         close the selected tunnel
+  q         quit`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		client := pb.NewTunnelServiceClient(conn)
+		stream, err := client.WatchTunnels(ctx, &pb.WatchTunnelsRequest{
+			IntervalMs: int32(watchInterval(cmd).Milliseconds()),
+		})
+		if err != nil {
+			failRPC("Failed to watch tunnels", err)
+		}
+
+		m := &dashboardModel{
+			client: client,
+			stream: stream,
+		}
+		if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+			log.Fatalf("Dashboard failed: %v", err)
+		}
+	},
+}
+
+// Columns the dashboard can be sorted by
+var dashboardSorts = []string{"host", "local port", "transfer", "bandwidth", "connections"}
+
+var selectedColor = color.New(color.ReverseVideo).SprintFunc()
+
+type snapshotMsg []*pb.ListTunnelsResponse_TunnelInfo
+
+type streamErrMsg struct{ err error }
+
+type statusMsg string
+
+type dashboardModel struct {
+	client pb.TunnelServiceClient
+	stream pb.TunnelService_WatchTunnelsClient
+
+	tunnels  []*pb.ListTunnelsResponse_TunnelInfo
+	selected string // Key of the selected tunnel, kept across snapshots
+	cursor   int
+	sortBy   int
+	reverse  bool
+
+	inspecting   bool
+	confirmClose bool
+	status       string
+	err          error
+}
+
+func tunnelKey(t *pb.ListTunnelsResponse_TunnelInfo) string {
+	return fmt.Sprintf("%d:%s:%d", t.LocalPort, t.Host, t.RemotePort)
+}
+
+func (m *dashboardModel) waitForSnapshot() tea.Msg {
+	resp, err := m.stream.Recv()
+	if err != nil {
+		return streamErrMsg{err}
+	}
+	return snapshotMsg(resp.Tunnels)
+}
+
+func (m *dashboardModel) closeSelected() tea.Cmd {
+	t := m.current()
+	if t == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		// Leave time for the connections in progress to drain
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		_, err := m.client.CloseTunnel(ctx, &pb.CloseTunnelRequest{
+			Host:       t.Host,
+			RemotePort: t.RemotePort,
+			LocalPort:  t.LocalPort,
+		})
+		if err != nil {
+			return statusMsg(fmt.Sprintf("Failed to close tunnel: %s", rpcMessage(err)))
+		}
+		return statusMsg(fmt.Sprintf("Tunnel closed: %s", tunnelKey(t)))
+	}
+}
+
+func (m *dashboardModel) togglePause() tea.Cmd {
+	t := m.current()
+	if t == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		action := "pause"
+		var err error
+		if t.Paused {
+			action = "resume"
+			_, err = m.client.ResumeTunnel(ctx, &pb.ResumeTunnelRequest{
+				Host:       t.Host,
+				RemotePort: t.RemotePort,
+				LocalPort:  t.LocalPort,
+			})
+		} else {
+			_, err = m.client.PauseTunnel(ctx, &pb.PauseTunnelRequest{
+				Host:       t.Host,
+				RemotePort: t.RemotePort,
+				LocalPort:  t.LocalPort,
+			})
+		}
+
+		if err != nil {
+			return statusMsg(fmt.Sprintf("Failed to %s tunnel: %s", action, rpcMessage(err)))
+		}
+		return statusMsg(fmt.Sprintf("Tunnel %sd: %s", action, tunnelKey(t)))
+	}
+}
+
+func (m *dashboardModel) current() *pb.ListTunnelsResponse_TunnelInfo {
+	if m.cursor < 0 || m.cursor >= len(m.tunnels) {
+		return nil
+	}
+	return m.tunnels[m.cursor]
+}
+
+// sort orders the tunnels by the selected column and moves the cursor to
+// follow the selected tunnel
+func (m *dashboardModel) sort() {
+	less := func(a, b *pb.ListTunnelsResponse_TunnelInfo) bool {
+		switch dashboardSorts[m.sortBy] {
+		case "local port":
+			return a.LocalPort < b.LocalPort
+		case "transfer":
+			return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived
+		case "bandwidth":
+			return a.BandwidthUp+a.BandwidthDown > b.BandwidthUp+b.BandwidthDown
+		case "connections":
+			return a.ActiveConns > b.ActiveConns
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.RemotePort < b.RemotePort
+	}
+
+	sort.SliceStable(m.tunnels, func(i, j int) bool {
+		if m.reverse {
+			return less(m.tunnels[j], m.tunnels[i])
+		}
+		return less(m.tunnels[i], m.tunnels[j])
+	})
+
+	for i, t := range m.tunnels {
+		if tunnelKey(t) == m.selected {
+			m.cursor = i
+			return
+		}
+	}
+	if m.cursor >= len(m.tunnels) {
+		m.cursor = len(m.tunnels) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+	m.selectCursor()
+}
+
+func (m *dashboardModel) selectCursor() {
+	if t := m.current(); t != nil {
+		m.selected = tunnelKey(t)
+	}
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	return m.waitForSnapshot
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case snapshotMsg:
+		m.tunnels = msg
+		m.sort()
+		return m, m.waitForSnapshot
+
+	case streamErrMsg:
+		m.err = msg.err
+		return m, tea.Quit
+
+	case statusMsg:
+		m.status = string(msg)
+		return m, nil
+
+	case tea.KeyMsg:
+		if m.confirmClose {
+			m.confirmClose = false
+			if msg.String() == "y" {
+				return m, m.closeSelected()
+			}
+			m.status = ""
+			return m, nil
+		}
+
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "esc":
+			m.inspecting = false
+		case "up", "k":
+			if m.cursor > 0 {
+				m.cursor--
+				m.selectCursor()
+			}
+		case "down", "j":
+			if m.cursor < len(m.tunnels)-1 {
+				m.cursor++
+				m.selectCursor()
+			}
+		case "s":
+			m.sortBy = (m.sortBy + 1) % len(dashboardSorts)
+			m.sort()
+		case "r":
+			m.reverse = !m.reverse
+			m.sort()
+		case "enter":
+			m.inspecting = !m.inspecting
+		case "p":
+			return m, m.togglePause()
+		case "x":
+			if t := m.current(); t != nil {
+				m.confirmClose = true
+				m.status = fmt.Sprintf("Close tunnel %s? (y/n)", tunnelKey(t))
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *dashboardModel) View() string {
+	if m.err != nil {
+		return fmt.Sprintf("%s Lost connection to daemon: %v\n", errorColor("✗"), m.err)
+	}
+
+	var b strings.Builder
+
+	order := "↓"
+	if m.reverse {
+		order = "↑"
+	}
+	fmt.Fprintf(&b, "%s %s\n\n",
+		headerColor("Active Tunnels"),
+		infoColor(fmt.Sprintf("(sorted by %s %s)", dashboardSorts[m.sortBy], order)),
+	)
+
+	if len(m.tunnels) == 0 {
+		fmt.Fprintf(&b, "%s No active tunnels\n", infoColor("ℹ"))
+	} else if t := m.current(); m.inspecting && t != nil {
+		m.viewDetails(&b, t)
+	} else {
+		m.viewTable(&b)
+	}
+
+	b.WriteString("\n")
+	if m.status != "" {
+		b.WriteString(m.status + "\n")
+	}
+	b.WriteString(infoColor("↑/↓ select • s sort • r reverse • enter inspect • p pause/resume • x close • q quit"))
+	b.WriteString("\n")
+	return b.String()
+}
+
+func (m *dashboardModel) viewTable(b *strings.Builder) {
+	fmt.Fprintf(b, "  %s\n", tableHeader())
+
+	for i, t := range m.tunnels {
+		row := tableLine(t)
+		if i == m.cursor {
+			fmt.Fprintf(b, "> %s\n", selectedColor(row))
+		} else {
+			fmt.Fprintf(b, "  %s\n", row)
+		}
+	}
+}
+
+func (m *dashboardModel) viewDetails(b *strings.Builder, t *pb.ListTunnelsResponse_TunnelInfo) {
+	fmt.Fprintf(b, "%s %s:%d -> localhost:%d\n",
+		headerColor("Tunnel:"),
+		t.Host,
+		t.RemotePort,
+		t.LocalPort,
+	)
+	if len(t.Addresses) > 0 {
+		fmt.Fprintf(b, "  %s %s\n", infoColor("Listening:"), strings.Join(t.Addresses, ", "))
+	}
+	fmt.Fprintf(b, "  %s %s (since %s)\n",
+		infoColor("Uptime:"),
+		formatDuration(time.Since(time.Unix(t.CreatedAt, 0))),
+		time.Unix(t.CreatedAt, 0).Format(time.DateTime),
+	)
+	fmt.Fprintf(b, "  %s %s ago\n",
+		infoColor("Last Activity:"),
+		formatDuration(time.Since(time.Unix(t.LastActivity, 0))),
+	)
+	fmt.Fprintf(b, "  %s %s (↑) / %s (↓)\n",
+		infoColor("Total Transfer:"),
+		formatBytes(t.BytesSent),
+		formatBytes(t.BytesReceived),
+	)
+	fmt.Fprintf(b, "  %s %s/s (↑) / %s/s (↓)\n",
+		infoColor("Current Speed:"),
+		formatBytes(uint64(t.BandwidthUp)),
+		formatBytes(uint64(t.BandwidthDown)),
+	)
+	fmt.Fprintf(b, "  %s %d active / %d total\n",
+		infoColor("Connections:"),
+		t.ActiveConns,
+		t.TotalConns,
+	)
+	fmt.Fprintf(b, "  %s %s (%d keepalive failure(s))\n",
+		infoColor("Latency:"),
+		formatLatency(t.LatencyMs),
+		t.KeepaliveFailures,
+	)
+	b.WriteString(infoColor("\n(esc or enter to go back)\n"))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/maximeaubaret/go-tunnel/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// Defaults of the flags, from the cli section of the user config
+var cliDefaults userconfig.CLIDefaults
+
+// Whether to color the output, from --color
+var colorMode string
+
+// applyCLIDefaults loads the cli section of the user config, and applies it
+// to the persistent flags which were not given on the command line
+func applyCLIDefaults(cmd *cobra.Command) error {
+	config, err := userconfig.Load()
+	if err != nil {
+		return err
+	}
+	cliDefaults = config.CLI
+	flags := cmd.Flags()
+
+	if !flags.Changed("json") && !flags.Changed("yaml") && !plainOutput {
+		switch cliDefaults.Output {
+		case "", "text":
+		case "json":
+			jsonOutput = true
+		case "yaml":
+			yamlOutput = true
+		default:
+			return fmt.Errorf("invalid output %q in %s, expected text, json or yaml", cliDefaults.Output, userconfig.Path())
+		}
+	}
+
+	// $TUNNEL_SOCKET is as explicit as --socket
+	if !flags.Changed("socket") && os.Getenv(client.SocketEnv) == "" && cliDefaults.Socket != "" {
+		socketPath = userconfig.ExpandHome(cliDefaults.Socket)
+	}
+
+	if !flags.Changed("color") && cliDefaults.Color != "" {
+		colorMode = cliDefaults.Color
+	}
+	switch colorMode {
+	case "auto":
+	case "always":
+		color.NoColor = false
+	case "never":
+		color.NoColor = true
+	default:
+		return fmt.Errorf("invalid color %q, expected auto, always or never", colorMode)
+	}
+
+	if cliDefaults.WatchInterval < 0 {
+		return fmt.Errorf("invalid watch_interval %s in %s", cliDefaults.WatchInterval, userconfig.Path())
+	}
+	return nil
+}
+
+// bindFlag returns the addresses of --bind, else the bind of the user config
+// unless a hosts section of the config sets the addresses to listen on for
+// host
+func bindFlag(cmd *cobra.Command, host string) []string {
+	if cmd.Flags().Changed("bind") {
+		binds, _ := cmd.Flags().GetStringSlice("bind")
+		return binds
+	}
+	config, err := userconfig.Load()
+	if err == nil && config.HostDefaults(host).Bind != nil {
+		return nil
+	}
+	return cliDefaults.Bind
+}
+
+// watchInterval returns how often the watch modes refresh: --interval, else
+// the watch_interval of the user config, else every second
+func watchInterval(cmd *cobra.Command) time.Duration {
+	interval, _ := cmd.Flags().GetDuration("interval")
+	if !cmd.Flags().Changed("interval") && cliDefaults.WatchInterval > 0 {
+		interval = cliDefaults.WatchInterval
+	}
+	if interval <= 0 {
+		fail(exitUsage, "--interval must be positive")
+	}
+	return interval
+}
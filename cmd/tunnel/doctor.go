@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor <machine> [port]",
+	Short: "Diagnose connectivity to a machine",
+	Long: `Run through the steps a tunnel takes to reach a machine and report
+which one fails: DNS resolution, TCP connection to the SSH port, host key
+check, authentication and, when a port is given, dialing the remote port.`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeSSHHosts,
+	Run: func(cmd *cobra.Command, args []string) {
+		host := args[0]
+		port := 0
+		if len(args) > 1 {
+			var err error
+			port, err = strconv.Atoi(args[1])
+			if err != nil {
+				fail(exitUsage, "Invalid port: %v", err)
+			}
+		}
+
+		checks := runDoctor(host, port)
+
+		exitCode := 0
+		for _, c := range checks {
+			if c.Status == checkFailed {
+				exitCode = c.exitCode
+				break
+			}
+		}
+
+		if structuredOutput() {
+			printStructured(doctorOutput{Host: host, Checks: checks})
+		} else {
+			displayChecks(host, checks)
+		}
+
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	},
+}
+
+// Outcome of a diagnostic step
+const (
+	checkPassed  = "pass"
+	checkWarning = "warn"
+	checkFailed  = "fail"
+	checkSkipped = "skip"
+)
+
+type checkResult struct {
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty" yaml:"hint,omitempty"`
+
+	exitCode int
+}
+
+type doctorOutput struct {
+	Host   string        `json:"host" yaml:"host"`
+	Checks []checkResult `json:"checks" yaml:"checks"`
+}
+
+// Timeout of each network step of the diagnostic
+const doctorTimeout = 10 * time.Second
+
+// runDoctor runs the diagnostic steps in order, skipping the steps which
+// depend on a failed one
+func runDoctor(host string, port int) []checkResult {
+	var checks []checkResult
+	failed := false
+	add := func(c checkResult) {
+		if failed {
+			c.Status = checkSkipped
+			c.Detail = ""
+			c.Hint = ""
+		}
+		if c.Status == checkFailed {
+			failed = true
+		}
+		checks = append(checks, c)
+	}
+
+	// DNS resolution
+	dns := checkResult{Name: "DNS resolution", Status: checkPassed}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		dns.Status = checkFailed
+		dns.Detail = err.Error()
+		dns.Hint = "Check the machine name for typos, or your DNS and /etc/hosts configuration"
+		dns.exitCode = exitHostUnreachable
+	} else {
+		dns.Detail = fmt.Sprintf("%v", addrs)
+	}
+	add(dns)
+
+	// TCP connection to the SSH port
+	addr := net.JoinHostPort(host, "22")
+	tcp := checkResult{Name: "TCP connection to " + addr, Status: checkPassed}
+	var conn net.Conn
+	if !failed {
+		start := time.Now()
+		conn, err = net.DialTimeout("tcp", addr, doctorTimeout)
+		if err != nil {
+			tcp.Status = checkFailed
+			tcp.Detail = err.Error()
+			tcp.Hint = "Make sure the machine is up, sshd is listening on port 22 and no firewall blocks it"
+			tcp.exitCode = exitHostUnreachable
+		} else {
+			defer conn.Close()
+			tcp.Detail = fmt.Sprintf("connected in %s", time.Since(start).Round(time.Millisecond))
+		}
+	}
+	add(tcp)
+
+	// SSH handshake: the host key is checked against known_hosts but, like
+	// for tunnels, an unknown or changed key does not abort the connection
+	hostKey := checkResult{Name: "Host key", Status: checkFailed}
+	auth := checkResult{Name: "Authentication", Status: checkPassed}
+	var client *ssh.Client
+	if !failed {
+		config := sshauth.ClientConfig()
+		config.Timeout = doctorTimeout
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = checkHostKey(hostname, remote, key)
+			return nil
+		}
+
+		conn.SetDeadline(time.Now().Add(doctorTimeout))
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if hostKey.Status == checkFailed && hostKey.Detail == "" {
+			// The handshake did not get as far as the host key
+			hostKey.Detail = fmt.Sprintf("SSH handshake failed: %v", err)
+			hostKey.Hint = "Make sure an SSH server is listening on port 22"
+			hostKey.exitCode = exitHostUnreachable
+		}
+		add(hostKey)
+
+		if err != nil {
+			auth.Status = checkFailed
+			auth.Detail = err.Error()
+			auth.Hint = fmt.Sprintf("Make sure your public key is in ~/.ssh/authorized_keys of user %q on the machine, or set SSH_KEY_PATH (and SSH_KEY_PASSPHRASE for an encrypted key)", config.User)
+			auth.exitCode = exitAuthFailed
+		} else {
+			conn.SetDeadline(time.Time{})
+			client = ssh.NewClient(sshConn, chans, reqs)
+			defer client.Close()
+			auth.Detail = fmt.Sprintf("logged in as %q", config.User)
+		}
+	} else {
+		add(hostKey)
+	}
+	add(auth)
+
+	// Remote port dial
+	if port != 0 {
+		remote := checkResult{Name: fmt.Sprintf("Remote port %d", port), Status: checkPassed}
+		if !failed {
+			remoteConn, err := dialWithTimeout(client, fmt.Sprintf("localhost:%d", port))
+			if err != nil {
+				remote.Status = checkFailed
+				remote.Detail = err.Error()
+				remote.Hint = fmt.Sprintf("Make sure a service listens on port %d of the machine and that sshd allows TCP forwarding (AllowTcpForwarding)", port)
+				remote.exitCode = exitError
+			} else {
+				remoteConn.Close()
+				remote.Detail = "reachable from the machine"
+			}
+		}
+		add(remote)
+	}
+
+	return checks
+}
+
+// checkHostKey looks the host key up in ~/.ssh/known_hosts
+func checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) checkResult {
+	result := checkResult{Name: "Host key", Status: checkPassed}
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	path := filepath.Join(userconfig.Home(), ".ssh", "known_hosts")
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		result.Status = checkWarning
+		result.Detail = fmt.Sprintf("%s, cannot read known_hosts: %v", fingerprint, err)
+		result.Hint = "Connect once with ssh to record the host key"
+		return result
+	}
+
+	var keyErr *knownhosts.KeyError
+	err = callback(hostname, remote, key)
+	switch {
+	case err == nil:
+		result.Detail = fmt.Sprintf("%s matches known_hosts", fingerprint)
+	case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+		result.Status = checkWarning
+		result.Detail = fmt.Sprintf("%s is not in known_hosts", fingerprint)
+		result.Hint = "Connect once with ssh to verify and record the host key"
+	default:
+		result.Status = checkWarning
+		result.Detail = fmt.Sprintf("%s: %v", fingerprint, err)
+		result.Hint = "The host key changed: make sure the machine was reinstalled and not impersonated, then update known_hosts"
+	}
+	return result
+}
+
+// dialWithTimeout dials addr from the machine, giving up after doctorTimeout
+func dialWithTimeout(client *ssh.Client, addr string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		done <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(doctorTimeout):
+		return nil, fmt.Errorf("timed out after %s", doctorTimeout)
+	}
+}
+
+func displayChecks(host string, checks []checkResult) {
+	notify("%s %s\n\n", headerColor("Diagnosing"), host)
+
+	for _, c := range checks {
+		var mark string
+		switch c.Status {
+		case checkPassed:
+			mark = successColor("✓")
+		case checkWarning:
+			mark = infoColor("!")
+		case checkFailed:
+			mark = errorColor("✗")
+		default:
+			mark = infoColor("-")
+		}
+
+		fmt.Printf("%s %s", mark, c.Name)
+		if c.Status == checkSkipped {
+			fmt.Printf(" %s", infoColor("(skipped)"))
+		}
+		if c.Detail != "" {
+			fmt.Printf(": %s", c.Detail)
+		}
+		fmt.Println()
+		if c.Hint != "" {
+			fmt.Printf("  %s %s\n", infoColor("→"), c.Hint)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Print active tunnels as shell exports",
+	Long: `Print export statements describing the active tunnels, for scripts to
+find where a service is forwarded:
+
+  eval $(tunnel env --host server1)
+  psql -h localhost -p $TUNNEL_SERVER1_5432_PORT
+
+Each tunnel exports TUNNEL_<MACHINE>_<REMOTE_PORT>=localhost:<LOCAL_PORT> and
+TUNNEL_<MACHINE>_<REMOTE_PORT>_PORT=<LOCAL_PORT>. Tunnels to the same remote
+port of a machine are told apart by their local port, as in
+TUNNEL_<MACHINE>_<REMOTE_PORT>_<LOCAL_PORT>.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		host, _ := cmd.Flags().GetString("host")
+		labels, _ := cmd.Flags().GetStringToString("label")
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.ListTunnels(context.Background(), &pb.ListTunnelsRequest{
+			Labels: labels,
+		})
+		if err != nil {
+			failRPC("Failed to list tunnels", err)
+		}
+
+		var tunnels []envTunnel
+		for _, t := range resp.Tunnels {
+			if host != "" && t.Host != host {
+				continue
+			}
+			tunnels = append(tunnels, envTunnel{host: t.Host, remotePort: int(t.RemotePort), localPort: int(t.LocalPort)})
+		}
+		vars := tunnelEnvVars(tunnels)
+
+		if structuredOutput() {
+			printStructured(vars)
+			return
+		}
+
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("export %s=%s\n", name, vars[name])
+		}
+	},
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/spf13/cobra"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec <machine> [port_from:]port_to [[port_from:]port_to...] -- <command> [args...]",
+	Short: "Run a command with ephemeral tunnels",
+	Long: `Create tunnels in the current process, without going through tunneld,
+run a command and close the tunnels when it exits. The command sees each
+tunnel as an environment variable named after the machine and remote port:
+
+  tunnel exec server1 15432:5432 -- psql -h localhost -p 15432
+  # TUNNEL_SERVER1_5432=localhost:15432 TUNNEL_SERVER1_5432_PORT=15432
+
+Tunnels to the same remote port are told apart by their local port, as in
+TUNNEL_SERVER1_5432_15432. The exit code is the one of the command, or 128
+plus the number of the signal which killed it, as in shells.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 {
+			return errors.New("missing -- before the command to run")
+		}
+		if dash < 2 {
+			return errors.New("requires a machine and at least one port before --")
+		}
+		if dash == len(args) {
+			return errors.New("missing command after --")
+		}
+		return nil
+	},
+	ValidArgsFunction: completeHostPorts,
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		host := args[0]
+		command := args[dash:]
+
+		portMappings, err := expandPortGroups(args[1:dash])
+		if err != nil {
+			fail(exitUsage, "%v", err)
+		}
+
+		var pairs []portPair
+		for _, ports := range portMappings {
+			pair, err := parsePortMapping(ports)
+			if err != nil {
+				fail(exitUsage, "%v", err)
+			}
+			pairs = append(pairs, pair)
+		}
+
+		family := familyFlag(cmd)
+		binds := bindFlag(cmd, host)
+		proxyProtocol, _ := cmd.Flags().GetBool("proxy-protocol")
+		noDelay, _ := cmd.Flags().GetBool("nodelay")
+		manager := tunnel.NewTunnelManager()
+
+		config := sshauth.ClientConfig()
+		var tunnels []envTunnel
+		for _, pair := range pairs {
+			if err := manager.CreateTunnel(cmd.Context(), host, pair.local, pair.remote, config, tunnel.Options{Family: family, Bind: binds, ProxyProtocol: proxyProtocol, Nagle: !noDelay}); err != nil {
+				manager.CloseAllTunnels()
+				fail(tunnelExitCode(err), "Failed to create tunnel %d:%d: %v", pair.local, pair.remote, err)
+			}
+			tunnels = append(tunnels, envTunnel{host: host, remotePort: pair.remote, localPort: pair.local})
+		}
+		env := os.Environ()
+		for name, value := range tunnelEnvVars(tunnels) {
+			env = append(env, name+"="+value)
+		}
+
+		// Catch the signals rather than ignoring them, which the command
+		// would inherit, and wait for it to exit before closing the tunnels
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+		child := exec.Command(command[0], command[1:]...)
+		child.Stdin = os.Stdin
+		child.Stdout = os.Stdout
+		child.Stderr = os.Stderr
+		child.Env = env
+		if err := child.Start(); err != nil {
+			manager.CloseAllTunnels()
+			fail(exitError, "Failed to run %s: %v", command[0], err)
+		}
+
+		go func() {
+			for sig := range sigChan {
+				// The command gets Ctrl+C from the terminal along with us
+				if sig != syscall.SIGINT {
+					forwardSignal(child.Process, sig)
+				}
+			}
+		}()
+
+		err = child.Wait()
+		manager.CloseAllTunnels()
+
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exitErr):
+			// Like shells, tell a command killed by a signal by 128 plus
+			// its number. Signaled is always false on Windows.
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			if code := exitErr.ExitCode(); code > 0 {
+				os.Exit(code)
+			}
+			os.Exit(exitError)
+		default:
+			fail(exitError, "Failed to run %s: %v", command[0], err)
+		}
+	},
+}
+
+// envTunnel is a tunnel described by environment variables
+type envTunnel struct {
+	host       string
+	remotePort int
+	localPort  int
+}
+
+// tunnelEnvVars returns the environment variables describing the tunnels, by
+// name: TUNNEL_SERVER1_5432=localhost:15432 and TUNNEL_SERVER1_5432_PORT=15432.
+// The tunnels sharing a name, such as to the same remote port, are told apart
+// by their local port, as in TUNNEL_SERVER1_5432_15432.
+func tunnelEnvVars(tunnels []envTunnel) map[string]string {
+	count := make(map[string]int)
+	for _, t := range tunnels {
+		count[tunnelEnvName(t.host, t.remotePort)]++
+	}
+	vars := make(map[string]string)
+	for _, t := range tunnels {
+		name := tunnelEnvName(t.host, t.remotePort)
+		if count[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, t.localPort)
+		}
+		vars[name] = fmt.Sprintf("localhost:%d", t.localPort)
+		vars[name+"_PORT"] = strconv.Itoa(t.localPort)
+	}
+	return vars
+}
+
+// tunnelEnvName returns the environment variable describing a tunnel, such
+// as TUNNEL_SERVER1_5432
+func tunnelEnvName(host string, remotePort int) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+	return fmt.Sprintf("TUNNEL_%s_%d", name, remotePort)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes, so that scripts can branch on the kind of failure
+const (
+	exitError             = 1  // Any other failure
+	exitUsage             = 2  // Invalid arguments
+	exitDaemonUnreachable = 3  // tunneld is not running or not reachable
+	exitAlreadyExists     = 4  // The tunnel already exists
+	exitNotFound          = 5  // The tunnel does not exist
+	exitAuthFailed        = 6  // SSH authentication failed
+	exitPortInUse         = 7  // The local port is already in use
+	exitHostUnreachable   = 8  // The SSH host could not be reached
+	exitNotReady          = 9  // The remote service did not answer --wait in time
+	exitIncompatible      = 10 // tunneld speaks another protocol version
+	exitUnauthorized      = 11 // The API token is missing, invalid or read-only
+	exitHostKeyMismatch   = 12 // The SSH host key changed
+	exitBindFailed        = 13 // The local port could not be bound, other than a conflict
+)
+
+// Decorative output flag, shared by all commands
+var quiet bool
+
+// notify prints decorative output, unless --quiet was given
+func notify(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// fail prints an error on stderr and exits with the given code
+func fail(code int, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", errorColor("✗"), fmt.Sprintf(format, args...))
+	os.Exit(code)
+}
+
+// failRPC prints a failed daemon call, with how to fix it when known, and
+// exits with the matching code
+func failRPC(what string, err error) {
+	message := rpcMessage(err)
+	if hint := rpcHint(err); hint != "" {
+		message += "\n  " + formatHint(hint)
+	}
+	fail(rpcExitCode(err), "%s: %s", what, message)
+}
+
+// formatHint renders how to fix a failure, below it
+func formatHint(hint string) string {
+	return fmt.Sprintf("%s %s", infoColor("→"), hint)
+}
+
+// failDial prints a failed connection to the daemon and exits with the
+// matching code
+func failDial(err error) {
+	code := exitDaemonUnreachable
+	var versionErr *incompatibleError
+	if errors.As(err, &versionErr) {
+		code = exitIncompatible
+	} else if unauthorized(err) {
+		code = exitUnauthorized
+	}
+	fail(code, "Failed to connect: %v", err)
+}
+
+// reasonExitCodes maps the reasons of the daemon errors to exit codes
+var reasonExitCodes = map[pb.ErrorReason]int{
+	pb.ErrorReason_ALREADY_EXISTS:   exitAlreadyExists,
+	pb.ErrorReason_NOT_FOUND:        exitNotFound,
+	pb.ErrorReason_AUTH_FAILED:      exitAuthFailed,
+	pb.ErrorReason_PORT_IN_USE:      exitPortInUse,
+	pb.ErrorReason_HOST_UNREACHABLE: exitHostUnreachable,
+	pb.ErrorReason_NOT_READY:        exitNotReady,
+
+	pb.ErrorReason_HOST_NOT_FOUND:     exitHostUnreachable,
+	pb.ErrorReason_CONNECTION_REFUSED: exitHostUnreachable,
+	pb.ErrorReason_TIMED_OUT:          exitHostUnreachable,
+	pb.ErrorReason_HOST_KEY_MISMATCH:  exitHostKeyMismatch,
+	pb.ErrorReason_BIND_FAILED:        exitBindFailed,
+	pb.ErrorReason_PRIVILEGED_PORT:    exitBindFailed,
+}
+
+// rpcExitCode returns the exit code matching an error returned by a call to
+// the daemon
+func rpcExitCode(err error) int {
+	if reason := rpcReason(err); reason != pb.ErrorReason_ERROR_REASON_UNSPECIFIED {
+		if code, ok := reasonExitCodes[reason]; ok {
+			return code
+		}
+		return exitError
+	}
+	if status.Code(err) == codes.Unavailable {
+		return exitDaemonUnreachable
+	}
+	if unauthorized(err) {
+		return exitUnauthorized
+	}
+	return errorExitCode(err.Error())
+}
+
+// unauthorized reports whether the daemon refused the API token of a call
+func unauthorized(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unauthenticated || code == codes.PermissionDenied
+}
+
+// resultExitCode returns the exit code matching the failure of a single
+// tunnel reported in the results of ApplyTunnels
+func resultExitCode(reason pb.ErrorReason, message string) int {
+	if code, ok := reasonExitCodes[reason]; ok {
+		return code
+	}
+	return errorExitCode(message)
+}
+
+// rpcReason returns the reason attached to an error of the daemon
+func rpcReason(err error) pb.ErrorReason {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return pb.ErrorReason(pb.ErrorReason_value[info.Reason])
+		}
+	}
+	return pb.ErrorReason_ERROR_REASON_UNSPECIFIED
+}
+
+// rpcHint returns how to fix an error of the daemon, empty when unknown
+func rpcHint(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Metadata["hint"]
+		}
+	}
+	return ""
+}
+
+// rpcPortInUse returns what holds the local port when creating a tunnel
+// failed because of it, nil otherwise
+func rpcPortInUse(err error) *pb.PortInUse {
+	for _, detail := range status.Convert(err).Details() {
+		if conflict, ok := detail.(*pb.PortInUse); ok {
+			return conflict
+		}
+	}
+	return nil
+}
+
+// rpcMessage returns the message of an error of the daemon, without the
+// status code
+func rpcMessage(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return st.Message()
+	}
+	return err.Error()
+}
+
+// tunnelExitCode returns the exit code matching an error of a tunnel running
+// in this process
+func tunnelExitCode(err error) int {
+	var portErr *tunnel.PortInUseError
+	switch {
+	case errors.As(err, &portErr):
+		return exitPortInUse
+	case errors.Is(err, tunnel.ErrAlreadyExists):
+		return exitAlreadyExists
+	case errors.Is(err, tunnel.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, tunnel.ErrAuthFailed):
+		return exitAuthFailed
+	case errors.Is(err, tunnel.ErrHostKeyMismatch):
+		return exitHostKeyMismatch
+	case errors.Is(err, tunnel.ErrBindFailed):
+		return exitBindFailed
+	case errors.Is(err, tunnel.ErrHostUnreachable):
+		return exitHostUnreachable
+	case errors.Is(err, tunnel.ErrNotReady):
+		return exitNotReady
+	}
+	return errorExitCode(err.Error())
+}
+
+// errorExitCode classifies an error message, for the daemons that predate
+// the error reasons
+func errorExitCode(message string) int {
+	switch {
+	case strings.Contains(message, "tunnel already exists"):
+		return exitAlreadyExists
+	case strings.Contains(message, "tunnel not found"):
+		return exitNotFound
+	case strings.Contains(message, "unable to authenticate"):
+		return exitAuthFailed
+	case strings.Contains(message, "address already in use"):
+		return exitPortInUse
+	case strings.Contains(message, "failed to connect to host"):
+		return exitHostUnreachable
+	case strings.Contains(message, "remote service not ready"):
+		return exitNotReady
+	default:
+		return exitError
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [machine] [port]",
+	Short: "Print the ssh command reproducing the active tunnels",
+	Long: `Print the plain ssh command reproducing the active tunnels, one per machine,
+so they can be shared with people who do not run the daemon. Use --ssh-config
+to print LocalForward directives for ~/.ssh/config instead.
+
+Limit the output to the tunnels of a machine, or to a single tunnel by also
+giving its remote port.`,
+	Args:              cobra.MaximumNArgs(2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		sshConfig, _ := cmd.Flags().GetBool("ssh-config")
+		labels, _ := cmd.Flags().GetStringToString("label")
+
+		var host string
+		var port int
+		if len(args) > 0 {
+			host = args[0]
+		}
+		if len(args) > 1 {
+			var err error
+			if port, err = strconv.Atoi(args[1]); err != nil {
+				fail(exitUsage, "Invalid port '%s': %v", args[1], err)
+			}
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.ListTunnels(context.Background(), &pb.ListTunnelsRequest{Labels: labels})
+		if err != nil {
+			failRPC("Failed to list tunnels", err)
+		}
+
+		// Group the forwards by machine, in a stable order
+		forwards := make(map[string][]string)
+		var hosts []string
+		sortTunnels(resp.Tunnels)
+		for _, t := range resp.Tunnels {
+			if (host != "" && t.Host != host) || (port != 0 && int(t.RemotePort) != port) {
+				continue
+			}
+			if strings.HasPrefix(t.Host, "k8s://") || strings.HasPrefix(t.Host, "docker://") {
+				fmt.Fprintf(os.Stderr, "%s %s:%d is not forwarded by ssh alone, skipped\n", infoColor("!"), t.Host, t.RemotePort)
+				continue
+			}
+			if t.ProxyProtocol {
+				fmt.Fprintf(os.Stderr, "%s %s:%d sends a PROXY protocol header, which ssh cannot reproduce\n", infoColor("!"), t.Host, t.RemotePort)
+			}
+			if _, ok := forwards[t.Host]; !ok {
+				hosts = append(hosts, t.Host)
+			}
+			forwards[t.Host] = append(forwards[t.Host], localForwards(t)...)
+		}
+		if len(hosts) == 0 {
+			fail(exitNotFound, "No matching tunnel")
+		}
+		sort.Strings(hosts)
+
+		for i, h := range hosts {
+			if sshConfig {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("Host %s\n", h)
+				for _, f := range forwards[h] {
+					fmt.Printf("  LocalForward %s\n", f)
+				}
+				continue
+			}
+
+			var b strings.Builder
+			b.WriteString("ssh -N")
+			for _, f := range forwards[h] {
+				// ssh -L takes the same fields as LocalForward, joined by
+				// a colon. Quote the wildcards and brackets from the shell.
+				arg := strings.Replace(f, " ", ":", 1)
+				if strings.ContainsAny(arg, "*[]") {
+					arg = "'" + arg + "'"
+				}
+				fmt.Fprintf(&b, " -L %s", arg)
+			}
+			fmt.Fprintf(&b, " %s", h)
+			fmt.Println(b.String())
+		}
+	},
+}
+
+// localForwards returns the "[bind_address:]port host:hostport" arguments of
+// LocalForward reproducing a tunnel, one per address it listens on. Loopback
+// addresses are ssh's default and left out, wildcard ones become "*".
+func localForwards(t *pb.ListTunnelsResponse_TunnelInfo) []string {
+	target := fmt.Sprintf("localhost:%d", t.RemotePort)
+
+	var forwards []string
+	loopback := false
+	for _, addr := range t.Addresses {
+		ip, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil || parsed.IsLoopback() {
+			loopback = true
+			continue
+		}
+		bind := net.JoinHostPort(ip, port)
+		if parsed.IsUnspecified() {
+			bind = "*:" + port // All the interfaces for ssh
+		}
+		forwards = append(forwards, fmt.Sprintf("%s %s", bind, target))
+	}
+	if loopback || len(forwards) == 0 {
+		forwards = append([]string{fmt.Sprintf("%d %s", t.LocalPort, target)}, forwards...)
+	}
+	return forwards
+}
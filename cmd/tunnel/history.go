@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+// Layout of the history table
+const historyRow = "%-19s %-8s %-24s %7s %7s %9s %21s %6s  %s"
+
+var historyCmd = &cobra.Command{
+	Use:   "history [machine]",
+	Short: "Show the recently closed tunnels",
+	Long: `Show the last tunnels closed by the daemon, most recent first: when and
+why they were closed, how long they lived and what they carried. The daemon
+remembers the last 100 until it restarts.
+
+Create a closed tunnel again, with the same ports and labels, with --recreate
+and its ID or a prefix of it.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeSSHHosts,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &pb.ListClosedTunnelsRequest{}
+		if len(args) > 0 {
+			req.Host = args[0]
+		}
+		req.Labels, _ = cmd.Flags().GetStringToString("label")
+		recreate, _ := cmd.Flags().GetString("recreate")
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.ListClosedTunnels(context.Background(), req)
+		if err != nil {
+			failRPC("Failed to get history", err)
+		}
+
+		if recreate != "" {
+			recreateTunnel(client, resp.Tunnels, recreate)
+			return
+		}
+
+		if structuredOutput() {
+			out := make([]closedTunnelOutput, 0, len(resp.Tunnels))
+			for _, t := range resp.Tunnels {
+				out = append(out, newClosedTunnelOutput(t))
+			}
+			printStructured(out)
+			return
+		}
+
+		if len(resp.Tunnels) == 0 {
+			notify("%s No closed tunnels\n", infoColor("ℹ"))
+			return
+		}
+		fmt.Println(headerColor(fmt.Sprintf(historyRow, "CLOSED", "ID", "HOST", "REMOTE", "LOCAL", "LIFETIME", "TRANSFER ↑/↓", "CONNS", "REASON")))
+		for _, t := range resp.Tunnels {
+			closedAt := time.Unix(t.ClosedAt, 0)
+			fmt.Printf(historyRow+"\n",
+				closedAt.Format(time.DateTime),
+				t.Id,
+				t.Host,
+				fmt.Sprint(t.RemotePort),
+				fmt.Sprint(t.LocalPort),
+				formatDuration(closedAt.Sub(time.Unix(t.CreatedAt, 0))),
+				formatBytes(t.BytesSent)+" / "+formatBytes(t.BytesReceived),
+				fmt.Sprint(t.TotalConns),
+				t.Reason,
+			)
+		}
+	},
+}
+
+// recreateTunnel creates the closed tunnel whose ID starts with id again
+func recreateTunnel(client pb.TunnelServiceClient, history []*pb.ListClosedTunnelsResponse_ClosedTunnel, id string) {
+	var match *pb.ListClosedTunnelsResponse_ClosedTunnel
+	for _, t := range history {
+		if !strings.HasPrefix(t.Id, id) {
+			continue
+		}
+		// The same tunnel may have been closed several times, take the
+		// most recent one
+		if match != nil && match.Id != t.Id {
+			fail(exitUsage, "Tunnel ID %q is ambiguous, it matches %s and %s", id, match.Id, t.Id)
+		}
+		if match == nil {
+			match = t
+		}
+	}
+	if match == nil {
+		fail(exitNotFound, "No closed tunnel with ID %q", id)
+	}
+
+	result, code := createTunnel(client, &pb.CreateTunnelRequest{
+		Host:       match.Host,
+		LocalPort:  match.LocalPort,
+		RemotePort: match.RemotePort,
+		Labels:     match.Labels,
+	}, "", "", 0)
+	if structuredOutput() {
+		printStructured([]createOutput{result})
+	} else {
+		reportCreate(result)
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <machine>",
+	Short: "Create the tunnels forwarded for a machine in ~/.ssh/config",
+	Long: `Read the LocalForward directives which apply to a machine in ~/.ssh/config
+and create the matching tunnels.
+
+Only forwards to a port of the machine itself (localhost, 127.0.0.1 or ::1)
+can be imported. Forwards to other hosts and RemoteForward directives are
+reported and skipped.
+
+Example ~/.ssh/config:
+  Host server1
+    LocalForward 15432 localhost:5432
+    LocalForward 127.0.0.1:8080 127.0.0.1:80`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSSHHosts,
+	Run: func(cmd *cobra.Command, args []string) {
+		host := args[0]
+		path, _ := cmd.Flags().GetString("config")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		labels, _ := cmd.Flags().GetStringToString("label")
+
+		forwards, warnings, err := sshConfigForwards(path, host)
+		if err != nil {
+			fail(exitUsage, "Failed to read %s: %v", path, err)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "%s %s\n", infoColor("!"), warning)
+		}
+		if len(forwards) == 0 {
+			fail(exitError, "No forward to import for %s in %s", host, path)
+		}
+
+		if dryRun {
+			for _, f := range forwards {
+				fmt.Printf("tunnel %s %d:%d%s\n", host, f.local, f.remote, bindArgs(f.binds))
+			}
+			return
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		var results []createOutput
+		exitCode := 0
+		for _, f := range forwards {
+			req := &pb.CreateTunnelRequest{
+				Host:          host,
+				LocalPort:     int32(f.local),
+				RemotePort:    int32(f.remote),
+				Labels:        labels,
+				BindAddresses: f.binds,
+			}
+			result, code := createTunnel(client, req, "", "", 0)
+			if !structuredOutput() {
+				reportCreate(result)
+			}
+			if code != 0 && exitCode == 0 {
+				exitCode = code
+			}
+			results = append(results, result)
+		}
+
+		if structuredOutput() {
+			printStructured(results)
+		}
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	},
+}
+
+// sshForward is a LocalForward which can be turned into a tunnel
+type sshForward struct {
+	local  int
+	remote int
+	binds  []string // Local addresses, loopback when empty
+}
+
+// sshConfigForwards returns the LocalForward directives of the ssh config
+// file which apply to host, along with warnings about the ones which cannot
+// be imported
+func sshConfigForwards(path, host string) ([]sshForward, []string, error) {
+	directives, warnings, err := userconfig.SSHConfig(path, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var forwards []sshForward
+	for _, d := range directives {
+		switch d.Keyword {
+		case "localforward":
+			forward, err := parseLocalForward(d.Args)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: LocalForward %s: %v, skipped", d.Where, d.Value, err))
+				continue
+			}
+			forwards = append(forwards, forward)
+		case "remoteforward":
+			warnings = append(warnings, fmt.Sprintf("%s: RemoteForward %s is not supported, skipped", d.Where, d.Value))
+		}
+	}
+	return forwards, warnings, nil
+}
+
+// parseLocalForward parses the "[bind_address:]port host:hostport"
+// arguments of LocalForward
+func parseLocalForward(args []string) (sshForward, error) {
+	if len(args) != 2 {
+		return sshForward{}, fmt.Errorf("expected a local and a remote address")
+	}
+	if strings.Contains(args[0], "/") || strings.Contains(args[1], "/") {
+		return sshForward{}, fmt.Errorf("Unix sockets are not supported")
+	}
+
+	var forward sshForward
+	bind, port := "", args[0]
+	if i := strings.LastIndex(args[0], ":"); i >= 0 {
+		bind, port = strings.Trim(args[0][:i], "[]"), args[0][i+1:]
+	}
+	local, err := strconv.Atoi(port)
+	if err != nil {
+		return sshForward{}, fmt.Errorf("invalid local port %q", port)
+	}
+	forward.local = local
+
+	switch bind {
+	case "", "localhost":
+	case "*":
+		forward.binds = []string{"0.0.0.0"}
+	default:
+		forward.binds = []string{bind}
+	}
+
+	target, port, err := net.SplitHostPort(args[1])
+	if err != nil {
+		return sshForward{}, err
+	}
+	switch target {
+	case "localhost", "127.0.0.1", "::1":
+	default:
+		return sshForward{}, fmt.Errorf("forwards to %s, only ports of the machine itself can be tunneled", target)
+	}
+	if forward.remote, err = strconv.Atoi(port); err != nil {
+		return sshForward{}, fmt.Errorf("invalid remote port %q", port)
+	}
+	return forward, nil
+}
+
+// bindArgs returns the --bind flags creating a tunnel on binds
+func bindArgs(binds []string) string {
+	var b strings.Builder
+	for _, bind := range binds {
+		fmt.Fprintf(&b, " --bind %s", bind)
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var keychainCmd = &cobra.Command{
+	Use:   "keychain <key_file>",
+	Short: "Store the passphrase of an encrypted SSH key in the macOS Keychain",
+	Long: `Prompt once for the passphrase of an encrypted SSH key and store it in the
+macOS Keychain, where the daemon finds it by the fingerprint of the key
+instead of reading SSH_KEY_PASSPHRASE. Run "tunnel reload-keys" afterwards
+for a daemon already running. Use --forget to remove the passphrase.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyPath := args[0]
+		forget, _ := cmd.Flags().GetBool("forget")
+		if forget {
+			if err := sshauth.ForgetPassphrase(keyPath); err != nil {
+				fail(exitError, "%v", err)
+			}
+			notify("%s Passphrase of %s removed from the Keychain\n", successColor("✓"), keyPath)
+			return
+		}
+
+		if err := sshauth.CheckEncrypted(keyPath); err != nil {
+			fail(exitError, "%v", err)
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", keyPath))
+		if err != nil {
+			fail(exitError, "Failed to read the passphrase: %v", err)
+		}
+		if err := sshauth.StorePassphrase(keyPath, passphrase); err != nil {
+			fail(exitError, "%v", err)
+		}
+		notify("%s Passphrase of %s stored in the Keychain, run %s to use it now\n",
+			successColor("✓"), keyPath, infoColor("tunnel reload-keys"))
+	},
+}
+
+// readPassphrase prompts for a passphrase without echoing it, or reads a
+// line when stdin is not a terminal
+func readPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(fd)
+}
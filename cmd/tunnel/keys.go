@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+type reloadKeysOutput struct {
+	Keys   []string `json:"keys" yaml:"keys"`
+	Errors []string `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+var reloadKeysCmd = &cobra.Command{
+	Use:   "reload-keys",
+	Short: "Make the daemon read its SSH keys again",
+	Long: `Make the daemon read its SSH keys and the identity files in use again,
+after a key rotation. The tunnels keep their SSH connections, the new keys
+are used when they reconnect and for the next tunnels. When a key fails to
+load, the previous one stays in use.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.ReloadKeys(context.Background(), &pb.ReloadKeysRequest{})
+		if err != nil {
+			failRPC("Failed to reload keys", err)
+		}
+
+		if structuredOutput() {
+			printStructured(reloadKeysOutput{Keys: resp.Keys, Errors: resp.Errors})
+		} else {
+			for _, key := range resp.Keys {
+				notify("%s %s\n", successColor("✓ Key in use:"), key)
+			}
+			for _, e := range resp.Errors {
+				fmt.Fprintf(os.Stderr, "%s %s\n", errorColor("✗"), e)
+			}
+		}
+		if len(resp.Errors) > 0 {
+			os.Exit(exitError)
+		}
+	},
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var setLogLevelCmd = &cobra.Command{
+	Use:   "set-log-level <machine> <port> <level>",
+	Short: "Change how much a tunnel writes to the daemon log",
+	Long: `Change how much a single tunnel writes to the daemon log: error, info, or
+debug to also log every connection and keepalive. default goes back to the
+level of the daemon.`,
+	Args: cobra.ExactArgs(3),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 2 {
+			return []string{"error", "info", "debug", "default"}, cobra.ShellCompDirectiveNoFileComp
+		}
+		return completeActiveTunnels(cmd, args, toComplete)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, localPort := parseTunnelArgs(args)
+		level := args[2]
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		_, err = client.SetLogLevel(context.Background(), &pb.SetLogLevelRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+			Level:      level,
+		})
+		if err != nil {
+			failRPC("Failed to set the log level", err)
+		}
+
+		notify("%s %s:%d logs at %s level\n", successColor("✓"), host, port, level)
+	},
+}
@@ -3,17 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"io"
 
 	"github.com/maximeaubaret/go-tunnel/internal/version"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/maximeaubaret/go-tunnel/pkg/client"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
@@ -28,6 +33,201 @@ var (
 	infoColor    = color.New(color.FgCyan).SprintFunc()
 )
 
+// Socket of the daemon, from --socket or $TUNNEL_SOCKET
+var socketPath string
+
+// API token of the daemon, from --token or $TUNNEL_TOKEN
+var apiToken string
+
+// dialDaemon connects to the tunneld socket and checks that the daemon
+// speaks the same protocol version
+func dialDaemon() (*grpc.ClientConn, error) {
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(client.Dialer(socketPath)),
+	}
+	if apiToken != "" {
+		options = append(options, grpc.WithPerRPCCredentials(client.TokenCredentials(apiToken)))
+	}
+	conn, err := grpc.Dial(client.Target(socketPath), options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(pb.NewTunnelServiceClient(conn)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+type portPair struct {
+	local  int
+	remote int
+}
+
+// parsePortMapping parses a [port_from:]port_to mapping
+func parsePortMapping(ports string) (portPair, error) {
+	if strings.Contains(ports, ":") {
+		parts := strings.Split(ports, ":")
+		localPort, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return portPair{}, fmt.Errorf("invalid local port '%s': %v", parts[0], err)
+		}
+		remotePort, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return portPair{}, fmt.Errorf("invalid remote port '%s': %v", parts[1], err)
+		}
+		return portPair{local: localPort, remote: remotePort}, nil
+	}
+
+	port, err := strconv.Atoi(ports)
+	if err != nil {
+		return portPair{}, fmt.Errorf("invalid port '%s': %v", ports, err)
+	}
+	return portPair{local: port, remote: port}, nil
+}
+
+// reconnectPolicyFlags returns the reconnection policy given with
+// --supervise, --max-retries, --retry-window and --on-give-up, nil to use the
+// policy of the daemon
+func reconnectPolicyFlags(cmd *cobra.Command) *pb.ReconnectPolicy {
+	flags := cmd.Flags()
+	if !flags.Changed("supervise") && !flags.Changed("max-retries") && !flags.Changed("retry-window") && !flags.Changed("on-give-up") {
+		return nil
+	}
+
+	supervised, _ := flags.GetBool("supervise")
+	maxRetries, _ := flags.GetInt32("max-retries")
+	window, _ := flags.GetDuration("retry-window")
+	onGiveUp, _ := flags.GetString("on-give-up")
+	if _, err := tunnel.ParseGiveUpAction(onGiveUp); err != nil {
+		fail(exitUsage, "Invalid --on-give-up: %v", err)
+	}
+	if supervised && (flags.Changed("max-retries") || flags.Changed("retry-window") || flags.Changed("on-give-up")) {
+		fail(exitUsage, "--supervise retries forever, it cannot be combined with --max-retries, --retry-window or --on-give-up")
+	}
+	if maxRetries < 0 || window < 0 {
+		fail(exitUsage, "--max-retries and --retry-window cannot be negative")
+	}
+	return &pb.ReconnectPolicy{
+		Supervised: supervised,
+		MaxRetries: maxRetries,
+		WindowMs:   window.Milliseconds(),
+		OnGiveUp:   onGiveUp,
+	}
+}
+
+// dialRetryFlags returns the dial retry policy given with --dial-retries,
+// --dial-backoff, --dial-timeout and --fail-fast, nil for the default one
+func dialRetryFlags(cmd *cobra.Command) *pb.DialRetry {
+	flags := cmd.Flags()
+	if !flags.Changed("dial-retries") && !flags.Changed("dial-backoff") && !flags.Changed("dial-timeout") && !flags.Changed("fail-fast") {
+		return nil
+	}
+
+	attempts, _ := flags.GetInt32("dial-retries")
+	backoff, _ := flags.GetDuration("dial-backoff")
+	timeout, _ := flags.GetDuration("dial-timeout")
+	failFast, _ := flags.GetBool("fail-fast")
+	if failFast && (flags.Changed("dial-retries") || flags.Changed("dial-backoff")) {
+		fail(exitUsage, "--fail-fast dials once, it cannot be combined with --dial-retries or --dial-backoff")
+	}
+	if attempts < 1 || backoff < 0 || (flags.Changed("dial-timeout") && timeout <= 0) {
+		fail(exitUsage, "--dial-retries must be at least 1, --dial-backoff not negative and --dial-timeout positive")
+	}
+	return &pb.DialRetry{
+		Attempts:  attempts,
+		BackoffMs: backoff.Milliseconds(),
+		TimeoutMs: timeout.Milliseconds(),
+		FailFast:  failFast,
+	}
+}
+
+// keepAliveFlags returns the keepalive settings given with
+// --keepalive-interval, --keepalive-count-max and --keepalive-timeout, nil
+// for the ones of the daemon
+func keepAliveFlags(cmd *cobra.Command) *pb.KeepAlive {
+	flags := cmd.Flags()
+	if !flags.Changed("keepalive-interval") && !flags.Changed("keepalive-count-max") && !flags.Changed("keepalive-timeout") {
+		return nil
+	}
+
+	interval, _ := flags.GetDuration("keepalive-interval")
+	countMax, _ := flags.GetInt32("keepalive-count-max")
+	timeout, _ := flags.GetDuration("keepalive-timeout")
+	if interval < 0 || (flags.Changed("keepalive-count-max") && countMax < 1) || (flags.Changed("keepalive-timeout") && timeout <= 0) {
+		fail(exitUsage, "--keepalive-interval cannot be negative, --keepalive-count-max must be at least 1 and --keepalive-timeout positive")
+	}
+	return &pb.KeepAlive{
+		IntervalMs: interval.Milliseconds(),
+		CountMax:   countMax,
+		Disabled:   flags.Changed("keepalive-interval") && interval == 0,
+		TimeoutMs:  timeout.Milliseconds(),
+	}
+}
+
+// sshOptionsFlags returns the SSH options given with --user, --identity,
+// --ssh-port, --address, --jump, --proxy, --control-path, --connect-timeout
+// and --handshake-timeout, nil to use the defaults
+func sshOptionsFlags(cmd *cobra.Command) *pb.SSHOptions {
+	flags := cmd.Flags()
+	user, _ := flags.GetString("user")
+	identity, _ := flags.GetString("identity")
+	port, _ := flags.GetInt32("ssh-port")
+	address, _ := flags.GetString("address")
+	jump, _ := flags.GetString("jump")
+	proxy, _ := flags.GetString("proxy")
+	controlPath, _ := flags.GetString("control-path")
+	connectTimeout, _ := flags.GetDuration("connect-timeout")
+	handshakeTimeout, _ := flags.GetDuration("handshake-timeout")
+	if user == "" && identity == "" && port == 0 && address == "" && jump == "" && proxy == "" && controlPath == "" && connectTimeout == 0 && handshakeTimeout == 0 {
+		return nil
+	}
+
+	if port < 0 || port > 65535 {
+		fail(exitUsage, "Invalid --ssh-port %d", port)
+	}
+	if connectTimeout < 0 || handshakeTimeout < 0 {
+		fail(exitUsage, "--connect-timeout and --handshake-timeout cannot be negative")
+	}
+	// The daemon does not run in the current directory
+	if identity != "" && !strings.HasPrefix(identity, "~/") {
+		abs, err := filepath.Abs(identity)
+		if err != nil {
+			fail(exitUsage, "Invalid --identity: %v", err)
+		}
+		identity = abs
+	}
+	if controlPath != "" && !strings.HasPrefix(controlPath, "~/") {
+		abs, err := filepath.Abs(controlPath)
+		if err != nil {
+			fail(exitUsage, "Invalid --control-path: %v", err)
+		}
+		controlPath = abs
+	}
+	return &pb.SSHOptions{
+		User:               user,
+		IdentityFile:       identity,
+		Port:               port,
+		Address:            address,
+		JumpHost:           jump,
+		Proxy:              proxy,
+		ControlPath:        controlPath,
+		ConnectTimeoutMs:   connectTimeout.Milliseconds(),
+		HandshakeTimeoutMs: handshakeTimeout.Milliseconds(),
+	}
+}
+
+// familyFlag returns the address family given with --family
+func familyFlag(cmd *cobra.Command) tunnel.AddressFamily {
+	value, _ := cmd.Flags().GetString("family")
+	family, err := tunnel.ParseAddressFamily(value)
+	if err != nil {
+		fail(exitUsage, "Invalid --family: %v", err)
+	}
+	return family
+}
+
 var rootCmd = &cobra.Command{
 	Use:     "tunnel <machine> [port_from:]port_to [[port_from:]port_to...]",
 	Version: version.Version,
@@ -36,151 +236,525 @@ var rootCmd = &cobra.Command{
 Examples:
   tunnel server1 8080                    # Local 8080 to remote 8080
   tunnel server1 8080:80                 # Local 8080 to remote 80
-  tunnel server1 8080 9090 3000:3001    # Multiple tunnels`,
-	Args: cobra.MinimumNArgs(2),
+  tunnel server1 8080 9090 3000:3001    # Multiple tunnels
+  tunnel server1 8080 --label project=acme  # Labeled tunnel
+  tunnel server1 3000 --open            # Open http://localhost:3000
+  tunnel server1 5432 --wait            # Wait until the remote port accepts connections
+  tunnel server1 3000 --wait=/health    # Wait until GET /health answers
+  tunnel server1 5432 --supervise       # Reconnect forever, like autossh
+  tunnel server1 6379 --fail-fast       # Refuse connections at once while SSH is down
+  tunnel server1 5432 -l deploy -J bastion  # Connect as deploy through bastion
+  tunnel server1 8080 --ttl 2h           # Close the tunnel in 2 hours
+  tunnel server1 8080 --session          # Close the tunnel when this shell exits
+  tunnel server1 8080 5432 --atomic      # Create both tunnels or neither
+  tunnel server1 8080 --if-not-exists    # Succeed if the tunnel already exists
+  tunnel server1 8080 --replace --bind 0.0.0.0  # Recreate the tunnel with new settings
+  tunnel server1 @web                   # The ports of the group web in ~/.config/tunnel/config.yaml`,
+	Args:              cobra.MinimumNArgs(2),
+	ValidArgsFunction: completeHostPorts,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := applyCLIDefaults(cmd); err != nil {
+			fail(exitUsage, "%v", err)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		host := args[0]
-		portMappings := args[1:]
+		portMappings, err := expandPortGroups(args[1:])
+		if err != nil {
+			fail(exitUsage, "%v", err)
+		}
+		labels, _ := cmd.Flags().GetStringToString("label")
+		family := familyFlag(cmd)
+		binds := bindFlag(cmd, host)
+		proxyProtocol, _ := cmd.Flags().GetBool("proxy-protocol")
+		noDelay, _ := cmd.Flags().GetBool("nodelay")
+		acceptRate, _ := cmd.Flags().GetInt32("accept-rate")
+		if acceptRate < 0 {
+			fail(exitUsage, "--accept-rate cannot be negative")
+		}
+		holdWhileDown, _ := cmd.Flags().GetBool("hold-while-down")
+		idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+		if idleTimeout < 0 {
+			fail(exitUsage, "--idle-timeout cannot be negative")
+		}
+		logLevel, _ := cmd.Flags().GetString("log-level")
+		policy := reconnectPolicyFlags(cmd)
+		dialRetry := dialRetryFlags(cmd)
+		keepAlive := keepAliveFlags(cmd)
+		sshOptions := sshOptionsFlags(cmd)
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		if ttl < 0 {
+			fail(exitUsage, "--ttl cannot be negative")
+		}
+		ownerPID, _ := cmd.Flags().GetInt("pid")
+		if ownerPID < 0 {
+			fail(exitUsage, "--pid must be a process ID")
+		}
+		if session, _ := cmd.Flags().GetBool("session"); session {
+			if ownerPID != 0 {
+				fail(exitUsage, "--pid and --session cannot be combined")
+			}
+			ownerPID = os.Getppid()
+		}
+		onOpen, _ := cmd.Flags().GetString("on-open")
+		onClose, _ := cmd.Flags().GetString("on-close")
+		check, _ := cmd.Flags().GetString("check")
+		if _, err := tunnel.ParsePreCheck(check); err != nil {
+			fail(exitUsage, "Invalid --check: %v", err)
+		}
+		ifExists := "fail"
+		replace, _ := cmd.Flags().GetBool("replace")
+		ifNotExists, _ := cmd.Flags().GetBool("if-not-exists")
+		switch {
+		case replace && ifNotExists:
+			fail(exitUsage, "--replace and --if-not-exists cannot be combined")
+		case replace:
+			ifExists = "replace"
+		case ifNotExists:
+			ifExists = "keep"
+		}
+		open, _ := cmd.Flags().GetBool("open")
+		wait, _ := cmd.Flags().GetString("wait")
+		waitTimeout, _ := cmd.Flags().GetDuration("wait-timeout")
 
-		type portPair struct {
-			local  int
-			remote int
+		var httpPath string
+		switch {
+		case wait == "" || wait == "tcp":
+		case wait == "http":
+			httpPath = "/"
+		case strings.HasPrefix(wait, "/"):
+			httpPath = wait
+		default:
+			fail(exitUsage, "Invalid --wait probe %q: expected tcp, http or an HTTP path", wait)
 		}
 
 		// Parse all port mappings first to validate
 		var pairs []portPair
 		for _, ports := range portMappings {
-			var localPort, remotePort int
-			if strings.Contains(ports, ":") {
-				parts := strings.Split(ports, ":")
-				var err error
-				localPort, err = strconv.Atoi(parts[0])
-				if err != nil {
-					log.Fatalf("Invalid local port '%s': %v", parts[0], err)
-				}
-				remotePort, err = strconv.Atoi(parts[1])
-				if err != nil {
-					log.Fatalf("Invalid remote port '%s': %v", parts[1], err)
-				}
-			} else {
-				var err error
-				remotePort, err = strconv.Atoi(ports)
-				if err != nil {
-					log.Fatalf("Invalid port '%s': %v", ports, err)
-				}
-				localPort = remotePort
+			pair, err := parsePortMapping(ports)
+			if err != nil {
+				fail(exitUsage, "%v", err)
 			}
-			pairs = append(pairs, portPair{local: localPort, remote: remotePort})
+			pairs = append(pairs, pair)
 		}
 
-		conn, err := grpc.Dial("unix:///tmp/tunnel.sock", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := dialDaemon()
 		if err != nil {
-			log.Fatalf("Failed to connect: %v", err)
+			failDial(err)
 		}
 		defer conn.Close()
 
 		client := pb.NewTunnelServiceClient(conn)
-		// Create all tunnels
-		for _, pair := range pairs {
-			resp, err := client.CreateTunnel(context.Background(), &pb.CreateTunnelRequest{
-				Host:       host,
-				LocalPort:  int32(pair.local),
-				RemotePort: int32(pair.remote),
-			})
 
-			if err != nil {
-				fmt.Printf("%s Failed to create tunnel %d:%d: %v\n", errorColor("✗"), pair.local, pair.remote, err)
-				continue
+		reqs := make([]*pb.CreateTunnelRequest, len(pairs))
+		for i, pair := range pairs {
+			reqs[i] = &pb.CreateTunnelRequest{
+				Host:            host,
+				LocalPort:       int32(pair.local),
+				RemotePort:      int32(pair.remote),
+				Labels:          labels,
+				AddressFamily:   string(family),
+				BindAddresses:   binds,
+				ProxyProtocol:   proxyProtocol,
+				Nagle:           !noDelay,
+				AcceptRate:      acceptRate,
+				HoldWhileDown:   holdWhileDown,
+				IdleTimeoutMs:   idleTimeout.Milliseconds(),
+				LogLevel:        logLevel,
+				ReconnectPolicy: policy,
+				OnOpen:          onOpen,
+				OnClose:         onClose,
+				PreCheck:        check,
+				DialRetry:       dialRetry,
+				Keepalive:       keepAlive,
+				Ssh:             sshOptions,
+				TtlMs:           ttl.Milliseconds(),
+				OwnerPid:        int32(ownerPID),
+				IfExists:        ifExists,
 			}
+		}
 
-			if !resp.Success {
-				fmt.Printf("%s Failed to create tunnel %d:%d: %s\n", errorColor("✗"), pair.local, pair.remote, resp.Error)
-				continue
+		var results []createOutput
+		var codes []int
+		if atomic, _ := cmd.Flags().GetBool("atomic"); atomic {
+			results, codes = createTunnelsAtomic(client, reqs, wait, httpPath, waitTimeout)
+		} else {
+			results, codes = createTunnels(client, reqs, wait, httpPath, waitTimeout)
+		}
+
+		exitCode := 0
+		created := 0
+		for i, result := range results {
+			if result.Success {
+				created++
+			} else if exitCode == 0 {
+				exitCode = codes[i]
 			}
+		}
+		if len(results) > 1 && !structuredOutput() {
+			notify("%s %d created, %d failed\n", infoColor("ℹ"), created, len(results)-created)
+		}
 
-			fmt.Printf("%s %s:%d -> localhost:%d\n",
-				successColor("✓ Tunnel created:"),
-				host,
-				pair.remote,
-				pair.local,
-			)
+		if open {
+			for _, result := range results {
+				if !result.Success {
+					continue
+				}
+				url := fmt.Sprintf("http://localhost:%d", result.LocalPort)
+				if err := openBrowser(url); err != nil {
+					fmt.Fprintf(os.Stderr, "%s Failed to open %s: %v\n", errorColor("✗"), url, err)
+				}
+			}
+		}
+
+		if structuredOutput() {
+			printStructured(results)
+		}
+		if exitCode != 0 {
+			os.Exit(exitCode)
 		}
 	},
 }
 
+// watchFrame renders the watch mode table. Lines are overwritten in place
+// instead of clearing the screen, which would flicker.
+func watchFrame(tunnels []*pb.ListTunnelsResponse_TunnelInfo) string {
+	lines := []string{
+		fmt.Sprintf("%s %s", headerColor("Active Tunnels"), infoColor("(Press Ctrl+C to exit)")),
+		"",
+	}
+	if len(tunnels) == 0 {
+		lines = append(lines, fmt.Sprintf("%s No active tunnels", infoColor("ℹ")))
+	} else {
+		sortTunnels(tunnels)
+		lines = append(lines, headerColor(tableHeader()))
+		for _, t := range tunnels {
+			lines = append(lines, tableLine(t))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H") // Move the cursor to the top-left corner
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\033[K\n") // Clear the rest of the line
+	}
+	b.WriteString("\033[J") // Clear the lines left from a longer frame
+	return b.String()
+}
+
+// Number of tunnels created at the same time
+const maxParallelCreates = 4
+
+// createTunnels creates the tunnels concurrently, the SSH handshakes being the
+// slow part, and reports each as soon as it is done
+func createTunnels(client pb.TunnelServiceClient, reqs []*pb.CreateTunnelRequest, wait, httpPath string, waitTimeout time.Duration) ([]createOutput, []int) {
+	results := make([]createOutput, len(reqs))
+	codes := make([]int, len(reqs))
+	progress := len(reqs) > 1 && !structuredOutput()
+	sem := make(chan struct{}, maxParallelCreates)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if progress {
+				notify("%s Creating tunnel %s:%d -> localhost:%d\n", infoColor("…"), req.Host, req.RemotePort, req.LocalPort)
+			}
+			results[i], codes[i] = createTunnel(client, req, wait, httpPath, waitTimeout)
+			if !structuredOutput() {
+				reportCreate(results[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results, codes
+}
+
+// createTunnelsAtomic creates the tunnels in a single batch which the daemon
+// rolls back if any of them fails. A failed --wait probe closes the whole
+// batch as well.
+func createTunnelsAtomic(client pb.TunnelServiceClient, reqs []*pb.CreateTunnelRequest, wait, httpPath string, waitTimeout time.Duration) ([]createOutput, []int) {
+	resp, err := client.CreateTunnels(context.Background(), &pb.CreateTunnelsRequest{
+		Tunnels: reqs,
+		Atomic:  true,
+	})
+	if err != nil {
+		failRPC("Failed to create tunnels", err)
+	}
+
+	results := make([]createOutput, len(resp.Results))
+	codes := make([]int, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = createOutput{
+			Host:       r.Tunnel.Host,
+			LocalPort:  int(r.Tunnel.LocalPort),
+			RemotePort: int(r.Tunnel.RemotePort),
+			Warnings:   r.Warnings,
+		}
+		switch r.Action {
+		case "created", "kept", "replaced":
+			results[i].Success = true
+			results[i].Action = r.Action
+		}
+		switch r.Action {
+		case "failed":
+			results[i].Error = r.Error
+			if r.Reason != pb.ErrorReason_ERROR_REASON_UNSPECIFIED {
+				results[i].Reason = r.Reason.String()
+			}
+			results[i].Hint = r.Hint
+			codes[i] = resultExitCode(r.Reason, r.Error)
+		// The exit code is that of the tunnel which failed, not of the
+		// ones it took down
+		case "rolled_back":
+			results[i].Error = "rolled back, another tunnel of the batch failed"
+		case "skipped":
+			results[i].Error = "not created, another tunnel of the batch failed"
+		}
+	}
+
+	if resp.Success && wait != "" {
+		failed := false
+		for i, req := range reqs {
+			if err := probeTunnel(client, req, httpPath, waitTimeout); err != nil {
+				results[i].Success = false
+				results[i].Error = rpcMessage(err)
+				codes[i] = rpcExitCode(err)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			for i, req := range reqs {
+				if !results[i].Success || results[i].Action == "kept" {
+					continue
+				}
+				client.CloseTunnel(context.Background(), &pb.CloseTunnelRequest{
+					Host:       req.Host,
+					RemotePort: req.RemotePort,
+					LocalPort:  req.LocalPort,
+					Force:      true,
+				})
+				results[i].Success = false
+				results[i].Error = "rolled back, another tunnel of the batch failed"
+			}
+		}
+	}
+
+	if !structuredOutput() {
+		for _, result := range results {
+			reportCreate(result)
+		}
+	}
+	return results, codes
+}
+
+// createTunnel creates a single tunnel, retrying on another local port if
+// the requested one is in use, and waits for the remote service if asked to.
+// It returns the exit code matching the failure, if any.
+func createTunnel(client pb.TunnelServiceClient, req *pb.CreateTunnelRequest, wait, httpPath string, waitTimeout time.Duration) (createOutput, int) {
+	result := createOutput{
+		Host:       req.Host,
+		LocalPort:  int(req.LocalPort),
+		RemotePort: int(req.RemotePort),
+	}
+
+	resp, err := client.CreateTunnel(context.Background(), req)
+
+	// Retry once on another local port if the user agrees
+	if conflict := rpcPortInUse(err); conflict != nil {
+		if port := choosePort(int(req.LocalPort), conflict); port != 0 {
+			result.LocalPort = port
+			req.LocalPort = int32(port)
+			resp, err = client.CreateTunnel(context.Background(), req)
+		}
+	}
+
+	if err != nil {
+		result.Error = rpcMessage(err)
+		if reason := rpcReason(err); reason != pb.ErrorReason_ERROR_REASON_UNSPECIFIED {
+			result.Reason = reason.String()
+		}
+		result.Hint = rpcHint(err)
+		return result, rpcExitCode(err)
+	}
+	result.Action = resp.Action
+	result.Warnings = resp.Warnings
+
+	// Only report success once the remote service answers, closing the
+	// tunnel otherwise so that a retry starts from scratch
+	if wait != "" {
+		if err := probeTunnel(client, req, httpPath, waitTimeout); err != nil {
+			result.Error = rpcMessage(err)
+			return result, rpcExitCode(err)
+		}
+	}
+
+	result.Success = true
+	return result, 0
+}
+
+// reportCreate prints the outcome of a tunnel creation
+func reportCreate(result createOutput) {
+	if !result.Success {
+		fmt.Fprintf(os.Stderr, "%s Failed to create tunnel %d:%d: %s\n", errorColor("✗"), result.LocalPort, result.RemotePort, result.Error)
+		if result.Hint != "" {
+			fmt.Fprintf(os.Stderr, "  %s\n", formatHint(result.Hint))
+		}
+		return
+	}
+
+	label := "✓ Tunnel created:"
+	switch result.Action {
+	case "kept":
+		label = "✓ Tunnel already exists:"
+	case "replaced":
+		label = "✓ Tunnel replaced:"
+	}
+	notify("%s %s:%d -> localhost:%d\n",
+		successColor(label),
+		result.Host,
+		result.RemotePort,
+		result.LocalPort,
+	)
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "%s %s\n", infoColor("!"), warning)
+	}
+}
+
+// probeTunnel waits for the service behind a new tunnel, and closes the
+// tunnel if it does not answer in time
+func probeTunnel(client pb.TunnelServiceClient, req *pb.CreateTunnelRequest, httpPath string, timeout time.Duration) error {
+	_, err := client.ProbeTunnel(context.Background(), &pb.ProbeTunnelRequest{
+		Host:       req.Host,
+		RemotePort: req.RemotePort,
+		LocalPort:  req.LocalPort,
+		HttpPath:   httpPath,
+		TimeoutMs:  int32(timeout / time.Millisecond),
+	})
+	if err == nil {
+		return nil
+	}
+
+	client.CloseTunnel(context.Background(), &pb.CloseTunnelRequest{
+		Host:       req.Host,
+		RemotePort: req.RemotePort,
+		LocalPort:  req.LocalPort,
+		Force:      true,
+	})
+	return err
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List active tunnels",
 	Long: `List active tunnels and their status.
 	
-Use --watch or -w to continuously monitor tunnels in real-time.`,
+Use --watch or -w to continuously monitor tunnels in real-time, and --label
+to only show the tunnels carrying the given labels.
+
+With --plain, each tunnel is printed on one line of tab-separated fields for
+awk, grep or cut: id, host, remote port, local port, active or paused, active
+connections, total connections, bytes sent, bytes received and labels.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		watch, _ := cmd.Flags().GetBool("watch")
-		conn, err := grpc.Dial("unix:///tmp/tunnel.sock", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		labels, _ := cmd.Flags().GetStringToString("label")
+		checkPlain()
+		var interval time.Duration
+		if watch {
+			interval = watchInterval(cmd)
+		}
+		conn, err := dialDaemon()
 		if err != nil {
-			log.Fatalf("Failed to connect: %v", err)
+			failDial(err)
 		}
 		defer conn.Close()
 
 		client := pb.NewTunnelServiceClient(conn)
-		resp, err := client.ListTunnels(context.Background(), &pb.ListTunnelsRequest{})
-		if err != nil {
-			log.Fatalf("Failed to list tunnels: %v", err)
-		}
 
 		if watch {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
 			// Handle Ctrl+C gracefully
 			sigChan := make(chan os.Signal, 1)
 			signal.Notify(sigChan, os.Interrupt)
-			done := make(chan bool)
 
 			go func() {
 				<-sigChan
-				fmt.Print("\033[?25h") // Show cursor
-				fmt.Println("\nExiting watch mode...")
-				done <- true
+				cancel()
 			}()
 
-			fmt.Print("\033[?25l")       // Hide cursor
-			defer fmt.Print("\033[?25h") // Show cursor on exit
+			// Draw in the alternate screen so that the scrollback is left
+			// untouched, and restore it before exiting
+			restore := func() {}
+			if !structuredOutput() && !plainOutput {
+				fmt.Print("\033[?1049h\033[?25l") // Alternate screen, hide cursor
+				restore = func() { fmt.Print("\033[?25h\033[?1049l") }
+				defer restore()
+			}
 
-			ticker := time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
+			// The daemon pushes a new snapshot whenever a tunnel changes state
+			// and at least once per interval to refresh the statistics
+			stream, err := client.WatchTunnels(ctx, &pb.WatchTunnelsRequest{
+				IntervalMs: int32(interval.Milliseconds()),
+				Labels:     labels,
+			})
+			if err != nil {
+				restore()
+				failRPC("Failed to watch tunnels", err)
+			}
 
 			for {
-				select {
-				case <-done:
-					return
-				case <-ticker.C:
-					// Clear screen and move cursor to top-left
-					fmt.Print("\033[H\033[2J")
-
-					resp, err = client.ListTunnels(context.Background(), &pb.ListTunnelsRequest{})
-					if err != nil {
-						log.Printf("Failed to list tunnels: %v", err)
-						continue
-					}
-
-					if len(resp.Tunnels) == 0 {
-						fmt.Printf("%s No active tunnels\n", infoColor("ℹ"))
-						continue
+				resp, err := stream.Recv()
+				if err != nil {
+					if ctx.Err() != nil {
+						return
 					}
+					restore()
+					failRPC("Failed to watch tunnels", err)
+				}
 
-					fmt.Printf("%s %s\n", headerColor("Active Tunnels"), infoColor("(Press Ctrl+C to exit)"))
-					fmt.Println()
+				// Emit one document per snapshot in machine-readable mode
+				if structuredOutput() {
+					printStructured(newListOutput(resp.Tunnels))
+					continue
+				}
+				if plainOutput {
+					printPlainTunnels(resp.Tunnels)
+					continue
 				}
 
-				displayTunnels(resp.Tunnels)
+				fmt.Print(watchFrame(resp.Tunnels))
 			}
 		}
 
+		resp, err := client.ListTunnels(context.Background(), &pb.ListTunnelsRequest{
+			Labels: labels,
+		})
+		if err != nil {
+			failRPC("Failed to list tunnels", err)
+		}
+
+		if structuredOutput() {
+			printStructured(newListOutput(resp.Tunnels))
+			return
+		}
+		if plainOutput {
+			printPlainTunnels(resp.Tunnels)
+			return
+		}
+
 		if len(resp.Tunnels) == 0 {
-			fmt.Printf("%s No active tunnels\n", infoColor("ℹ"))
+			notify("%s No active tunnels\n", infoColor("ℹ"))
 			return
 		}
 
-		fmt.Printf("%s\n", headerColor("Active Tunnels"))
-		fmt.Println()
+		notify("%s\n\n", headerColor("Active Tunnels"))
 
 		displayTunnels(resp.Tunnels)
 
@@ -188,39 +762,88 @@ Use --watch or -w to continuously monitor tunnels in real-time.`,
 }
 
 var closeCmd = &cobra.Command{
-	Use:   "close <machine> <port>",
+	Use:   "close <machine> <port> | :<local_port> | <id>",
 	Short: "Close a tunnel",
-	Args:  cobra.ExactArgs(2),
+	Long: `Close a tunnel, identified either by its machine and remote port, by its
+local port (":8080") or by its ID as shown by "tunnel list". A unique prefix
+of the ID is enough. When several local ports forward the same remote port,
+give both as in "tunnel close server1 9090:80".
+
+The tunnel stops accepting connections right away, and those in progress get
+up to --drain-timeout to complete before being cut. Use --force to cut them
+immediately.`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeCloseTargets,
 	Run: func(cmd *cobra.Command, args []string) {
-		host := args[0]
-		port, err := strconv.Atoi(args[1])
-		if err != nil {
-			log.Fatalf("Invalid port: %v", err)
+		force, _ := cmd.Flags().GetBool("force")
+		drainTimeout, _ := cmd.Flags().GetDuration("drain-timeout")
+		if drainTimeout <= 0 {
+			fail(exitUsage, "Invalid --drain-timeout: must be positive, use --force to skip draining")
 		}
 
-		conn, err := grpc.Dial("unix:///tmp/tunnel.sock", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		req := &pb.CloseTunnelRequest{
+			Force:          force,
+			DrainTimeoutMs: int32(drainTimeout / time.Millisecond),
+		}
+		var target string
+		switch {
+		case len(args) == 2:
+			host, port, localPort := parseTunnelArgs(args)
+			req.Host = host
+			req.RemotePort = int32(port)
+			req.LocalPort = int32(localPort)
+			target = fmt.Sprintf("%s:%d", req.Host, port)
+		case strings.HasPrefix(args[0], ":"):
+			port, err := strconv.Atoi(args[0][1:])
+			if err != nil {
+				fail(exitUsage, "Invalid local port: %v", err)
+			}
+			req.LocalPort = int32(port)
+			target = fmt.Sprintf("localhost:%d", port)
+		case args[0] == "":
+			fail(exitUsage, "Invalid tunnel ID: empty")
+		default:
+			req.Id = args[0]
+			target = args[0]
+		}
+
+		conn, err := dialDaemon()
 		if err != nil {
-			log.Fatalf("Failed to connect: %v", err)
+			failDial(err)
 		}
 		defer conn.Close()
 
 		client := pb.NewTunnelServiceClient(conn)
-		resp, err := client.CloseTunnel(context.Background(), &pb.CloseTunnelRequest{
-			Host:       host,
-			RemotePort: int32(port),
-		})
+		resp, err := client.CloseTunnel(context.Background(), req)
 
-		if err != nil {
-			fmt.Printf("%s Failed to close tunnel: %v\n", errorColor("✗"), err)
-			os.Exit(1)
+		if structuredOutput() {
+			result := closeOutput{
+				ID:         req.Id,
+				Host:       req.Host,
+				LocalPort:  int(req.LocalPort),
+				RemotePort: int(req.RemotePort),
+			}
+			if err != nil {
+				result.Error = rpcMessage(err)
+				printStructured(result)
+				os.Exit(rpcExitCode(err))
+			}
+			result.Success = true
+			result.Drained = int(resp.Drained)
+			result.Cut = int(resp.Cut)
+			printStructured(result)
+			return
 		}
 
-		if !resp.Success {
-			fmt.Printf("%s Failed to close tunnel: %s\n", errorColor("✗"), resp.Error)
-			os.Exit(1)
+		if err != nil {
+			failRPC("Failed to close tunnel", err)
 		}
 
-		fmt.Printf("%s %s:%d\n", successColor("✓ Tunnel closed:"), host, port)
+		if resp.Drained+resp.Cut > 0 {
+			notify("%s %s (%d connection(s) drained, %d cut)\n", successColor("✓ Tunnel closed:"), target, resp.Drained, resp.Cut)
+		} else {
+			notify("%s %s\n", successColor("✓ Tunnel closed:"), target)
+		}
 	},
 }
 
@@ -228,26 +851,143 @@ var closeAllCmd = &cobra.Command{
 	Use:   "closeall",
 	Short: "Close all active tunnels",
 	Run: func(cmd *cobra.Command, args []string) {
-		conn, err := grpc.Dial("unix:///tmp/tunnel.sock", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := dialDaemon()
 		if err != nil {
-			log.Fatalf("Failed to connect: %v", err)
+			failDial(err)
 		}
 		defer conn.Close()
 
 		client := pb.NewTunnelServiceClient(conn)
-		resp, err := client.CloseAllTunnels(context.Background(), &pb.CloseAllTunnelsRequest{})
+		labels, _ := cmd.Flags().GetStringToString("label")
+		resp, err := client.CloseAllTunnels(context.Background(), &pb.CloseAllTunnelsRequest{
+			Labels: labels,
+		})
 		if err != nil {
-			log.Fatalf("Failed to close all tunnels: %v", err)
+			failRPC("Failed to close all tunnels", err)
 		}
 
-		if !resp.Success {
-			log.Fatalf("Failed to close all tunnels: %s", resp.Error)
+		if structuredOutput() {
+			printStructured(closeAllOutput{Count: resp.Count})
+			return
 		}
 
-		fmt.Printf("%s Closed %d tunnel(s)\n", successColor("✓"), resp.Count)
+		notify("%s Closed %d tunnel(s)\n", successColor("✓"), resp.Count)
 	},
 }
 
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Stream tunnel events",
+	Long: `Stream tunnel state changes (creation, closing, reconnections,
+connections and errors) as they happen.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		stream, err := client.SubscribeEvents(context.Background(), &pb.SubscribeEventsRequest{})
+		if err != nil {
+			failRPC("Failed to subscribe to events", err)
+		}
+
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				failRPC("Event stream closed", err)
+			}
+			if structuredOutput() {
+				printStructured(newEventOutput(ev))
+				continue
+			}
+			displayEvent(ev)
+		}
+	},
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show the daemon logs",
+	Long: `Show the most recent log lines of the daemon.
+
+Use --follow or -f to keep streaming new lines, and --host to only show lines
+about tunnels to a given host.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		follow, _ := cmd.Flags().GetBool("follow")
+		host, _ := cmd.Flags().GetString("host")
+		tail, _ := cmd.Flags().GetInt32("tail")
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		stream, err := client.StreamLogs(context.Background(), &pb.StreamLogsRequest{
+			Host:   host,
+			Follow: follow,
+			Tail:   tail,
+		})
+		if err != nil {
+			failRPC("Failed to stream logs", err)
+		}
+
+		for {
+			entry, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				failRPC("Log stream closed", err)
+			}
+			if structuredOutput() {
+				printStructured(logOutput{
+					Time:    time.Unix(entry.Timestamp, 0),
+					Message: entry.Message,
+				})
+				continue
+			}
+			fmt.Println(entry.Message)
+		}
+	},
+}
+
+// eventName returns the short, lower-case name of an event type
+func eventName(typ pb.EventType) string {
+	return strings.ToLower(strings.TrimPrefix(typ.String(), "EVENT_"))
+}
+
+func displayEvent(ev *pb.Event) {
+	name := eventName(ev.Type)
+	switch ev.Type {
+	case pb.EventType_EVENT_ERROR, pb.EventType_EVENT_RECONNECT_FAILED, pb.EventType_EVENT_TUNNEL_PAUSED:
+		name = errorColor(name)
+	case pb.EventType_EVENT_TUNNEL_CREATED, pb.EventType_EVENT_RECONNECT_SUCCEEDED, pb.EventType_EVENT_TUNNEL_RESUMED:
+		name = successColor(name)
+	default:
+		name = infoColor(name)
+	}
+
+	fmt.Printf("%s %s %s:%d -> localhost:%d",
+		time.Unix(ev.Timestamp, 0).Format("15:04:05"),
+		name,
+		ev.Host,
+		ev.RemotePort,
+		ev.LocalPort,
+	)
+	if ev.TunnelId != "" {
+		fmt.Printf(" %s", infoColor("["+ev.TunnelId+"]"))
+	}
+	if ev.Message != "" {
+		fmt.Printf(" (%s)", ev.Message)
+	}
+	fmt.Println()
+}
+
 // formatBytes converts bytes to human readable string
 func formatBytes(bytes uint64) string {
 	const unit = 1024
@@ -296,6 +1036,16 @@ func sortTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo) {
 	})
 }
 
+// formatLabels renders labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
 func displayTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo) {
 	// Sort tunnels before display
 	sortTunnels(tunnels)
@@ -305,12 +1055,49 @@ func displayTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo) {
 		lastActivity := time.Since(time.Unix(t.LastActivity, 0))
 
 		// Format the basic tunnel information
-		fmt.Printf("%s %s:%d -> localhost:%d\n",
+		fmt.Printf("%s %s:%d -> localhost:%d %s",
 			headerColor("Tunnel:"),
 			t.Host,
 			t.RemotePort,
 			t.LocalPort,
+			infoColor("["+t.Id+"]"),
 		)
+		if t.Paused {
+			fmt.Printf(" %s", errorColor("(paused)"))
+		}
+		fmt.Println()
+
+		if len(t.Labels) > 0 {
+			fmt.Printf("  %s %s\n", infoColor("Labels:"), formatLabels(t.Labels))
+		}
+		if t.HostAddress != "" {
+			fmt.Printf("  %s %s\n", infoColor("Host Address:"), t.HostAddress)
+		}
+		if len(t.Addresses) > 0 {
+			fmt.Printf("  %s %s\n", infoColor("Listening:"), strings.Join(t.Addresses, ", "))
+		}
+		if t.ProxyProtocol {
+			fmt.Printf("  %s v2\n", infoColor("PROXY Protocol:"))
+		}
+		if t.Nagle {
+			fmt.Printf("  %s on\n", infoColor("Nagle:"))
+		}
+		if t.LogLevel != "" && t.LogLevel != "info" {
+			fmt.Printf("  %s %s\n", infoColor("Log Level:"), t.LogLevel)
+		}
+		if t.AcceptRate > 0 || t.HoldWhileDown {
+			var limits []string
+			if t.AcceptRate > 0 {
+				limits = append(limits, fmt.Sprintf("%d/s", t.AcceptRate))
+			}
+			if t.HoldWhileDown {
+				limits = append(limits, "held while SSH is down")
+			}
+			fmt.Printf("  %s %s\n", infoColor("Accept:"), strings.Join(limits, ", "))
+		}
+		if t.IdleTimeoutMs > 0 {
+			fmt.Printf("  %s connections closed after %s without traffic\n", infoColor("Idle Timeout:"), time.Duration(t.IdleTimeoutMs)*time.Millisecond)
+		}
 
 		// Format uptime and activity
 		fmt.Printf("  %s %s\n",
@@ -321,6 +1108,17 @@ func displayTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo) {
 			infoColor("Last Activity:"),
 			formatDuration(lastActivity),
 		)
+		if t.ExpiresAt != 0 {
+			expiresAt := time.Unix(t.ExpiresAt, 0)
+			fmt.Printf("  %s in %s (%s)\n",
+				infoColor("Expires:"),
+				formatDuration(max(time.Until(expiresAt), 0)),
+				expiresAt.Format(time.DateTime),
+			)
+		}
+		if t.OwnerPid != 0 {
+			fmt.Printf("  %s process %d\n", infoColor("Owner:"), t.OwnerPid)
+		}
 
 		// Format data transfer information
 		fmt.Printf("  %s %s (↑) / %s (↓)\n",
@@ -343,20 +1141,147 @@ func displayTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo) {
 			t.TotalConns,
 		)
 
+		// Format the latency of the SSH connection
+		fmt.Printf("  %s %s (%d keepalive failure(s))\n",
+			infoColor("Latency:"),
+			formatLatency(t.LatencyMs),
+			t.KeepaliveFailures,
+		)
+
 		fmt.Println()
 	}
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Output in JSON format")
+	rootCmd.PersistentFlags().BoolVar(&yamlOutput, "yaml", false, "Output in YAML format")
+	rootCmd.MarkFlagsMutuallyExclusive("json", "yaml")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Suppress decorative output")
+	rootCmd.PersistentFlags().StringVarP(&socketPath, "socket", "S", client.Socket(), "Unix socket or tcp://host:port of the daemon, also set with $"+client.SocketEnv)
+	rootCmd.PersistentFlags().StringVar(&colorMode, "color", "auto", "Color the output: auto, always or never")
+	rootCmd.RegisterFlagCompletionFunc("color", cobra.FixedCompletions([]string{"auto", "always", "never"}, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.PersistentFlags().StringVar(&apiToken, "token", os.Getenv(client.TokenEnv), "API token of the daemon, also set with $"+client.TokenEnv)
+	rootCmd.Flags().StringToString("label", nil, "Attach labels to the tunnels (key=value, can be repeated)")
+	rootCmd.Flags().Bool("open", false, "Open the forwarded ports in the default browser")
+	rootCmd.Flags().BoolVar(&autoPort, "auto-port", false, "Use the next free local port when a port is already in use")
+	rootCmd.Flags().String("wait", "", "Wait until the remote service answers: tcp, http or an HTTP path such as /health")
+	rootCmd.Flags().Lookup("wait").NoOptDefVal = "tcp"
+	rootCmd.Flags().Duration("wait-timeout", 30*time.Second, "How long --wait waits for the remote service")
+	rootCmd.Flags().Bool("replace", false, "Recreate the tunnel with the new settings if it exists")
+	rootCmd.Flags().Bool("if-not-exists", false, "Succeed without change if an identical tunnel exists")
+	rootCmd.Flags().Bool("atomic", false, "Create all the tunnels or none: close the created ones if any fails")
+	rootCmd.Flags().Bool("supervise", false, "Keep reconnecting the tunnels forever, whatever the policy of the daemon")
+	rootCmd.Flags().Int32("max-retries", 0, "SSH reconnection attempts before giving up, 0 to retry forever")
+	rootCmd.Flags().Duration("retry-window", 0, "Give up reconnecting after this long, 0 for no limit")
+	rootCmd.Flags().String("on-give-up", "wait", "What to do once reconnecting gave up: wait for the next connection to retry, or close the tunnel")
+	rootCmd.Flags().Int32("dial-retries", 3, "Attempts to connect to the remote service for each connection")
+	rootCmd.Flags().Duration("dial-backoff", time.Second, "Delay after the first failed attempt, growing linearly")
+	rootCmd.Flags().Duration("dial-timeout", 0, "How long a connection waits for the remote service, including SSH reconnections (default of the daemon: 10s)")
+	rootCmd.Flags().Bool("fail-fast", false, "Connect to the remote service once, without waiting for SSH to reconnect")
+	rootCmd.Flags().Int32("accept-rate", 0, "New connections accepted per second, the others wait in the listen backlog (default of the daemon: no limit)")
+	rootCmd.Flags().Bool("hold-while-down", false, "Stop accepting connections while the SSH connection is down")
+	rootCmd.Flags().Duration("idle-timeout", 0, "Close the connections without traffic in either direction for this long (default of the daemon: keep them open)")
+	rootCmd.Flags().String("log-level", "", "How much the tunnel writes to the daemon log: error, info or debug (default of the daemon: info)")
+	rootCmd.Flags().Duration("keepalive-interval", 0, "Interval between two SSH keepalive requests, 0 to only rely on TCP keepalives (default of the daemon: 10s)")
+	rootCmd.Flags().Int32("keepalive-count-max", 0, "Consecutive failed SSH keepalive requests before reconnecting (default of the daemon: 1)")
+	rootCmd.Flags().Duration("keepalive-timeout", 0, "How long to wait for the answer to an SSH keepalive request (default of the daemon: 5s)")
+	rootCmd.Flags().StringP("user", "l", "", "SSH user, instead of the one of the user config or the daemon")
+	rootCmd.Flags().StringP("identity", "i", "", "Private key to authenticate with, instead of the keys of the daemon")
+	rootCmd.Flags().Int32("ssh-port", 0, "Port of the SSH server (default 22)")
+	rootCmd.Flags().String("address", "", "Connect to this address, such as an IP, keeping the host for its host key, the user config and the display")
+	rootCmd.Flags().StringP("jump", "J", "", "Connect through this SSH server, as [user@]host[:port]")
+	rootCmd.Flags().String("proxy", "", "Connect through this SOCKS5 or HTTP proxy, as socks5:// or http://[user:password@]host:port")
+	rootCmd.Flags().String("control-path", "", "Forward through the OpenSSH ControlMaster listening on this socket, with the tokens of ControlPath such as ~/.ssh/cm-%C")
+	rootCmd.Flags().Duration("connect-timeout", 0, "How long connecting to the SSH server may take (default of the daemon: 30s)")
+	rootCmd.Flags().Duration("handshake-timeout", 0, "How long the SSH handshake may take (default of the daemon: no limit)")
+	rootCmd.Flags().Duration("ttl", 0, "Close the tunnels after this long, whatever their activity")
+	rootCmd.Flags().Int("pid", 0, "Close the tunnels when this process exits")
+	rootCmd.Flags().Bool("session", false, "Close the tunnels when the shell running this command exits")
+	rootCmd.Flags().String("on-open", "", "Command to run on the machine once the tunnel is connected, the tunnel is not created if it fails")
+	rootCmd.Flags().String("on-close", "", "Command to run on the machine when the tunnel is closed")
+	rootCmd.Flags().String("check", "none", "Connect once to the remote port after connecting: fail, or warn to create the tunnel anyway")
+	rootCmd.Flags().Lookup("check").NoOptDefVal = "fail"
 	listCmd.Flags().BoolP("watch", "w", false, "Watch mode - continuously update the display")
+	listCmd.Flags().Duration("interval", time.Second, "How often --watch refreshes the statistics")
+	listCmd.Flags().StringToString("label", nil, "Only list tunnels with these labels (key=value)")
+	listCmd.Flags().BoolVar(&plainOutput, "plain", false, "One tunnel per line of tab-separated fields, without colors")
 	rootCmd.AddCommand(listCmd)
+	closeCmd.Flags().Bool("force", false, "Cut the connections in progress instead of waiting for them")
+	closeCmd.Flags().Duration("drain-timeout", 10*time.Second, "How long to wait for the connections in progress")
 	rootCmd.AddCommand(closeCmd)
+	closeAllCmd.Flags().StringToString("label", nil, "Only close tunnels with these labels (key=value)")
 	rootCmd.AddCommand(closeAllCmd)
+	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(notifyCmd)
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep streaming new log lines")
+	logsCmd.Flags().String("host", "", "Only show lines about tunnels to this host")
+	logsCmd.Flags().Int32P("tail", "n", 100, "Number of recent lines to show, 0 for all")
+	logsCmd.RegisterFlagCompletionFunc("host", completeActiveTunnels)
+	rootCmd.AddCommand(logsCmd)
+	dashboardCmd.Flags().Duration("interval", time.Second, "How often the statistics refresh")
+	rootCmd.AddCommand(dashboardCmd)
+	statusCmd.Flags().BoolVar(&plainOutput, "plain", false, "One line of tab-separated fields, the fields of list followed by the SSH state")
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(connectionsCmd)
+	captureCmd.Flags().StringP("out", "o", "", "Write the traffic to this pcap file instead of printing a hexdump")
+	captureCmd.Flags().Duration("duration", 30*time.Second, "How long to record")
+	captureCmd.Flags().Int("max-bytes", 64*1024, "Bytes recorded per connection and direction, 0 for no limit")
+	rootCmd.AddCommand(captureCmd)
+	statsCmd.Flags().StringToString("label", nil, "Only show tunnels with these labels (key=value)")
+	statsCmd.Flags().String("export", "", "Print the usage over --since as csv or json instead of the bandwidth")
+	statsCmd.Flags().Duration("since", time.Hour, "Period covered by --export, up to a day")
+	rootCmd.AddCommand(statsCmd)
+	upCmd.Flags().StringP("file", "f", "tunnels.yaml", "File declaring the tunnels")
+	upCmd.Flags().Bool("prune", false, "Close active tunnels which are not declared in the file")
+	rootCmd.AddCommand(upCmd)
+	downCmd.Flags().StringP("file", "f", "tunnels.yaml", "File declaring the tunnels")
+	rootCmd.AddCommand(downCmd)
+	importCmd.Flags().String("config", userconfig.SSHConfigPath(), "ssh config file to read")
+	importCmd.Flags().Bool("dry-run", false, "Print the tunnels instead of creating them")
+	importCmd.Flags().StringToString("label", nil, "Attach labels to the tunnels (key=value, can be repeated)")
+	rootCmd.AddCommand(importCmd)
+	exportCmd.Flags().Bool("ssh-config", false, "Print LocalForward directives for ~/.ssh/config instead of an ssh command")
+	exportCmd.Flags().StringToString("label", nil, "Only export tunnels with these labels (key=value)")
+	rootCmd.AddCommand(exportCmd)
+	for _, cmd := range []*cobra.Command{rootCmd, runCmd, execCmd} {
+		cmd.Flags().String("family", "any", "IP versions to listen on and connect with: any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+		cmd.Flags().StringSlice("bind", nil, "Local addresses to listen on instead of localhost (can be repeated)")
+		cmd.Flags().Bool("proxy-protocol", false, "Send a PROXY protocol v2 header so the remote service sees the client address")
+		cmd.Flags().Bool("nodelay", true, "Set TCP_NODELAY so that small writes are sent at once, --nodelay=false batches them for bulk transfers")
+	}
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(execCmd)
+	pauseCmd.Flags().Bool("sever", false, "Also close the connections in progress")
+	rootCmd.AddCommand(pauseCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(setLogLevelCmd)
+	updateCmd.Flags().Int("local-port", 0, "Listen on this local port instead")
+	updateCmd.Flags().StringSlice("bind", nil, "Listen on these local addresses instead (can be repeated)")
+	updateCmd.Flags().Int("remote-port", 0, "Forward to this remote port instead")
+	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(reloadKeysCmd)
+	keychainCmd.Flags().Bool("forget", false, "Remove the passphrase of the key from the Keychain")
+	rootCmd.AddCommand(keychainCmd)
+	rootCmd.AddCommand(daemonStatsCmd)
+	historyCmd.Flags().StringToString("label", nil, "Only show tunnels which had these labels (key=value)")
+	historyCmd.Flags().String("recreate", "", "Create the closed tunnel with this ID again")
+	rootCmd.AddCommand(historyCmd)
+	envCmd.Flags().String("host", "", "Only export tunnels to this host")
+	envCmd.Flags().StringToString("label", nil, "Only export tunnels with these labels (key=value)")
+	envCmd.RegisterFlagCompletionFunc("host", completeActiveTunnels)
+	rootCmd.AddCommand(envCmd)
+	rootCmd.AddCommand(doctorCmd)
+	upgradeCmd.Flags().Bool("check", false, "Only tell whether a newer release exists")
+	upgradeCmd.Flags().String("version", "", "Install this release tag instead of the latest one")
+	upgradeCmd.Flags().Bool("force", false, "Install the release even if it is not newer")
+	upgradeCmd.Flags().Bool("no-restart", false, "Replace the binaries without restarting tunneld")
+	upgradeCmd.Flags().Bool("insecure", false, "Upgrade without a release key, trusting the checksums of the release")
+	rootCmd.AddCommand(upgradeCmd)
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
 	}
 }
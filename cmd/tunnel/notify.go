@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+// How long notify waits before subscribing again when the daemon goes away
+const notifyRetryDelay = 5 * time.Second
+
+var notifyCmd = &cobra.Command{
+	Use:   "notify",
+	Short: "Show desktop notifications when tunnels drop",
+	Long: `Stay subscribed to the daemon events and show a desktop notification when
+a tunnel loses its SSH connection, when it is restored, and when the daemon
+gives up reconnecting.
+
+Notifications use notify-send on Linux and osascript on macOS. Run it in the
+background of your session, it waits for the daemon when it is not running.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := desktopNotify("go-tunnel", "Watching tunnels"); err != nil {
+			fail(exitError, "Desktop notifications are not available: %v", err)
+		}
+
+		for {
+			err := watchNotifications()
+			fmt.Fprintf(os.Stderr, "%s Event stream closed: %s, retrying in %s\n", infoColor("!"), rpcMessage(err), notifyRetryDelay)
+			time.Sleep(notifyRetryDelay)
+		}
+	},
+}
+
+// watchNotifications notifies the events of the daemon until the stream
+// breaks
+func watchNotifications() error {
+	conn, err := dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := pb.NewTunnelServiceClient(conn)
+	stream, err := client.SubscribeEvents(context.Background(), &pb.SubscribeEventsRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		title, body := eventNotification(ev)
+		if title == "" {
+			continue
+		}
+		displayEvent(ev)
+		if err := desktopNotify(title, body); err != nil {
+			fmt.Fprintf(os.Stderr, "%s Failed to show notification: %v\n", errorColor("✗"), err)
+		}
+	}
+}
+
+// eventNotification returns the notification of an event, an empty title
+// when the event is not worth one
+func eventNotification(ev *pb.Event) (string, string) {
+	tunnel := fmt.Sprintf("%s:%d -> localhost:%d", ev.Host, ev.RemotePort, ev.LocalPort)
+	switch ev.Type {
+	case pb.EventType_EVENT_RECONNECT_STARTED:
+		return "Tunnel dropped", fmt.Sprintf("%s lost its SSH connection (%s), reconnecting", tunnel, ev.Message)
+	case pb.EventType_EVENT_RECONNECT_SUCCEEDED:
+		return "Tunnel restored", fmt.Sprintf("%s is connected again", tunnel)
+	case pb.EventType_EVENT_RECONNECT_FAILED:
+		// Failed attempts are followed by another one, unless the daemon
+		// gave up
+		if strings.HasPrefix(ev.Message, "giving up") {
+			return "Tunnel down", fmt.Sprintf("%s could not reconnect, %s", tunnel, ev.Message)
+		}
+	}
+	return "", ""
+}
+
+// desktopNotify shows a desktop notification
+func desktopNotify(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", "--app-name=go-tunnel", title, body)
+	default:
+		return fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// appleScriptString quotes s as an AppleScript string literal
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Output format flags, shared by all commands
+var (
+	jsonOutput bool
+	yamlOutput bool
+)
+
+// structuredOutput reports whether a machine-readable format was requested
+func structuredOutput() bool {
+	return jsonOutput || yamlOutput
+}
+
+// printStructured writes v to stdout in the requested machine-readable format
+func printStructured(v interface{}) {
+	var err error
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(v)
+	} else {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		err = enc.Encode(v)
+		enc.Close()
+	}
+	if err != nil {
+		fail(exitError, "Failed to encode output: %v", err)
+	}
+}
+
+type tunnelOutput struct {
+	ID            string            `json:"id" yaml:"id"`
+	Host          string            `json:"host" yaml:"host"`
+	HostAddress   string            `json:"host_address,omitempty" yaml:"host_address,omitempty"`
+	LocalPort     int32             `json:"local_port" yaml:"local_port"`
+	RemotePort    int32             `json:"remote_port" yaml:"remote_port"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	CreatedAt     time.Time         `json:"created_at" yaml:"created_at"`
+	LastActivity  time.Time         `json:"last_activity" yaml:"last_activity"`
+	BytesSent     uint64            `json:"bytes_sent" yaml:"bytes_sent"`
+	BytesReceived uint64            `json:"bytes_received" yaml:"bytes_received"`
+	BandwidthUp   float64           `json:"bandwidth_up" yaml:"bandwidth_up"`
+	BandwidthDown float64           `json:"bandwidth_down" yaml:"bandwidth_down"`
+	ActiveConns   int32             `json:"active_conns" yaml:"active_conns"`
+	TotalConns    uint64            `json:"total_conns" yaml:"total_conns"`
+	Paused        bool              `json:"paused" yaml:"paused"`
+
+	LatencyMs         float64 `json:"latency_ms" yaml:"latency_ms"`
+	KeepaliveFailures uint64  `json:"keepalive_failures" yaml:"keepalive_failures"`
+
+	Addresses     []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+	ProxyProtocol bool     `json:"proxy_protocol" yaml:"proxy_protocol"`
+	Nagle         bool     `json:"nagle" yaml:"nagle"`
+	AcceptRate    int32    `json:"accept_rate,omitempty" yaml:"accept_rate,omitempty"`
+	HoldWhileDown bool     `json:"hold_while_down" yaml:"hold_while_down"`
+	IdleTimeoutMs int64    `json:"idle_timeout_ms,omitempty" yaml:"idle_timeout_ms,omitempty"`
+	LogLevel      string   `json:"log_level" yaml:"log_level"`
+
+	ReconnectPolicy *reconnectPolicyOutput `json:"reconnect_policy,omitempty" yaml:"reconnect_policy,omitempty"`
+	DialRetry       *dialRetryOutput       `json:"dial_retry,omitempty" yaml:"dial_retry,omitempty"`
+	KeepAlive       *keepAliveOutput       `json:"keepalive,omitempty" yaml:"keepalive,omitempty"`
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+	OwnerPID  int32      `json:"owner_pid,omitempty" yaml:"owner_pid,omitempty"`
+}
+
+type reconnectPolicyOutput struct {
+	Supervised    bool   `json:"supervised" yaml:"supervised"`
+	MaxRetries    int32  `json:"max_retries" yaml:"max_retries"`
+	RetryWindowMs int64  `json:"retry_window_ms" yaml:"retry_window_ms"`
+	OnGiveUp      string `json:"on_give_up" yaml:"on_give_up"`
+}
+
+type dialRetryOutput struct {
+	Attempts  int32 `json:"attempts" yaml:"attempts"`
+	BackoffMs int64 `json:"backoff_ms" yaml:"backoff_ms"`
+	TimeoutMs int64 `json:"timeout_ms" yaml:"timeout_ms"`
+	FailFast  bool  `json:"fail_fast" yaml:"fail_fast"`
+}
+
+type keepAliveOutput struct {
+	IntervalMs int64 `json:"interval_ms" yaml:"interval_ms"`
+	CountMax   int32 `json:"count_max" yaml:"count_max"`
+}
+
+func newTunnelOutput(t *pb.ListTunnelsResponse_TunnelInfo) tunnelOutput {
+	out := tunnelOutput{
+		ID:            t.Id,
+		Host:          t.Host,
+		HostAddress:   t.HostAddress,
+		LocalPort:     t.LocalPort,
+		RemotePort:    t.RemotePort,
+		Labels:        t.Labels,
+		CreatedAt:     time.Unix(t.CreatedAt, 0),
+		LastActivity:  time.Unix(t.LastActivity, 0),
+		BytesSent:     t.BytesSent,
+		BytesReceived: t.BytesReceived,
+		BandwidthUp:   t.BandwidthUp,
+		BandwidthDown: t.BandwidthDown,
+		ActiveConns:   t.ActiveConns,
+		TotalConns:    t.TotalConns,
+		Paused:        t.Paused,
+
+		LatencyMs:         t.LatencyMs,
+		KeepaliveFailures: t.KeepaliveFailures,
+
+		Addresses:     t.Addresses,
+		ProxyProtocol: t.ProxyProtocol,
+		Nagle:         t.Nagle,
+		AcceptRate:    t.AcceptRate,
+		HoldWhileDown: t.HoldWhileDown,
+		IdleTimeoutMs: t.IdleTimeoutMs,
+		LogLevel:      t.LogLevel,
+		OwnerPID:      t.OwnerPid,
+	}
+	if p := t.ReconnectPolicy; p != nil {
+		out.ReconnectPolicy = &reconnectPolicyOutput{
+			Supervised:    p.Supervised,
+			MaxRetries:    p.MaxRetries,
+			RetryWindowMs: p.WindowMs,
+			OnGiveUp:      p.OnGiveUp,
+		}
+	}
+	if r := t.DialRetry; r != nil {
+		out.DialRetry = &dialRetryOutput{
+			Attempts:  r.Attempts,
+			BackoffMs: r.BackoffMs,
+			TimeoutMs: r.TimeoutMs,
+			FailFast:  r.FailFast,
+		}
+	}
+	if t.ExpiresAt != 0 {
+		expiresAt := time.Unix(t.ExpiresAt, 0)
+		out.ExpiresAt = &expiresAt
+	}
+	if k := t.Keepalive; k != nil {
+		out.KeepAlive = &keepAliveOutput{
+			IntervalMs: k.IntervalMs,
+			CountMax:   k.CountMax,
+		}
+	}
+	return out
+}
+
+type listOutput struct {
+	Tunnels []tunnelOutput `json:"tunnels" yaml:"tunnels"`
+}
+
+func newListOutput(tunnels []*pb.ListTunnelsResponse_TunnelInfo) listOutput {
+	sortTunnels(tunnels)
+	out := listOutput{Tunnels: make([]tunnelOutput, 0, len(tunnels))}
+	for _, t := range tunnels {
+		out.Tunnels = append(out.Tunnels, newTunnelOutput(t))
+	}
+	return out
+}
+
+type createOutput struct {
+	Host       string `json:"host" yaml:"host"`
+	LocalPort  int    `json:"local_port" yaml:"local_port"`
+	RemotePort int    `json:"remote_port" yaml:"remote_port"`
+	Success    bool   `json:"success" yaml:"success"`
+	Error      string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"` // ErrorReason of the failure
+	Hint   string `json:"hint,omitempty" yaml:"hint,omitempty"`     // How to fix it
+
+	Action string `json:"action,omitempty" yaml:"action,omitempty"` // created, kept or replaced on success
+
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+type closeOutput struct {
+	ID         string `json:"id,omitempty" yaml:"id,omitempty"`
+	Host       string `json:"host,omitempty" yaml:"host,omitempty"`
+	LocalPort  int    `json:"local_port,omitempty" yaml:"local_port,omitempty"`
+	RemotePort int    `json:"remote_port,omitempty" yaml:"remote_port,omitempty"`
+	Drained    int    `json:"drained,omitempty" yaml:"drained,omitempty"`
+	Cut        int    `json:"cut,omitempty" yaml:"cut,omitempty"`
+	Success    bool   `json:"success" yaml:"success"`
+	Error      string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type closeAllOutput struct {
+	Count int32 `json:"count" yaml:"count"`
+}
+
+type eventOutput struct {
+	Type       string    `json:"type" yaml:"type"`
+	ID         string    `json:"id,omitempty" yaml:"id,omitempty"`
+	Host       string    `json:"host" yaml:"host"`
+	LocalPort  int32     `json:"local_port" yaml:"local_port"`
+	RemotePort int32     `json:"remote_port" yaml:"remote_port"`
+	Message    string    `json:"message,omitempty" yaml:"message,omitempty"`
+	Time       time.Time `json:"time" yaml:"time"`
+}
+
+func newEventOutput(ev *pb.Event) eventOutput {
+	return eventOutput{
+		Type:       eventName(ev.Type),
+		ID:         ev.TunnelId,
+		Host:       ev.Host,
+		LocalPort:  ev.LocalPort,
+		RemotePort: ev.RemotePort,
+		Message:    ev.Message,
+		Time:       time.Unix(ev.Timestamp, 0),
+	}
+}
+
+type connectionOutput struct {
+	ID            uint64    `json:"id" yaml:"id"`
+	SourceAddress string    `json:"source_address" yaml:"source_address"`
+	Destination   string    `json:"destination" yaml:"destination"`
+	StartedAt     time.Time `json:"started_at" yaml:"started_at"`
+	BytesSent     uint64    `json:"bytes_sent" yaml:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received" yaml:"bytes_received"`
+	BandwidthUp   float64   `json:"bandwidth_up" yaml:"bandwidth_up"`
+	BandwidthDown float64   `json:"bandwidth_down" yaml:"bandwidth_down"`
+}
+
+func newConnectionOutput(c *pb.GetTunnelStatusResponse_ConnectionInfo) connectionOutput {
+	return connectionOutput{
+		ID:            c.Id,
+		SourceAddress: c.SourceAddress,
+		Destination:   c.Destination,
+		StartedAt:     time.Unix(c.StartedAt, 0),
+		BytesSent:     c.BytesSent,
+		BytesReceived: c.BytesReceived,
+		BandwidthUp:   c.BandwidthUp,
+		BandwidthDown: c.BandwidthDown,
+	}
+}
+
+type connectionsOutput struct {
+	Connections []connectionOutput `json:"connections" yaml:"connections"`
+}
+
+type errorOutput struct {
+	Time    time.Time `json:"time" yaml:"time"`
+	Message string    `json:"message" yaml:"message"`
+}
+
+type statusOutput struct {
+	Tunnel              tunnelOutput       `json:"tunnel" yaml:"tunnel"`
+	SSHState            string             `json:"ssh_state" yaml:"ssh_state"`
+	LastReconnect       *time.Time         `json:"last_reconnect,omitempty" yaml:"last_reconnect,omitempty"`
+	LastReconnectReason string             `json:"last_reconnect_reason,omitempty" yaml:"last_reconnect_reason,omitempty"`
+	ReconnectAttempts   int32              `json:"reconnect_attempts,omitempty" yaml:"reconnect_attempts,omitempty"`
+	NextReconnect       *time.Time         `json:"next_reconnect,omitempty" yaml:"next_reconnect,omitempty"`
+	Connections         []connectionOutput `json:"connections" yaml:"connections"`
+	RecentErrors        []errorOutput      `json:"recent_errors" yaml:"recent_errors"`
+}
+
+func newStatusOutput(status *pb.GetTunnelStatusResponse) statusOutput {
+	out := statusOutput{
+		Tunnel:              newTunnelOutput(status.Tunnel),
+		SSHState:            status.SshState,
+		LastReconnectReason: status.LastReconnectReason,
+		ReconnectAttempts:   status.ReconnectAttempts,
+		Connections:         make([]connectionOutput, 0, len(status.Connections)),
+		RecentErrors:        make([]errorOutput, 0, len(status.RecentErrors)),
+	}
+	if status.LastReconnect != 0 {
+		lastReconnect := time.Unix(status.LastReconnect, 0)
+		out.LastReconnect = &lastReconnect
+	}
+	if status.NextReconnect != 0 {
+		nextReconnect := time.Unix(status.NextReconnect, 0)
+		out.NextReconnect = &nextReconnect
+	}
+	for _, c := range status.Connections {
+		out.Connections = append(out.Connections, newConnectionOutput(c))
+	}
+	for _, e := range status.RecentErrors {
+		out.RecentErrors = append(out.RecentErrors, errorOutput{
+			Time:    time.Unix(e.Timestamp, 0),
+			Message: e.Message,
+		})
+	}
+	return out
+}
+
+type logOutput struct {
+	Time    time.Time `json:"time" yaml:"time"`
+	Message string    `json:"message" yaml:"message"`
+}
+
+type applyOutput struct {
+	Host       string `json:"host" yaml:"host"`
+	LocalPort  int32  `json:"local_port" yaml:"local_port"`
+	RemotePort int32  `json:"remote_port" yaml:"remote_port"`
+	Action     string `json:"action" yaml:"action"`
+	Error      string `json:"error,omitempty" yaml:"error,omitempty"`
+	Reason     string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Hint       string `json:"hint,omitempty" yaml:"hint,omitempty"`
+}
+
+type sampleOutput struct {
+	Time          time.Time `json:"time" yaml:"time"`
+	BandwidthUp   float64   `json:"bandwidth_up" yaml:"bandwidth_up"`
+	BandwidthDown float64   `json:"bandwidth_down" yaml:"bandwidth_down"`
+}
+
+type tunnelStatsOutput struct {
+	Tunnel  tunnelOutput   `json:"tunnel" yaml:"tunnel"`
+	Samples []sampleOutput `json:"samples" yaml:"samples"`
+}
+
+type statsOutput struct {
+	IntervalMs int32               `json:"interval_ms" yaml:"interval_ms"`
+	Tunnels    []tunnelStatsOutput `json:"tunnels" yaml:"tunnels"`
+}
+
+func newStatsOutput(stats *pb.GetStatsResponse) statsOutput {
+	out := statsOutput{
+		IntervalMs: stats.IntervalMs,
+		Tunnels:    make([]tunnelStatsOutput, 0, len(stats.Tunnels)),
+	}
+	for _, t := range stats.Tunnels {
+		ts := tunnelStatsOutput{
+			Tunnel:  newTunnelOutput(t.Tunnel),
+			Samples: make([]sampleOutput, 0, len(t.Samples)),
+		}
+		for _, s := range t.Samples {
+			ts.Samples = append(ts.Samples, sampleOutput{
+				Time:          time.Unix(s.Timestamp, 0),
+				BandwidthUp:   s.BandwidthUp,
+				BandwidthDown: s.BandwidthDown,
+			})
+		}
+		out.Tunnels = append(out.Tunnels, ts)
+	}
+	return out
+}
+
+type usageSampleOutput struct {
+	Time          time.Time `json:"time"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	ActiveConns   int32     `json:"active_conns"`
+	NewConns      uint64    `json:"new_conns"`
+}
+
+type tunnelUsageOutput struct {
+	Tunnel tunnelOutput        `json:"tunnel"`
+	Usage  []usageSampleOutput `json:"usage"`
+}
+
+type usageOutput struct {
+	IntervalMs int32               `json:"interval_ms"`
+	Tunnels    []tunnelUsageOutput `json:"tunnels"`
+}
+
+func newUsageOutput(stats *pb.GetStatsResponse) usageOutput {
+	out := usageOutput{
+		IntervalMs: stats.UsageIntervalMs,
+		Tunnels:    make([]tunnelUsageOutput, 0, len(stats.Tunnels)),
+	}
+	for _, t := range stats.Tunnels {
+		tu := tunnelUsageOutput{
+			Tunnel: newTunnelOutput(t.Tunnel),
+			Usage:  make([]usageSampleOutput, 0, len(t.Usage)),
+		}
+		for _, u := range t.Usage {
+			tu.Usage = append(tu.Usage, usageSampleOutput{
+				Time:          time.Unix(u.Timestamp, 0),
+				BytesSent:     u.BytesSent,
+				BytesReceived: u.BytesReceived,
+				ActiveConns:   u.ActiveConns,
+				NewConns:      u.NewConns,
+			})
+		}
+		out.Tunnels = append(out.Tunnels, tu)
+	}
+	return out
+}
+
+type daemonStatsOutput struct {
+	Version           string    `json:"version" yaml:"version"`
+	StartedAt         time.Time `json:"started_at" yaml:"started_at"`
+	UptimeMs          int64     `json:"uptime_ms" yaml:"uptime_ms"`
+	Goroutines        int32     `json:"goroutines" yaml:"goroutines"`
+	HeapBytes         uint64    `json:"heap_bytes" yaml:"heap_bytes"`
+	ActiveTunnels     int32     `json:"active_tunnels" yaml:"active_tunnels"`
+	TunnelsCreated    uint64    `json:"tunnels_created" yaml:"tunnels_created"`
+	TunnelsClosed     uint64    `json:"tunnels_closed" yaml:"tunnels_closed"`
+	TotalConns        uint64    `json:"total_conns" yaml:"total_conns"`
+	BytesSent         uint64    `json:"bytes_sent" yaml:"bytes_sent"`
+	BytesReceived     uint64    `json:"bytes_received" yaml:"bytes_received"`
+	Reconnects        uint64    `json:"reconnects" yaml:"reconnects"`
+	ReconnectFailures uint64    `json:"reconnect_failures" yaml:"reconnect_failures"`
+}
+
+func newDaemonStatsOutput(stats *pb.GetDaemonStatsResponse) daemonStatsOutput {
+	return daemonStatsOutput{
+		Version:           stats.Version,
+		StartedAt:         time.Unix(stats.StartedAt, 0),
+		UptimeMs:          stats.UptimeMs,
+		Goroutines:        stats.Goroutines,
+		HeapBytes:         stats.HeapBytes,
+		ActiveTunnels:     stats.ActiveTunnels,
+		TunnelsCreated:    stats.TunnelsCreated,
+		TunnelsClosed:     stats.TunnelsClosed,
+		TotalConns:        stats.TotalConns,
+		BytesSent:         stats.BytesSent,
+		BytesReceived:     stats.BytesReceived,
+		Reconnects:        stats.Reconnects,
+		ReconnectFailures: stats.ReconnectFailures,
+	}
+}
+
+type closedTunnelOutput struct {
+	ID            string            `json:"id" yaml:"id"`
+	Host          string            `json:"host" yaml:"host"`
+	LocalPort     int32             `json:"local_port" yaml:"local_port"`
+	RemotePort    int32             `json:"remote_port" yaml:"remote_port"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	CreatedAt     time.Time         `json:"created_at" yaml:"created_at"`
+	ClosedAt      time.Time         `json:"closed_at" yaml:"closed_at"`
+	Reason        string            `json:"reason" yaml:"reason"`
+	BytesSent     uint64            `json:"bytes_sent" yaml:"bytes_sent"`
+	BytesReceived uint64            `json:"bytes_received" yaml:"bytes_received"`
+	TotalConns    uint64            `json:"total_conns" yaml:"total_conns"`
+}
+
+func newClosedTunnelOutput(t *pb.ListClosedTunnelsResponse_ClosedTunnel) closedTunnelOutput {
+	return closedTunnelOutput{
+		ID:            t.Id,
+		Host:          t.Host,
+		LocalPort:     t.LocalPort,
+		RemotePort:    t.RemotePort,
+		Labels:        t.Labels,
+		CreatedAt:     time.Unix(t.CreatedAt, 0),
+		ClosedAt:      time.Unix(t.ClosedAt, 0),
+		Reason:        t.Reason,
+		BytesSent:     t.BytesSent,
+		BytesReceived: t.BytesReceived,
+		TotalConns:    t.TotalConns,
+	}
+}
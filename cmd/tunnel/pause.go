@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause <machine> <port>",
+	Short: "Stop accepting connections on a tunnel",
+	Long: `Make a tunnel refuse new connections without closing it, so that it can
+be resumed later without recreating it. Use --sever to also close the
+connections in progress.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, localPort := parseTunnelArgs(args)
+		sever, _ := cmd.Flags().GetBool("sever")
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		_, err = client.PauseTunnel(context.Background(), &pb.PauseTunnelRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+			Sever:      sever,
+		})
+		if err != nil {
+			failRPC("Failed to pause tunnel", err)
+		}
+
+		notify("%s %s:%d\n", successColor("✓ Tunnel paused:"), host, port)
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:               "resume <machine> <port>",
+	Short:             "Accept connections again on a paused tunnel",
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, localPort := parseTunnelArgs(args)
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		_, err = client.ResumeTunnel(context.Background(), &pb.ResumeTunnelRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+		})
+		if err != nil {
+			failRPC("Failed to resume tunnel", err)
+		}
+
+		notify("%s %s:%d\n", successColor("✓ Tunnel resumed:"), host, port)
+	},
+}
+
+// parseTunnelArgs parses the <machine> <port> arguments identifying a tunnel.
+// The port is the remote one, or local:remote to pick among the tunnels to
+// the same remote port, in which case the local port is returned too.
+func parseTunnelArgs(args []string) (string, int, int) {
+	if strings.Contains(args[1], ":") {
+		pair, err := parsePortMapping(args[1])
+		if err != nil {
+			fail(exitUsage, "%v", err)
+		}
+		return args[0], pair.remote, pair.local
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		fail(exitUsage, "Invalid port: %v", err)
+	}
+	return args[0], port, 0
+}
+
+// resolveTunnelArgs is parseTunnelArgs for the commands which also accept a
+// tunnel ID, or a unique prefix of it, as their only argument. The daemon
+// is asked for the tunnel with that ID.
+func resolveTunnelArgs(client pb.TunnelServiceClient, args []string) (string, int, int) {
+	if len(args) == 2 {
+		return parseTunnelArgs(args)
+	}
+	if args[0] == "" {
+		fail(exitUsage, "Invalid tunnel ID: empty")
+	}
+
+	resp, err := client.GetTunnel(context.Background(), &pb.GetTunnelRequest{Id: args[0]})
+	if err != nil {
+		failRPC("Failed to find tunnel", err)
+	}
+	return resp.Tunnel.Host, int(resp.Tunnel.RemotePort), int(resp.Tunnel.LocalPort)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+)
+
+const (
+	pcapLinkTypeRaw = 101 // Packets start with their IPv4 or IPv6 header
+	pcapSnapLen     = 65535
+
+	// Largest payload put in a single synthesized packet
+	pcapMaxPayload = 65000
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapWriter writes captured connections as a pcap file. The daemon only
+// sees the streams, so the IP and TCP headers of the packets are
+// synthesized, with a handshake when a connection opens and FINs when it
+// closes.
+type pcapWriter struct {
+	w     io.Writer
+	conns map[uint64]*pcapConn
+}
+
+// pcapConn tracks the sequence numbers of a synthesized connection
+type pcapConn struct {
+	client, server       netip.AddrPort
+	clientSeq, serverSeq uint32
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w, conns: make(map[uint64]*pcapConn)}, nil
+}
+
+// write adds the packets matching a captured record
+func (pw *pcapWriter) write(r *pb.CaptureRecord) error {
+	ts := time.UnixMicro(r.TimestampUs)
+
+	c, known := pw.conns[r.ConnectionId]
+	if !known {
+		c = &pcapConn{
+			client:    parseAddrPort(r.ClientAddress),
+			server:    parseAddrPort(r.LocalAddress),
+			clientSeq: 1000,
+			serverSeq: 2000,
+		}
+		pw.conns[r.ConnectionId] = c
+
+		// Connections already open when the capture started get a
+		// handshake too, so that Wireshark follows their streams
+		if r.Kind != pb.CaptureKind_CAPTURE_CLOSED {
+			if err := pw.handshake(c, ts); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch r.Kind {
+	case pb.CaptureKind_CAPTURE_DATA:
+		data := r.Data
+		for len(data) > 0 {
+			n := min(len(data), pcapMaxPayload)
+			if err := pw.packet(c, ts, r.Upload, tcpPSH|tcpACK, data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	case pb.CaptureKind_CAPTURE_CLOSED:
+		delete(pw.conns, r.ConnectionId)
+		if err := pw.packet(c, ts, true, tcpFIN|tcpACK, nil); err != nil {
+			return err
+		}
+		if err := pw.packet(c, ts, false, tcpFIN|tcpACK, nil); err != nil {
+			return err
+		}
+		return pw.packet(c, ts, true, tcpACK, nil)
+	}
+	return nil
+}
+
+func (pw *pcapWriter) handshake(c *pcapConn, ts time.Time) error {
+	if err := pw.packet(c, ts, true, tcpSYN, nil); err != nil {
+		return err
+	}
+	if err := pw.packet(c, ts, false, tcpSYN|tcpACK, nil); err != nil {
+		return err
+	}
+	return pw.packet(c, ts, true, tcpACK, nil)
+}
+
+// packet writes a single TCP segment and advances the sequence number of
+// its sender
+func (pw *pcapWriter) packet(c *pcapConn, ts time.Time, fromClient bool, flags byte, payload []byte) error {
+	src, dst := c.client, c.server
+	seq, ack := &c.clientSeq, c.serverSeq
+	if !fromClient {
+		src, dst = c.server, c.client
+		seq, ack = &c.serverSeq, c.clientSeq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	segment := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], src.Port())
+	binary.BigEndian.PutUint16(segment[2:], dst.Port())
+	binary.BigEndian.PutUint32(segment[4:], *seq)
+	binary.BigEndian.PutUint32(segment[8:], ack)
+	segment[12] = 5 << 4 // Header length in 32-bit words
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 65535) // Window
+	segment = append(segment, payload...)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	var packet []byte
+	if src.Addr().Is4() && dst.Addr().Is4() {
+		packet = ipv4Packet(src.Addr(), dst.Addr(), segment)
+	} else {
+		packet = ipv6Packet(src.Addr(), dst.Addr(), segment)
+	}
+
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	_, err := pw.w.Write(append(record, packet...))
+	return err
+}
+
+func ipv4Packet(src, dst netip.Addr, segment []byte) []byte {
+	header := make([]byte, 20)
+	header[0] = 0x45 // Version 4, 5 words of header
+	binary.BigEndian.PutUint16(header[2:], uint16(20+len(segment)))
+	binary.BigEndian.PutUint16(header[6:], 0x4000) // Don't fragment
+	header[8] = 64                                 // TTL
+	header[9] = 6                                  // TCP
+	s, d := src.As4(), dst.As4()
+	copy(header[12:], s[:])
+	copy(header[16:], d[:])
+	binary.BigEndian.PutUint16(header[10:], checksum(header, 0))
+
+	pseudo := append(append([]byte(nil), header[12:20]...), 0, 6, 0, 0)
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	binary.BigEndian.PutUint16(segment[16:], checksum(segment, sum(pseudo)))
+	return append(header, segment...)
+}
+
+func ipv6Packet(src, dst netip.Addr, segment []byte) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(header[4:], uint16(len(segment)))
+	header[6] = 6  // TCP
+	header[7] = 64 // Hop limit
+	s, d := src.As16(), dst.As16()
+	copy(header[8:], s[:])
+	copy(header[24:], d[:])
+
+	pseudo := make([]byte, 40)
+	copy(pseudo, header[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(segment)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(segment[16:], checksum(segment, sum(pseudo)))
+	return append(header, segment...)
+}
+
+// sum adds b as 16-bit big endian words, as the Internet checksum does
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the Internet checksum of b, starting from initial
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+// parseAddrPort parses an address reported by the daemon, falling back to
+// the unspecified IPv4 address
+func parseAddrPort(addr string) netip.AddrPort {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
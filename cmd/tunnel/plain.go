@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+)
+
+// Tab-separated output flag of list and status
+var plainOutput bool
+
+// checkPlain refuses --plain together with a machine-readable format
+func checkPlain() {
+	if plainOutput && structuredOutput() {
+		fail(exitUsage, "--plain cannot be combined with --json or --yaml")
+	}
+}
+
+// printPlainTunnels prints one line per tunnel, with the tab-separated
+// fields: id, host, remote port, local port, active or paused, active
+// connections, total connections, bytes sent, bytes received and labels.
+// Empty fields are "-" so that the columns never shift.
+func printPlainTunnels(tunnels []*pb.ListTunnelsResponse_TunnelInfo, extra ...string) {
+	sortTunnels(tunnels)
+	for _, t := range tunnels {
+		state := "active"
+		if t.Paused {
+			state = "paused"
+		}
+		labels := strings.ReplaceAll(formatLabels(t.Labels), ", ", ",")
+		if labels == "" {
+			labels = "-"
+		}
+		fields := []string{
+			t.Id,
+			t.Host,
+			strconv.Itoa(int(t.RemotePort)),
+			strconv.Itoa(int(t.LocalPort)),
+			state,
+			strconv.Itoa(int(t.ActiveConns)),
+			strconv.FormatUint(t.TotalConns, 10),
+			strconv.FormatUint(t.BytesSent, 10),
+			strconv.FormatUint(t.BytesReceived, 10),
+			labels,
+		}
+		fmt.Println(strings.Join(append(fields, extra...), "\t"))
+	}
+}
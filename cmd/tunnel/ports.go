@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+)
+
+// Automatically switch to a free local port on conflicts
+var autoPort bool
+
+// Tunnels are created concurrently, only one of them may prompt at a time
+var promptMu sync.Mutex
+
+// choosePort picks another local port when the requested one is in use,
+// either automatically with --auto-port or by asking the user. It returns 0
+// to keep the failure.
+func choosePort(port int, conflict *pb.PortInUse) int {
+	suggested := int(conflict.SuggestedPort)
+	if suggested == 0 {
+		return 0
+	}
+
+	holder := ""
+	if conflict.Pid != 0 {
+		holder = fmt.Sprintf(" by %s (pid %d)", conflict.Process, conflict.Pid)
+	}
+
+	if autoPort {
+		if !structuredOutput() {
+			notify("%s Local port %d is in use%s, using %d instead\n", infoColor("ℹ"), port, holder, suggested)
+		}
+		return suggested
+	}
+
+	if structuredOutput() || !isInteractive() {
+		return 0
+	}
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Printf("%s Local port %d is in use%s. Use %d instead? [Y/n] ", infoColor("?"), port, holder, suggested)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "", "y", "yes":
+		return suggested
+	default:
+		return 0
+	}
+}
+
+// isInteractive reports whether stdin is a terminal the user can answer from
+func isInteractive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
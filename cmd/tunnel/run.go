@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run <machine> [port_from:]port_to [[port_from:]port_to...]",
+	Short: "Run tunnels in the foreground, without the daemon",
+	Long: `Create one or more SSH tunnels in the current process, without going
+through tunneld. The tunnels are closed on Ctrl+C.`,
+	Args:              cobra.MinimumNArgs(2),
+	ValidArgsFunction: completeHostPorts,
+	Run: func(cmd *cobra.Command, args []string) {
+		host := args[0]
+		portMappings, err := expandPortGroups(args[1:])
+		if err != nil {
+			fail(exitUsage, "%v", err)
+		}
+
+		var pairs []portPair
+		for _, ports := range portMappings {
+			pair, err := parsePortMapping(ports)
+			if err != nil {
+				fail(exitUsage, "%v", err)
+			}
+			pairs = append(pairs, pair)
+		}
+
+		family := familyFlag(cmd)
+		binds := bindFlag(cmd, host)
+		proxyProtocol, _ := cmd.Flags().GetBool("proxy-protocol")
+		noDelay, _ := cmd.Flags().GetBool("nodelay")
+		manager := tunnel.NewTunnelManager()
+		events, unsubscribe := manager.Subscribe()
+		defer unsubscribe()
+
+		config := sshauth.ClientConfig()
+		created := 0
+		exitCode := exitError
+		for _, pair := range pairs {
+			if err := manager.CreateTunnel(cmd.Context(), host, pair.local, pair.remote, config, tunnel.Options{Family: family, Bind: binds, ProxyProtocol: proxyProtocol, Nagle: !noDelay}); err != nil {
+				fmt.Fprintf(os.Stderr, "%s Failed to create tunnel %d:%d: %v\n", errorColor("✗"), pair.local, pair.remote, err)
+				exitCode = tunnelExitCode(err)
+				continue
+			}
+			created++
+		}
+		if created == 0 {
+			os.Exit(exitCode)
+		}
+
+		notify("%s\n", infoColor("Press Ctrl+C to close the tunnels"))
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+		for {
+			select {
+			case <-sigChan:
+				fmt.Println()
+				count := manager.CloseAllTunnels()
+				notify("%s Closed %d tunnel(s)\n", successColor("✓"), count)
+				return
+			case ev := <-events:
+				displayLocalEvent(ev)
+			}
+		}
+	},
+}
+
+// displayLocalEvent prints an event of a tunnel running in this process
+func displayLocalEvent(ev tunnel.Event) {
+	name := ev.Type.String()
+	switch ev.Type {
+	case tunnel.EventTunnelCreated:
+		notify("%s %s:%d -> localhost:%d\n", successColor("✓ Tunnel created:"), ev.Host, ev.RemotePort, ev.LocalPort)
+		return
+	case tunnel.EventError, tunnel.EventReconnectFailed, tunnel.EventTunnelPaused:
+		name = errorColor(name)
+	case tunnel.EventReconnectSucceeded, tunnel.EventTunnelResumed:
+		name = successColor(name)
+	default:
+		name = infoColor(name)
+	}
+
+	fmt.Printf("%s %s:%d -> localhost:%d %s",
+		ev.Time.Format("15:04:05"),
+		ev.Host,
+		ev.RemotePort,
+		ev.LocalPort,
+		name,
+	)
+	if ev.Message != "" {
+		fmt.Printf(" (%s)", ev.Message)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// forwardSignal passes a signal received by tunnel exec to its command
+func forwardSignal(process *os.Process, sig os.Signal) {
+	process.Signal(sig)
+}
@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// forwardSignal passes a signal received by tunnel exec to its command.
+// Windows cannot send signals to another process, so the command is killed.
+func forwardSignal(process *os.Process, sig os.Signal) {
+	process.Kill()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats [machine]",
+	Short: "Show the recent bandwidth of the tunnels",
+	Long: `Show the bandwidth history of the active tunnels over the last few
+minutes as sparklines, one line for upload and one for download.
+
+With --export, print instead the usage of the tunnels over the --since
+period, up to a day, as csv or json: one sample per minute and tunnel with
+the bytes sent and received and the connections opened during that minute,
+and the connections open at its end.`,
+	Example: `  tunnel stats --export csv --since 1h > usage.csv
+  tunnel stats server1 --export json --since 24h`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &pb.GetStatsRequest{}
+		if len(args) > 0 {
+			req.Host = args[0]
+		}
+		req.Labels, _ = cmd.Flags().GetStringToString("label")
+		export, _ := cmd.Flags().GetString("export")
+		since, _ := cmd.Flags().GetDuration("since")
+		switch {
+		case export != "" && export != "csv" && export != "json":
+			fail(exitUsage, "Invalid --export '%s': expected csv or json", export)
+		case export != "" && structuredOutput():
+			fail(exitUsage, "--export cannot be combined with --json or --yaml")
+		case since <= 0:
+			fail(exitUsage, "Invalid --since: must be positive")
+		case export != "":
+			req.UsageSinceMs = since.Milliseconds()
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.GetStats(context.Background(), req)
+		if err != nil {
+			failRPC("Failed to get stats", err)
+		}
+
+		sort.Slice(resp.Tunnels, func(i, j int) bool {
+			a, b := resp.Tunnels[i].Tunnel, resp.Tunnels[j].Tunnel
+			if a.Host != b.Host {
+				return a.Host < b.Host
+			}
+			return a.RemotePort < b.RemotePort
+		})
+
+		if export != "" {
+			exportUsage(resp, export)
+			return
+		}
+		if structuredOutput() {
+			printStructured(newStatsOutput(resp))
+			return
+		}
+
+		if len(resp.Tunnels) == 0 {
+			notify("%s No active tunnels\n", infoColor("ℹ"))
+			return
+		}
+
+		interval := time.Duration(resp.IntervalMs) * time.Millisecond
+		notify("%s %s\n\n",
+			headerColor("Bandwidth"),
+			infoColor(fmt.Sprintf("(one sample every %s)", interval)),
+		)
+
+		for _, t := range resp.Tunnels {
+			displayStats(t)
+		}
+	},
+}
+
+func displayStats(stats *pb.GetStatsResponse_TunnelStats) {
+	t := stats.Tunnel
+	fmt.Printf("%s %s:%d -> localhost:%d %s\n",
+		headerColor("Tunnel:"),
+		t.Host,
+		t.RemotePort,
+		t.LocalPort,
+		infoColor("["+t.Id+"]"),
+	)
+
+	if len(stats.Samples) == 0 {
+		fmt.Printf("  %s No samples yet\n\n", infoColor("ℹ"))
+		return
+	}
+
+	up := make([]float64, len(stats.Samples))
+	down := make([]float64, len(stats.Samples))
+	for i, s := range stats.Samples {
+		up[i] = s.BandwidthUp
+		down[i] = s.BandwidthDown
+	}
+
+	for _, line := range []struct {
+		arrow  string
+		values []float64
+	}{
+		{"↑", up},
+		{"↓", down},
+	} {
+		fmt.Printf("  %s %s  %s %s/s  %s %s/s\n",
+			line.arrow,
+			successColor(sparkline(line.values)),
+			infoColor("now"),
+			formatBytes(uint64(line.values[len(line.values)-1])),
+			infoColor("peak"),
+			formatBytes(uint64(peak(line.values))),
+		)
+	}
+	fmt.Println()
+}
+
+// exportUsage prints the usage samples of the tunnels as csv, one line per
+// sample, or as a json document
+func exportUsage(stats *pb.GetStatsResponse, format string) {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(newUsageOutput(stats)); err != nil {
+			fail(exitError, "Failed to write the usage: %v", err)
+		}
+		return
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "id", "host", "remote_port", "local_port", "bytes_sent", "bytes_received", "active_conns", "new_conns"})
+	for _, t := range stats.Tunnels {
+		for _, u := range t.Usage {
+			w.Write([]string{
+				time.Unix(u.Timestamp, 0).UTC().Format(time.RFC3339),
+				t.Tunnel.Id,
+				t.Tunnel.Host,
+				strconv.Itoa(int(t.Tunnel.RemotePort)),
+				strconv.Itoa(int(t.Tunnel.LocalPort)),
+				strconv.FormatUint(u.BytesSent, 10),
+				strconv.FormatUint(u.BytesReceived, 10),
+				strconv.Itoa(int(u.ActiveConns)),
+				strconv.FormatUint(u.NewConns, 10),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fail(exitError, "Failed to write the usage: %v", err)
+	}
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders values scaled to their peak, idle samples use the lowest
+// bar so that any traffic at all stands out
+func sparkline(values []float64) string {
+	top := peak(values)
+
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if top > 0 && v > 0 {
+			i = 1 + int(v/top*float64(len(sparks)-2))
+		}
+		b.WriteRune(sparks[i])
+	}
+	return b.String()
+}
+
+func peak(values []float64) float64 {
+	var top float64
+	for _, v := range values {
+		if v > top {
+			top = v
+		}
+	}
+	return top
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status <machine> <port> | <id>",
+	Short: "Show the detailed status of a tunnel",
+	Long: `Show a tunnel in depth: SSH connection state, last reconnection, active connections and recent errors.
+The tunnel is given by its machine and remote port, or by its ID as shown by
+"tunnel list".
+
+With --plain, the tunnel is printed on one line of tab-separated fields, those
+of "tunnel list --plain" followed by the SSH state.`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		checkPlain()
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		host, port, localPort := resolveTunnelArgs(client, args)
+		resp, err := client.GetTunnelStatus(context.Background(), &pb.GetTunnelStatusRequest{
+			Host:       host,
+			RemotePort: int32(port),
+			LocalPort:  int32(localPort),
+		})
+		if err != nil {
+			failRPC("Failed to get tunnel status", err)
+		}
+
+		if structuredOutput() {
+			printStructured(newStatusOutput(resp))
+			return
+		}
+		if plainOutput {
+			printPlainTunnels([]*pb.ListTunnelsResponse_TunnelInfo{resp.Tunnel}, resp.SshState)
+			return
+		}
+
+		displayStatus(resp)
+	},
+}
+
+func displayStatus(status *pb.GetTunnelStatusResponse) {
+	displayTunnels([]*pb.ListTunnelsResponse_TunnelInfo{status.Tunnel})
+
+	state := status.SshState
+	switch state {
+	case "connected":
+		state = successColor(state)
+	default:
+		state = errorColor(state)
+	}
+	fmt.Printf("%s %s\n", headerColor("SSH:"), state)
+
+	if status.LastReconnect == 0 {
+		fmt.Printf("  %s never\n", infoColor("Last Reconnect:"))
+	} else {
+		fmt.Printf("  %s %s ago (%s)\n",
+			infoColor("Last Reconnect:"),
+			formatDuration(time.Since(time.Unix(status.LastReconnect, 0))),
+			status.LastReconnectReason,
+		)
+	}
+	if status.SshState != "connected" && status.ReconnectAttempts > 0 {
+		next := ""
+		if status.NextReconnect != 0 {
+			next = fmt.Sprintf(", next in %s", formatDuration(max(time.Until(time.Unix(status.NextReconnect, 0)), 0)))
+		}
+		fmt.Printf("  %s %d%s\n", infoColor("Attempts:"), status.ReconnectAttempts, next)
+	}
+	if policy := status.Tunnel.ReconnectPolicy; policy != nil {
+		fmt.Printf("  %s %s\n", infoColor("Policy:"), describePolicy(policy))
+	}
+	if retry := status.Tunnel.DialRetry; retry != nil {
+		fmt.Printf("  %s %s\n", infoColor("Dial:"), describeDialRetry(retry))
+	}
+	if k := status.Tunnel.Keepalive; k != nil {
+		keepAlive := "disabled"
+		if !k.Disabled {
+			keepAlive = fmt.Sprintf("every %s, reconnect after %d failure(s)", time.Duration(k.IntervalMs)*time.Millisecond, k.CountMax)
+		}
+		fmt.Printf("  %s %s\n", infoColor("Keepalive:"), keepAlive)
+	}
+	fmt.Println()
+
+	fmt.Printf("%s\n", headerColor("Connections:"))
+	if len(status.Connections) == 0 {
+		fmt.Printf("  %s No active connections\n", infoColor("ℹ"))
+	}
+	for _, c := range status.Connections {
+		fmt.Printf("  #%d %s  %s  %s (↑) / %s (↓)\n",
+			c.Id,
+			c.SourceAddress,
+			formatDuration(time.Since(time.Unix(c.StartedAt, 0))),
+			formatBytes(c.BytesSent),
+			formatBytes(c.BytesReceived),
+		)
+	}
+	fmt.Println()
+
+	fmt.Printf("%s\n", headerColor("Recent Errors:"))
+	if len(status.RecentErrors) == 0 {
+		fmt.Printf("  %s No errors\n", infoColor("ℹ"))
+	}
+	for _, e := range status.RecentErrors {
+		fmt.Printf("  %s %s\n",
+			time.Unix(e.Timestamp, 0).Format(time.DateTime),
+			errorColor(e.Message),
+		)
+	}
+}
+
+// describePolicy summarizes a reconnection policy, such as "up to 10
+// attempts within 5m, then close"
+func describePolicy(p *pb.ReconnectPolicy) string {
+	if p.Supervised {
+		return "supervised, retries forever"
+	}
+
+	var limits []string
+	if p.MaxRetries > 0 {
+		limits = append(limits, fmt.Sprintf("up to %d attempts", p.MaxRetries))
+	}
+	if p.WindowMs > 0 {
+		limits = append(limits, fmt.Sprintf("within %s", time.Duration(p.WindowMs)*time.Millisecond))
+	}
+	if len(limits) == 0 {
+		return "retries forever"
+	}
+	return fmt.Sprintf("%s, then %s", strings.Join(limits, " "), p.OnGiveUp)
+}
+
+// describeDialRetry summarizes a dial retry policy, such as "up to 3
+// attempts, backoff 1s, within 10s"
+func describeDialRetry(r *pb.DialRetry) string {
+	timeout := time.Duration(r.TimeoutMs) * time.Millisecond
+	if r.FailFast {
+		return fmt.Sprintf("fail fast, within %s", timeout)
+	}
+	return fmt.Sprintf("up to %d attempts, backoff %s, within %s", r.Attempts, time.Duration(r.BackoffMs)*time.Millisecond, timeout)
+}
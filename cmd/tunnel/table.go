@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+)
+
+// Layout of the tunnel tables of the watch mode and the dashboard
+const tableRow = "%-8s %-6s %-24s %7s %7s %12s %12s %21s %9s %8s %8s"
+
+func tableHeader() string {
+	return fmt.Sprintf(tableRow, "ID", "STATE", "HOST", "REMOTE", "LOCAL", "UP", "DOWN", "TRANSFER ↑/↓", "CONNS", "RTT", "UPTIME")
+}
+
+func tableLine(t *pb.ListTunnelsResponse_TunnelInfo) string {
+	state := "active"
+	if t.Paused {
+		state = "paused"
+	}
+	return fmt.Sprintf(tableRow,
+		t.Id,
+		state,
+		t.Host,
+		fmt.Sprint(t.RemotePort),
+		fmt.Sprint(t.LocalPort),
+		formatBytes(uint64(t.BandwidthUp))+"/s",
+		formatBytes(uint64(t.BandwidthDown))+"/s",
+		formatBytes(t.BytesSent)+" / "+formatBytes(t.BytesReceived),
+		fmt.Sprintf("%d/%d", t.ActiveConns, t.TotalConns),
+		formatLatency(t.LatencyMs),
+		formatDuration(time.Since(time.Unix(t.CreatedAt, 0))),
+	)
+}
+
+// formatLatency formats a round trip time given in milliseconds
+func formatLatency(ms float64) string {
+	if ms == 0 {
+		return "-"
+	}
+	if ms < 10 {
+		return fmt.Sprintf("%.1fms", ms)
+	}
+	return fmt.Sprintf("%.0fms", ms)
+}
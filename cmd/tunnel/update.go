@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/spf13/cobra"
+)
+
+var updateCmd = &cobra.Command{
+	Use:   "update <machine> <port>",
+	Short: "Change the ports or addresses of a tunnel in place",
+	Long: `Move a tunnel to another local port, bind address or remote port without
+closing it. The tunnel keeps its ID, statistics and SSH connection, and the
+connections in progress keep going until they end.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeActiveTunnels,
+	Run: func(cmd *cobra.Command, args []string) {
+		host, port, localPort := parseTunnelArgs(args)
+		newLocalPort, _ := cmd.Flags().GetInt("local-port")
+		bind, _ := cmd.Flags().GetStringSlice("bind")
+		newRemotePort, _ := cmd.Flags().GetInt("remote-port")
+		if !cmd.Flags().Changed("bind") {
+			bind = nil
+		}
+		if newLocalPort == 0 && bind == nil && newRemotePort == 0 {
+			fail(exitUsage, "Nothing to update: give --local-port, --bind or --remote-port")
+		}
+
+		conn, err := dialDaemon()
+		if err != nil {
+			failDial(err)
+		}
+		defer conn.Close()
+
+		client := pb.NewTunnelServiceClient(conn)
+		resp, err := client.UpdateTunnel(context.Background(), &pb.UpdateTunnelRequest{
+			Host:             host,
+			RemotePort:       int32(port),
+			LocalPort:        int32(localPort),
+			NewLocalPort:     int32(newLocalPort),
+			NewBindAddresses: bind,
+			NewRemotePort:    int32(newRemotePort),
+		})
+		if err != nil {
+			failRPC("Failed to update tunnel", err)
+		}
+
+		t := resp.Tunnel
+		local := fmt.Sprintf("localhost:%d", t.LocalPort)
+		if len(t.Addresses) > 0 {
+			local = strings.Join(t.Addresses, ", ")
+		}
+		notify("%s %s:%d -> %s\n", successColor("✓ Tunnel updated:"), t.Host, t.RemotePort, local)
+	},
+}
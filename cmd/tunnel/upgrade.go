@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/version"
+	"github.com/maximeaubaret/go-tunnel/pkg/client"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Repository whose GitHub releases carry the binaries
+const releaseRepo = "maximeaubaret/go-tunnel"
+
+// Assets of a release listing the SHA-256 of the binaries, and signing that
+// list with the release key
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// How long the restarted daemon may take to answer again
+const restartTimeout = 30 * time.Second
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Replace tunnel and tunneld with the latest release",
+	Long: `Download the binaries of the latest release for this system, check them
+against the checksums of the release, and replace the ones of tunnel and of
+the running tunneld. The daemon is then restarted and creates its tunnels
+again, the connections in progress are cut. Use --check to only tell whether
+a newer release exists, and --version to install a given one.
+
+The checksums must be signed with the release key built into tunnel. Builds
+without a key, such as development ones, refuse to upgrade unless --insecure
+is given, which trusts the checksums downloaded along with the binaries.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		check, _ := cmd.Flags().GetBool("check")
+		tag, _ := cmd.Flags().GetString("version")
+		force, _ := cmd.Flags().GetBool("force")
+		noRestart, _ := cmd.Flags().GetBool("no-restart")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		release, err := fetchRelease(ctx, tag)
+		if err != nil {
+			fail(exitError, "Failed to find the release: %v", err)
+		}
+		if !force && !newerVersion(release.TagName, version.Version) {
+			notify("%s tunnel %s is up to date (latest release: %s)\n", successColor("✓"), version.Version, release.TagName)
+			return
+		}
+		if check {
+			notify("%s %s is available, this is %s; run tunnel upgrade to install it\n", infoColor("ℹ"), release.TagName, version.Version)
+			return
+		}
+
+		// The daemon tells where its binary is, otherwise it is expected
+		// next to the CLI
+		daemon, conn := runningDaemon()
+		if conn != nil {
+			defer conn.Close()
+		}
+		cliPath, err := executablePath()
+		if err != nil {
+			fail(exitError, "Failed to find the binary of tunnel: %v", err)
+		}
+		daemonPath := filepath.Join(filepath.Dir(cliPath), binaryName("tunneld"))
+		if daemon != nil && daemon.Executable != "" {
+			daemonPath = daemon.Executable
+		} else if _, err := os.Stat(daemonPath); err != nil {
+			if daemonPath, err = exec.LookPath(binaryName("tunneld")); err != nil {
+				daemonPath = ""
+			}
+		}
+
+		checksums, err := releaseChecksums(ctx, release, insecure)
+		if err != nil {
+			fail(exitError, "Failed to verify the release: %v", err)
+		}
+		binaries := []struct{ name, path string }{{"tunnel", cliPath}}
+		if daemonPath != "" {
+			binaries = append(binaries, struct{ name, path string }{"tunneld", daemonPath})
+		} else {
+			fmt.Fprintf(os.Stderr, "%s tunneld was not found, only tunnel is upgraded\n", infoColor("!"))
+		}
+		for _, b := range binaries {
+			asset := releaseAssetName(b.name)
+			notify("%s Downloading %s %s\n", infoColor("…"), asset, release.TagName)
+			data, err := downloadAsset(ctx, release, asset)
+			if err != nil {
+				fail(exitError, "Failed to download %s: %v", asset, err)
+			}
+			if err := verifyChecksum(checksums, asset, data); err != nil {
+				fail(exitError, "Failed to verify %s: %v", asset, err)
+			}
+			if err := replaceBinary(b.path, data); err != nil {
+				fail(exitError, "Failed to replace %s: %v; run the upgrade as the owner of the binary", b.path, err)
+			}
+			notify("%s %s replaced by %s\n", successColor("✓"), b.path, release.TagName)
+		}
+
+		if daemon == nil || daemonPath == "" {
+			return
+		}
+		if noRestart {
+			notify("%s Restart tunneld to run %s\n", infoColor("ℹ"), release.TagName)
+			return
+		}
+		restartDaemon(conn)
+	},
+}
+
+// githubRelease is the part of a GitHub release used by upgrade
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// fetchRelease returns the release with the tag, or the latest one when the
+// tag is empty
+func fetchRelease(ctx context.Context, tag string) (*githubRelease, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", releaseRepo)
+	if tag != "" {
+		url = fmt.Sprintf("https://api.github.com/repos/%s/releases/tags/%s", releaseRepo, tag)
+	}
+	data, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var release githubRelease
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("invalid release: %w", err)
+	}
+	return &release, nil
+}
+
+// downloadAsset returns the content of the asset of a release
+func downloadAsset(ctx context.Context, release *githubRelease, name string) ([]byte, error) {
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return httpGet(ctx, asset.URL)
+		}
+	}
+	return nil, fmt.Errorf("release %s has no %s, this system may not be supported", release.TagName, name)
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// releaseChecksums returns the SHA-256 of the assets of a release, by name.
+// The list must be signed with the release key of the binary, unless it has
+// none and insecure is set.
+func releaseChecksums(ctx context.Context, release *githubRelease, insecure bool) (map[string]string, error) {
+	if version.ReleaseKey == "" && !insecure {
+		return nil, fmt.Errorf("this binary has no release key to check the signature of %s, build it with one or use --insecure", checksumsAsset)
+	}
+	data, err := downloadAsset(ctx, release, checksumsAsset)
+	if err != nil {
+		return nil, err
+	}
+	if version.ReleaseKey != "" {
+		key, err := base64.StdEncoding.DecodeString(version.ReleaseKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid release key in this binary")
+		}
+		signature, err := downloadAsset(ctx, release, signatureAsset)
+		if err != nil {
+			return nil, err
+		}
+		if sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+			signature = sig
+		}
+		if !ed25519.Verify(key, data, signature) {
+			return nil, fmt.Errorf("the signature of %s does not match the release key", checksumsAsset)
+		}
+	}
+
+	// Lines of sha256sum: the hash, then the name
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			checksums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return checksums, nil
+}
+
+// verifyChecksum checks the content of an asset against its checksum
+func verifyChecksum(checksums map[string]string, name string, data []byte) error {
+	want, ok := checksums[name]
+	if !ok {
+		return fmt.Errorf("no checksum for %s in %s", name, checksumsAsset)
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("checksum mismatch: got %s, expected %s", got, want)
+	}
+	return nil
+}
+
+// releaseAssetName returns the name of the asset of a binary for this system,
+// such as tunneld_linux_amd64
+func releaseAssetName(binary string) string {
+	return binaryName(fmt.Sprintf("%s_%s_%s", binary, runtime.GOOS, runtime.GOARCH))
+}
+
+// binaryName adds the extension of the executables of this system
+func binaryName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".exe"
+	}
+	return name
+}
+
+// executablePath returns the path of the running binary, without symlinks
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// replaceBinary swaps the binary at path for data. The running one is moved
+// aside first, which Windows allows while renaming over it fails.
+func replaceBinary(path string, data []byte) error {
+	mode := os.FileMode(0o755)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".new-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	old := path + ".old"
+	os.Remove(old)
+	if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Rename(old, path)
+		return err
+	}
+	// Still in use on Windows, removed by the next upgrade
+	os.Remove(old)
+	return nil
+}
+
+// newerVersion reports whether the release tag is newer than the current
+// version. Versions which are not numbered, such as development builds, are
+// older than any release.
+func newerVersion(tag, current string) bool {
+	latest, ok := parseVersion(tag)
+	if !ok {
+		return false
+	}
+	installed, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range latest {
+		if latest[i] != installed[i] {
+			return latest[i] > installed[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses the major, minor and patch numbers of versions such as
+// v1.2.3 or tunnel-1.2.3, ignoring pre-release and build suffixes
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	start := strings.IndexAny(v, "0123456789")
+	if start < 0 {
+		return parsed, false
+	}
+	v = v[start:]
+	if end := strings.IndexAny(v, "-+"); end >= 0 {
+		v = v[:end]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > len(parsed) {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// runningDaemon returns the version of the running daemon and a connection
+// to it, or nil when it does not answer. The protocol is not checked since it
+// may change across the upgrade.
+func runningDaemon() (*pb.GetVersionResponse, *grpc.ClientConn) {
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(client.Dialer(socketPath)),
+	}
+	if apiToken != "" {
+		options = append(options, grpc.WithPerRPCCredentials(client.TokenCredentials(apiToken)))
+	}
+	conn, err := grpc.Dial(client.Target(socketPath), options...)
+	if err != nil {
+		return nil, nil
+	}
+	resp, err := daemonVersion(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil
+	}
+	return resp, conn
+}
+
+func daemonVersion(conn *grpc.ClientConn) (*pb.GetVersionResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return pb.NewTunnelServiceClient(conn).GetVersion(ctx, &pb.GetVersionRequest{Protocol: version.Protocol})
+}
+
+// restartDaemon asks the daemon to run its new binary and waits for the new
+// process to answer
+func restartDaemon(conn *grpc.ClientConn) {
+	client := pb.NewTunnelServiceClient(conn)
+	before, err := client.GetDaemonStats(context.Background(), &pb.GetDaemonStatsRequest{})
+	if err != nil {
+		failRPC("Failed to restart tunneld", err)
+	}
+	resp, err := client.RestartDaemon(context.Background(), &pb.RestartDaemonRequest{})
+	if err != nil {
+		failRPC("Failed to restart tunneld", err)
+	}
+	notify("%s Restarting tunneld with %d tunnel(s)\n", infoColor("…"), resp.Tunnels)
+
+	deadline := time.Now().Add(restartTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		after, err := client.GetDaemonStats(ctx, &pb.GetDaemonStatsRequest{})
+		cancel()
+		if err == nil && after.StartedAt != before.StartedAt {
+			notify("%s tunneld %s is running, its tunnels reconnect in the background\n", successColor("✓"), after.Version)
+			return
+		}
+	}
+	fail(exitDaemonUnreachable, "tunneld did not come back within %s, check its logs", restartTimeout)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maximeaubaret/go-tunnel/internal/version"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"v1.2.3", [3]int{1, 2, 3}, true},
+		{"1.2.3", [3]int{1, 2, 3}, true},
+		{"tunnel-1.2.3", [3]int{1, 2, 3}, true},
+		{"v1.2.3-rc.1", [3]int{1, 2, 3}, true},
+		{"v1.2.3+dirty", [3]int{1, 2, 3}, true},
+		{"v1.2", [3]int{1, 2, 0}, true},
+		{"v2", [3]int{2, 0, 0}, true},
+		{"v1.10.0", [3]int{1, 10, 0}, true},
+		{"", [3]int{}, false},
+		{"dev", [3]int{}, false},
+		{"v1.2.3.4", [3]int{}, false},
+		{"v1.x.3", [3]int{}, false},
+		{"v1..3", [3]int{}, false},
+	} {
+		got, ok := parseVersion(tt.version)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("%q: got %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	for _, tt := range []struct {
+		tag, current string
+		newer        bool
+	}{
+		{"v1.2.4", "1.2.3", true},
+		{"v1.3.0", "1.2.9", true},
+		{"v2.0.0", "1.9.9", true},
+		{"v1.2.3", "1.2.3", false},
+		{"v1.2.2", "1.2.3", false},
+		{"v1.9.0", "1.10.0", false},
+		{"v1.10.0", "1.9.0", true},
+		{"v1.2", "1.2.0", false},
+		// Pre-release suffixes are ignored
+		{"v1.2.3-rc.1", "1.2.3", false},
+		{"v1.2.3", "1.2.3-rc.1", false},
+		// Development builds are older than any release
+		{"v0.0.1", "dev", true},
+		{"v0.0.1", "unknown", true},
+		// Tags which are not numbered are never newer
+		{"nightly", "1.2.3", false},
+		{"nightly", "dev", false},
+	} {
+		if got := newerVersion(tt.tag, tt.current); got != tt.newer {
+			t.Errorf("%s over %s: got %v, want %v", tt.tag, tt.current, got, tt.newer)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	data := []byte("binary")
+	sum := sha256.Sum256(data)
+	checksums := map[string]string{"tunneld_linux_amd64": hex.EncodeToString(sum[:])}
+
+	if err := verifyChecksum(checksums, "tunneld_linux_amd64", data); err != nil {
+		t.Errorf("got %v, want the checksum to match", err)
+	}
+	if err := verifyChecksum(checksums, "tunneld_linux_amd64", []byte("tampered")); err == nil {
+		t.Error("tampered binary accepted")
+	}
+	if err := verifyChecksum(checksums, "tunneld_linux_arm64", data); err == nil {
+		t.Error("binary without a checksum accepted")
+	}
+}
+
+// testRelease serves a release whose checksums.txt lists one binary, signed
+// by signature unless it is nil
+func testRelease(t *testing.T, signature []byte) *githubRelease {
+	t.Helper()
+	assets := map[string][]byte{checksumsAsset: []byte(testChecksums)}
+	if signature != nil {
+		assets[signatureAsset] = signature
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := assets[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	release := &githubRelease{TagName: "v1.2.3"}
+	for name := range assets {
+		release.Assets = append(release.Assets, struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		}{name, srv.URL + "/" + name})
+	}
+	return release
+}
+
+const testChecksums = "0123abcd  tunneld_linux_amd64\n4567EF01 *tunnel_linux_amd64\n"
+
+// setReleaseKey makes key the release key of the binary for the test
+func setReleaseKey(t *testing.T, key ed25519.PublicKey) {
+	t.Helper()
+	previous := version.ReleaseKey
+	version.ReleaseKey = ""
+	if key != nil {
+		version.ReleaseKey = base64.StdEncoding.EncodeToString(key)
+	}
+	t.Cleanup(func() { version.ReleaseKey = previous })
+}
+
+func TestReleaseChecksums(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := ed25519.Sign(private, []byte(testChecksums))
+	ctx := context.Background()
+
+	check := func(release *githubRelease, insecure bool) error {
+		checksums, err := releaseChecksums(ctx, release, insecure)
+		if err != nil {
+			return err
+		}
+		want := map[string]string{"tunneld_linux_amd64": "0123abcd", "tunnel_linux_amd64": "4567ef01"}
+		if fmt.Sprint(checksums) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", checksums, want)
+		}
+		return nil
+	}
+
+	setReleaseKey(t, public)
+	for name, sig := range map[string][]byte{
+		"raw":    signature,
+		"base64": []byte(base64.StdEncoding.EncodeToString(signature) + "\n"),
+	} {
+		if err := check(testRelease(t, sig), false); err != nil {
+			t.Errorf("%s signature: got %v, want it accepted", name, err)
+		}
+	}
+
+	for name, sig := range map[string][]byte{
+		"other key":  ed25519.Sign(other, []byte(testChecksums)),
+		"other list": ed25519.Sign(private, []byte(testChecksums+"ffff  evil\n")),
+		"truncated":  signature[:len(signature)-1],
+		"garbage":    []byte("not a signature"),
+	} {
+		if err := check(testRelease(t, sig), false); err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Errorf("%s signature: got %v, want it refused", name, err)
+		}
+	}
+
+	// A missing signature is never skipped, even with --insecure
+	for _, insecure := range []bool{false, true} {
+		if err := check(testRelease(t, nil), insecure); err == nil {
+			t.Errorf("insecure %v: release without a signature accepted", insecure)
+		}
+	}
+
+	version.ReleaseKey = "not base64"
+	if err := check(testRelease(t, signature), false); err == nil {
+		t.Error("invalid release key accepted")
+	}
+
+	// Without a release key, only --insecure skips the signature
+	setReleaseKey(t, nil)
+	if err := check(testRelease(t, nil), false); err == nil || !strings.Contains(err.Error(), "--insecure") {
+		t.Errorf("got %v, want the release refused without a key", err)
+	}
+	if err := check(testRelease(t, nil), true); err != nil {
+		t.Errorf("got %v, want the release accepted with --insecure", err)
+	}
+}
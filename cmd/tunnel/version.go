@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/version"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// incompatibleError is returned when tunneld speaks another protocol version
+type incompatibleError struct {
+	daemon *pb.GetVersionResponse
+}
+
+func (e *incompatibleError) Error() string {
+	return fmt.Sprintf("tunneld %s speaks protocol %d but this CLI (%s) speaks protocol %d, restart tunneld with the same version as the CLI",
+		e.daemon.Version, e.daemon.Protocol, version.Version, version.Protocol)
+}
+
+// checkVersion asks the daemon for its version and refuses to talk to a
+// daemon speaking another protocol. Daemons predating the handshake are only
+// warned about.
+func checkVersion(client pb.TunnelServiceClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := client.GetVersion(ctx, &pb.GetVersionRequest{
+		Protocol: version.Protocol,
+	})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		fmt.Fprintf(os.Stderr, "%s tunneld is older than this CLI (%s), restart it to avoid surprises\n", infoColor("!"), version.Version)
+		return nil
+	case err != nil:
+		return err
+	case resp.Protocol != version.Protocol:
+		return &incompatibleError{daemon: resp}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Scopes of the API tokens
+const (
+	scopeRead   = "read"   // Inspect the tunnels without changing them
+	scopeManage = "manage" // Everything
+)
+
+// readMethods are the calls allowed with the read scope. The others, and
+// the ones added later, need the manage scope.
+var readMethods = map[string]bool{
+	"GetVersion":        true,
+	"ListTunnels":       true,
+	"GetTunnel":         true,
+	"WatchTunnels":      true,
+	"SubscribeEvents":   true,
+	"GetTunnelStatus":   true,
+	"StreamLogs":        true,
+	"GetStats":          true,
+	"ListConnections":   true,
+	"GetDaemonStats":    true,
+	"ListClosedTunnels": true,
+
+	"ServerReflectionInfo": true,
+}
+
+// publicServices are the gRPC services callable without a token, so that
+// health probes which cannot send one work
+var publicServices = map[string]bool{
+	healthpb.Health_ServiceDesc.ServiceName: true,
+}
+
+type apiToken struct {
+	name   string
+	secret []byte
+	scope  string
+}
+
+// authenticator checks the bearer tokens of the calls, when the user config
+// defines any
+type authenticator struct {
+	tokens []apiToken
+}
+
+// newAuthenticator reads the tokens of the user config, nil without tokens
+func newAuthenticator(config *userconfig.Config) (*authenticator, error) {
+	if len(config.Tokens) == 0 {
+		return nil, nil
+	}
+	a := &authenticator{}
+	for name, token := range config.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %q: missing token", name)
+		}
+		if token.Scope != scopeRead && token.Scope != scopeManage {
+			return nil, fmt.Errorf("token %q: invalid scope %q, expected %s or %s", name, token.Scope, scopeRead, scopeManage)
+		}
+		a.tokens = append(a.tokens, apiToken{name: name, secret: []byte(token.Token), scope: token.Scope})
+	}
+	return a, nil
+}
+
+// authorize checks that the "Bearer <token>" authorization allows method
+func (a *authenticator) authorize(authorization, method string) error {
+	secret, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing API token")
+	}
+	for _, token := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(secret), token.secret) != 1 {
+			continue
+		}
+		if token.scope != scopeManage && !readMethods[method] {
+			return status.Errorf(codes.PermissionDenied, "token %q is read-only, %s needs the %s scope", token.name, method, scopeManage)
+		}
+		return nil
+	}
+	return status.Error(codes.Unauthenticated, "invalid API token")
+}
+
+// authorizeContext checks the token in the metadata of a call
+func (a *authenticator) authorizeContext(ctx context.Context, fullMethod string) error {
+	if publicServices[strings.TrimPrefix(path.Dir(fullMethod), "/")] {
+		return nil
+	}
+	var authorization string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	return a.authorize(authorization, path.Base(fullMethod))
+}
+
+// serverOptions returns the interceptors checking the tokens
+func (a *authenticator) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := a.authorizeContext(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := a.authorizeContext(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+// handler checks the token of the HTTP requests, which call method
+func (a *authenticator) handler(method string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := a.authorize(r.Header.Get("Authorization"), method); err != nil {
+			writeError(w, err)
+			return
+		}
+		next(w, r)
+	}
+}
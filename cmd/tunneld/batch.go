@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+// Number of tunnels of a batch created at the same time
+const maxParallelCreates = 4
+
+// CreateTunnels creates several tunnels concurrently. In an atomic batch,
+// the first failure cancels the creations in progress and closes the
+// tunnels already created, so that either all of them exist or none. Kept
+// tunnels existed before the batch and are left alone.
+func (s *server) CreateTunnels(ctx context.Context, req *pb.CreateTunnelsRequest) (*pb.CreateTunnelsResponse, error) {
+	batchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*pb.CreateTunnelsResponse_Result, len(req.Tunnels))
+	var failed sync.Once
+	sem := make(chan struct{}, maxParallelCreates)
+	var wg sync.WaitGroup
+	for i, create := range req.Tunnels {
+		results[i] = &pb.CreateTunnelsResponse_Result{
+			Tunnel: &pb.TunnelSpec{
+				Host:       create.Host,
+				LocalPort:  create.LocalPort,
+				RemotePort: create.RemotePort,
+			},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := results[i]
+			if req.Atomic && batchCtx.Err() != nil && ctx.Err() == nil {
+				result.Action = "skipped"
+				return
+			}
+			resp, err := s.CreateTunnel(batchCtx, create)
+			if err == nil {
+				result.Action = resp.Action
+				result.Warnings = resp.Warnings
+				return
+			}
+			// Creations interrupted by the failure of another tunnel
+			if req.Atomic && batchCtx.Err() != nil && ctx.Err() == nil {
+				result.Action = "skipped"
+				return
+			}
+
+			result.Action = "failed"
+			st := status.Convert(err)
+			result.Error = st.Message()
+			for _, detail := range st.Details() {
+				if info, ok := detail.(*errdetails.ErrorInfo); ok {
+					result.Reason = pb.ErrorReason(pb.ErrorReason_value[info.Reason])
+					result.Hint = info.Metadata["hint"]
+				}
+			}
+			if req.Atomic {
+				failed.Do(cancel)
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := &pb.CreateTunnelsResponse{Success: true, Results: results}
+	for _, result := range results {
+		if result.Action == "failed" || result.Action == "skipped" {
+			resp.Success = false
+		}
+	}
+	if !req.Atomic || resp.Success {
+		return resp, nil
+	}
+
+	for _, result := range results {
+		if result.Action != "created" && result.Action != "replaced" {
+			continue
+		}
+		t := result.Tunnel
+		log.Printf("Rolling back tunnel: %s:%d", t.Host, t.RemotePort)
+		if _, err := s.manager.CloseTunnel(t.Host, int(t.RemotePort), int(t.LocalPort), 0); err != nil {
+			log.Printf("Failed to roll back tunnel %s:%d: %v", t.Host, t.RemotePort, err)
+			continue
+		}
+		result.Action = "rolled_back"
+		result.Warnings = nil
+	}
+	return resp, nil
+}
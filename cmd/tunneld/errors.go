@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// Domain of the ErrorInfo details attached to failed calls
+const errorDomain = "go-tunnel"
+
+// errorKinds maps the errors of the manager to a status code and a reason.
+// The causes of ErrHostUnreachable and ErrBindFailed come first since they
+// match them too.
+var errorKinds = []struct {
+	err    error
+	code   codes.Code
+	reason pb.ErrorReason
+}{
+	{tunnel.ErrAlreadyExists, codes.AlreadyExists, pb.ErrorReason_ALREADY_EXISTS},
+	{tunnel.ErrNotFound, codes.NotFound, pb.ErrorReason_NOT_FOUND},
+	{tunnel.ErrAmbiguous, codes.InvalidArgument, pb.ErrorReason_AMBIGUOUS},
+	{tunnel.ErrAuthFailed, codes.Unauthenticated, pb.ErrorReason_AUTH_FAILED},
+	{tunnel.ErrHostKeyMismatch, codes.Unauthenticated, pb.ErrorReason_HOST_KEY_MISMATCH},
+	{tunnel.ErrHostNotFound, codes.Unavailable, pb.ErrorReason_HOST_NOT_FOUND},
+	{tunnel.ErrConnectionRefused, codes.Unavailable, pb.ErrorReason_CONNECTION_REFUSED},
+	{tunnel.ErrTimedOut, codes.Unavailable, pb.ErrorReason_TIMED_OUT},
+	{tunnel.ErrHostUnreachable, codes.Unavailable, pb.ErrorReason_HOST_UNREACHABLE},
+	{tunnel.ErrNotReady, codes.DeadlineExceeded, pb.ErrorReason_NOT_READY},
+	{tunnel.ErrPrivilegedPort, codes.FailedPrecondition, pb.ErrorReason_PRIVILEGED_PORT},
+	{tunnel.ErrBindFailed, codes.FailedPrecondition, pb.ErrorReason_BIND_FAILED},
+}
+
+// errorHints tell how to fix the failures of each reason, sent to clients
+// along with the reason
+var errorHints = map[pb.ErrorReason]string{
+	pb.ErrorReason_ALREADY_EXISTS:     "Pass --replace to replace it, or --if-not-exists to keep it when identical",
+	pb.ErrorReason_AMBIGUOUS:          "Give the local port along with the remote one, as local:remote, or the tunnel ID",
+	pb.ErrorReason_PORT_IN_USE:        "Free the port, choose another local port, or pass --auto-port to use the next free one",
+	pb.ErrorReason_AUTH_FAILED:        "Make sure the public key of the daemon is in ~/.ssh/authorized_keys of the user on the machine, or choose the user and key with -l and -i; tunnel doctor checks each step",
+	pb.ErrorReason_HOST_UNREACHABLE:   "Check the network connection to the machine",
+	pb.ErrorReason_NOT_READY:          "Make sure the remote service runs and listens on the remote port",
+	pb.ErrorReason_HOST_NOT_FOUND:     "Check the machine name for typos, and that the VPN or DNS server resolving it is reachable",
+	pb.ErrorReason_CONNECTION_REFUSED: "Make sure sshd runs on the machine and listens on this port, or give its port with --ssh-port",
+	pb.ErrorReason_TIMED_OUT:          "Make sure the machine is up and no firewall drops SSH; on slow links raise --connect-timeout, or go through a jump host (-J) or a proxy (--proxy)",
+	pb.ErrorReason_HOST_KEY_MISMATCH:  "The host key changed: make sure the machine was reinstalled and not impersonated, then update known_hosts",
+	pb.ErrorReason_BIND_FAILED:        "Ports below 1024 need privileges, and the --bind addresses must belong to this machine",
+	pb.ErrorReason_PRIVILEGED_PORT:    "Install tunnel-bind next to tunneld with sudo setcap cap_net_bind_service=+ep, or choose a local port above 1023",
+}
+
+// errorReason classifies an error of the manager
+func errorReason(err error) (codes.Code, pb.ErrorReason) {
+	var portErr *tunnel.PortInUseError
+	if errors.As(err, &portErr) {
+		return codes.FailedPrecondition, pb.ErrorReason_PORT_IN_USE
+	}
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.code, kind.reason
+		}
+	}
+	return codes.Unknown, pb.ErrorReason_ERROR_REASON_UNSPECIFIED
+}
+
+// rpcError turns an error of the manager into a status error, with details
+// telling clients what went wrong
+func rpcError(err error) error {
+	code, reason := errorReason(err)
+	if reason == pb.ErrorReason_ERROR_REASON_UNSPECIFIED {
+		return status.Error(code, err.Error())
+	}
+
+	info := &errdetails.ErrorInfo{
+		Reason: reason.String(),
+		Domain: errorDomain,
+	}
+	if hint := errorHints[reason]; hint != "" {
+		info.Metadata = map[string]string{"hint": hint}
+	}
+	details := []protoadapt.MessageV1{info}
+	var portErr *tunnel.PortInUseError
+	if errors.As(err, &portErr) {
+		details = append(details, &pb.PortInUse{
+			Process:       portErr.Process,
+			Pid:           int32(portErr.PID),
+			SuggestedPort: int32(portErr.Suggested),
+		})
+	}
+
+	st, detailErr := status.New(code, err.Error()).WithDetails(details...)
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
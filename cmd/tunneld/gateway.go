@@ -0,0 +1,331 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// httpCodes maps the gRPC codes returned by the daemon to HTTP statuses,
+// like grpc-gateway does
+var httpCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.Canceled:           499,
+}
+
+var jsonOptions = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// dashboardPage is the web dashboard, it only uses the endpoints below
+//
+//go:embed web/index.html
+var dashboardPage []byte
+
+// gateway exposes the tunnel operations as REST endpoints. Bodies are the
+// JSON mapping of the gRPC messages.
+type gateway struct {
+	server *server
+	tokens bool // Requests authenticate with API tokens
+}
+
+// serveGateway serves the REST endpoints on addr until the daemon exits.
+// With API tokens, the requests authenticate with an "Authorization: Bearer"
+// header, the dashboard page itself is public.
+func serveGateway(addr string, s *server, auth *authenticator) {
+	if err := checkGatewayAddress(addr, auth); err != nil {
+		log.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen for HTTP: %v", err)
+	}
+
+	g := &gateway{server: s, tokens: auth != nil}
+	log.Printf("HTTP gateway listening at %v", lis.Addr())
+	go func() {
+		if err := http.Serve(lis, g.handler(auth)); err != nil {
+			log.Printf("HTTP gateway stopped: %v", err)
+		}
+	}()
+}
+
+// checkGatewayAddress checks that the gateway may listen on addr: without
+// API tokens, only loopback addresses are served, as anyone reaching the
+// gateway could create tunnels
+func checkGatewayAddress(addr string, auth *authenticator) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP address %q: %v", addr, err)
+	}
+	if auth == nil && !isLoopback(host) {
+		return fmt.Errorf("refusing to serve HTTP on %s without API tokens, define tokens in %s or listen on a loopback address", addr, userconfig.Path())
+	}
+	return nil
+}
+
+// handler routes the requests to the endpoints, behind guard
+func (g *gateway) handler(auth *authenticator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", auth.handler("ListTunnels", g.listTunnels))
+	mux.HandleFunc("POST /tunnels", auth.handler("CreateTunnel", g.createTunnel))
+	mux.HandleFunc("GET /tunnels/{id}", auth.handler("GetTunnel", g.getTunnel))
+	mux.HandleFunc("DELETE /tunnels/{id}", auth.handler("CloseTunnel", g.closeTunnel))
+	mux.HandleFunc("PATCH /tunnels/{id}", auth.handler("UpdateTunnel", g.updateTunnel))
+	mux.HandleFunc("POST /tunnels/{id}/pause", auth.handler("PauseTunnel", g.pauseTunnel))
+	mux.HandleFunc("POST /tunnels/{id}/resume", auth.handler("ResumeTunnel", g.resumeTunnel))
+	mux.HandleFunc("GET /stats", auth.handler("GetStats", g.getStats))
+	mux.HandleFunc("GET /{$}", g.dashboard)
+	return g.guard(mux)
+}
+
+// guard rejects the requests web pages could send without being allowed to:
+// cross-origin ones, and, without API tokens, the ones for another host than
+// a loopback address, which a page rebinding its DNS name to the loopback
+// would send
+func (g *gateway) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !g.tokens && !isLoopback(host) {
+			writeError(w, status.Errorf(codes.PermissionDenied, "host %q is not a loopback address", r.Host))
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, status.Errorf(codes.PermissionDenied, "cross-origin request from %q", origin))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether host is localhost or a loopback address
+func isLoopback(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// listTunnels handles GET /tunnels?label=key=value
+func (g *gateway) listTunnels(w http.ResponseWriter, r *http.Request) {
+	labels := make(map[string]string)
+	for _, label := range r.URL.Query()["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid label %q: expected key=value", label))
+			return
+		}
+		labels[key] = value
+	}
+
+	resp, err := g.server.ListTunnels(r.Context(), &pb.ListTunnelsRequest{Labels: labels})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp)
+}
+
+// createTunnel handles POST /tunnels with a CreateTunnelRequest body, and
+// answers with the new tunnel
+func (g *gateway) createTunnel(w http.ResponseWriter, r *http.Request) {
+	req := &pb.CreateTunnelRequest{}
+	if err := readMessage(r, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.LocalPort == 0 {
+		req.LocalPort = req.RemotePort
+	}
+
+	if _, err := g.server.CreateTunnel(r.Context(), req); err != nil {
+		writeError(w, err)
+		return
+	}
+	t, err := g.server.manager.GetTunnel(req.Host, int(req.RemotePort), int(req.LocalPort))
+	if err != nil {
+		writeError(w, rpcError(err))
+		return
+	}
+	writeMessage(w, http.StatusCreated, tunnelInfo(t))
+}
+
+// getTunnel handles GET /tunnels/{id}
+func (g *gateway) getTunnel(w http.ResponseWriter, r *http.Request) {
+	resp, err := g.server.GetTunnel(r.Context(), &pb.GetTunnelRequest{Id: r.PathValue("id")})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp.Tunnel)
+}
+
+// closeTunnel handles DELETE /tunnels/{id}?force=true
+func (g *gateway) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	req := &pb.CloseTunnelRequest{Id: r.PathValue("id")}
+	if force := r.URL.Query().Get("force"); force != "" {
+		var err error
+		if req.Force, err = strconv.ParseBool(force); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid force %q", force))
+			return
+		}
+	}
+
+	resp, err := g.server.CloseTunnel(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp)
+}
+
+// updateTunnel handles PATCH /tunnels/{id} with an UpdateTunnelRequest body,
+// whose new fields are used, and answers with the updated tunnel
+func (g *gateway) updateTunnel(w http.ResponseWriter, r *http.Request) {
+	t, err := g.lookup(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	req := &pb.UpdateTunnelRequest{}
+	if err := readMessage(r, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	req.Host, req.RemotePort, req.LocalPort = t.Host, int32(t.RemotePort), int32(t.LocalPort)
+
+	resp, err := g.server.UpdateTunnel(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp.Tunnel)
+}
+
+// pauseTunnel handles POST /tunnels/{id}/pause?sever=true
+func (g *gateway) pauseTunnel(w http.ResponseWriter, r *http.Request) {
+	t, err := g.lookup(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	req := &pb.PauseTunnelRequest{Host: t.Host, RemotePort: int32(t.RemotePort), LocalPort: int32(t.LocalPort)}
+	if sever := r.URL.Query().Get("sever"); sever != "" {
+		if req.Sever, err = strconv.ParseBool(sever); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid sever %q", sever))
+			return
+		}
+	}
+
+	resp, err := g.server.PauseTunnel(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp)
+}
+
+// resumeTunnel handles POST /tunnels/{id}/resume
+func (g *gateway) resumeTunnel(w http.ResponseWriter, r *http.Request) {
+	t, err := g.lookup(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp, err := g.server.ResumeTunnel(r.Context(), &pb.ResumeTunnelRequest{Host: t.Host, RemotePort: int32(t.RemotePort), LocalPort: int32(t.LocalPort)})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp)
+}
+
+// getStats handles GET /stats, the tunnels with their bandwidth history
+func (g *gateway) getStats(w http.ResponseWriter, r *http.Request) {
+	resp, err := g.server.GetStats(r.Context(), &pb.GetStatsRequest{Host: r.URL.Query().Get("host")})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, resp)
+}
+
+// dashboard handles GET /
+func (g *gateway) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// lookup returns the tunnel with the given ID, or an unambiguous prefix of it
+func (g *gateway) lookup(id string) (*tunnel.Tunnel, error) {
+	t, err := g.server.manager.GetTunnelByID(id)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return t, nil
+}
+
+// readMessage reads the JSON body of r into m. Other content types are
+// refused, as web pages can send them cross-origin without asking, such as
+// text/plain forms.
+func readMessage(r *http.Request, m proto.Message) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return status.Error(codes.InvalidArgument, "the body must be application/json")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to read body: %v", err)
+	}
+	if err := protojson.Unmarshal(body, m); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid body: %v", err)
+	}
+	return nil
+}
+
+func writeMessage(w http.ResponseWriter, code int, m proto.Message) {
+	data, err := jsonOptions.Marshal(m)
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "failed to encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeError sends the status of err, with its details, like grpc-gateway
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, ok := httpCodes[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	data, _ := jsonOptions.Marshal(st.Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+)
+
+func newTestGateway(auth *authenticator) http.Handler {
+	g := &gateway{server: &server{manager: tunnel.NewTunnelManager()}, tokens: auth != nil}
+	return g.handler(auth)
+}
+
+func TestCheckGatewayAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080"} {
+		if err := checkGatewayAddress(addr, nil); err != nil {
+			t.Errorf("%s: got %v, want it served", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:8080", ":8080", "192.168.1.10:8080", "[::]:8080", "example.com:8080"} {
+		if err := checkGatewayAddress(addr, nil); err == nil {
+			t.Errorf("%s: served without API tokens", addr)
+		}
+		if err := checkGatewayAddress(addr, newTestAuthenticator(t)); err != nil {
+			t.Errorf("%s: got %v, want it served with API tokens", addr, err)
+		}
+	}
+}
+
+func TestGatewayHost(t *testing.T) {
+	for _, tt := range []struct {
+		host  string
+		token string
+		code  int
+	}{
+		{"localhost:8080", "", http.StatusOK},
+		{"127.0.0.1:8080", "", http.StatusOK},
+		{"[::1]:8080", "", http.StatusOK},
+		// A page whose DNS name was rebound to the loopback
+		{"evil.example:8080", "", http.StatusForbidden},
+		{"evil.example", "", http.StatusForbidden},
+		// Tokens protect the other hosts
+		{"tunnels.example:8080", "manage-secret", http.StatusOK},
+		{"tunnels.example:8080", "", http.StatusUnauthorized},
+	} {
+		var auth *authenticator
+		if tt.host == "tunnels.example:8080" {
+			auth = newTestAuthenticator(t)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+		r.Host = tt.host
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		newTestGateway(auth).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d: %s", tt.host, w.Code, tt.code, w.Body)
+		}
+	}
+}
+
+func TestGatewayOrigin(t *testing.T) {
+	for _, tt := range []struct {
+		origin string
+		code   int
+	}{
+		{"", http.StatusOK},
+		{"http://localhost:8080", http.StatusOK},
+		{"http://evil.example", http.StatusForbidden},
+		{"http://localhost:9090", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/tunnels", nil)
+		r.Host = "localhost:8080"
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		newTestGateway(nil).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%q: got %d, want %d: %s", tt.origin, w.Code, tt.code, w.Body)
+		}
+	}
+}
+
+func TestGatewayContentType(t *testing.T) {
+	for _, tt := range []struct {
+		contentType string
+		accepted    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		// Forms which pages can post to any site without a preflight
+		{"text/plain", false},
+		{"application/x-www-form-urlencoded", false},
+		{"multipart/form-data; boundary=x", false},
+		{"", false},
+	} {
+		// The body of the accepted requests is then refused by itself
+		r := httptest.NewRequest(http.MethodPost, "/tunnels", strings.NewReader(`{"unknown": 1}`))
+		r.Host = "localhost:8080"
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		newTestGateway(nil).ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%q: got %d: %s", tt.contentType, w.Code, w.Body)
+		}
+		if refused := strings.Contains(w.Body.String(), "application/json"); refused == tt.accepted {
+			t.Errorf("%q: got %d, accepted %v: %s", tt.contentType, w.Code, tt.accepted, w.Body)
+		}
+	}
+}
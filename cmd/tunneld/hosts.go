@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConfigKey identifies the SSH configs derived from the one of the daemon
+type sshConfigKey struct {
+	user         string
+	identityFile string
+	vault        userconfig.Vault // Certificates signed by Vault when the role is set
+
+	// Keys generated by the daemon and pushed to the machines
+	ec2        userconfig.EC2InstanceConnect // When the instance ID is set
+	osLogin    userconfig.OSLogin
+	useOSLogin bool
+}
+
+// sshConfigs caches the SSH configs of the tunnels using another user or
+// key than the daemon, so that their keys are only loaded once, and
+// reloaded together by ReloadKeys
+type sshConfigs struct {
+	configs map[sshConfigKey]*ssh.ClientConfig
+	keys    map[string]*sshauth.Keys // By identity file
+	mu      sync.Mutex
+}
+
+// hostConfig returns the SSH config of a new tunnel to host, and fills its
+// options. The overrides of the request win over the defaults of the hosts
+// section of the user config. The file is read on every call so that edits
+// apply to the next tunnels without restarting.
+func (s *server) hostConfig(host string, overrides *pb.SSHOptions, opts *tunnel.Options) (*ssh.ClientConfig, error) {
+	config, err := userconfig.Load()
+	if err != nil {
+		return nil, err
+	}
+	defaults := config.HostDefaults(host)
+	if overrides == nil {
+		overrides = &pb.SSHOptions{}
+	}
+	if overrides.Port < 0 || overrides.ConnectTimeoutMs < 0 || overrides.HandshakeTimeoutMs < 0 {
+		return nil, fmt.Errorf("invalid SSH options: negative port or timeout")
+	}
+
+	opts.SSHPort = int(overrides.Port)
+	if opts.SSHPort == 0 {
+		opts.SSHPort = defaults.Port
+	}
+	opts.JumpHost = overrides.JumpHost
+	if opts.JumpHost == "" {
+		opts.JumpHost = defaults.JumpHost
+	}
+	opts.HostAddress = overrides.Address
+	if opts.HostAddress == "" {
+		opts.HostAddress = defaults.Address
+	}
+	opts.Proxy = overrides.Proxy
+	if opts.Proxy == "" {
+		opts.Proxy = defaults.Proxy
+	}
+	opts.ControlPath = overrides.ControlPath
+	if opts.ControlPath == "" {
+		opts.ControlPath = defaults.ControlPath
+	}
+	opts.ControlPath = userconfig.ExpandHome(opts.ControlPath)
+	if opts.JumpHost == "" && opts.Proxy == "" {
+		if opts.ProxyCommand, err = proxyCommand(host); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Bind) == 0 {
+		opts.Bind = defaults.Bind
+	}
+	opts.ConnectTimeout = time.Duration(overrides.ConnectTimeoutMs) * time.Millisecond
+	opts.HandshakeTimeout = time.Duration(overrides.HandshakeTimeoutMs) * time.Millisecond
+
+	key := sshConfigKey{user: overrides.User, identityFile: overrides.IdentityFile}
+	if key.user == "" {
+		key.user = defaults.User
+	}
+	s.redactHost(host, key.user, opts)
+	if key.identityFile == "" {
+		key.identityFile = defaults.IdentityFile
+	} else {
+		key.identityFile = userconfig.ExpandHome(key.identityFile)
+	}
+	if defaults.Vault != nil {
+		if defaults.Vault.Role == "" {
+			return nil, fmt.Errorf("invalid vault settings for %s in %s: role is missing", host, userconfig.Path())
+		}
+		key.vault = *defaults.Vault
+	}
+	if defaults.EC2InstanceConnect != nil {
+		if defaults.EC2InstanceConnect.InstanceID == "" {
+			return nil, fmt.Errorf("invalid ec2_instance_connect settings for %s in %s: instance_id is missing", host, userconfig.Path())
+		}
+		key.ec2 = *defaults.EC2InstanceConnect
+	}
+	if defaults.OSLogin != nil {
+		key.osLogin, key.useOSLogin = *defaults.OSLogin, true
+	}
+	methods := 0
+	for _, set := range []bool{key.vault.Role != "", key.ec2.InstanceID != "", key.useOSLogin} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return nil, fmt.Errorf("invalid settings for %s in %s: vault, ec2_instance_connect and os_login cannot be combined", host, userconfig.Path())
+	}
+	return s.sshConfig(key)
+}
+
+// ssh config files read for the ProxyCommand of the hosts, the one of the user
+// first like ssh
+var sshConfigPaths = []string{userconfig.SSHConfigPath(), "/etc/ssh/ssh_config"}
+
+// proxyCommand returns the ProxyCommand of host in ssh_config, empty when
+// none applies. The files are read on every call like the user config.
+func proxyCommand(host string) (string, error) {
+	for _, path := range sshConfigPaths {
+		directives, _, err := userconfig.SSHConfig(path, host)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		for _, d := range directives {
+			switch d.Keyword {
+			case "proxycommand":
+				if strings.EqualFold(d.Value, "none") {
+					return "", nil
+				}
+				return d.Value, nil
+			case "proxyjump":
+				// The first of the two set wins, like ssh
+				return "", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// sshConfig returns the config of the daemon with the user and key of key,
+// loading the key on first use
+func (s *server) sshConfig(key sshConfigKey) (*ssh.ClientConfig, error) {
+	if key == (sshConfigKey{}) {
+		return s.config, nil
+	}
+
+	s.configs.mu.Lock()
+	defer s.configs.mu.Unlock()
+	if config, ok := s.configs.configs[key]; ok {
+		return config, nil
+	}
+
+	config := *s.config
+	if key.user != "" {
+		config.User = key.user
+	}
+	keys := s.keys
+	if key.identityFile != "" {
+		var ok bool
+		keys, ok = s.configs.keys[key.identityFile]
+		if !ok {
+			var err error
+			keys, err = sshauth.FileKeys(key.identityFile)
+			if err != nil {
+				return nil, fmt.Errorf("identity file %s: %v", key.identityFile, err)
+			}
+			if s.configs.keys == nil {
+				s.configs.keys = make(map[string]*sshauth.Keys)
+			}
+			s.configs.keys[key.identityFile] = keys
+		}
+		config.Auth = []ssh.AuthMethod{keys.AuthMethod()}
+	}
+	switch {
+	case key.vault.Role != "":
+		config.Auth = []ssh.AuthMethod{keys.VaultAuthMethod(key.vault, config.User)}
+	case key.ec2.InstanceID != "":
+		auth, err := sshauth.EC2InstanceConnectAuthMethod(key.ec2, config.User)
+		if err != nil {
+			return nil, fmt.Errorf("EC2 Instance Connect: %v", err)
+		}
+		config.Auth = []ssh.AuthMethod{auth}
+	case key.useOSLogin:
+		auth, user, err := sshauth.OSLoginAuthMethod(key.osLogin)
+		if err != nil {
+			return nil, fmt.Errorf("OS Login: %v", err)
+		}
+		config.Auth = []ssh.AuthMethod{auth}
+		if key.user == "" {
+			config.User = user
+		}
+	}
+	if s.configs.configs == nil {
+		s.configs.configs = make(map[sshConfigKey]*ssh.ClientConfig)
+	}
+	s.configs.configs[key] = &config
+	return &config, nil
+}
+
+// ReloadKeys reads the keys of the daemon and the identity files in use
+// again. The SSH configs authenticate with the keys of the moment, so the
+// next connections and reconnections of every tunnel use the new ones.
+func (s *server) ReloadKeys(ctx context.Context, req *pb.ReloadKeysRequest) (*pb.ReloadKeysResponse, error) {
+	s.configs.mu.Lock()
+	all := []*sshauth.Keys{s.keys}
+	for _, keys := range s.configs.keys {
+		all = append(all, keys)
+	}
+	s.configs.mu.Unlock()
+
+	resp := &pb.ReloadKeysResponse{}
+	for _, keys := range all {
+		if err := keys.Reload(); err != nil {
+			log.Printf("Failed to reload SSH key: %v", err)
+			resp.Errors = append(resp.Errors, err.Error())
+		}
+		if path := keys.Path(); path != "" {
+			resp.Keys = append(resp.Keys, path)
+		}
+	}
+	sort.Strings(resp.Keys)
+	log.Printf("Reloaded SSH keys: %d in use, %d failed", len(resp.Keys), len(resp.Errors))
+	return resp, nil
+}
+
+// redactHost masks the names of a new tunnel in the logs, when they are
+// redacted: its host, address and user, and the ones of its jump host and
+// proxy
+func (s *server) redactHost(host, user string, opts *tunnel.Options) {
+	if s.redact == nil {
+		return
+	}
+	s.redact.add("host", host)
+	s.redact.add("host", opts.HostAddress)
+	s.redact.add("user", user)
+	jump := opts.JumpHost
+	if jumpUser, rest, ok := strings.Cut(jump, "@"); ok {
+		s.redact.add("user", jumpUser)
+		jump = rest
+	}
+	if jumpHost, _, err := net.SplitHostPort(jump); err == nil {
+		jump = jumpHost
+	}
+	s.redact.add("host", jump)
+	if proxy, err := url.Parse(opts.Proxy); err == nil && proxy.Host != "" {
+		s.redact.add("host", proxy.Hostname())
+		if proxy.User != nil {
+			s.redact.add("user", proxy.User.Username())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of log lines kept in memory for `tunnel logs`
+const logBufferSize = 1000
+
+type logEntry struct {
+	Time    time.Time
+	Message string
+}
+
+// logBuffer is an io.Writer keeping the most recent log lines in memory and
+// forwarding new ones to subscribers
+type logBuffer struct {
+	entries     []logEntry
+	subscribers map[chan logEntry]struct{}
+	mu          sync.RWMutex
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{
+		subscribers: make(map[chan logEntry]struct{}),
+	}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	entry := logEntry{
+		Time:    time.Now(),
+		Message: strings.TrimRight(string(p), "\n"),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries = append(b.entries, entry)
+	if len(b.entries) > logBufferSize {
+		b.entries = b.entries[len(b.entries)-logBufferSize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the buffered entries along with a channel receiving new
+// ones, so that no line is missed or duplicated in between
+func (b *logBuffer) subscribe() ([]logEntry, <-chan logEntry, func()) {
+	ch := make(chan logEntry, 256)
+
+	b.mu.Lock()
+	entries := append([]logEntry(nil), b.entries...)
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return entries, ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// hostFilter matches log lines mentioning host as "host:port", which is how
+// both the daemon and the tunnels tag their messages
+func hostFilter(host string) func(string) bool {
+	if host == "" {
+		return func(string) bool { return true }
+	}
+	re := regexp.MustCompile(`(^|[\s\[])` + regexp.QuoteMeta(host) + `:\d`)
+	return re.MatchString
+}
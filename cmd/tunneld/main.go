@@ -4,94 +4,811 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 
 	"github.com/maximeaubaret/go-tunnel/internal/version"
-	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"os/user"
+	"runtime"
 	"syscall"
+	"time"
 
 	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
 	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"github.com/maximeaubaret/go-tunnel/pkg/client"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
 	pb.UnimplementedTunnelServiceServer
 	manager *tunnel.TunnelManager
 	config  *ssh.ClientConfig
+	keys    *sshauth.Keys // Used by config
+	configs sshConfigs    // Per user and key, see hostConfig
+	logs    *logBuffer
+	redact  *redactor // nil unless the logs are redacted
+
+	startedAt  time.Time
+	executable string           // Resolved at startup, as an upgrade moves the running binary away
+	handoff    handoff          // Requests of the tunnels, see RestartDaemon
+	restart    chan restoreFile // Carries the tunnels to hand over
 }
 
 func (s *server) CreateTunnel(ctx context.Context, req *pb.CreateTunnelRequest) (*pb.CreateTunnelResponse, error) {
+	family, err := tunnel.ParseAddressFamily(req.AddressFamily)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	preCheck, err := tunnel.ParsePreCheck(req.PreCheck)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ifExists, err := tunnel.ParseExistsPolicy(req.IfExists)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	logLevel, err := tunnel.ParseLogLevel(req.LogLevel)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	opts := tunnel.Options{
+		Labels: req.Labels,
+		Family: family,
+		Bind:   req.BindAddresses,
+
+		ProxyProtocol: req.ProxyProtocol,
+		Nagle:         req.Nagle,
+		AcceptRate:    int(req.AcceptRate),
+		HoldWhileDown: req.HoldWhileDown,
+		IdleTimeout:   time.Duration(req.IdleTimeoutMs) * time.Millisecond,
+		OnOpen:        req.OnOpen,
+		OnClose:       req.OnClose,
+		PreCheck:      preCheck,
+		IfExists:      ifExists,
+		LogLevel:      logLevel,
+	}
+	if policy := req.ReconnectPolicy; policy != nil {
+		giveUp, err := tunnel.ParseGiveUpAction(policy.OnGiveUp)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if policy.MaxRetries < 0 || policy.WindowMs < 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid reconnect policy: negative retries or window")
+		}
+		backoff := s.manager.Reconnect
+		backoff.MaxRetries = int(policy.MaxRetries)
+		backoff.Window = time.Duration(policy.WindowMs) * time.Millisecond
+		backoff.GiveUp = giveUp
+		opts.Reconnect = &backoff
+		opts.Supervised = policy.Supervised
+	}
+	if retry := req.DialRetry; retry != nil {
+		if retry.Attempts < 0 || retry.BackoffMs < 0 || retry.TimeoutMs < 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid dial retry: negative attempts, backoff or timeout")
+		}
+		dialRetry := s.manager.DialRetry
+		if retry.Attempts > 0 {
+			dialRetry.Attempts = int(retry.Attempts)
+		}
+		if retry.BackoffMs > 0 {
+			dialRetry.Backoff = time.Duration(retry.BackoffMs) * time.Millisecond
+		}
+		if retry.TimeoutMs > 0 {
+			dialRetry.Timeout = time.Duration(retry.TimeoutMs) * time.Millisecond
+		}
+		dialRetry.FailFast = retry.FailFast
+		opts.DialRetry = &dialRetry
+	}
+	if req.AcceptRate < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid accept rate: negative rate")
+	}
+	if req.IdleTimeoutMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid idle timeout: negative duration")
+	}
+	if req.TtlMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid TTL: negative duration")
+	}
+	opts.TTL = time.Duration(req.TtlMs) * time.Millisecond
+	if req.OwnerPid != 0 && !tunnel.ProcessRunning(int(req.OwnerPid)) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid owner: process %d is not running", req.OwnerPid)
+	}
+	opts.OwnerPID = int(req.OwnerPid)
+	if k := req.Keepalive; k != nil {
+		if k.IntervalMs < 0 || k.CountMax < 0 || k.TimeoutMs < 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid keepalive: negative interval, count or timeout")
+		}
+		keepAlive := s.manager.KeepAlive
+		if k.IntervalMs > 0 {
+			keepAlive.Interval = time.Duration(k.IntervalMs) * time.Millisecond
+		}
+		if k.CountMax > 0 {
+			keepAlive.CountMax = int(k.CountMax)
+		}
+		if k.TimeoutMs > 0 {
+			keepAlive.Timeout = time.Duration(k.TimeoutMs) * time.Millisecond
+		}
+		if k.Disabled {
+			keepAlive.Interval = 0
+		}
+		opts.KeepAlive = &keepAlive
+	}
+	config, err := s.hostConfig(req.Host, req.Ssh, &opts)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	// Tell apart a kept or replaced tunnel by its ID
+	var previousID string
+	if t, err := s.manager.GetTunnel(req.Host, int(req.RemotePort), int(req.LocalPort)); err == nil {
+		previousID = t.ID
+	}
+
 	log.Printf("Creating tunnel: %s:%d -> localhost:%d", req.Host, req.RemotePort, req.LocalPort)
-	err := s.manager.CreateTunnel(req.Host, int(req.LocalPort), int(req.RemotePort), s.config)
+	err = s.manager.CreateTunnel(ctx, req.Host, int(req.LocalPort), int(req.RemotePort), config, opts)
 	if err != nil {
-		return &pb.CreateTunnelResponse{
-			Success: false,
-			Error:   err.Error(),
-		}, nil
+		return nil, rpcError(err)
 	}
-	return &pb.CreateTunnelResponse{
-		Success: true,
-	}, nil
+
+	resp := &pb.CreateTunnelResponse{Action: "created"}
+	if t, err := s.manager.GetTunnel(req.Host, int(req.RemotePort), int(req.LocalPort)); err == nil {
+		switch {
+		case previousID == "":
+		case t.ID == previousID:
+			resp.Action = "kept"
+			return resp, nil
+		default:
+			resp.Action = "replaced"
+		}
+		s.remember(t.ID, req)
+		resp.Warnings = t.Warnings
+		for _, warning := range t.Warnings {
+			log.Printf("[%s:%d] Warning: %s", req.Host, req.RemotePort, warning)
+		}
+	}
+	return resp, nil
 }
 
 func (s *server) CloseTunnel(ctx context.Context, req *pb.CloseTunnelRequest) (*pb.CloseTunnelResponse, error) {
-	log.Printf("Closing tunnel: %s:%d", req.Host, req.RemotePort)
-	err := s.manager.CloseTunnel(req.Host, int(req.RemotePort))
+	drain := tunnel.DefaultDrainTimeout
+	if req.DrainTimeoutMs > 0 {
+		drain = time.Duration(req.DrainTimeoutMs) * time.Millisecond
+	}
+	if req.Force {
+		drain = 0
+	}
+
+	var result tunnel.CloseResult
+	var err error
+	switch {
+	case req.Id != "":
+		log.Printf("Closing tunnel: %s", req.Id)
+		result, err = s.manager.CloseTunnelByID(req.Id, drain)
+	case req.LocalPort != 0 && req.Host == "":
+		log.Printf("Closing tunnel: localhost:%d", req.LocalPort)
+		result, err = s.manager.CloseTunnelByLocalPort(int(req.LocalPort), drain)
+	default:
+		log.Printf("Closing tunnel: %s:%d", req.Host, req.RemotePort)
+		result, err = s.manager.CloseTunnel(req.Host, int(req.RemotePort), int(req.LocalPort), drain)
+	}
 	if err != nil {
-		return &pb.CloseTunnelResponse{
-			Success: false,
-			Error:   err.Error(),
-		}, nil
+		return nil, rpcError(err)
 	}
 	return &pb.CloseTunnelResponse{
-		Success: true,
+		Drained: int32(result.Drained),
+		Cut:     int32(result.Cut),
 	}, nil
 }
 
+// ApplyTunnels reconciles the active tunnels with the declared ones: missing
+// tunnels are created, existing ones are left untouched and, when pruning,
+// undeclared ones are closed.
+func (s *server) ApplyTunnels(ctx context.Context, req *pb.ApplyTunnelsRequest) (*pb.ApplyTunnelsResponse, error) {
+	active := make(map[string]*tunnel.Tunnel)
+	for _, t := range s.manager.ListTunnels() {
+		active[tunnel.TunnelKey(t.Host, t.RemotePort, t.LocalPort)] = t
+	}
+
+	resp := &pb.ApplyTunnelsResponse{Success: true}
+	declared := make(map[string]bool)
+	for _, spec := range req.Tunnels {
+		k := tunnel.TunnelKey(spec.Host, int(spec.RemotePort), int(spec.LocalPort))
+		declared[k] = true
+		s.redact.add("host", spec.Host)
+
+		result := &pb.ApplyTunnelsResponse_Result{Tunnel: spec}
+		if _, exists := active[k]; exists {
+			result.Action = "unchanged"
+		} else {
+			log.Printf("Creating tunnel: %s:%d -> localhost:%d", spec.Host, spec.RemotePort, spec.LocalPort)
+			var opts tunnel.Options
+			config, err := s.hostConfig(spec.Host, nil, &opts)
+			if err == nil {
+				err = s.manager.CreateTunnel(ctx, spec.Host, int(spec.LocalPort), int(spec.RemotePort), config, opts)
+			}
+			if err != nil {
+				result.Action = "failed"
+				result.Error = err.Error()
+				_, result.Reason = errorReason(err)
+				result.Hint = errorHints[result.Reason]
+				resp.Success = false
+			} else {
+				result.Action = "created"
+			}
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	if req.Prune {
+		for k, t := range active {
+			if declared[k] {
+				continue
+			}
+
+			log.Printf("Pruning tunnel: %s:%d", t.Host, t.RemotePort)
+			result := &pb.ApplyTunnelsResponse_Result{
+				Tunnel: &pb.TunnelSpec{
+					Host:       t.Host,
+					LocalPort:  int32(t.LocalPort),
+					RemotePort: int32(t.RemotePort),
+				},
+				Action: "pruned",
+			}
+			if _, err := s.manager.CloseTunnel(t.Host, t.RemotePort, t.LocalPort, tunnel.DefaultDrainTimeout); err != nil {
+				result.Action = "failed"
+				result.Error = err.Error()
+				_, result.Reason = errorReason(err)
+				resp.Success = false
+			}
+			resp.Results = append(resp.Results, result)
+		}
+	}
+
+	return resp, nil
+}
+
 func (s *server) CloseAllTunnels(ctx context.Context, req *pb.CloseAllTunnelsRequest) (*pb.CloseAllTunnelsResponse, error) {
-	log.Printf("Closing all tunnels...")
-	count := s.manager.CloseAllTunnels()
+	var count int
+	if len(req.Labels) > 0 {
+		log.Printf("Closing tunnels labeled %v...", req.Labels)
+		count = s.manager.CloseTunnelsWithLabels(req.Labels)
+	} else {
+		log.Printf("Closing all tunnels...")
+		count = s.manager.CloseAllTunnels()
+	}
 	log.Printf("Closed %d tunnel(s)", count)
 	return &pb.CloseAllTunnelsResponse{
-		Success: true,
-		Count:   int32(count),
-		Error:   "",
+		Count: int32(count),
 	}, nil
 }
 
 func (s *server) ListTunnels(ctx context.Context, req *pb.ListTunnelsRequest) (*pb.ListTunnelsResponse, error) {
+	return s.snapshot(req.Labels), nil
+}
+
+// Shortest time between two snapshots pushed on changes, so that busy tunnels
+// opening connections do not flood the watchers with the list of the tunnels
+const watchCoalesce = 200 * time.Millisecond
+
+func (s *server) WatchTunnels(req *pb.WatchTunnelsRequest, stream pb.TunnelService_WatchTunnelsServer) error {
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	events, unsubscribe := s.manager.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := stream.Send(s.snapshot(req.Labels)); err != nil {
+			return err
+		}
+		sent := time.Now()
+
+		// Push state changes right away, along with the ones following
+		// them within watchCoalesce
+		var changed <-chan time.Time
+	wait:
+		for {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-events:
+				if changed == nil {
+					changed = time.After(time.Until(sent.Add(watchCoalesce)))
+				}
+			case <-changed:
+				ticker.Reset(interval)
+				break wait
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// snapshot returns the current state of the tunnels matching the label
+// selector
+func (s *server) snapshot(labels map[string]string) *pb.ListTunnelsResponse {
 	tunnels := s.manager.ListTunnels()
 	var pbTunnels []*pb.ListTunnelsResponse_TunnelInfo
 
 	for _, t := range tunnels {
-		pbTunnels = append(pbTunnels, &pb.ListTunnelsResponse_TunnelInfo{
+		if !t.MatchLabels(labels) {
+			continue
+		}
+		pbTunnels = append(pbTunnels, tunnelInfo(t))
+	}
+
+	return &pb.ListTunnelsResponse{
+		Tunnels: pbTunnels,
+	}
+}
+
+func tunnelInfo(t *tunnel.Tunnel) *pb.ListTunnelsResponse_TunnelInfo {
+	var expiresAt int64
+	if !t.ExpiresAt.IsZero() {
+		expiresAt = t.ExpiresAt.Unix()
+	}
+	return &pb.ListTunnelsResponse_TunnelInfo{
+		Id:            t.ID,
+		Host:          t.Host,
+		Labels:        t.Labels,
+		Paused:        t.Paused(),
+		LocalPort:     int32(t.LocalPort),
+		RemotePort:    int32(t.RemotePort),
+		LastActivity:  t.LastActivity.Unix(),
+		CreatedAt:     t.CreatedAt.Unix(),
+		BytesSent:     t.BytesSent,
+		BytesReceived: t.BytesReceived,
+		BandwidthUp:   t.BandwidthUp,
+		BandwidthDown: t.BandwidthDown,
+		ActiveConns:   t.ActiveConns,
+		TotalConns:    t.TotalConns,
+
+		LatencyMs:         float64(t.Latency) / float64(time.Millisecond),
+		KeepaliveFailures: t.KeepAliveFailures,
+		Addresses:         t.Addresses,
+		ProxyProtocol:     t.ProxyProtocol,
+		Nagle:             t.Nagle,
+		AcceptRate:        int32(t.AcceptRate),
+		HoldWhileDown:     t.HoldWhileDown,
+		IdleTimeoutMs:     t.IdleTimeout.Milliseconds(),
+		LogLevel:          t.LogLevel().String(),
+		ReconnectPolicy: &pb.ReconnectPolicy{
+			Supervised: t.Supervised,
+			MaxRetries: int32(t.Reconnect.MaxRetries),
+			WindowMs:   t.Reconnect.Window.Milliseconds(),
+			OnGiveUp:   t.Reconnect.GiveUp.String(),
+		},
+		DialRetry: &pb.DialRetry{
+			Attempts:  int32(t.DialRetry.Attempts),
+			BackoffMs: t.DialRetry.Backoff.Milliseconds(),
+			TimeoutMs: t.DialRetry.Timeout.Milliseconds(),
+			FailFast:  t.DialRetry.FailFast,
+		},
+		ExpiresAt:   expiresAt,
+		OwnerPid:    int32(t.OwnerPID),
+		HostAddress: t.HostAddress,
+		Keepalive: &pb.KeepAlive{
+			IntervalMs: t.KeepAlive.Interval.Milliseconds(),
+			CountMax:   int32(t.KeepAlive.CountMax),
+			Disabled:   t.KeepAlive.Interval == 0,
+			TimeoutMs:  t.KeepAlive.Timeout.Milliseconds(),
+		},
+	}
+}
+
+func (s *server) GetTunnelStatus(ctx context.Context, req *pb.GetTunnelStatusRequest) (*pb.GetTunnelStatusResponse, error) {
+	status, err := s.manager.GetStatus(req.Host, int(req.RemotePort), int(req.LocalPort))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	resp := &pb.GetTunnelStatusResponse{
+		Tunnel:              tunnelInfo(status.Tunnel),
+		SshState:            status.State.String(),
+		LastReconnectReason: status.LastReconnectReason,
+		ReconnectAttempts:   int32(status.ReconnectAttempts),
+	}
+	if !status.LastReconnect.IsZero() {
+		resp.LastReconnect = status.LastReconnect.Unix()
+	}
+	if !status.NextReconnect.IsZero() {
+		resp.NextReconnect = status.NextReconnect.Unix()
+	}
+	for _, c := range status.Connections {
+		resp.Connections = append(resp.Connections, connectionInfo(c))
+	}
+	for _, e := range status.RecentErrors {
+		resp.RecentErrors = append(resp.RecentErrors, &pb.GetTunnelStatusResponse_ErrorInfo{
+			Timestamp: e.Time.Unix(),
+			Message:   e.Message,
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) GetTunnel(ctx context.Context, req *pb.GetTunnelRequest) (*pb.GetTunnelResponse, error) {
+	var t *tunnel.Tunnel
+	var err error
+	if req.Id != "" {
+		t, err = s.manager.GetTunnelByID(req.Id)
+	} else {
+		t, err = s.manager.GetTunnel(req.Host, int(req.RemotePort), int(req.LocalPort))
+	}
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.GetTunnelResponse{Tunnel: tunnelInfo(t)}, nil
+}
+
+func (s *server) PauseTunnel(ctx context.Context, req *pb.PauseTunnelRequest) (*pb.PauseTunnelResponse, error) {
+	log.Printf("Pausing tunnel: %s:%d", req.Host, req.RemotePort)
+	err := s.manager.PauseTunnel(req.Host, int(req.RemotePort), int(req.LocalPort), req.Sever)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.PauseTunnelResponse{}, nil
+}
+
+func (s *server) ResumeTunnel(ctx context.Context, req *pb.ResumeTunnelRequest) (*pb.ResumeTunnelResponse, error) {
+	log.Printf("Resuming tunnel: %s:%d", req.Host, req.RemotePort)
+	err := s.manager.ResumeTunnel(req.Host, int(req.RemotePort), int(req.LocalPort))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.ResumeTunnelResponse{}, nil
+}
+
+func (s *server) SetLogLevel(ctx context.Context, req *pb.SetLogLevelRequest) (*pb.SetLogLevelResponse, error) {
+	level, err := tunnel.ParseLogLevel(req.Level)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	err = s.manager.SetLogLevel(req.Host, int(req.RemotePort), int(req.LocalPort), level)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	if t, err := s.manager.GetTunnel(req.Host, int(req.RemotePort), int(req.LocalPort)); err == nil {
+		s.amend(t.ID, func(create *pb.CreateTunnelRequest) { create.LogLevel = req.Level })
+	}
+	return &pb.SetLogLevelResponse{}, nil
+}
+
+func (s *server) UpdateTunnel(ctx context.Context, req *pb.UpdateTunnelRequest) (*pb.UpdateTunnelResponse, error) {
+	if req.NewLocalPort < 0 || req.NewLocalPort > 65535 || req.NewRemotePort < 0 || req.NewRemotePort > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "invalid port: expected 1-65535")
+	}
+
+	log.Printf("Updating tunnel: %s:%d", req.Host, req.RemotePort)
+	update := tunnel.Update{
+		LocalPort:  int(req.NewLocalPort),
+		Bind:       req.NewBindAddresses,
+		RemotePort: int(req.NewRemotePort),
+	}
+	if len(update.Bind) == 0 {
+		update.Bind = nil
+	}
+	t, err := s.manager.UpdateTunnel(req.Host, int(req.RemotePort), int(req.LocalPort), update)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	if update.Bind != nil {
+		s.amend(t.ID, func(create *pb.CreateTunnelRequest) { create.BindAddresses = update.Bind })
+	}
+	return &pb.UpdateTunnelResponse{Tunnel: tunnelInfo(t)}, nil
+}
+
+func (s *server) GetVersion(ctx context.Context, req *pb.GetVersionRequest) (*pb.GetVersionResponse, error) {
+	if req.Protocol != version.Protocol {
+		log.Printf("Warning: client speaks protocol %d, daemon speaks %d", req.Protocol, version.Protocol)
+	}
+	return &pb.GetVersionResponse{
+		Version:    version.Version,
+		Commit:     version.Commit,
+		Date:       version.Date,
+		Protocol:   version.Protocol,
+		Executable: s.executable,
+	}, nil
+}
+
+func (s *server) GetDaemonStats(ctx context.Context, req *pb.GetDaemonStatsRequest) (*pb.GetDaemonStatsResponse, error) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	totals := s.manager.Totals()
+	return &pb.GetDaemonStatsResponse{
+		Version:           version.Version,
+		StartedAt:         s.startedAt.Unix(),
+		UptimeMs:          time.Since(s.startedAt).Milliseconds(),
+		Goroutines:        int32(runtime.NumGoroutine()),
+		HeapBytes:         mem.HeapAlloc,
+		ActiveTunnels:     int32(totals.ActiveTunnels),
+		TunnelsCreated:    totals.TunnelsCreated,
+		TunnelsClosed:     totals.TunnelsClosed,
+		TotalConns:        totals.Connections,
+		BytesSent:         totals.BytesSent,
+		BytesReceived:     totals.BytesReceived,
+		Reconnects:        totals.Reconnects,
+		ReconnectFailures: totals.ReconnectFailures,
+	}, nil
+}
+
+func (s *server) ListClosedTunnels(ctx context.Context, req *pb.ListClosedTunnelsRequest) (*pb.ListClosedTunnelsResponse, error) {
+	resp := &pb.ListClosedTunnelsResponse{}
+	for _, t := range s.manager.History() {
+		if req.Host != "" && t.Host != req.Host {
+			continue
+		}
+		if !t.MatchLabels(req.Labels) {
+			continue
+		}
+		resp.Tunnels = append(resp.Tunnels, &pb.ListClosedTunnelsResponse_ClosedTunnel{
+			Id:            t.ID,
 			Host:          t.Host,
 			LocalPort:     int32(t.LocalPort),
 			RemotePort:    int32(t.RemotePort),
-			LastActivity:  t.LastActivity.Unix(),
+			Labels:        t.Labels,
 			CreatedAt:     t.CreatedAt.Unix(),
+			ClosedAt:      t.ClosedAt.Unix(),
+			Reason:        t.Reason,
 			BytesSent:     t.BytesSent,
 			BytesReceived: t.BytesReceived,
-			BandwidthUp:   t.BandwidthUp,
-			BandwidthDown: t.BandwidthDown,
-			ActiveConns:   t.ActiveConns,
 			TotalConns:    t.TotalConns,
 		})
 	}
+	return resp, nil
+}
 
-	return &pb.ListTunnelsResponse{
-		Tunnels: pbTunnels,
-	}, nil
+func (s *server) ProbeTunnel(ctx context.Context, req *pb.ProbeTunnelRequest) (*pb.ProbeTunnelResponse, error) {
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	err := s.manager.Probe(req.Host, int(req.RemotePort), int(req.LocalPort), req.HttpPath, timeout)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &pb.ProbeTunnelResponse{}, nil
+}
+
+func (s *server) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.GetStatsResponse, error) {
+	if req.UsageSinceMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid usage duration: negative duration")
+	}
+	resp := &pb.GetStatsResponse{
+		IntervalMs:      int32(tunnel.HistoryInterval / time.Millisecond),
+		UsageIntervalMs: int32(tunnel.UsageInterval / time.Millisecond),
+	}
+	for _, t := range s.manager.ListTunnels() {
+		if req.Host != "" && t.Host != req.Host {
+			continue
+		}
+		if !t.MatchLabels(req.Labels) {
+			continue
+		}
+
+		stats := &pb.GetStatsResponse_TunnelStats{
+			Tunnel: tunnelInfo(t),
+		}
+		for _, sample := range t.History() {
+			stats.Samples = append(stats.Samples, &pb.GetStatsResponse_Sample{
+				Timestamp:     sample.Time.Unix(),
+				BandwidthUp:   sample.Up,
+				BandwidthDown: sample.Down,
+			})
+		}
+		if req.UsageSinceMs > 0 {
+			since := time.Now().Add(-time.Duration(req.UsageSinceMs) * time.Millisecond)
+			for _, sample := range t.Usage(since) {
+				stats.Usage = append(stats.Usage, &pb.GetStatsResponse_UsageSample{
+					Timestamp:     sample.Time.Unix(),
+					BytesSent:     sample.BytesSent,
+					BytesReceived: sample.BytesReceived,
+					ActiveConns:   sample.ActiveConns,
+					NewConns:      sample.NewConns,
+				})
+			}
+		}
+		resp.Tunnels = append(resp.Tunnels, stats)
+	}
+	return resp, nil
+}
+
+func (s *server) ListConnections(ctx context.Context, req *pb.ListConnectionsRequest) (*pb.ListConnectionsResponse, error) {
+	conns, err := s.manager.ListConnections(req.Host, int(req.RemotePort), int(req.LocalPort))
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	resp := &pb.ListConnectionsResponse{}
+	for _, c := range conns {
+		resp.Connections = append(resp.Connections, connectionInfo(c))
+	}
+	return resp, nil
+}
+
+func connectionInfo(c tunnel.Connection) *pb.GetTunnelStatusResponse_ConnectionInfo {
+	return &pb.GetTunnelStatusResponse_ConnectionInfo{
+		Id:            c.ID,
+		SourceAddress: c.SourceAddr,
+		Destination:   c.Destination,
+		StartedAt:     c.StartedAt.Unix(),
+		BytesSent:     c.BytesSent,
+		BytesReceived: c.BytesReceived,
+		BandwidthUp:   c.BandwidthUp,
+		BandwidthDown: c.BandwidthDown,
+	}
+}
+
+// Default duration of a traffic capture
+const defaultCaptureDuration = 30 * time.Second
+
+var captureKinds = map[tunnel.CaptureKind]pb.CaptureKind{
+	tunnel.CaptureData:   pb.CaptureKind_CAPTURE_DATA,
+	tunnel.CaptureOpened: pb.CaptureKind_CAPTURE_OPENED,
+	tunnel.CaptureClosed: pb.CaptureKind_CAPTURE_CLOSED,
+}
+
+func (s *server) CaptureTraffic(req *pb.CaptureTrafficRequest, stream pb.TunnelService_CaptureTrafficServer) error {
+	duration := defaultCaptureDuration
+	if req.DurationMs > 0 {
+		duration = time.Duration(req.DurationMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(stream.Context(), duration)
+	defer cancel()
+
+	records, err := s.manager.Capture(ctx, req.Host, int(req.RemotePort), int(req.LocalPort), int(req.MaxBytes))
+	if err != nil {
+		return rpcError(err)
+	}
+
+	log.Printf("Capturing traffic of %s:%d for %s", req.Host, req.RemotePort, duration)
+	for r := range records {
+		err := stream.Send(&pb.CaptureRecord{
+			Kind:          captureKinds[r.Kind],
+			ConnectionId:  r.ConnectionID,
+			TimestampUs:   r.Time.UnixMicro(),
+			ClientAddress: r.ClientAddr,
+			LocalAddress:  r.LocalAddr,
+			Upload:        r.Upload,
+			Data:          r.Data,
+		})
+		if err != nil {
+			// Stop the capture, and let the channel be closed
+			cancel()
+			for range records {
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+var eventTypes = map[tunnel.EventType]pb.EventType{
+	tunnel.EventTunnelCreated:      pb.EventType_EVENT_TUNNEL_CREATED,
+	tunnel.EventTunnelClosed:       pb.EventType_EVENT_TUNNEL_CLOSED,
+	tunnel.EventReconnectStarted:   pb.EventType_EVENT_RECONNECT_STARTED,
+	tunnel.EventReconnectSucceeded: pb.EventType_EVENT_RECONNECT_SUCCEEDED,
+	tunnel.EventReconnectFailed:    pb.EventType_EVENT_RECONNECT_FAILED,
+	tunnel.EventConnectionOpened:   pb.EventType_EVENT_CONNECTION_OPENED,
+	tunnel.EventConnectionClosed:   pb.EventType_EVENT_CONNECTION_CLOSED,
+	tunnel.EventError:              pb.EventType_EVENT_ERROR,
+	tunnel.EventTunnelPaused:       pb.EventType_EVENT_TUNNEL_PAUSED,
+	tunnel.EventTunnelResumed:      pb.EventType_EVENT_TUNNEL_RESUMED,
+}
+
+func (s *server) SubscribeEvents(req *pb.SubscribeEventsRequest, stream pb.TunnelService_SubscribeEventsServer) error {
+	events, unsubscribe := s.manager.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			err := stream.Send(&pb.Event{
+				Type:       eventTypes[ev.Type],
+				TunnelId:   ev.ID,
+				Host:       ev.Host,
+				LocalPort:  int32(ev.LocalPort),
+				RemotePort: int32(ev.RemotePort),
+				Message:    ev.Message,
+				Timestamp:  ev.Time.Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *server) StreamLogs(req *pb.StreamLogsRequest, stream pb.TunnelService_StreamLogsServer) error {
+	entries, live, unsubscribe := s.logs.subscribe()
+	defer unsubscribe()
+
+	match := hostFilter(s.redact.name(req.Host))
+	send := func(e logEntry) error {
+		return stream.Send(&pb.LogEntry{
+			Timestamp: e.Time.Unix(),
+			Message:   e.Message,
+		})
+	}
+
+	var backlog []logEntry
+	for _, e := range entries {
+		if match(e.Message) {
+			backlog = append(backlog, e)
+		}
+	}
+	if req.Tail > 0 && len(backlog) > int(req.Tail) {
+		backlog = backlog[len(backlog)-int(req.Tail):]
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return err
+		}
+	}
+
+	if !req.Follow {
+		return nil
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-live:
+			if !match(e.Message) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+	}
 }
 
 func main() {
-	socketPath := "/tmp/tunnel.sock"
+	socketPath := flag.String("socket", client.Socket(), "Unix socket or loopback tcp://host:port to listen on, also set with $"+client.SocketEnv)
+	flag.StringVar(socketPath, "S", client.Socket(), "Shorthand for -socket")
 	showVersion := flag.Bool("version", false, "Show version information")
+	bufferSize := flag.Int("buffer-size", tunnel.DefaultBufferSize, "Size in bytes of the buffers used to forward connections")
+	bindHelper := flag.String("bind-helper", tunnel.BindHelperName, "Helper binding the local ports below 1024, a path or a name looked up next to tunneld and in PATH, empty to disable")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close connections without traffic for this long, 0 to keep them open")
+	maxSession := flag.Duration("max-session", 0, "Close connections open for this long, 0 for no limit")
+	logLevel := flag.String("log-level", "info", "How much the tunnels which do not set their own level log: error, info or debug")
+	acceptRate := flag.Int("accept-rate", 0, "New connections accepted per second by each tunnel which does not set its own rate, 0 for no limit")
+	reconnectDelay := flag.Duration("reconnect-delay", tunnel.DefaultBackoff.Initial, "Delay before retrying a failed SSH reconnection, doubled after each attempt")
+	reconnectMaxDelay := flag.Duration("reconnect-max-delay", tunnel.DefaultBackoff.Max, "Maximum delay between two SSH reconnection attempts")
+	reconnectRetries := flag.Int("reconnect-retries", tunnel.DefaultBackoff.MaxRetries, "SSH reconnection attempts before giving up, 0 to retry forever")
+	keepAliveInterval := flag.Duration("keepalive-interval", tunnel.DefaultKeepAlive.Interval, "Interval between two SSH keepalive requests, 0 to only rely on TCP keepalives")
+	keepAliveCountMax := flag.Int("keepalive-count-max", tunnel.DefaultKeepAlive.CountMax, "Consecutive failed SSH keepalive requests before reconnecting")
+	keepAliveTimeout := flag.Duration("keepalive-timeout", tunnel.DefaultKeepAlive.Timeout, "How long to wait for the answer to an SSH keepalive request, also used to check the connection after a failed remote dial")
+	connectTimeout := flag.Duration("connect-timeout", tunnel.DefaultConnectTimeout, "Timeout of the TCP connection to the SSH servers")
+	handshakeTimeout := flag.Duration("handshake-timeout", 0, "Timeout of the SSH handshake and authentication, 0 for no limit")
+	watchNetwork := flag.Bool("watch-network", true, "Reconnect the tunnels as soon as the system wakes up from sleep or its network changes")
+	dialTimeout := flag.Duration("dial-timeout", tunnel.DefaultDialRetry.Timeout, "Timeout of each forwarded connection to reach the remote service, including the wait for SSH to reconnect")
+	httpAddr := flag.String("http", "", "Also serve the REST API on this address, such as localhost:8080")
+	var webhookURLs stringsFlag
+	flag.Var(&webhookURLs, "webhook", "URL to POST tunnel events to (can be repeated)")
+	webhookFormat := flag.String("webhook-format", "json", "Payload of the webhooks: json, or slack for a Slack-compatible message")
+	webhookEvents := flag.String("webhook-events", defaultWebhookEvents, "Comma-separated events sent to the webhooks")
+	redactLogs := flag.Bool("redact", false, "Hash the hostnames and usernames, and mask the IP addresses, of the logs so that they can be shared")
+	webhookTemplate := flag.String("webhook-template", defaultWebhookTemplate, "Go template of the webhook message, with .Event, .ID, .Host, .LocalPort, .RemotePort, .Message and .Time")
 	flag.Parse()
 
 	if *showVersion {
@@ -100,102 +817,193 @@ func main() {
 		return
 	}
 
+	if err := tunnel.SetBufferSize(*bufferSize); err != nil {
+		log.Fatalf("failed to configure forwarding buffers: %v", err)
+	}
+	tunnel.SetBindHelper(*bindHelper)
+
+	// Keep recent log lines in memory so they can be streamed to the CLI
+	logs := newLogBuffer()
+	var logOutput io.Writer = io.MultiWriter(os.Stderr, logs)
+	var redact *redactor
+	if *redactLogs {
+		redact = newRedactor(logOutput)
+		if u, err := user.Current(); err == nil {
+			redact.add("user", u.Username)
+		}
+		logOutput = redact
+	}
+	log.SetOutput(logOutput)
+
 	// Cleanup any existing socket file
-	if err := os.RemoveAll(socketPath); err != nil {
-		log.Printf("Warning: could not remove existing socket: %v", err)
+	network, _ := client.Network(*socketPath)
+	if network == "unix" {
+		if err := os.RemoveAll(*socketPath); err != nil {
+			log.Printf("Warning: could not remove existing socket: %v", err)
+		}
 	}
 
 	// Load SSH config (you might want to make this configurable)
-	config := &ssh.ClientConfig{
-		User: os.Getenv("USER"),
-		Auth: []ssh.AuthMethod{
-			getSSHAuth(),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
+	keys := sshauth.DefaultKeys()
+	config := keys.ClientConfig()
 
-	lis, err := net.Listen("unix", socketPath)
+	lis, err := client.Listen(*socketPath)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	pb.RegisterTunnelServiceServer(s, &server{
-		manager: tunnel.NewTunnelManager(),
-		config:  config,
-	})
-
-	// Handle shutdown gracefully
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-		s.GracefulStop()
-		// Cleanup socket file on shutdown
-		if err := os.RemoveAll(socketPath); err != nil {
-			log.Printf("Warning: could not remove socket file on shutdown: %v", err)
-		}
-	}()
+	manager := tunnel.NewTunnelManager()
+	manager.IdleTimeout = *idleTimeout
+	manager.MaxSession = *maxSession
+	if *acceptRate < 0 {
+		log.Fatalf("invalid accept rate: -accept-rate cannot be negative")
+	}
+	manager.AcceptRate = *acceptRate
+	if manager.LogLevel, err = tunnel.ParseLogLevel(*logLevel); err != nil || manager.LogLevel == tunnel.LogDefault {
+		log.Fatalf("invalid log level: -log-level must be error, info or debug")
+	}
+	if *reconnectDelay <= 0 || *reconnectMaxDelay < *reconnectDelay || *reconnectRetries < 0 {
+		log.Fatalf("invalid reconnection policy: -reconnect-delay must be positive, at most -reconnect-max-delay, and -reconnect-retries not negative")
+	}
+	manager.Reconnect = tunnel.Backoff{
+		Initial:    *reconnectDelay,
+		Max:        *reconnectMaxDelay,
+		MaxRetries: *reconnectRetries,
+	}
+	if *keepAliveInterval < 0 || *keepAliveCountMax < 1 || *keepAliveTimeout <= 0 {
+		log.Fatalf("invalid keepalive settings: -keepalive-interval cannot be negative, -keepalive-count-max must be at least 1 and -keepalive-timeout positive")
+	}
+	manager.KeepAlive = tunnel.KeepAlive{
+		Interval: *keepAliveInterval,
+		CountMax: *keepAliveCountMax,
+		Timeout:  *keepAliveTimeout,
+	}
+	if *connectTimeout <= 0 || *handshakeTimeout < 0 || *dialTimeout <= 0 {
+		log.Fatalf("invalid timeouts: -connect-timeout and -dial-timeout must be positive, -handshake-timeout not negative")
+	}
+	manager.ConnectTimeout = *connectTimeout
+	manager.HandshakeTimeout = *handshakeTimeout
+	manager.DialRetry.Timeout = *dialTimeout
 
-	log.Printf("Server listening at %v", lis.Addr())
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	if *watchNetwork {
+		go manager.WatchNetwork(context.Background())
 	}
-}
 
-func getSSHAuth() ssh.AuthMethod {
-	// Check for custom SSH key path first
-	if keyPath := os.Getenv("SSH_KEY_PATH"); keyPath != "" {
-		if auth := tryLoadKey(keyPath); auth != nil {
-			return auth
+	if len(webhookURLs) > 0 {
+		hooks, err := newWebhooks(webhookURLs, *webhookFormat, *webhookEvents, *webhookTemplate)
+		if err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("Warning: couldn't use specified SSH_KEY_PATH: %s", keyPath)
+		go hooks.run(manager)
 	}
 
-	// Common key file names to try
-	keyFiles := []string{
-		"id_ed25519", // Preferred modern key type
-		"id_rsa",     // Common RSA key
-		"id_ecdsa",   // ECDSA key
+	srv := &server{
+		manager: manager,
+		config:  config,
+		keys:    keys,
+		logs:    logs,
+		redact:  redact,
+
+		startedAt: time.Now(),
+		restart:   make(chan restoreFile, 1),
+	}
+	if srv.executable, err = os.Executable(); err != nil {
+		log.Printf("Warning: could not find the binary of the daemon, it cannot restart: %v", err)
+	}
+	userConfig, err := userconfig.Load()
+	if err != nil {
+		log.Fatalf("failed to read the user config: %v", err)
+	}
+	auth, err := newAuthenticator(userConfig)
+	if err != nil {
+		log.Fatalf("invalid API tokens in %s: %v", userconfig.Path(), err)
+	}
+	var serverOptions []grpc.ServerOption
+	if auth != nil {
+		serverOptions = auth.serverOptions()
+		log.Printf("API calls need one of the %d token(s) of %s", len(auth.tokens), userconfig.Path())
 	}
 
-	sshDir := os.ExpandEnv("$HOME/.ssh")
-	for _, keyFile := range keyFiles {
-		keyPath := filepath.Join(sshDir, keyFile)
-		if auth := tryLoadKey(keyPath); auth != nil {
-			return auth
-		}
+	if *httpAddr != "" {
+		serveGateway(*httpAddr, srv, auth)
 	}
 
-	log.Printf("Warning: no valid SSH keys found in %s", sshDir)
-	return nil
-}
+	// Create again the tunnels of the process this one replaces
+	if path := os.Getenv(restoreEnv); path != "" {
+		key := os.Getenv(restoreKeyEnv)
+		os.Unsetenv(restoreEnv)
+		os.Unsetenv(restoreKeyEnv)
+		go srv.restoreTunnels(restoreFile{path: path, key: key})
+	}
 
-func tryLoadKey(keyPath string) ssh.AuthMethod {
-	key, err := os.ReadFile(keyPath)
-	if err != nil {
-		// Skip logging for non-existent files
-		if !os.IsNotExist(err) {
-			log.Printf("Warning: couldn't read SSH key %s: %v", keyPath, err)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		s, healthServer := newGRPCServer(srv, serverOptions)
+
+		// Handle shutdown gracefully, then tell whether to restart
+		stopped := make(chan restoreFile, 1)
+		go func() {
+			var restore restoreFile
+			select {
+			case <-sigChan:
+			case restore = <-srv.restart:
+			}
+			healthServer.Shutdown()
+			if restore.path == "" {
+				s.GracefulStop()
+			} else {
+				// Let the answer of RestartDaemon go out, without waiting
+				// for the streams which never end
+				graceful := make(chan struct{})
+				go func() {
+					s.GracefulStop()
+					close(graceful)
+				}()
+				select {
+				case <-graceful:
+				case <-time.After(restartGrace):
+					s.Stop()
+				}
+			}
+			stopped <- restore
+		}()
+
+		log.Printf("Server listening at %v", lis.Addr())
+		if err := s.Serve(lis); err != nil {
+			log.Fatalf("failed to serve: %v", err)
 		}
-		return nil
-	}
+		restore := <-stopped
 
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		// Try parsing with passphrase if available
-		if passphrase := os.Getenv("SSH_KEY_PASSPHRASE"); passphrase != "" {
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
-			if err != nil {
-				log.Printf("Warning: couldn't parse SSH key %s with passphrase: %v", keyPath, err)
-				return nil
+		// Cleanup socket file on shutdown
+		if network == "unix" {
+			if err := os.RemoveAll(*socketPath); err != nil {
+				log.Printf("Warning: could not remove socket file on shutdown: %v", err)
 			}
-		} else {
-			log.Printf("Warning: couldn't parse SSH key %s (set SSH_KEY_PASSPHRASE if key is encrypted): %v", keyPath, err)
-			return nil
+		}
+		if restore.path == "" {
+			return
+		}
+
+		// The tunnels are still there when the new binary fails to start
+		err := execDaemon(srv.executable, restartEnv(restore))
+		log.Printf("Failed to restart with %s, serving again: %v", srv.executable, err)
+		os.Remove(restore.path)
+		if lis, err = client.Listen(*socketPath); err != nil {
+			log.Fatalf("failed to listen: %v", err)
 		}
 	}
+}
 
-	log.Printf("Successfully loaded SSH key: %s", keyPath)
-	return ssh.PublicKeys(signer)
+// newGRPCServer returns the gRPC server of the API of srv, along with the
+// health service telling it is serving
+func newGRPCServer(srv *server, options []grpc.ServerOption) (*grpc.Server, *health.Server) {
+	s := grpc.NewServer(options...)
+	pb.RegisterTunnelServiceServer(s, srv)
+	// Let generic tools such as grpcurl and health probes inspect the daemon
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(pb.TunnelService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+	reflection.Register(s)
+	return s, healthServer
 }
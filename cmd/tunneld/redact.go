@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	ipv6Pattern = regexp.MustCompile(`\b[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4}){2,7}\b`)
+)
+
+// redactor is an io.Writer masking the hostnames, usernames and IP addresses
+// of the log lines written through it, so that logs can be shared in bug
+// reports. Names become a hash, keyed per daemon so that short names cannot
+// be guessed, and consistent within its logs. Addresses keep their first
+// part, except loopback ones which are left as is.
+type redactor struct {
+	w     io.Writer
+	key   []byte
+	names map[string]string // Replacement of every name, see add
+	re    *regexp.Regexp    // Matches the names, nil without names
+	mu    sync.RWMutex
+}
+
+func newRedactor(w io.Writer) *redactor {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &redactor{w: w, key: key, names: make(map[string]string)}
+}
+
+// add masks name from now on, as kind-<hash>, unless it is localhost or an
+// address. A nil redactor does nothing.
+func (r *redactor) add(kind, name string) {
+	if r == nil || name == "" || name == "localhost" || net.ParseIP(name) != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[name]; ok {
+		return
+	}
+	r.names[name] = r.hash(kind, name)
+
+	// Longest first, so that a name containing another one wins
+	names := make([]string, 0, len(r.names))
+	for n := range r.names {
+		names = append(names, regexp.QuoteMeta(n))
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	r.re = regexp.MustCompile(`\b(` + strings.Join(names, "|") + `)\b`)
+}
+
+// hash returns the replacement of name
+func (r *redactor) hash(kind, name string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(name))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil))[:6]
+}
+
+// name returns how host appears in the logs
+func (r *redactor) name(host string) string {
+	if r == nil {
+		return host
+	}
+	return r.redact(host)
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redact masks the names and addresses of s
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	if r.re != nil {
+		s = r.re.ReplaceAllStringFunc(s, func(name string) string { return r.names[name] })
+	}
+	r.mu.RUnlock()
+
+	s = ipv4Pattern.ReplaceAllStringFunc(s, maskIP)
+	return ipv6Pattern.ReplaceAllStringFunc(s, maskIP)
+}
+
+// maskIP keeps the first part of an address, 10.x.x.x or 2001:x, and leaves
+// loopback and unspecified addresses, and what is not an address, as is
+func maskIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return s
+	}
+	if ip.To4() != nil {
+		first, _, _ := strings.Cut(s, ".")
+		return first + ".x.x.x"
+	}
+	first, _, _ := strings.Cut(s, ":")
+	return first + ":x"
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Environment variables giving a restarted daemon the file of the tunnels to
+// create again, and the key it is encrypted with
+const (
+	restoreEnv    = "TUNNELD_RESTORE"
+	restoreKeyEnv = "TUNNELD_RESTORE_KEY"
+)
+
+// How long a restart waits for the calls in progress before cutting them
+const restartGrace = time.Second
+
+// handoff keeps the requests which created the tunnels, so that a restarted
+// daemon can create them again with the same settings
+type handoff struct {
+	requests map[string]*pb.CreateTunnelRequest // By tunnel ID
+	mu       sync.Mutex
+}
+
+// remember records the request which created the tunnel id, and forgets the
+// tunnels which are gone
+func (s *server) remember(id string, req *pb.CreateTunnelRequest) {
+	active := make(map[string]bool)
+	for _, t := range s.manager.ListTunnels() {
+		active[t.ID] = true
+	}
+
+	s.handoff.mu.Lock()
+	defer s.handoff.mu.Unlock()
+	if s.handoff.requests == nil {
+		s.handoff.requests = make(map[string]*pb.CreateTunnelRequest)
+	}
+	for known := range s.handoff.requests {
+		if !active[known] {
+			delete(s.handoff.requests, known)
+		}
+	}
+	s.handoff.requests[id] = proto.Clone(req).(*pb.CreateTunnelRequest)
+}
+
+// amend changes the request recorded for the tunnel id, after a change of
+// its settings
+func (s *server) amend(id string, change func(req *pb.CreateTunnelRequest)) {
+	s.handoff.mu.Lock()
+	defer s.handoff.mu.Unlock()
+	if req := s.handoff.requests[id]; req != nil {
+		change(req)
+	}
+}
+
+// restoreRequest returns the request creating t again. Tunnels created
+// without a request, from a file, only keep their ports and labels.
+func (s *server) restoreRequest(t *tunnel.Tunnel) *pb.CreateTunnelRequest {
+	req := &pb.CreateTunnelRequest{}
+	s.handoff.mu.Lock()
+	if known := s.handoff.requests[t.ID]; known != nil {
+		req = proto.Clone(known).(*pb.CreateTunnelRequest)
+	}
+	s.handoff.mu.Unlock()
+
+	req.Host = t.Host
+	req.LocalPort = int32(t.LocalPort)
+	req.RemotePort = int32(t.RemotePort)
+	req.Labels = t.Labels
+	req.IfExists = ""
+	if !t.ExpiresAt.IsZero() {
+		req.TtlMs = max(time.Until(t.ExpiresAt).Milliseconds(), 1)
+	}
+	return req
+}
+
+// RestartDaemon hands the tunnels over to a new process running the current
+// binary of the daemon, typically after an upgrade. The connections in
+// progress are cut, the new process connects the tunnels again.
+func (s *server) RestartDaemon(ctx context.Context, req *pb.RestartDaemonRequest) (*pb.RestartDaemonResponse, error) {
+	if runtime.GOOS == "windows" {
+		return nil, status.Error(codes.Unimplemented, "restarting is not supported on Windows, restart tunneld by hand")
+	}
+	if _, err := os.Stat(s.executable); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to find the binary of the daemon: %v", err)
+	}
+
+	restore := &pb.CreateTunnelsRequest{}
+	for _, t := range s.manager.ListTunnels() {
+		restore.Tunnels = append(restore.Tunnels, s.restoreRequest(t))
+	}
+	file, err := writeRestore(restore)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save the tunnels: %v", err)
+	}
+
+	log.Printf("Restarting with %s, handing over %d tunnel(s)", s.executable, len(restore.Tunnels))
+	select {
+	case s.restart <- file:
+	default:
+		os.Remove(file.path)
+		return nil, status.Error(codes.FailedPrecondition, "the daemon is already restarting")
+	}
+	return &pb.RestartDaemonResponse{Tunnels: int32(len(restore.Tunnels))}, nil
+}
+
+// restoreFile is a file holding the tunnels to create again, encrypted
+// with key, which only goes to the new process through its environment
+type restoreFile struct {
+	path string
+	key  string // Base64 AES-256 key
+}
+
+// writeRestore saves the tunnels to create again to a file only readable by
+// the user. It is encrypted with a new key, as the settings of the tunnels
+// may hold the passwords of proxies, and it is left behind when the new
+// process fails to start.
+func writeRestore(restore *pb.CreateTunnelsRequest) (restoreFile, error) {
+	data, err := protojson.Marshal(restore)
+	if err != nil {
+		return restoreFile{}, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return restoreFile{}, err
+	}
+	aead, err := restoreCipher(key)
+	if err != nil {
+		return restoreFile{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return restoreFile{}, err
+	}
+
+	f, err := os.CreateTemp("", "tunneld-restore-*")
+	if err != nil {
+		return restoreFile{}, err
+	}
+	defer f.Close()
+	if _, err := f.Write(aead.Seal(nonce, nonce, data, nil)); err != nil {
+		os.Remove(f.Name())
+		return restoreFile{}, err
+	}
+	return restoreFile{path: f.Name(), key: base64.StdEncoding.EncodeToString(key)}, nil
+}
+
+// readRestore decrypts the tunnels of a restore file
+func readRestore(file restoreFile) (*pb.CreateTunnelsRequest, error) {
+	data, err := os.ReadFile(file.path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(file.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	aead, err := restoreCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated file")
+	}
+	data, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	restore := &pb.CreateTunnelsRequest{}
+	if err := protojson.Unmarshal(data, restore); err != nil {
+		return nil, err
+	}
+	return restore, nil
+}
+
+func restoreCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// restoreTunnels creates the tunnels handed over by the previous process of
+// the daemon, then removes their file
+func (s *server) restoreTunnels(file restoreFile) {
+	restore, err := readRestore(file)
+	os.Remove(file.path)
+	if err != nil {
+		log.Printf("Failed to read the tunnels to restore: %v", err)
+		return
+	}
+
+	log.Printf("Restoring %d tunnel(s)", len(restore.Tunnels))
+	resp, err := s.CreateTunnels(context.Background(), restore)
+	if err != nil {
+		log.Printf("Failed to restore the tunnels: %v", err)
+		return
+	}
+	for _, result := range resp.Results {
+		if result.Action == "failed" {
+			log.Printf("Failed to restore tunnel %s:%d: %s", result.Tunnel.Host, result.Tunnel.RemotePort, result.Error)
+		}
+	}
+}
+
+// restartEnv returns the environment of the restarted daemon, which tells it
+// where the tunnels to restore are and how to decrypt them
+func restartEnv(file restoreFile) []string {
+	env := []string{
+		fmt.Sprintf("%s=%s", restoreEnv, file.path),
+		fmt.Sprintf("%s=%s", restoreKeyEnv, file.key),
+	}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, restoreEnv+"=") || strings.HasPrefix(kv, restoreKeyEnv+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
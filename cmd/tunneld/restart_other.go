@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// execDaemon replaces the process with a new one running exe, with the same
+// arguments and PID, so that service managers keep tracking it
+func execDaemon(exe string, env []string) error {
+	return syscall.Exec(exe, os.Args, env)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// execDaemon is not supported on Windows, which cannot replace a process
+func execDaemon(exe string, env []string) error {
+	return errors.New("restarting is not supported on Windows")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/maximeaubaret/go-tunnel/internal/tunnel"
+)
+
+const (
+	// Events sent to webhooks unless -webhook-events is given
+	defaultWebhookEvents = "tunnel_created,tunnel_closed,reconnect_failed"
+
+	// Text of the notifications unless -webhook-template is given
+	defaultWebhookTemplate = "Tunnel {{.Host}}:{{.RemotePort}} -> localhost:{{.LocalPort}}: {{.Event}}{{with .Message}} ({{.}}){{end}}"
+
+	webhookTimeout = 10 * time.Second
+)
+
+// stringsFlag collects the values of a flag given several times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// webhookData is what the templates and JSON payloads are made of
+type webhookData struct {
+	Event      string    `json:"event"`
+	ID         string    `json:"id,omitempty"`
+	Host       string    `json:"host"`
+	LocalPort  int       `json:"local_port"`
+	RemotePort int       `json:"remote_port"`
+	Message    string    `json:"message,omitempty"`
+	Time       time.Time `json:"time"`
+	Text       string    `json:"text"`
+}
+
+// webhooks posts the tunnel events to a set of URLs
+type webhooks struct {
+	urls     []string
+	slack    bool // Send {"text": ...} instead of the full event
+	events   map[string]bool
+	template *template.Template
+	client   *http.Client
+}
+
+// newWebhooks validates the webhook flags
+func newWebhooks(urls []string, format, events, text string) (*webhooks, error) {
+	w := &webhooks{
+		urls:   urls,
+		events: make(map[string]bool),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+
+	switch format {
+	case "json":
+	case "slack":
+		w.slack = true
+	default:
+		return nil, fmt.Errorf("invalid webhook format %q: expected json or slack", format)
+	}
+
+	for _, event := range strings.Split(events, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			w.events[event] = true
+		}
+	}
+
+	tmpl, err := template.New("webhook").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %v", err)
+	}
+	w.template = tmpl
+	return w, nil
+}
+
+// run posts the selected events of the manager until the daemon exits
+func (w *webhooks) run(manager *tunnel.TunnelManager) {
+	events, unsubscribe := manager.Subscribe()
+	defer unsubscribe()
+
+	for ev := range events {
+		if !w.events[ev.Type.String()] {
+			continue
+		}
+		payload, err := w.payload(ev)
+		if err != nil {
+			log.Printf("Webhook: failed to render %s event: %v", ev.Type, err)
+			continue
+		}
+		for _, url := range w.urls {
+			go w.post(url, payload)
+		}
+	}
+}
+
+// payload renders the body sent for an event
+func (w *webhooks) payload(ev tunnel.Event) ([]byte, error) {
+	data := webhookData{
+		Event:      ev.Type.String(),
+		ID:         ev.ID,
+		Host:       ev.Host,
+		LocalPort:  ev.LocalPort,
+		RemotePort: ev.RemotePort,
+		Message:    ev.Message,
+		Time:       ev.Time,
+	}
+
+	var text bytes.Buffer
+	err := w.template.Execute(&text, data)
+	if err != nil {
+		return nil, err
+	}
+	data.Text = text.String()
+
+	// Keep the arrows of the messages readable
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	if w.slack {
+		err = enc.Encode(map[string]string{"text": data.Text})
+	} else {
+		err = enc.Encode(data)
+	}
+	return body.Bytes(), err
+}
+
+func (w *webhooks) post(url string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("Webhook %s: %v", url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		log.Printf("Webhook %s: %v", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook %s: unexpected status %s", url, resp.Status)
+	}
+}
@@ -10,6 +10,10 @@
     flake-utils.lib.eachDefaultSystem (system:
       let
         pkgs = nixpkgs.legacyPackages.${system};
+        # Public key signing the checksums of the releases, checked by tunnel upgrade
+        releaseKey = if builtins.pathExists ./release.pub
+          then pkgs.lib.removeSuffix "\n" (builtins.readFile ./release.pub)
+          else "";
       in
       {
         packages = rec {
@@ -18,7 +22,7 @@
             version = "0.1.0";
             src = ./.;
 
-            vendorHash = "sha256-1p/Hcqig5YgILDtdSdc0EozsK3prgnnpAo8MTbjwWo0=";
+            vendorHash = "sha256-CHHfsm8PqdwlozXPZAOO0pWAl0EJVet1nNE4PrTPGio=";
             proxyVendor = true;
 
             nativeBuildInputs = with pkgs; [
@@ -37,8 +41,9 @@
 
             # Build both binaries with version info
             postBuild = ''
-              go build -ldflags "-X github.com/maximeaubaret/go-tunnel/internal/version.Version=$pname-$version -X github.com/maximeaubaret/go-tunnel/internal/version.Commit=$(git rev-parse --short HEAD) -X github.com/maximeaubaret/go-tunnel/internal/version.Date=$(date -u +%Y-%m-%d)" -o $GOPATH/bin/tunnel ./cmd/tunnel
-              go build -ldflags "-X github.com/maximeaubaret/go-tunnel/internal/version.Version=$pname-$version -X github.com/maximeaubaret/go-tunnel/internal/version.Commit=$(git rev-parse --short HEAD) -X github.com/maximeaubaret/go-tunnel/internal/version.Date=$(date -u +%Y-%m-%d)" -o $GOPATH/bin/tunneld ./cmd/tunneld
+              go build -ldflags "-X github.com/maximeaubaret/go-tunnel/internal/version.Version=$pname-$version -X github.com/maximeaubaret/go-tunnel/internal/version.Commit=$(git rev-parse --short HEAD) -X github.com/maximeaubaret/go-tunnel/internal/version.Date=$(date -u +%Y-%m-%d) -X github.com/maximeaubaret/go-tunnel/internal/version.ReleaseKey=${releaseKey}" -o $GOPATH/bin/tunnel ./cmd/tunnel
+              go build -ldflags "-X github.com/maximeaubaret/go-tunnel/internal/version.Version=$pname-$version -X github.com/maximeaubaret/go-tunnel/internal/version.Commit=$(git rev-parse --short HEAD) -X github.com/maximeaubaret/go-tunnel/internal/version.Date=$(date -u +%Y-%m-%d) -X github.com/maximeaubaret/go-tunnel/internal/version.ReleaseKey=${releaseKey}" -o $GOPATH/bin/tunneld ./cmd/tunneld
+              go build -o $GOPATH/bin/tunnel-bind ./cmd/tunnel-bind
             '';
 
             # Install both binaries
@@ -46,6 +51,7 @@
               mkdir -p $out/bin
               cp $GOPATH/bin/tunnel $out/bin/
               cp $GOPATH/bin/tunneld $out/bin/
+              cp $GOPATH/bin/tunnel-bind $out/bin/
             '';
           };
 
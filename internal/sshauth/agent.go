@@ -0,0 +1,51 @@
+package sshauth
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errNoAgent = errors.New("no SSH agent is running")
+
+// sshAgent is the connection to the SSH agent of the user, opened on first
+// use and again after a failure, so that an agent started or restarted
+// later is picked up
+type sshAgent struct {
+	conn   io.ReadWriteCloser
+	client agent.ExtendedAgent
+	mu     sync.Mutex
+}
+
+// The agent tried after the default keys
+var defaultAgent sshAgent
+
+// signers returns the keys held by the agent, none if it is not reachable
+func (a *sshAgent) signers() []ssh.Signer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil {
+		if signers, err := a.client.Signers(); err == nil {
+			return signers
+		}
+		a.conn.Close()
+		a.conn, a.client = nil, nil
+	}
+
+	conn, err := dialAgent()
+	if err != nil {
+		return nil
+	}
+	client := agent.NewClient(conn)
+	signers, err := client.Signers()
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	a.conn, a.client = conn, client
+	return signers
+}
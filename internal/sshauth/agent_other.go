@@ -0,0 +1,18 @@
+//go:build !windows
+
+package sshauth
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// dialAgent connects to the agent listening on SSH_AUTH_SOCK
+func dialAgent() (io.ReadWriteCloser, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errNoAgent
+	}
+	return net.Dial("unix", socket)
+}
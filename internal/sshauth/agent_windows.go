@@ -0,0 +1,136 @@
+package sshauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Named pipe of the agent of Windows OpenSSH
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to the agent of SSH_AUTH_SOCK, a named pipe or a Unix
+// socket, else to the Windows OpenSSH agent, else to Pageant
+func dialAgent() (io.ReadWriteCloser, error) {
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if strings.HasPrefix(socket, `\\.\pipe\`) {
+			return os.OpenFile(socket, os.O_RDWR, 0)
+		}
+		return net.Dial("unix", socket)
+	}
+	if pipe, err := os.OpenFile(openSSHAgentPipe, os.O_RDWR, 0); err == nil {
+		return pipe, nil
+	}
+	return dialPageant()
+}
+
+// Pageant answers the requests of the agent protocol written to a shared
+// memory mapping, whose name is sent with a WM_COPYDATA message
+const (
+	pageantMaxMessage = 8192
+	pageantCopyDataID = 0x804e50ba
+	wmCopyData        = 0x004a
+)
+
+var (
+	user32             = syscall.NewLazyDLL("user32.dll")
+	findWindow         = user32.NewProc("FindWindowW")
+	sendMessage        = user32.NewProc("SendMessageW")
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	getCurrentThreadID = kernel32.NewProc("GetCurrentThreadId")
+)
+
+// copyData is the COPYDATASTRUCT of WM_COPYDATA
+type copyData struct {
+	id   uintptr
+	size uint32
+	data *byte
+}
+
+// pageantConn exchanges the messages of the agent protocol with Pageant. A
+// request is sent once fully written, and its answer is then read.
+type pageantConn struct {
+	window  uintptr
+	request bytes.Buffer
+	answer  bytes.Buffer
+}
+
+func dialPageant() (io.ReadWriteCloser, error) {
+	name, _ := syscall.UTF16PtrFromString("Pageant")
+	window, _, _ := findWindow.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)))
+	if window == 0 {
+		return nil, errNoAgent
+	}
+	return &pageantConn{window: window}, nil
+}
+
+func (c *pageantConn) Write(p []byte) (int, error) {
+	c.request.Write(p)
+	// Messages start with their length
+	if c.request.Len() < 4 {
+		return len(p), nil
+	}
+	size := int(binary.BigEndian.Uint32(c.request.Bytes())) + 4
+	if c.request.Len() < size {
+		return len(p), nil
+	}
+	answer, err := c.query(c.request.Next(size))
+	if err != nil {
+		return 0, err
+	}
+	c.answer.Write(answer)
+	return len(p), nil
+}
+
+func (c *pageantConn) Read(p []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(p)
+}
+
+func (c *pageantConn) Close() error {
+	return nil
+}
+
+// query sends a request to Pageant and returns its answer
+func (c *pageantConn) query(request []byte) ([]byte, error) {
+	if len(request) > pageantMaxMessage {
+		return nil, fmt.Errorf("agent request of %d bytes is too large for Pageant", len(request))
+	}
+
+	thread, _, _ := getCurrentThreadID.Call()
+	name := fmt.Sprintf("PageantRequest%08x", thread)
+	mappingName, _ := syscall.UTF16PtrFromString(name)
+	mapping, err := syscall.CreateFileMapping(syscall.InvalidHandle, nil, syscall.PAGE_READWRITE, 0, pageantMaxMessage, mappingName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to share memory with Pageant: %v", err)
+	}
+	defer syscall.CloseHandle(mapping)
+	view, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to share memory with Pageant: %v", err)
+	}
+	defer syscall.UnmapViewOfFile(view)
+	shared := unsafe.Slice((*byte)(unsafe.Add(nil, view)), pageantMaxMessage)
+	copy(shared, request)
+
+	// Pageant reads the name of the mapping as a null-terminated ANSI string
+	ansiName := append([]byte(name), 0)
+	message := copyData{id: pageantCopyDataID, size: uint32(len(ansiName)), data: &ansiName[0]}
+	if ok, _, _ := sendMessage.Call(c.window, wmCopyData, 0, uintptr(unsafe.Pointer(&message))); ok == 0 {
+		return nil, fmt.Errorf("Pageant refused the request")
+	}
+
+	size := binary.BigEndian.Uint32(shared) + 4
+	if size > pageantMaxMessage {
+		return nil, fmt.Errorf("invalid answer of %d bytes from Pageant", size)
+	}
+	return append([]byte(nil), shared[:size]...), nil
+}
@@ -0,0 +1,180 @@
+package sshauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// How long EC2 Instance Connect keeps a pushed key
+	ec2KeyValidity = 60 * time.Second
+
+	// How long OS Login keeps an added key
+	osLoginKeyValidity = 10 * time.Minute
+
+	cloudCLITimeout = 30 * time.Second
+)
+
+// ephemeralKey is a key generated by the daemon, pushed to the machines
+// before the handshakes, and again once half its validity has passed
+type ephemeralKey struct {
+	signer   ssh.Signer
+	push     func(publicKey string) error
+	validity time.Duration
+	pushed   time.Time
+	mu       sync.Mutex
+}
+
+func newEphemeralKey(validity time.Duration, push func(publicKey string) error) (*ephemeralKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return &ephemeralKey{signer: signer, push: push, validity: validity}, nil
+}
+
+// pushIfNeeded pushes the key unless it was pushed recently enough to
+// remain valid during the handshake
+func (e *ephemeralKey) pushIfNeeded() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.pushed) < e.validity/2 {
+		return nil
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(e.signer.PublicKey())))
+	if err := e.push(publicKey); err != nil {
+		return err
+	}
+	e.pushed = time.Now()
+	return nil
+}
+
+func (e *ephemeralKey) authMethod() ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if err := e.pushIfNeeded(); err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{e.signer}, nil
+	})
+}
+
+// EC2InstanceConnectAuthMethod authenticates as user with a key generated by
+// the daemon, pushed to the instance with EC2 Instance Connect right before
+// the handshakes
+func EC2InstanceConnectAuthMethod(ec2 userconfig.EC2InstanceConnect, user string) (ssh.AuthMethod, error) {
+	if ec2.InstanceID == "" {
+		return nil, fmt.Errorf("ec2_instance_connect needs the instance_id")
+	}
+	if user == "" {
+		return nil, fmt.Errorf("ec2_instance_connect needs the SSH user")
+	}
+	key, err := newEphemeralKey(ec2KeyValidity, func(publicKey string) error {
+		args := []string{"ec2-instance-connect", "send-ssh-public-key",
+			"--instance-id", ec2.InstanceID,
+			"--instance-os-user", user,
+			"--ssh-public-key", publicKey,
+		}
+		if ec2.Region != "" {
+			args = append(args, "--region", ec2.Region)
+		}
+		if ec2.Profile != "" {
+			args = append(args, "--profile", ec2.Profile)
+		}
+		_, err := runCloudCLI("aws", args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key.authMethod(), nil
+}
+
+// OSLoginAuthMethod authenticates with a key generated by the daemon, added
+// to the OS Login profile of the gcloud account for a limited time. The key
+// is added at once, to learn the POSIX user of the profile.
+func OSLoginAuthMethod(osLogin userconfig.OSLogin) (method ssh.AuthMethod, user string, err error) {
+	key, err := newEphemeralKey(osLoginKeyValidity, func(publicKey string) error {
+		args := []string{"compute", "os-login", "ssh-keys", "add",
+			"--key", publicKey,
+			"--ttl", fmt.Sprintf("%ds", int(osLoginKeyValidity.Seconds())),
+			"--format", "json",
+		}
+		if osLogin.Project != "" {
+			args = append(args, "--project", osLogin.Project)
+		}
+		out, err := runCloudCLI("gcloud", args...)
+		if err != nil {
+			return err
+		}
+		if user == "" {
+			user, err = osLoginUser(out)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := key.pushIfNeeded(); err != nil {
+		return nil, "", err
+	}
+	return key.authMethod(), user, nil
+}
+
+// osLoginUser returns the primary POSIX user of the login profile printed by
+// gcloud compute os-login ssh-keys add
+func osLoginUser(out []byte) (string, error) {
+	var profile struct {
+		LoginProfile struct {
+			PosixAccounts []struct {
+				Username string `json:"username"`
+				Primary  bool   `json:"primary"`
+			} `json:"posixAccounts"`
+		} `json:"loginProfile"`
+	}
+	if err := json.Unmarshal(out, &profile); err != nil {
+		return "", fmt.Errorf("gcloud: invalid login profile: %v", err)
+	}
+	accounts := profile.LoginProfile.PosixAccounts
+	for _, account := range accounts {
+		if account.Primary {
+			return account.Username, nil
+		}
+	}
+	if len(accounts) > 0 {
+		return accounts[0].Username, nil
+	}
+	return "", fmt.Errorf("gcloud: the login profile has no POSIX account")
+}
+
+// runCloudCLI runs a command of the CLI of a cloud provider, and returns its
+// output, or its error output in the error
+func runCloudCLI(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cloudCLITimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return out, nil
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, fmt.Errorf("%s is not installed", name)
+	case errors.As(err, &exitErr) && len(exitErr.Stderr) > 0:
+		return nil, fmt.Errorf("%s: %s", name, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return nil, fmt.Errorf("%s: %v", name, err)
+}
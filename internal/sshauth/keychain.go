@@ -0,0 +1,73 @@
+package sshauth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The passphrases of the encrypted keys are kept in the Keychain as generic
+// passwords of this service, with the fingerprint of the key as account
+const keychainService = "go-tunnel"
+
+// keyAccount returns the Keychain account of the passphrase of an encrypted
+// key: its fingerprint, or its absolute path for the PEM keys which do not
+// tell their public key until decrypted
+func keyAccount(keyPath string, missing *ssh.PassphraseMissingError) string {
+	if missing.PublicKey != nil {
+		return ssh.FingerprintSHA256(missing.PublicKey)
+	}
+	if abs, err := filepath.Abs(keyPath); err == nil {
+		return abs
+	}
+	return keyPath
+}
+
+// encryptedKey reads the key file at keyPath, and fails unless it is
+// encrypted
+func encryptedKey(keyPath string) ([]byte, *ssh.PassphraseMissingError, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var missing *ssh.PassphraseMissingError
+	if _, err := ssh.ParsePrivateKey(key); !errors.As(err, &missing) {
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't parse SSH key %s: %v", keyPath, err)
+		}
+		return nil, nil, fmt.Errorf("SSH key %s is not encrypted", keyPath)
+	}
+	return key, missing, nil
+}
+
+// CheckEncrypted fails unless the key file at keyPath is encrypted
+func CheckEncrypted(keyPath string) error {
+	_, _, err := encryptedKey(keyPath)
+	return err
+}
+
+// StorePassphrase keeps the passphrase of the encrypted key at keyPath in
+// the Keychain, after checking that it decrypts the key
+func StorePassphrase(keyPath string, passphrase []byte) error {
+	key, missing, err := encryptedKey(keyPath)
+	if err != nil {
+		return err
+	}
+	if _, err := ssh.ParsePrivateKeyWithPassphrase(key, passphrase); err != nil {
+		return fmt.Errorf("couldn't decrypt SSH key %s: %v", keyPath, err)
+	}
+	return keychainStore(keyAccount(keyPath, missing), string(passphrase))
+}
+
+// ForgetPassphrase removes the passphrase of the encrypted key at keyPath
+// from the Keychain
+func ForgetPassphrase(keyPath string) error {
+	_, missing, err := encryptedKey(keyPath)
+	if err != nil {
+		return err
+	}
+	return keychainDelete(keyAccount(keyPath, missing))
+}
@@ -0,0 +1,56 @@
+package sshauth
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The Keychain is used through the security tool, so that the items it
+// creates can be read back without a prompt for every new build of tunneld
+const securityTool = "/usr/bin/security"
+
+// How to give the passphrase of an encrypted key
+const passphraseHint = "store its passphrase with tunnel keychain or set SSH_KEY_PASSPHRASE"
+
+// keychainPassphrase returns the passphrase stored for account
+func keychainPassphrase(account string) (string, error) {
+	out, err := exec.Command(securityTool, "find-generic-password", "-s", keychainService, "-a", account, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("no passphrase in the Keychain for %s", account)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// keychainStore stores the passphrase of account, replacing the previous one
+func keychainStore(account, passphrase string) error {
+	if strings.ContainsAny(passphrase, "\r\n") {
+		return fmt.Errorf("passphrases with line breaks cannot be stored in the Keychain")
+	}
+
+	// The passphrase goes through stdin, the command line of a process can
+	// be read by the other users
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	cmd := exec.Command(securityTool, "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -w \"%s\"\n",
+		quote.Replace(keychainService), quote.Replace(account), quote.Replace(passphrase)))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to store the passphrase in the Keychain: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// The interactive mode of security exits successfully whatever the
+	// outcome of its commands
+	if stored, err := keychainPassphrase(account); err != nil || stored != passphrase {
+		return fmt.Errorf("failed to store the passphrase in the Keychain: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// keychainDelete removes the passphrase of account
+func keychainDelete(account string) error {
+	if out, err := exec.Command(securityTool, "delete-generic-password", "-s", keychainService, "-a", account).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove the passphrase from the Keychain: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !darwin
+
+package sshauth
+
+import "errors"
+
+var errNoKeychain = errors.New("the Keychain is only available on macOS")
+
+// How to give the passphrase of an encrypted key
+const passphraseHint = "set SSH_KEY_PASSPHRASE"
+
+func keychainPassphrase(account string) (string, error) {
+	return "", errNoKeychain
+}
+
+func keychainStore(account, passphrase string) error {
+	return errNoKeychain
+}
+
+func keychainDelete(account string) error {
+	return errNoKeychain
+}
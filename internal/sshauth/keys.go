@@ -0,0 +1,88 @@
+package sshauth
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Keys is the private key of long-lived SSH configs. Reload reads it again,
+// so that the next handshakes of the configs use a rotated key without
+// rebuilding them.
+type Keys struct {
+	path   string // Key file, empty for the default keys
+	signer ssh.Signer
+	loaded string // Path of the key in use
+	mu     sync.RWMutex
+}
+
+// DefaultKeys loads the user's SSH key, from SSH_KEY_PATH or the default key
+// files in ~/.ssh. Without one only the keys of the SSH agent are used,
+// until a key is found by Reload.
+func DefaultKeys() *Keys {
+	k := &Keys{}
+	k.Reload()
+	return k
+}
+
+// FileKeys loads the private key file at path
+func FileKeys(path string) (*Keys, error) {
+	k := &Keys{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the key again. The key in use is kept if it fails.
+func (k *Keys) Reload() error {
+	var signer ssh.Signer
+	path := k.path
+	var err error
+	if path == "" {
+		signer, path, err = defaultSigner()
+	} else {
+		signer, err = loadSigner(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.signer = signer
+	k.loaded = path
+	k.mu.Unlock()
+	return nil
+}
+
+// Path returns the file of the key in use, empty if none was loaded
+func (k *Keys) Path() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.loaded
+}
+
+// AuthMethod authenticates with the key in use at the time of each
+// handshake. The default keys are followed by those of the SSH agent.
+func (k *Keys) AuthMethod() ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		k.mu.RLock()
+		if k.signer != nil {
+			signers = append(signers, k.signer)
+		}
+		k.mu.RUnlock()
+		if k.path == "" {
+			signers = append(signers, defaultAgent.signers()...)
+		}
+		return signers, nil
+	})
+}
+
+// ClientConfig returns the SSH client configuration used for tunnels,
+// authenticating with k
+func (k *Keys) ClientConfig() *ssh.ClientConfig {
+	config := baseConfig()
+	config.Auth = []ssh.AuthMethod{k.AuthMethod()}
+	return config
+}
@@ -0,0 +1,101 @@
+package sshauth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+// ClientConfig returns the SSH client configuration used for tunnels,
+// authenticating with the default keys then with the SSH agent
+func ClientConfig() *ssh.ClientConfig {
+	return DefaultKeys().ClientConfig()
+}
+
+// baseConfig returns the SSH client configuration without authentication
+func baseConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            os.Getenv("USER"),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+// defaultSigner loads the user's SSH key, see DefaultKeys, and returns the
+// path it was read from
+func defaultSigner() (ssh.Signer, string, error) {
+	// Check for custom SSH key path first
+	if keyPath := os.Getenv("SSH_KEY_PATH"); keyPath != "" {
+		if signer := tryLoadKey(keyPath); signer != nil {
+			return signer, keyPath, nil
+		}
+		log.Printf("Warning: couldn't use specified SSH_KEY_PATH: %s", keyPath)
+	}
+
+	// Common key file names to try
+	keyFiles := []string{
+		"id_ed25519", // Preferred modern key type
+		"id_rsa",     // Common RSA key
+		"id_ecdsa",   // ECDSA key
+	}
+
+	sshDir := filepath.Join(userconfig.Home(), ".ssh")
+	for _, keyFile := range keyFiles {
+		keyPath := filepath.Join(sshDir, keyFile)
+		if signer := tryLoadKey(keyPath); signer != nil {
+			return signer, keyPath, nil
+		}
+	}
+
+	log.Printf("Warning: no valid SSH keys found in %s", sshDir)
+	return nil, "", fmt.Errorf("no valid SSH keys found in %s", sshDir)
+}
+
+func tryLoadKey(keyPath string) ssh.Signer {
+	signer, err := loadSigner(keyPath)
+	if err != nil {
+		// Skip logging for non-existent files
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: %v", err)
+		}
+		return nil
+	}
+
+	log.Printf("Successfully loaded SSH key: %s", keyPath)
+	return signer
+}
+
+// loadSigner loads the private key file at keyPath, decrypted with
+// SSH_KEY_PASSPHRASE or the passphrase stored in the Keychain if it is
+// encrypted
+func loadSigner(keyPath string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("couldn't read SSH key %s: %v", keyPath, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		// Try parsing with passphrase if available
+		passphrase := os.Getenv("SSH_KEY_PASSPHRASE")
+		var missing *ssh.PassphraseMissingError
+		if passphrase == "" && errors.As(err, &missing) {
+			passphrase, _ = keychainPassphrase(keyAccount(keyPath, missing))
+		}
+		if passphrase == "" {
+			return nil, fmt.Errorf("couldn't parse SSH key %s (%s if key is encrypted): %v", keyPath, passphraseHint, err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse SSH key %s with passphrase: %v", keyPath, err)
+		}
+	}
+	return signer, nil
+}
@@ -0,0 +1,165 @@
+package sshauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximeaubaret/go-tunnel/internal/userconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// A certificate is signed again when it expires within this margin, so
+	// that it does not expire during a handshake
+	vaultRenewMargin = 30 * time.Second
+
+	vaultTimeout = 10 * time.Second
+)
+
+// vaultCertificates signs the key of Keys with Vault, and keeps the
+// certificate until it is about to expire or the key changes
+type vaultCertificates struct {
+	keys  *Keys
+	vault userconfig.Vault
+	user  string
+
+	key  ssh.Signer // Key of the certificate
+	cert ssh.Signer
+	mu   sync.Mutex
+}
+
+// VaultAuthMethod authenticates with certificates of the key in use, signed
+// by the SSH secrets engine of Vault for user. A certificate is requested
+// for the first handshake, then again once it is about to expire.
+func (k *Keys) VaultAuthMethod(vault userconfig.Vault, user string) ssh.AuthMethod {
+	c := &vaultCertificates{keys: k, vault: vault, user: user}
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		cert, err := c.certificate()
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{cert}, nil
+	})
+}
+
+// certificate returns the signer of a valid certificate of the key in use
+func (c *vaultCertificates) certificate() (ssh.Signer, error) {
+	c.keys.mu.RLock()
+	key := c.keys.signer
+	c.keys.mu.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("no SSH key to have signed by Vault")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && c.key == key {
+		validBefore := c.cert.PublicKey().(*ssh.Certificate).ValidBefore
+		if validBefore == ssh.CertTimeInfinity || time.Now().Add(vaultRenewMargin).Before(time.Unix(int64(validBefore), 0)) {
+			return c.cert, nil
+		}
+	}
+
+	cert, err := signWithVault(c.vault, key.PublicKey(), c.user)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	log.Printf("Vault signed a certificate with role %s, valid until %s", c.vault.Role, time.Unix(int64(cert.ValidBefore), 0).Format(time.DateTime))
+	c.key, c.cert = key, signer
+	return signer, nil
+}
+
+// signWithVault has the role of the SSH secrets engine sign key for user
+func signWithVault(vault userconfig.Vault, key ssh.PublicKey, user string) (*ssh.Certificate, error) {
+	address := vault.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("no address, set address in the vault settings of the host or VAULT_ADDR")
+	}
+	mount := vault.Mount
+	if mount == "" {
+		mount = "ssh"
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return nil, err
+	}
+
+	request := map[string]string{
+		"public_key": string(ssh.MarshalAuthorizedKey(key)),
+		"cert_type":  "user",
+	}
+	if user != "" {
+		request["valid_principals"] = user
+	}
+	body, _ := json.Marshal(request)
+	url := fmt.Sprintf("%s/v1/%s/sign/%s", strings.TrimSuffix(address, "/"), strings.Trim(mount, "/"), vault.Role)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := (&http.Client{Timeout: vaultTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid answer: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(answer.Errors) > 0 {
+			return nil, fmt.Errorf("signing with role %s failed: %s", vault.Role, strings.Join(answer.Errors, "; "))
+		}
+		return nil, fmt.Errorf("signing with role %s failed: %s", vault.Role, resp.Status)
+	}
+
+	signed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(answer.Data.SignedKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	cert, ok := signed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("invalid certificate: got a %s key", signed.Type())
+	}
+	return cert, nil
+}
+
+// vaultToken returns $VAULT_TOKEN, else the token saved by vault login. The
+// file is read for every certificate, so that logging in again is enough
+// when the token expires.
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	data, err := os.ReadFile(filepath.Join(userconfig.Home(), ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("no token, set VAULT_TOKEN or run vault login")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter spaces the connections accepted by a tunnel to rate per
+// second, allowing bursts of rate connections after a quiet second
+type acceptLimiter struct {
+	interval  time.Duration // Between two connections at the steady rate
+	tolerance time.Duration // How far ahead of the steady rate a burst may go
+	mu        sync.Mutex
+	next      time.Time // When the next connection is due at the steady rate
+}
+
+// newAcceptLimiter returns a limiter of rate connections per second, nil for
+// no limit
+func newAcceptLimiter(rate int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	interval := time.Second / time.Duration(rate)
+	return &acceptLimiter{interval: interval, tolerance: time.Second - interval}
+}
+
+// wait returns once another connection may be accepted, or false if stop is
+// closed first
+func (l *acceptLimiter) wait(stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now) - l.tolerance
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// admit waits until the tunnel may accept another connection: within its
+// accept rate and, when it holds them while down, with SSH connected. The
+// connections meanwhile wait in the listen backlog of the kernel. It returns
+// false once the listeners are closed.
+func (t *Tunnel) admit() bool {
+	return t.holdWhileDown() && t.acceptLimit.wait(t.closing)
+}
+
+// holdWhileDown waits for SSH to be connected when the tunnel holds its
+// connections while down, and returns false once the listeners are closed.
+// It is called again once a connection is accepted, as SSH may have gone
+// down while waiting for it.
+func (t *Tunnel) holdWhileDown() bool {
+	if !t.HoldWhileDown {
+		return true
+	}
+	select {
+	case <-t.connected():
+		return true
+	case <-t.closing:
+		return false
+	}
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import "time"
+
+// The traffic of a tunnel is counted in 1s buckets. The current bandwidth is
+// averaged over the last RateWindow buckets, and every HistoryInterval a
+// sample is kept for the last HistorySize intervals, about 5 minutes.
+const (
+	rateBucket      = time.Second
+	RateWindow      = 30
+	HistoryInterval = 5 * time.Second
+	HistorySize     = 60
+)
+
+// BandwidthSample is the average bandwidth of a tunnel over one
+// HistoryInterval
+type BandwidthSample struct {
+	Time time.Time
+	Up   float64 // bytes/sec
+	Down float64 // bytes/sec
+}
+
+// trafficBucket is the traffic of a tunnel during one rateBucket
+type trafficBucket struct {
+	sent     uint64
+	received uint64
+	duration time.Duration
+}
+
+// sampleBandwidth updates the bandwidth and its history until the tunnel is
+// closed
+func (t *Tunnel) sampleBandwidth() {
+	ticker := time.NewTicker(rateBucket)
+	defer ticker.Stop()
+
+	bucketsPerSample := int(HistoryInterval / rateBucket)
+	bucketsPerUsage := int(UsageInterval / rateBucket)
+	var buckets []trafficBucket
+	ticks := 0
+
+	lastSent, lastReceived := t.traffic.sent.Load(), t.traffic.received.Load()
+	last := time.Now()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			ticks++
+			sent, received := t.traffic.sent.Load(), t.traffic.received.Load()
+			buckets = append(buckets, trafficBucket{
+				sent:     sent - lastSent,
+				received: received - lastReceived,
+				duration: now.Sub(last),
+			})
+			if len(buckets) > RateWindow {
+				buckets = buckets[len(buckets)-RateWindow:]
+			}
+			t.sampleConnections(now.Sub(last))
+			lastSent, lastReceived, last = sent, received, now
+
+			up, down := averageRate(buckets)
+
+			t.bandwidthMu.Lock()
+			t.BandwidthUp, t.BandwidthDown = up, down
+			if ticks%bucketsPerSample == 0 {
+				up, down := averageRate(buckets[len(buckets)-bucketsPerSample:])
+				t.history = append(t.history, BandwidthSample{Time: now, Up: up, Down: down})
+				if len(t.history) > HistorySize {
+					t.history = t.history[len(t.history)-HistorySize:]
+				}
+			}
+			t.bandwidthMu.Unlock()
+
+			if ticks%bucketsPerUsage == 0 {
+				t.sampleUsage(now)
+			}
+		}
+	}
+}
+
+// sampleConnections updates the bandwidth of each connection over the last
+// elapsed duration
+func (t *Tunnel) sampleConnections(elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+
+	t.connectionMu.Lock()
+	defer t.connectionMu.Unlock()
+	for _, c := range t.conns {
+		sent, received := c.traffic.sent.Load(), c.traffic.received.Load()
+		c.BandwidthUp = float64(sent-c.lastSent) / elapsed.Seconds()
+		c.BandwidthDown = float64(received-c.lastReceived) / elapsed.Seconds()
+		c.lastSent, c.lastReceived = sent, received
+	}
+}
+
+// averageRate returns the upload and download bandwidth over the buckets, in
+// bytes/sec
+func averageRate(buckets []trafficBucket) (float64, float64) {
+	var sent, received uint64
+	var duration time.Duration
+	for _, b := range buckets {
+		sent += b.sent
+		received += b.received
+		duration += b.duration
+	}
+	if duration <= 0 {
+		return 0, 0
+	}
+	return float64(sent) / duration.Seconds(), float64(received) / duration.Seconds()
+}
+
+// History returns the bandwidth samples of the tunnel, oldest first
+func (t *Tunnel) History() []BandwidthSample {
+	t.bandwidthMu.RLock()
+	defer t.bandwidthMu.RUnlock()
+	return append([]BandwidthSample(nil), t.history...)
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultBufferSize is the size of the buffers used to forward connections
+const DefaultBufferSize = 32 * 1024
+
+// buffers is shared by all the tunnels so that short-lived connections reuse
+// buffers instead of allocating new ones
+var buffers = newBufferPool(DefaultBufferSize)
+
+// bufferPool hands out byte slices of a fixed size
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() interface{} {
+		buf := make([]byte, bp.size)
+		return &buf
+	}
+	return bp
+}
+
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+}
+
+// SetBufferSize changes the size of the buffers used to forward connections.
+// It must be called before any tunnel is created.
+func SetBufferSize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid buffer size %d", size)
+	}
+	buffers = newBufferPool(size)
+	return nil
+}
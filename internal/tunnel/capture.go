@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Records buffered per capture before new ones are dropped
+const captureBuffer = 256
+
+type CaptureKind int
+
+const (
+	CaptureData CaptureKind = iota
+	CaptureOpened
+	CaptureClosed
+)
+
+// CaptureRecord is a piece of the traffic of a tunnel, see Capture
+type CaptureRecord struct {
+	Kind         CaptureKind
+	ConnectionID uint64
+	Time         time.Time
+	ClientAddr   string // Address of the client of the local port
+	LocalAddr    string // Address the client connected to
+	Upload       bool   // From the client to the remote service
+	Data         []byte
+}
+
+// capture receives the traffic of a tunnel while Capture runs
+type capture struct {
+	records  chan CaptureRecord
+	maxBytes int // Per connection and direction, 0 for no limit
+
+	mu       sync.Mutex
+	recorded map[captureStream]int
+	dropped  int
+}
+
+// captureStream is one direction of a connection
+type captureStream struct {
+	conn   uint64
+	upload bool
+}
+
+// Capture records the traffic of a tunnel until ctx is done, returning a
+// channel closed at the end of the capture. Only the first maxBytes of each
+// connection and direction are recorded, 0 for no limit. Records are
+// dropped rather than slowing the tunnel down when the reader lags behind.
+func (tm *TunnelManager) Capture(ctx context.Context, host string, remotePort, localPort int, maxBytes int) (<-chan CaptureRecord, error) {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{
+		records:  make(chan CaptureRecord, captureBuffer),
+		maxBytes: maxBytes,
+		recorded: make(map[captureStream]int),
+	}
+
+	t.captureMu.Lock()
+	if t.captures == nil {
+		t.captures = make(map[*capture]struct{})
+	}
+	t.captures[c] = struct{}{}
+	t.capturing.Add(1)
+	t.captureMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.ctx.Done():
+		}
+
+		t.captureMu.Lock()
+		delete(t.captures, c)
+		t.capturing.Add(-1)
+		t.captureMu.Unlock()
+
+		c.mu.Lock()
+		if c.dropped > 0 {
+			t.logf("Capture dropped %d record(s), the reader was too slow", c.dropped)
+		}
+		c.mu.Unlock()
+		close(c.records)
+	}()
+	return c.records, nil
+}
+
+// record hands a piece of traffic to the running captures
+func (t *Tunnel) record(kind CaptureKind, conn *Connection, upload bool, data []byte) {
+	if t.capturing.Load() == 0 {
+		return
+	}
+
+	t.captureMu.RLock()
+	defer t.captureMu.RUnlock()
+
+	for c := range t.captures {
+		c.add(CaptureRecord{
+			Kind:         kind,
+			ConnectionID: conn.ID,
+			Time:         time.Now(),
+			ClientAddr:   conn.SourceAddr,
+			LocalAddr:    conn.local.LocalAddr().String(),
+			Upload:       upload,
+			Data:         data,
+		})
+	}
+}
+
+func (c *capture) add(r CaptureRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.Kind == CaptureData {
+		stream := captureStream{conn: r.ConnectionID, upload: r.Upload}
+		if c.maxBytes > 0 {
+			left := c.maxBytes - c.recorded[stream]
+			if left <= 0 {
+				return
+			}
+			if len(r.Data) > left {
+				r.Data = r.Data[:left]
+			}
+		}
+		c.recorded[stream] += len(r.Data)
+		// The buffer is reused by the copy
+		r.Data = append([]byte(nil), r.Data...)
+	}
+
+	select {
+	case c.records <- r:
+	default:
+		c.dropped++
+	}
+}
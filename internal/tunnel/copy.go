@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// countingWriter adds the bytes written through it to traffic counters, so
+// that forwarding can go through io.CopyBuffer
+type countingWriter struct {
+	w        io.Writer
+	counters []*atomic.Uint64
+	onWrite  func(p []byte) // Called with the bytes written
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		for _, c := range cw.counters {
+			c.Add(uint64(n))
+		}
+		if cw.onWrite != nil {
+			cw.onWrite(p[:n])
+		}
+	}
+	return n, err
+}
+
+// copyConn copies src to dst until src is exhausted, then half-closes dst so
+// the peer sees the end of the stream while the other direction keeps going,
+// such as a client waiting for the answer to the request it ended. Reading
+// from src is shut down too, the connections are only closed once both
+// directions are done. On error both connections are closed, which also ends
+// the other direction.
+func copyConn(dst, src net.Conn, w io.Writer) error {
+	buf := buffers.get()
+	defer buffers.put(buf)
+
+	// Hide WriteTo so io.CopyBuffer uses the pooled buffer: for TCP
+	// connections it only splices to unix sockets and allocates otherwise
+	_, err := io.CopyBuffer(w, struct{ io.Reader }{src}, *buf)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return err
+	}
+	if cr, ok := src.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		// The peer would otherwise never see the end of the stream
+		dst.Close()
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchPayload = 64 << 20
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.Fatal("accept failed")
+	}
+	return client, server
+}
+
+// deadlineCopy is the read/write loop forwarding used before copyConn, kept
+// as a baseline for the benchmarks
+func deadlineCopy(dst, src net.Conn, counter *atomic.Uint64) {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := src.Read(buf)
+		if err != nil {
+			dst.Close()
+			return
+		}
+		dst.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+		counter.Add(uint64(n))
+	}
+}
+
+// benchmarkForward pushes benchPayload bytes through a forwarder sitting
+// between two loopback connections
+func benchmarkForward(b *testing.B, forward func(dst, src net.Conn, counter *atomic.Uint64)) {
+	payload := make([]byte, 256*1024)
+	b.SetBytes(benchPayload)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		writer, in := tcpPair(b)
+		out, reader := tcpPair(b)
+		var counter atomic.Uint64
+		b.StartTimer()
+
+		go forward(out, in, &counter)
+		go func() {
+			for sent := 0; sent < benchPayload; sent += len(payload) {
+				if _, err := writer.Write(payload); err != nil {
+					return
+				}
+			}
+			writer.Close()
+		}()
+
+		n, err := io.Copy(io.Discard, reader)
+		if err != nil || n != benchPayload {
+			b.Fatalf("received %d bytes, err %v", n, err)
+		}
+
+		b.StopTimer()
+		if counter.Load() != benchPayload {
+			b.Fatalf("counted %d bytes, want %d", counter.Load(), benchPayload)
+		}
+		in.Close()
+		out.Close()
+		reader.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkDeadlineCopy(b *testing.B) {
+	benchmarkForward(b, deadlineCopy)
+}
+
+func BenchmarkCopyConn(b *testing.B) {
+	benchmarkForward(b, func(dst, src net.Conn, counter *atomic.Uint64) {
+		copyConn(dst, src, &countingWriter{w: dst, counters: []*atomic.Uint64{counter}})
+	})
+}
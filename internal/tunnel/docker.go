@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// dockerScheme prefixes the hosts which are containers of a machine
+	dockerScheme = "docker://"
+
+	// Socket of the docker daemon on the machine
+	dockerSocket = "/var/run/docker.sock"
+)
+
+// isDockerHost reports whether host is a container given as
+// docker://machine/container
+func isDockerHost(host string) bool {
+	return strings.HasPrefix(host, dockerScheme)
+}
+
+// parseDockerHost splits docker://machine/container into its machine and
+// container
+func parseDockerHost(host string) (machine, container string, err error) {
+	machine, container, ok := strings.Cut(strings.TrimPrefix(host, dockerScheme), "/")
+	if !ok || machine == "" || container == "" || strings.Contains(container, "/") {
+		return "", "", fmt.Errorf("invalid docker host %q: expected docker://machine/container", host)
+	}
+	return machine, container, nil
+}
+
+// dockerTransport forwards connections to a container, through the SSH
+// connection to the machine running it. The address of the container is
+// asked to the docker daemon of the machine for every connection, as it
+// changes when the container is restarted.
+type dockerTransport struct {
+	sshTransport
+	container string
+}
+
+// dialDocker connects to the machine of a docker:// host and checks that
+// the container is running
+func dialDocker(ctx context.Context, host string, opts sshOptions) (transport, error) {
+	machine, container, err := parseDockerHost(host)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialSSH(ctx, machine, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &dockerTransport{sshTransport: sshTransport{client}, container: container}
+	if _, err := t.containerIP(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// DialContext opens a connection to a port of the container
+func (t *dockerTransport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := t.containerIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.Client.DialContext(ctx, network, net.JoinHostPort(ip, port))
+}
+
+// dockerContainer is the part of the docker inspect output we need
+type dockerContainer struct {
+	State struct {
+		Running bool
+	}
+	HostConfig struct {
+		NetworkMode string
+	}
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string
+			GlobalIPv6Address string
+		}
+	}
+}
+
+// containerIP asks the docker daemon of the machine for the address of the
+// container
+func (t *dockerTransport) containerIP(ctx context.Context) (string, error) {
+	conn, err := t.Client.Dial("unix", dockerSocket)
+	if err != nil {
+		return "", errorf(ErrHostUnreachable, "failed to reach the docker daemon at %s: %v", dockerSocket, err)
+	}
+	defer conn.Close()
+
+	// The socket serves a single request, the context cuts it if needed
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req, err := http.NewRequest(http.MethodGet, "http://docker/containers/"+url.PathEscape(t.container)+"/json", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return "", fmt.Errorf("failed to query the docker daemon: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query the docker daemon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errorf(ErrHostUnreachable, "no such container: %s", t.container)
+	default:
+		return "", fmt.Errorf("failed to inspect container %s: docker daemon returned %s", t.container, resp.Status)
+	}
+
+	var info dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %v", t.container, err)
+	}
+	if !info.State.Running {
+		return "", errorf(ErrHostUnreachable, "container %s is not running", t.container)
+	}
+
+	// Containers sharing the network of the machine listen on its loopback
+	if info.HostConfig.NetworkMode == "host" {
+		return "localhost", nil
+	}
+	// Pick the same network every time when the container has several
+	names := make([]string, 0, len(info.NetworkSettings.Networks))
+	for name := range info.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := info.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+	for _, name := range names {
+		if ip := info.NetworkSettings.Networks[name].GlobalIPv6Address; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", errorf(ErrHostUnreachable, "container %s has no network address", t.container)
+}
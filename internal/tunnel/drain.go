@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultDrainTimeout is how long a closed tunnel waits for its connections
+// in progress before cutting them
+const DefaultDrainTimeout = 10 * time.Second
+
+// CloseResult tells how the connections in progress ended when a tunnel was
+// closed
+type CloseResult struct {
+	Drained int // Completed on their own
+	Cut     int // Still open when the drain timeout expired
+}
+
+// shutdown stops the tunnel once its listener is closed. Connections in
+// progress get up to drain to complete, the remaining ones are cut.
+func (t *Tunnel) shutdown(drain time.Duration) CloseResult {
+	// No connection is accepted anymore once start returned
+	<-t.stopped
+
+	active := int(t.activeConns.Load())
+	if active > 0 && drain > 0 {
+		t.logf("Draining %d connection(s) for up to %s", active, drain)
+		finished := make(chan struct{})
+		go func() {
+			t.forwarding.Wait()
+			close(finished)
+		}()
+
+		select {
+		case <-finished:
+		case <-time.After(drain):
+		}
+	}
+
+	t.connectionMu.Lock()
+	cut := len(t.conns)
+	for _, c := range t.conns {
+		t.closeConnectionLocked(c, "tunnel closed")
+	}
+	t.connectionMu.Unlock()
+
+	t.runCloseHook()
+
+	// Stop the background goroutines and wait for them, along with the
+	// connections which were just cut
+	t.cancel()
+	t.sshClient().Close()
+	t.forwarding.Wait()
+	t.workers.Wait()
+	t.totals.addClosed(t)
+	t.closed.add(t)
+
+	result := CloseResult{Drained: max(active-cut, 0), Cut: cut}
+	message := t.closeReason
+	if active > 0 {
+		message += fmt.Sprintf(", %d connection(s) drained, %d cut", result.Drained, result.Cut)
+	}
+	t.emit(EventTunnelClosed, message)
+	return result
+}
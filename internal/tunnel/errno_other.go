@@ -0,0 +1,13 @@
+//go:build !windows
+
+package tunnel
+
+import "syscall"
+
+// Errors of a local address already in use, of a refused connection and of
+// a port which needs privileges to be bound
+var (
+	errAddrInUse   error = syscall.EADDRINUSE
+	errConnRefused error = syscall.ECONNREFUSED
+	errAccess      error = syscall.EACCES
+)
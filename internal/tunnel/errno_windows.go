@@ -0,0 +1,12 @@
+package tunnel
+
+import "syscall"
+
+// Errors of a local address already in use, of a refused connection and of
+// a port which cannot be bound. Winsock has its own codes, which
+// syscall.EADDRINUSE, syscall.ECONNREFUSED and syscall.EACCES do not match.
+var (
+	errAddrInUse   error = syscall.Errno(10048) // WSAEADDRINUSE
+	errConnRefused error = syscall.Errno(10061) // WSAECONNREFUSED
+	errAccess      error = syscall.Errno(10013) // WSAEACCES
+)
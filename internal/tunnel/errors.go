@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Kinds of failures, to be matched with errors.Is. A *PortInUseError is
+// returned when the local port is taken.
+var (
+	ErrAlreadyExists   = errors.New("tunnel already exists")
+	ErrNotFound        = errors.New("tunnel not found")
+	ErrAmbiguous       = errors.New("ambiguous tunnel")
+	ErrHostUnreachable = errors.New("host unreachable")
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrNotReady        = errors.New("remote service not ready")
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrBindFailed      = errors.New("failed to bind the local port")
+)
+
+// Causes of ErrHostUnreachable, which they match too
+var (
+	ErrHostNotFound      = fmt.Errorf("%w: host not found", ErrHostUnreachable)
+	ErrConnectionRefused = fmt.Errorf("%w: connection refused", ErrHostUnreachable)
+	ErrTimedOut          = fmt.Errorf("%w: timed out", ErrHostUnreachable)
+)
+
+// Cause of ErrBindFailed, which it matches too: the port is below 1024 and
+// neither the daemon nor the bind helper could bind it
+var ErrPrivilegedPort = fmt.Errorf("%w: privileged port", ErrBindFailed)
+
+// kindError keeps the message of an error while matching one of the kinds
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// errorf formats an error matching kind
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// dialErrorKind classifies a failed connection to a host
+func dialErrorKind(err error) error {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrHostNotFound
+	case errors.Is(err, errConnRefused):
+		return ErrConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimedOut
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimedOut
+	}
+	return ErrHostUnreachable
+}
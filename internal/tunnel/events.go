@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventTunnelCreated EventType = iota + 1
+	EventTunnelClosed
+	EventReconnectStarted
+	EventReconnectSucceeded
+	EventReconnectFailed
+	EventConnectionOpened
+	EventConnectionClosed
+	EventError
+	EventTunnelPaused
+	EventTunnelResumed
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventTunnelCreated:
+		return "tunnel_created"
+	case EventTunnelClosed:
+		return "tunnel_closed"
+	case EventReconnectStarted:
+		return "reconnect_started"
+	case EventReconnectSucceeded:
+		return "reconnect_succeeded"
+	case EventReconnectFailed:
+		return "reconnect_failed"
+	case EventConnectionOpened:
+		return "connection_opened"
+	case EventConnectionClosed:
+		return "connection_closed"
+	case EventError:
+		return "error"
+	case EventTunnelPaused:
+		return "tunnel_paused"
+	case EventTunnelResumed:
+		return "tunnel_resumed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a state change of a tunnel
+type Event struct {
+	Type       EventType
+	ID         string // ID of the tunnel, as several can share a host and remote port
+	Host       string
+	LocalPort  int
+	RemotePort int
+	Message    string
+	Time       time.Time
+}
+
+// eventBus fans out events to all current subscribers
+type eventBus struct {
+	subscribers map[chan Event]struct{}
+	mu          sync.RWMutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers {
+		// Never block the tunnel on a slow subscriber, drop the event instead
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all tunnel events and a function
+// to cancel the subscription
+func (tm *TunnelManager) Subscribe() (<-chan Event, func()) {
+	return tm.events.subscribe()
+}
+
+func (t *Tunnel) emit(typ EventType, message string) {
+	if t.events == nil {
+		return
+	}
+	localPort, remotePort := t.ports()
+	t.events.publish(Event{
+		Type:       typ,
+		ID:         t.ID,
+		Host:       t.Host,
+		LocalPort:  localPort,
+		RemotePort: remotePort,
+		Message:    message,
+		Time:       time.Now(),
+	})
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ExistsPolicy tells what CreateTunnel does when a tunnel forwarding the same
+// local port to the same remote port already exists
+type ExistsPolicy int
+
+const (
+	ExistsFail    ExistsPolicy = iota // Fail with ErrAlreadyExists
+	ExistsKeep                        // Succeed without change if identical, fail otherwise
+	ExistsReplace                     // Close it and create the new one
+)
+
+// ParseExistsPolicy parses fail, keep or replace, fail when empty
+func ParseExistsPolicy(s string) (ExistsPolicy, error) {
+	switch s {
+	case "", "fail":
+		return ExistsFail, nil
+	case "keep":
+		return ExistsKeep, nil
+	case "replace":
+		return ExistsReplace, nil
+	default:
+		return 0, fmt.Errorf("invalid if-exists policy %q: expected fail, keep or replace", s)
+	}
+}
+
+// sameSettings reports whether the tunnel was created with opts, whatever
+// their policy for existing tunnels. tm.mu must be held.
+func (t *Tunnel) sameSettings(opts Options) bool {
+	created := t.options
+	created.IfExists, opts.IfExists = 0, 0
+	return reflect.DeepEqual(created, opts)
+}
@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// AddressFamily selects the IP versions used for the local listener and the
+// SSH connection of a tunnel
+type AddressFamily string
+
+const (
+	FamilyAny        AddressFamily = ""
+	FamilyIPv4       AddressFamily = "ipv4"
+	FamilyIPv6       AddressFamily = "ipv6"
+	FamilyPreferIPv4 AddressFamily = "prefer-ipv4"
+	FamilyPreferIPv6 AddressFamily = "prefer-ipv6"
+)
+
+// ParseAddressFamily parses any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch f := AddressFamily(s); f {
+	case FamilyAny, FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+		return f, nil
+	case "any":
+		return FamilyAny, nil
+	default:
+		return "", fmt.Errorf("invalid address family %q: expected any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6", s)
+	}
+}
+
+// loopbacks returns the addresses the local listener tries, in order
+func (f AddressFamily) loopbacks() []string {
+	switch f {
+	case FamilyIPv4:
+		return []string{"127.0.0.1"}
+	case FamilyIPv6:
+		return []string{"::1"}
+	case FamilyPreferIPv4:
+		return []string{"127.0.0.1", "::1"}
+	case FamilyPreferIPv6:
+		return []string{"::1", "127.0.0.1"}
+	default:
+		return []string{"localhost"}
+	}
+}
+
+// resolve looks host up and returns its addresses of the family, preferred
+// ones first
+func (f AddressFamily) resolve(ctx context.Context, host string) ([]string, error) {
+	network := "ip"
+	switch f {
+	case FamilyIPv4:
+		network = "ip4"
+	case FamilyIPv6:
+		network = "ip6"
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f {
+	case FamilyPreferIPv4:
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].To4() != nil && ips[j].To4() == nil
+		})
+	case FamilyPreferIPv6:
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].To4() == nil && ips[j].To4() != nil
+		})
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+// normalizeHost strips the brackets around a literal IPv6 address, so that
+// [::1] and ::1 designate the same tunnels
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// TunnelKey identifies the tunnel forwarding localPort to remotePort of
+// host, written like ssh -L, whether the host is an IPv6 address in brackets
+// or not
+func TunnelKey(host string, remotePort, localPort int) string {
+	return fmt.Sprintf("%d:%s:%d", localPort, normalizeHost(host), remotePort)
+}
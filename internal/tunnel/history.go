@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Number of closed tunnels remembered by a manager
+const historySize = 100
+
+// Reasons why a tunnel was closed, see ClosedTunnel
+const (
+	ReasonClosed      = "closed"
+	ReasonGaveUp      = "reconnection gave up"
+	ReasonExpired     = "TTL expired"
+	ReasonOwnerExited = "owner exited"
+	ReasonReplaced    = "replaced"
+)
+
+// ClosedTunnel describes a tunnel once it is closed
+type ClosedTunnel struct {
+	ID            string
+	Host          string
+	LocalPort     int
+	RemotePort    int
+	Labels        map[string]string
+	CreatedAt     time.Time
+	ClosedAt      time.Time
+	Reason        string
+	BytesSent     uint64
+	BytesReceived uint64
+	TotalConns    uint64
+}
+
+// closedTunnels remembers the last tunnels closed by a manager
+type closedTunnels struct {
+	tunnels []ClosedTunnel // Oldest first
+	mu      sync.Mutex
+}
+
+// add records a tunnel which shut down
+func (h *closedTunnels) add(t *Tunnel) {
+	closed := ClosedTunnel{
+		ID:            t.ID,
+		Host:          t.Host,
+		LocalPort:     t.LocalPort,
+		RemotePort:    t.RemotePort,
+		Labels:        maps.Clone(t.Labels),
+		CreatedAt:     t.CreatedAt,
+		ClosedAt:      time.Now(),
+		Reason:        t.closeReason,
+		BytesSent:     t.traffic.sent.Load(),
+		BytesReceived: t.traffic.received.Load(),
+		TotalConns:    t.totalConns.Load(),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tunnels = append(h.tunnels, closed)
+	if len(h.tunnels) > historySize {
+		h.tunnels = h.tunnels[len(h.tunnels)-historySize:]
+	}
+}
+
+// History returns the last closed tunnels, most recent first
+func (tm *TunnelManager) History() []ClosedTunnel {
+	tm.closed.mu.Lock()
+	defer tm.closed.mu.Unlock()
+
+	history := make([]ClosedTunnel, len(tm.closed.tunnels))
+	for i, t := range tm.closed.tunnels {
+		history[len(history)-1-i] = t
+	}
+	return history
+}
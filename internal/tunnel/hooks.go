@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the command run when a tunnel is closed may take
+const closeHookTimeout = 30 * time.Second
+
+// runHook runs a command on the machine over a new SSH session, logging its
+// output. Canceling ctx kills the session.
+func runHook(ctx context.Context, client transport, name, host string, remotePort int, command string) error {
+	sessions, ok := client.(interface {
+		NewSession() (*ssh.Session, error)
+	})
+	if !ok {
+		return fmt.Errorf("%s command: remote commands are not supported for %s", name, host)
+	}
+	session, err := sessions.NewSession()
+	if err != nil {
+		return fmt.Errorf("%s command: failed to open SSH session: %v", name, err)
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	log.Printf("[%s:%d] Running %s command: %s", host, remotePort, name, command)
+	output, err := session.CombinedOutput(command)
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line != "" {
+			log.Printf("[%s:%d] %s: %s", host, remotePort, name, line)
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s command interrupted: %v", name, ctx.Err())
+	}
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			return fmt.Errorf("%s command failed: %v", name, err)
+		}
+		return fmt.Errorf("%s command failed: %v: %s", name, err, message)
+	}
+	return nil
+}
+
+// runCloseHook runs the command of a closing tunnel, before its SSH
+// connection is closed. The tunnel is gone by then, failures are only logged.
+func (t *Tunnel) runCloseHook() {
+	if t.onClose == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeHookTimeout)
+	defer cancel()
+	if err := runHook(ctx, t.sshClient(), "on-close", t.Host, t.RemotePort, t.onClose); err != nil {
+		t.logf("%v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package tunnel
+
+import "time"
+
+// closeIdleConnections closes the connections which carried no traffic for
+// IdleTimeout, until the tunnel is closed
+func (t *Tunnel) closeIdleConnections() {
+	ticker := time.NewTicker(min(t.IdleTimeout, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.connectionMu.Lock()
+			for _, c := range t.conns {
+				idle := now.Sub(time.Unix(0, c.traffic.lastWrite.Load()))
+				if idle >= t.IdleTimeout && t.closeConnectionLocked(c, "idle timeout") {
+					t.logf("Closing connection #%d from %s, idle for %s", c.ID, c.SourceAddr, idle.Round(time.Second))
+				}
+			}
+			t.connectionMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// k8sScheme prefixes the hosts reached through the Kubernetes API
+const k8sScheme = "k8s://"
+
+// isK8sHost reports whether host is a pod given as k8s://context/namespace/pod
+func isK8sHost(host string) bool {
+	return strings.HasPrefix(host, k8sScheme)
+}
+
+// k8sTarget is the pod of a k8s:// host. Empty context and namespace stand
+// for the current ones of the kubeconfig.
+type k8sTarget struct {
+	context   string
+	namespace string
+	pod       string
+}
+
+// parseK8sHost parses k8s://context/namespace/pod, k8s://context/pod or
+// k8s:///namespace/pod
+func parseK8sHost(host string) (k8sTarget, error) {
+	parts := strings.Split(strings.TrimPrefix(host, k8sScheme), "/")
+	switch {
+	case len(parts) == 2 && parts[1] != "":
+		return k8sTarget{context: parts[0], pod: parts[1]}, nil
+	case len(parts) == 3 && parts[2] != "":
+		return k8sTarget{context: parts[0], namespace: parts[1], pod: parts[2]}, nil
+	default:
+		return k8sTarget{}, fmt.Errorf("invalid Kubernetes host %q: expected k8s://context/namespace/pod", host)
+	}
+}
+
+func (t k8sTarget) String() string {
+	return t.namespace + "/" + t.pod
+}
+
+// k8sTransport forwards connections to a pod through the port-forward
+// subresource of the Kubernetes API, one pair of SPDY streams per connection
+type k8sTransport struct {
+	conn      httpstream.Connection
+	host      string
+	target    k8sTarget
+	requestID atomic.Int64
+}
+
+// dialK8s opens a port-forward connection to the pod of host, with the
+// credentials of the kubeconfig
+func dialK8s(ctx context.Context, host string) (transport, error) {
+	target, err := parseK8sHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: target.context},
+	)
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	if target.namespace == "" {
+		if target.namespace, _, err = loader.Namespace(); err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+		}
+	}
+
+	roundTripper, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the Kubernetes client: %v", err)
+	}
+	u, _, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kubernetes API server: %v", err)
+	}
+	u.Path = path.Join(u.Path, "api/v1/namespaces", target.namespace, "pods", target.pod, "portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, u)
+
+	// The dialer does not take a context, give up waiting for it instead
+	type result struct {
+		conn httpstream.Connection
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+		done <- result{conn, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+
+	if r.err != nil {
+		message := r.err.Error()
+		if strings.Contains(message, "Unauthorized") || strings.Contains(message, "Forbidden") {
+			return nil, errorf(ErrAuthFailed, "failed to port-forward to pod %s: %v", target, r.err)
+		}
+		return nil, errorf(ErrHostUnreachable, "failed to port-forward to pod %s: %v", target, r.err)
+	}
+	return &k8sTransport{conn: r.conn, host: host, target: target}, nil
+}
+
+// DialContext opens the streams of a new connection to a port of the pod
+func (c *k8sTransport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, port)
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(c.requestID.Add(1), 10))
+	errorStream, err := c.conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create error stream: %v", err)
+	}
+	// Only the pod writes to the error stream
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := c.conn.CreateStream(headers)
+	if err != nil {
+		c.conn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("failed to create data stream: %v", err)
+	}
+
+	sc := &streamConn{
+		Stream:     dataStream,
+		transport:  c,
+		errors:     errorStream,
+		remoteAddr: k8sAddr(fmt.Sprintf("%s:%s", c.target, port)),
+	}
+
+	// The pod reports a failure to reach the port, such as a refused
+	// connection, on the error stream. Cut the data stream so that the
+	// client does not wait for an answer.
+	go func() {
+		message, _ := io.ReadAll(errorStream)
+		if len(message) > 0 {
+			log.Printf("[%s:%s] Port-forward failed: %s", c.host, port, message)
+			sc.Close()
+		}
+	}()
+	return sc, nil
+}
+
+func (c *k8sTransport) RemoteAddr() net.Addr {
+	return k8sAddr(c.target.String())
+}
+
+func (c *k8sTransport) Close() error {
+	return c.conn.Close()
+}
+
+func (c *k8sTransport) ping(time.Duration) error {
+	select {
+	case <-c.conn.CloseChan():
+		return fmt.Errorf("port-forward connection to pod %s closed", c.target)
+	default:
+		return nil
+	}
+}
+
+// k8sAddr is the address of a pod, as namespace/pod
+type k8sAddr string
+
+func (a k8sAddr) Network() string { return "k8s" }
+func (a k8sAddr) String() string  { return string(a) }
+
+// streamConn is a forwarded connection, made of the data stream of a
+// port-forward
+type streamConn struct {
+	httpstream.Stream
+	transport  *k8sTransport
+	errors     httpstream.Stream
+	remoteAddr net.Addr
+	closeOnce  sync.Once
+}
+
+// CloseWrite half-closes the connection, closing an SPDY stream only ends
+// our side
+func (sc *streamConn) CloseWrite() error {
+	return sc.Stream.Close()
+}
+
+// Close discards the connection in both directions
+func (sc *streamConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.Stream.Reset()
+		sc.transport.conn.RemoveStreams(sc.errors, sc.Stream)
+	})
+	return nil
+}
+
+func (sc *streamConn) LocalAddr() net.Addr                { return k8sAddr("local") }
+func (sc *streamConn) RemoteAddr() net.Addr               { return sc.remoteAddr }
+func (sc *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (sc *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sc *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,38 @@
+package tunnel
+
+// MatchLabels reports whether the tunnel carries all the labels of selector,
+// an empty selector matches every tunnel
+func (t *Tunnel) MatchLabels(selector map[string]string) bool {
+	return matchLabels(t.Labels, selector)
+}
+
+// MatchLabels reports whether the closed tunnel carried all the labels of
+// selector
+func (t ClosedTunnel) MatchLabels(selector map[string]string) bool {
+	return matchLabels(t.Labels, selector)
+}
+
+func matchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// CloseTunnelsWithLabels closes the tunnels matching selector and returns how
+// many were closed
+func (tm *TunnelManager) CloseTunnelsWithLabels(selector map[string]string) int {
+	tm.mu.Lock()
+	var closed []*Tunnel
+	for key, t := range tm.tunnels {
+		if t.MatchLabels(selector) {
+			closed = append(closed, tm.detachLocked(key, ReasonClosed))
+		}
+	}
+	tm.mu.Unlock()
+
+	shutdownAll(closed)
+	return len(closed)
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import "time"
+
+// Number of keepalive round trips averaged into the latency of a tunnel
+const latencyWindow = 6
+
+// recordKeepAlive records the round trip time of a keepalive request, or
+// its failure
+func (t *Tunnel) recordKeepAlive(rtt time.Duration, err error) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	if err != nil {
+		t.keepAliveFailures++
+		return
+	}
+	t.rtts = append(t.rtts, rtt)
+	if len(t.rtts) > latencyWindow {
+		t.rtts = t.rtts[len(t.rtts)-latencyWindow:]
+	}
+}
+
+// resetLatency forgets the round trips measured on a previous SSH
+// connection, which may have taken another path
+func (t *Tunnel) resetLatency() {
+	t.stateMu.Lock()
+	t.rtts = nil
+	t.stateMu.Unlock()
+}
+
+// latency returns the average of the last keepalive round trips, 0 if none
+// succeeded yet, and the number of failed keepalives
+func (t *Tunnel) latency() (time.Duration, uint64) {
+	t.stateMu.RLock()
+	defer t.stateMu.RUnlock()
+
+	if len(t.rtts) == 0 {
+		return 0, t.keepAliveFailures
+	}
+	var total time.Duration
+	for _, rtt := range t.rtts {
+		total += rtt
+	}
+	return total / time.Duration(len(t.rtts)), t.keepAliveFailures
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel tells how much a tunnel writes to the log
+type LogLevel int
+
+const (
+	LogDefault LogLevel = iota // The level of the manager
+	LogError                   // Only errors
+	LogInfo                    // Also the changes of state, such as reconnections
+	LogDebug                   // Also every connection and keepalive
+)
+
+// ParseLogLevel parses error, info, debug or default, default when empty
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "", "default":
+		return LogDefault, nil
+	case "error":
+		return LogError, nil
+	case "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	default:
+		return 0, fmt.Errorf("invalid log level %q: expected error, info, debug or default", s)
+	}
+}
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogError:
+		return "error"
+	case LogInfo:
+		return "info"
+	case LogDebug:
+		return "debug"
+	default:
+		return "default"
+	}
+}
+
+// SetLogLevel changes how much a tunnel writes to the log, LogDefault
+// going back to the level of the manager
+func (tm *TunnelManager) SetLogLevel(host string, remotePort, localPort int, level LogLevel) error {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return err
+	}
+	if level == LogDefault {
+		level = tm.LogLevel
+	}
+	t.logLevel.Store(int32(level))
+	t.printf("Log level set to %s", level)
+	return nil
+}
+
+// LogLevel returns how much the tunnel writes to the log
+func (t *Tunnel) LogLevel() LogLevel {
+	return LogLevel(t.logLevel.Load())
+}
+
+// printf writes a message of the tunnel to the log whatever its level
+func (t *Tunnel) printf(format string, args ...interface{}) {
+	_, remotePort := t.ports()
+	log.Printf("[%s:%d] %s", t.Host, remotePort, fmt.Sprintf(format, args...))
+}
+
+// logf writes a message of the tunnel to the log from the info level
+func (t *Tunnel) logf(format string, args ...interface{}) {
+	if t.LogLevel() >= LogInfo {
+		t.printf(format, args...)
+	}
+}
+
+// debugf writes a message of the tunnel to the log at the debug level
+func (t *Tunnel) debugf(format string, args ...interface{}) {
+	if t.LogLevel() >= LogDebug {
+		t.printf(format, args...)
+	}
+}
@@ -0,0 +1,340 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages of the OpenSSH multiplexing protocol, see PROTOCOL.mux
+const (
+	muxHello            = 0x00000001
+	muxAliveCheck       = 0x10000004
+	muxNewStdioForward  = 0x10000008
+	muxPermissionDenied = 0x80000002
+	muxFailure          = 0x80000003
+	muxAlive            = 0x80000005
+	muxSessionOpened    = 0x80000006
+	muxProtocolVersion  = 4
+)
+
+const (
+	// Limit of the messages of the master, which are small
+	muxMaxMessageSize = 256 * 1024
+
+	// How long talking to the master may take when the caller sets no limit
+	muxTimeout = 10 * time.Second
+)
+
+// muxTransport forwards the connections of a tunnel through the
+// ControlMaster connection of OpenSSH listening on a control socket, like ssh
+// -W with ControlPath, so that the machine is only authenticated once, by
+// ssh. Each connection gets its own connection to the control socket, which
+// the master ties to a channel of its SSH connection.
+type muxTransport struct {
+	path      string
+	requestID atomic.Uint32
+
+	conns map[*muxConn]bool // Closed along with the transport
+	mu    sync.Mutex
+}
+
+// dialMux checks that the ControlMaster of the control socket of opts is
+// running, and returns the transport forwarding through it
+func dialMux(ctx context.Context, host string, opts sshOptions) (transport, error) {
+	path := expandControlPath(host, opts)
+	t := &muxTransport{path: path, conns: make(map[*muxConn]bool)}
+	timeout := opts.connectTimeout
+	if timeout == 0 {
+		timeout = muxTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	if err := t.ping(timeout); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// control opens a connection to the control socket and exchanges the hello
+// messages, within the deadline
+func (t *muxTransport) control(deadline time.Time) (*net.UnixConn, error) {
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial("unix", t.path)
+	if err != nil {
+		return nil, errorf(ErrHostUnreachable, "no ControlMaster on %s: %v", t.path, err)
+	}
+	ctl := conn.(*net.UnixConn)
+	ctl.SetDeadline(deadline)
+
+	hello, err := readMuxMessage(ctl)
+	if err == nil && muxUint32(&hello) != muxHello {
+		err = errors.New("unexpected message instead of hello")
+	}
+	if err == nil {
+		err = writeMuxMessage(ctl, muxHello, muxProtocolVersion)
+	}
+	if err != nil {
+		ctl.Close()
+		return nil, errorf(ErrHostUnreachable, "ControlMaster on %s: %v", t.path, err)
+	}
+	return ctl, nil
+}
+
+// ping checks that the master is alive
+func (t *muxTransport) ping(timeout time.Duration) error {
+	ctl, err := t.control(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	id := t.requestID.Add(1)
+	if err := writeMuxMessage(ctl, muxAliveCheck, id); err != nil {
+		return fmt.Errorf("ControlMaster on %s: %v", t.path, err)
+	}
+	reply, err := readMuxReply(ctl, id)
+	if err != nil {
+		return fmt.Errorf("ControlMaster on %s: %v", t.path, err)
+	}
+	if reply != muxAlive {
+		return fmt.Errorf("ControlMaster on %s: unexpected reply %#x to alive check", t.path, reply)
+	}
+	return nil
+}
+
+// DialContext asks the master to forward a new connection to addr, which it
+// opens from the machine
+func (t *muxTransport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	deadline := time.Now().Add(muxTimeout)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+	ctl, err := t.control(deadline)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { ctl.Close() })
+	defer stop()
+
+	// The master reads and writes the forwarded connection through the
+	// other end of a socket pair, given as both stdin and stdout of ssh -W
+	local, remote, err := muxSocketPair()
+	if err != nil {
+		ctl.Close()
+		return nil, err
+	}
+	defer remote.Close()
+
+	id := t.requestID.Add(1)
+	err = writeMuxMessage(ctl, muxNewStdioForward, id, "", host, uint32(port))
+	for i := 0; i < 2 && err == nil; i++ {
+		err = sendMuxFile(ctl, remote)
+	}
+	var reply uint32
+	if err == nil {
+		reply, err = readMuxReply(ctl, id)
+	}
+	if err != nil {
+		local.Close()
+		ctl.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ControlMaster on %s: %v", t.path, err)
+	}
+	if reply != muxSessionOpened {
+		local.Close()
+		ctl.Close()
+		return nil, fmt.Errorf("ControlMaster on %s: unexpected reply %#x to forward", t.path, reply)
+	}
+	ctl.SetDeadline(time.Time{})
+
+	conn := &muxConn{Conn: local, ctl: ctl, transport: t}
+	t.mu.Lock()
+	t.conns[conn] = true
+	t.mu.Unlock()
+	return conn, nil
+}
+
+func (t *muxTransport) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: t.path, Net: "unix"}
+}
+
+// Close cuts the connections forwarded through the master, which keeps its
+// own SSH connection
+func (t *muxTransport) Close() error {
+	t.mu.Lock()
+	conns := t.conns
+	t.conns = make(map[*muxConn]bool)
+	t.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// muxConn is a connection forwarded by the master, which forwards it as long
+// as ctl is open
+type muxConn struct {
+	net.Conn
+	ctl       *net.UnixConn
+	transport *muxTransport
+	closeOnce sync.Once
+}
+
+// CloseWrite half-closes the connection, the master sends the end of the
+// stream to the machine
+func (c *muxConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// CloseRead stops reading the connection
+func (c *muxConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.Close()
+		c.ctl.Close()
+		c.transport.mu.Lock()
+		delete(c.transport.conns, c)
+		c.transport.mu.Unlock()
+	})
+	return nil
+}
+
+// writeMuxMessage writes a message made of uint32 and string fields
+func writeMuxMessage(w io.Writer, fields ...interface{}) error {
+	var body []byte
+	for _, field := range fields {
+		switch v := field.(type) {
+		case int:
+			body = binary.BigEndian.AppendUint32(body, uint32(v))
+		case uint32:
+			body = binary.BigEndian.AppendUint32(body, v)
+		case string:
+			body = binary.BigEndian.AppendUint32(body, uint32(len(v)))
+			body = append(body, v...)
+		}
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// readMuxMessage reads the body of a message
+func readMuxMessage(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > muxMaxMessageSize {
+		return nil, fmt.Errorf("invalid message of %d bytes", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// readMuxReply reads the reply to the request id and returns its type,
+// failing with the reason of the master when it denied the request
+func readMuxReply(r io.Reader, id uint32) (uint32, error) {
+	body, err := readMuxMessage(r)
+	if err != nil {
+		return 0, err
+	}
+	kind := muxUint32(&body)
+	if got := muxUint32(&body); got != id {
+		return 0, fmt.Errorf("reply to request %d instead of %d", got, id)
+	}
+	switch kind {
+	case muxPermissionDenied:
+		return 0, fmt.Errorf("permission denied: %s", muxString(&body))
+	case muxFailure:
+		return 0, fmt.Errorf("%s", muxString(&body))
+	}
+	return kind, nil
+}
+
+// muxUint32 consumes a uint32 field of a message, 0 once it is exhausted
+func muxUint32(body *[]byte) uint32 {
+	if len(*body) < 4 {
+		*body = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(*body)
+	*body = (*body)[4:]
+	return v
+}
+
+// muxString consumes a string field of a message
+func muxString(body *[]byte) string {
+	n := int(muxUint32(body))
+	if n > len(*body) {
+		n = len(*body)
+	}
+	s := string((*body)[:n])
+	*body = (*body)[n:]
+	return s
+}
+
+// expandControlPath replaces the tokens of a ControlPath like ssh: %h the
+// address dialed, %n the host as given, %p the port, %r the user, %C a hash
+// of %l%h%p%r and the jump host, %l and %L the local host name and its first
+// component, %u and %i the local user and its ID, and %% a percent sign
+func expandControlPath(host string, opts sshOptions) string {
+	local, _ := os.Hostname()
+	short, _, _ := strings.Cut(local, ".")
+	var localUser string
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+	target, port := opts.target(host), strconv.Itoa(opts.port)
+	hash := sha1.Sum([]byte(local + target + port + opts.config.User + opts.jumpHost))
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%C", hex.EncodeToString(hash[:]),
+		"%h", target,
+		"%n", host,
+		"%p", port,
+		"%r", opts.config.User,
+		"%l", local,
+		"%L", short,
+		"%u", localUser,
+		"%i", strconv.Itoa(os.Getuid()),
+	).Replace(opts.controlPath)
+}
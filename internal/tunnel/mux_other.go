@@ -0,0 +1,40 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// muxSocketPair returns the two ends of a connection forwarded by the
+// master: the one of the tunnel and the one handed over to the master
+func muxSocketPair() (net.Conn, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create socket pair: %w", err)
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "mux")
+	defer local.Close()
+	conn, err := net.FileConn(local)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return conn, os.NewFile(uintptr(fds[1]), "mux"), nil
+}
+
+// sendMuxFile passes f to the master, along with a single byte like ssh
+func sendMuxFile(ctl *net.UnixConn, f *os.File) error {
+	_, _, err := ctl.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
@@ -0,0 +1,19 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// errMuxUnsupported is returned on Windows, where OpenSSH has no
+// ControlMaster
+var errMuxUnsupported = errors.New("ControlMaster sockets are not supported on Windows")
+
+func muxSocketPair() (net.Conn, *os.File, error) {
+	return nil, nil, errMuxUnsupported
+}
+
+func sendMuxFile(ctl *net.UnixConn, f *os.File) error {
+	return errMuxUnsupported
+}
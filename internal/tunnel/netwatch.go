@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the clocks are compared to notice a sleep of the system,
+	// and the lag of the monotonic clock behind the wall clock, which
+	// stops during sleep, telling the system slept
+	wakeCheckInterval = 5 * time.Second
+	wakeThreshold     = 5 * time.Second
+
+	// Network changes come in bursts, such as an interface losing its
+	// address then getting a new one: they are handled once none came for
+	// this long
+	networkSettle = time.Second
+)
+
+// Reasons of the reconnections triggered by WatchNetwork
+const (
+	reasonWake          = "system woke up"
+	reasonNetworkChange = "network changed"
+)
+
+// WatchNetwork reconnects the tunnels as soon as the system wakes up from
+// sleep or its network changes, such as another Wi-Fi, a VPN going up or down
+// or a new route, instead of waiting for keepalives to fail and backoffs to
+// expire. Interfaces are watched with netlink on Linux and polled elsewhere.
+// It returns once ctx is done.
+func (tm *TunnelManager) WatchNetwork(ctx context.Context) {
+	changes := make(chan struct{}, 1)
+	go func() {
+		if err := watchInterfaces(ctx, changes); err != nil {
+			log.Printf("Warning: not watching network changes: %v", err)
+		}
+	}()
+
+	ticker := time.NewTicker(wakeCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// Round(0) strips the monotonic reading, leaving the wall clock
+			slept := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+			last = now
+			if slept > wakeThreshold {
+				log.Printf("System woke up after sleeping for %s, checking the tunnels", slept.Round(time.Second))
+				tm.checkConnections(reasonWake, localAddresses())
+			}
+		case <-changes:
+			settled = time.After(networkSettle)
+		case <-settled:
+			settled = nil
+			log.Printf("Network changed, checking the tunnels")
+			tm.checkConnections(reasonNetworkChange, localAddresses())
+		}
+	}
+}
+
+// checkConnections checks all the tunnels at once after a sleep or a network
+// change, see networkChanged. addrs are the local addresses of the system.
+func (tm *TunnelManager) checkConnections(reason string, addrs map[string]bool) {
+	tm.mu.RLock()
+	tunnels := make([]*Tunnel, 0, len(tm.tunnels))
+	for _, t := range tm.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	tm.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.networkChanged(reason, addrs)
+		}()
+	}
+	wg.Wait()
+}
+
+// networkChanged reconnects the tunnel when its SSH connection did not
+// survive a sleep or a network change: its local address is gone, or it does
+// not answer a keepalive. A tunnel which is already reconnecting retries at
+// once, and one which gave up starts over.
+func (t *Tunnel) networkChanged(reason string, addrs map[string]bool) {
+	select {
+	case <-t.connected():
+	default:
+		select {
+		case t.retryNow <- struct{}{}:
+		default:
+		}
+		t.requestReconnect(reason)
+		return
+	}
+
+	client := t.sshClient()
+	if ip := localIP(client); ip != "" && addrs != nil && !addrs[ip] {
+		t.logf("SSH connection from %s lost: %s, reconnecting", ip, reason)
+	} else if err := client.ping(t.KeepAlive.timeout()); err != nil {
+		t.logf("SSH connection lost: %s, keepalive failed: %v, reconnecting", reason, err)
+	} else {
+		t.debugf("SSH connection still up: %s", reason)
+		return
+	}
+	t.markDisconnected()
+	t.requestReconnect(reason)
+}
+
+// localIP returns the local address of the SSH connection, empty for the
+// transports which do not have one
+func localIP(client transport) string {
+	conn, ok := client.(interface{ LocalAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// localAddresses returns the addresses of the interfaces of the system, nil
+// if they cannot be listed
+func localAddresses() map[string]bool {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	addrs := make(map[string]bool)
+	for _, addr := range ifaceAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			addrs[ipNet.IP.String()] = true
+		}
+	}
+	return addrs
+}
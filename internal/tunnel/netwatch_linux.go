@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Multicast groups of rtnetlink, which package syscall does not define
+const (
+	rtmgrpLink       uint32 = 0x1
+	rtmgrpIPv4Ifaddr        = 0x10
+	rtmgrpIPv4Route         = 0x40
+	rtmgrpIPv6Ifaddr        = 0x100
+	rtmgrpIPv6Route         = 0x400
+)
+
+// watchInterfaces signals the changes of the links, addresses and routes of
+// the system, as reported by netlink, until ctx is done
+func watchInterfaces(ctx context.Context, changes chan<- struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	groups := rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	// Non-blocking, so that closing the file interrupts Read
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		if _, err := f.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Messages were dropped since the buffer of the socket
+			// overflowed, which still means the network changed
+			if !errors.Is(err, syscall.ENOBUFS) {
+				return err
+			}
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often the addresses of the interfaces are compared, where there is no
+// netlink to be told about their changes
+const interfacePollInterval = 2 * time.Second
+
+// watchInterfaces signals the changes of the addresses of the system, polled
+// every interfacePollInterval, until ctx is done
+func watchInterfaces(ctx context.Context, changes chan<- struct{}) error {
+	ticker := time.NewTicker(interfacePollInterval)
+	defer ticker.Stop()
+
+	last := addressesKey()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if key := addressesKey(); key != last {
+			last = key
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// addressesKey returns the addresses of the system in a comparable form
+func addressesKey() string {
+	var addrs []string
+	for addr := range localAddresses() {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,27 @@
+package tunnel
+
+import "time"
+
+// How often the owner of a tunnel is checked
+const ownerCheckInterval = time.Second
+
+// watchOwner closes the tunnel once the process it is bound to exits
+func (t *Tunnel) watchOwner() {
+	ticker := time.NewTicker(ownerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			if ProcessRunning(t.OwnerPID) {
+				continue
+			}
+			t.logf("Owner process %d exited, closing the tunnel", t.OwnerPID)
+			// shutdown waits for the workers, including this one
+			go t.closeSelf(ReasonOwnerExited)
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+// PauseTunnel makes a tunnel refuse new connections while keeping its
+// definition, SSH connection and local port. With sever, the connections in
+// progress are closed as well.
+func (tm *TunnelManager) PauseTunnel(host string, remotePort, localPort int, sever bool) error {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return err
+	}
+
+	t.stateMu.Lock()
+	wasPaused := t.paused
+	t.paused = true
+	t.stateMu.Unlock()
+
+	if sever {
+		t.connectionMu.RLock()
+		for _, c := range t.conns {
+			c.local.Close()
+		}
+		t.connectionMu.RUnlock()
+	}
+
+	if !wasPaused {
+		t.logf("Tunnel paused")
+		t.emit(EventTunnelPaused, "")
+	}
+	return nil
+}
+
+// ResumeTunnel makes a paused tunnel accept connections again
+func (tm *TunnelManager) ResumeTunnel(host string, remotePort, localPort int) error {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return err
+	}
+
+	t.stateMu.Lock()
+	wasPaused := t.paused
+	t.paused = false
+	t.stateMu.Unlock()
+
+	if wasPaused {
+		t.logf("Tunnel resumed")
+		t.emit(EventTunnelResumed, "")
+	}
+	return nil
+}
+
+// Paused reports whether the tunnel refuses new connections
+func (t *Tunnel) Paused() bool {
+	t.stateMu.RLock()
+	defer t.stateMu.RUnlock()
+	return t.paused
+}
+
+// get returns the tunnel forwarding localPort to remotePort of host, see find
+func (tm *TunnelManager) get(host string, remotePort, localPort int) (*Tunnel, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	key, err := tm.find(host, remotePort, localPort)
+	if err != nil {
+		return nil, err
+	}
+	return tm.tunnels[key], nil
+}
@@ -0,0 +1,181 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Number of ports after the requested one searched for a free port
+const freePortSearch = 100
+
+// PortInUseError is returned when the local port of a tunnel is already bound
+type PortInUseError struct {
+	Port      int
+	Process   string // Name of the process holding the port, empty if unknown
+	PID       int    // PID of the process holding the port, 0 if unknown
+	Suggested int    // Next free port, 0 if none was found
+}
+
+func (e *PortInUseError) Error() string {
+	msg := fmt.Sprintf("local port %d: address already in use", e.Port)
+	if e.PID != 0 {
+		msg += fmt.Sprintf(" by %s (pid %d)", e.Process, e.PID)
+	}
+	return msg
+}
+
+func (e *PortInUseError) Unwrap() error {
+	return ErrBindFailed
+}
+
+// listenLocal binds the local end of a tunnel on every bind address or, when
+// there are none, on the loopback address of the family. Conflicts are
+// reported as a PortInUseError.
+func listenLocal(port int, family AddressFamily, binds []string) ([]net.Listener, error) {
+	if len(binds) == 0 {
+		listener, err := listenLoopback(port, family)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	var listeners []net.Listener
+	for _, addr := range binds {
+		listener, err := listenTCP(net.JoinHostPort(normalizeHost(addr), strconv.Itoa(port)), port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, listenError(port, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenLoopback binds port on the loopback address of the family. When a
+// family is only preferred, the other one is used if the preferred one is not
+// available.
+func listenLoopback(port int, family AddressFamily) (net.Listener, error) {
+	var err error
+	for _, ip := range family.loopbacks() {
+		var listener net.Listener
+		listener, err = listenTCP(net.JoinHostPort(ip, strconv.Itoa(port)), port)
+		if err == nil {
+			return listener, nil
+		}
+		if errors.Is(err, errAddrInUse) {
+			break
+		}
+	}
+	return nil, listenError(port, err)
+}
+
+// listenError turns an address conflict into a PortInUseError
+func listenError(port int, err error) error {
+	if errors.Is(err, ErrBindFailed) {
+		return err
+	}
+	if !errors.Is(err, errAddrInUse) {
+		return errorf(ErrBindFailed, "failed to start local listener: %v", err)
+	}
+
+	portErr := &PortInUseError{
+		Port:      port,
+		Suggested: FreePort(port + 1),
+	}
+	portErr.PID, portErr.Process = portHolder(port)
+	return portErr
+}
+
+// FreePort returns the first port from start which can be bound locally, or 0
+// if none was found
+func FreePort(start int) int {
+	for port := start; port < start+freePortSearch && port <= 65535; port++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+		if err == nil {
+			listener.Close()
+			return port
+		}
+	}
+	return 0
+}
+
+// portHolder finds the process listening on a TCP port, from /proc on Linux
+// and with lsof elsewhere. It returns a zero PID when the process cannot be
+// found, typically because it belongs to another user.
+func portHolder(port int) (int, string) {
+	if pid := procPortHolder(port); pid != 0 {
+		comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		return pid, strings.TrimSpace(string(comm))
+	}
+	return lsofPortHolder(port)
+}
+
+func procPortHolder(port int) int {
+	inodes := make(map[string]bool)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[3] != "0A" { // 0A is LISTEN
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			if p, err := strconv.ParseInt(hexPort, 16, 32); err == nil && int(p) == port {
+				inodes["socket:["+fields[9]+"]"] = true
+			}
+		}
+		f.Close()
+	}
+	if len(inodes) == 0 {
+		return 0
+	}
+
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !inodes[target] {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.Split(fd, "/")[2])
+		return pid
+	}
+	return 0
+}
+
+func lsofPortHolder(port int) (int, string) {
+	out, err := exec.Command("lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return 0, ""
+	}
+
+	// Output fields are prefixed by their name: p for the PID, c for the command
+	var pid int
+	var name string
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p") && pid == 0:
+			pid, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "c") && name == "":
+			name = line[1:]
+		}
+	}
+	return pid, name
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Ports below this one need privileges to be bound
+const privilegedPorts = 1024
+
+// BindHelperName is the name of the helper binding privileged ports for the
+// daemon, which is looked up next to the executable and then in PATH
+const BindHelperName = "tunnel-bind"
+
+// Helper binding privileged ports, empty when disabled
+var bindHelper = BindHelperName
+
+// SetBindHelper sets the helper which binds the local ports below 1024 when
+// the daemon is not allowed to, either a path or a name looked up next to the
+// executable and then in PATH. An empty helper disables it. It must be
+// called before any tunnel is created.
+func SetBindHelper(helper string) {
+	bindHelper = helper
+}
+
+// findBindHelper returns the path of the helper binding privileged ports
+func findBindHelper() (string, error) {
+	if bindHelper == "" {
+		return "", errors.New("the bind helper is disabled")
+	}
+	if strings.ContainsRune(bindHelper, filepath.Separator) {
+		return bindHelper, nil
+	}
+	if exe, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(exe), bindHelper)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(bindHelper)
+	if err != nil {
+		return "", fmt.Errorf("%s is not installed", bindHelper)
+	}
+	return path, nil
+}
+
+// listenTCP binds addr, going through the bind helper when the port is
+// privileged and the daemon may not bind it itself
+func listenTCP(addr string, port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err == nil || port >= privilegedPorts || !errors.Is(err, errAccess) {
+		return listener, err
+	}
+
+	helper, helperErr := findBindHelper()
+	if helperErr != nil {
+		return nil, errorf(ErrPrivilegedPort, "local port %d needs privileges to be bound and %v", port, helperErr)
+	}
+	listener, helperErr = helperListen(helper, addr)
+	if helperErr != nil {
+		return nil, errorf(ErrPrivilegedPort, "local port %d needs privileges to be bound and %s failed: %v", port, helper, helperErr)
+	}
+	return listener, nil
+}
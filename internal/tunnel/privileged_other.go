@@ -0,0 +1,95 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long the bind helper may take to hand over the listening socket
+const bindHelperTimeout = 10 * time.Second
+
+// helperListen runs the bind helper to bind addr. The helper gets one end of
+// a socket pair as file descriptor 3 and sends the listening socket over it
+// before exiting.
+func helperListen(helper, addr string) (net.Listener, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket pair: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "bind-helper")
+	remote := os.NewFile(uintptr(fds[1]), "bind-helper")
+	defer local.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(helper, addr)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, recvErr := receiveListener(local)
+	if recvErr != nil {
+		cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return listener, recvErr
+}
+
+// receiveListener reads a listening socket sent over a unix socket
+func receiveListener(f *os.File) (net.Listener, error) {
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket")
+	}
+	unixConn.SetReadDeadline(time.Now().Add(bindHelperTimeout))
+
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := unixConn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("no socket received: %w", err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.New("no socket received")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, errors.New("no socket received")
+	}
+
+	file := os.NewFile(uintptr(fds[0]), "listener")
+	defer file.Close()
+	return net.FileListener(file)
+}
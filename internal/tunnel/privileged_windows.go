@@ -0,0 +1,12 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+// helperListen is not supported on Windows, which lets any user bind the
+// ports below 1024
+func helperListen(helper, addr string) (net.Listener, error) {
+	return nil, errors.New("the bind helper is not supported on Windows")
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Delay between two probe attempts
+	probeRetryInterval = 500 * time.Millisecond
+
+	// How long the pre-check waits for the remote port
+	preCheckTimeout = 5 * time.Second
+)
+
+// PreCheck tells whether CreateTunnel checks that something listens on the
+// remote port before reporting success
+type PreCheck int
+
+const (
+	PreCheckNone PreCheck = iota
+	PreCheckWarn          // Create the tunnel anyway, with a warning
+	PreCheckFail          // Fail the creation
+)
+
+// ParsePreCheck parses none, warn or fail, none when empty
+func ParsePreCheck(s string) (PreCheck, error) {
+	switch s {
+	case "", "none":
+		return PreCheckNone, nil
+	case "warn":
+		return PreCheckWarn, nil
+	case "fail":
+		return PreCheckFail, nil
+	default:
+		return 0, fmt.Errorf("invalid pre-check %q: expected none, warn or fail", s)
+	}
+}
+
+// checkRemotePort opens and closes a connection to the remote port through
+// a new transport
+func checkRemotePort(ctx context.Context, client transport, remotePort int) error {
+	ctx, cancel := context.WithTimeout(ctx, preCheckTimeout)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", remotePort))
+	if err != nil {
+		return fmt.Errorf("nothing accepts connections on remote port %d: %v", remotePort, err)
+	}
+	return conn.Close()
+}
+
+// Probe waits until the service behind a tunnel accepts connections, or
+// timeout elapses. With an empty path, a TCP connection to the remote port
+// is opened through the SSH connection. With a path, an HTTP GET is sent
+// through the local port and any response counts as ready.
+func (tm *TunnelManager) Probe(host string, remotePort, localPort int, path string, timeout time.Duration) error {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return err
+	}
+
+	probe := t.probeTCP
+	if path != "" {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		probe = func() error { return t.probeHTTP(path) }
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probe()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(probeRetryInterval).After(deadline) {
+			return errorf(ErrNotReady, "remote service not ready after %s: %v", timeout, err)
+		}
+
+		select {
+		case <-t.ctx.Done():
+			return fmt.Errorf("tunnel closed while waiting for the remote service")
+		case <-time.After(probeRetryInterval):
+		}
+	}
+}
+
+func (t *Tunnel) probeTCP() error {
+	_, remotePort := t.ports()
+	conn, err := t.sshClient().DialContext(t.ctx, "tcp", fmt.Sprintf("localhost:%d", remotePort))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (t *Tunnel) probeHTTP(path string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	localPort, _ := t.ports()
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", localPort, path))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
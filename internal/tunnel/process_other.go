@@ -0,0 +1,23 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ProcessRunning reports whether the process pid exists, even if it belongs
+// to another user
+func ProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,31 @@
+package tunnel
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259 // Exit code of a running process
+)
+
+// ProcessRunning reports whether the process pid exists, even if it belongs
+// to another user. Windows keeps the processes which exited as long as a
+// handle refers to them, so the exit code tells whether it still runs.
+func ProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+	}
+	defer syscall.CloseHandle(handle)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
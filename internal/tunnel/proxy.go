@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// Ports of the proxies given without one
+var defaultProxyPorts = map[string]string{
+	"socks5":  "1080",
+	"socks5h": "1080",
+	"http":    "8080",
+}
+
+// parseProxy parses a socks5://, socks5h:// or http:// proxy with an optional
+// user and password, nil when empty. With socks5h:// and http:// the proxy
+// resolves the SSH host instead of the daemon.
+func parseProxy(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", value, err)
+	}
+	port, ok := defaultProxyPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid proxy %s: expected socks5://, socks5h:// or http://", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// dialProxy connects to the SSH server of host through the proxy of opts,
+// like ssh with ProxyCommand nc -X 5 or nc -X connect
+func dialProxy(ctx context.Context, host string, opts sshOptions) (*ssh.Client, error) {
+	timeout := opts.connectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	forward := &net.Dialer{KeepAlive: opts.keepAlive.tcpPeriod()}
+
+	var dialer proxy.ContextDialer
+	if opts.proxy.Scheme == "http" {
+		dialer = &connectDialer{proxy: opts.proxy, forward: forward}
+	} else {
+		var auth *proxy.Auth
+		if user := opts.proxy.User; user != nil {
+			password, _ := user.Password()
+			auth = &proxy.Auth{User: user.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", opts.proxy.Host, auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", opts.proxy.Redacted(), err)
+		}
+		dialer = socks.(proxy.ContextDialer)
+	}
+
+	targets := []string{opts.target(host)}
+	if opts.proxy.Scheme == "socks5" {
+		var err error
+		if targets, err = opts.family.resolve(ctx, opts.target(host)); err != nil {
+			return nil, errorf(ErrHostNotFound, "failed to resolve host: %v", err)
+		}
+	}
+
+	// The timeout covers the connection to the proxy and the one it makes
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	for _, target := range targets {
+		conn, err = dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(target, strconv.Itoa(opts.port)))
+		if err == nil || dialCtx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errorf(dialErrorKind(err), "failed to connect to host through proxy %s: %v", opts.proxy.Host, err)
+	}
+
+	// The host key is checked against the name of the host, not its address
+	return handshakeSSH(ctx, conn, net.JoinHostPort(host, strconv.Itoa(opts.port)), opts)
+}
+
+// connectDialer opens connections through an HTTP proxy with CONNECT
+// requests, authenticated with basic auth when the proxy has a user
+type connectDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	// The request does not take a context, closing the connection is the
+	// only way to interrupt it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.proxy.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", d.proxy.Host, addr, resp.Status)
+	}
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a connection whose first bytes were read ahead, such as
+// the SSH banner sent along with the answer of a proxy
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,221 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Bytes of the error output of a proxy command kept for the messages
+const proxyCommandStderr = 4096
+
+// How long a closed proxy command may take to exit once its standard input
+// is closed, before it is killed
+const proxyCommandGrace = 100 * time.Millisecond
+
+// Characters the shell running a proxy command interprets, which the values
+// of its tokens may not contain, like ssh
+const shellCharacters = "'`\"$\\;&<>|(){}*?[]~#!\n\r\t "
+
+// expandProxyCommand replaces the tokens of a ProxyCommand like ssh: %h the
+// address dialed, %n the host as given, %p the port, %r the user and %% a
+// percent sign. The command runs with the shell, so values it would
+// interpret are refused, as the host comes from the requests.
+func expandProxyCommand(host string, opts sshOptions) (string, error) {
+	for _, token := range []struct{ name, value string }{
+		{"host", host},
+		{"address", opts.target(host)},
+		{"user", opts.config.User},
+	} {
+		if strings.ContainsAny(token.value, shellCharacters) || strings.HasPrefix(token.value, "-") {
+			return "", fmt.Errorf("invalid %s %q for a proxy command", token.name, token.value)
+		}
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", opts.target(host),
+		"%n", host,
+		"%p", strconv.Itoa(opts.port),
+		"%r", opts.config.User,
+	).Replace(opts.proxyCommand), nil
+}
+
+// dialCommand runs the ProxyCommand of opts and connects to the SSH server of
+// host over its standard input and output, like ssh. The command lives as
+// long as the connection and is killed with it.
+func dialCommand(ctx context.Context, host string, opts sshOptions) (*ssh.Client, error) {
+	command, err := expandProxyCommand(host, opts)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := startCommand(command)
+	if err != nil {
+		return nil, errorf(ErrHostUnreachable, "failed to run proxy command: %v", err)
+	}
+
+	// The command stands for the connection to the SSH server: without a
+	// handshake timeout, the connect timeout limits the handshake
+	if opts.handshakeTimeout == 0 {
+		opts.handshakeTimeout = opts.connectTimeout
+		if opts.handshakeTimeout == 0 {
+			opts.handshakeTimeout = DefaultConnectTimeout
+		}
+	}
+	client, err := handshakeSSH(ctx, conn, net.JoinHostPort(host, strconv.Itoa(opts.port)), opts)
+	// Failures which are not about SSH itself come from the command, such as
+	// one which could not reach the machine
+	var kind *kindError
+	if err != nil && !errors.As(err, &kind) {
+		if exit := conn.exitError(); exit != "" {
+			return nil, errorf(ErrHostUnreachable, "%v, proxy command failed: %s", err, exit)
+		}
+	}
+	return client, err
+}
+
+// commandConn is a connection made of the standard input and output of a
+// proxy command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File // Written to the command
+	stdout *os.File // Read from the command
+	stderr *tailBuffer
+
+	done      chan struct{} // Closed once the command exited
+	waitErr   error
+	killed    bool // By Close, as it did not exit on its own
+	closeOnce sync.Once
+}
+
+// startCommand starts a proxy command with the shell of the system
+func startCommand(command string) (*commandConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+
+	c := &commandConn{
+		cmd:    shellCommand(command),
+		stdin:  stdinW,
+		stdout: stdoutR,
+		stderr: &tailBuffer{max: proxyCommandStderr},
+		done:   make(chan struct{}),
+	}
+	c.cmd.Stdin = stdinR
+	c.cmd.Stdout = stdoutW
+	c.cmd.Stderr = c.stderr
+	// Children of the command holding its error output do not delay Wait
+	c.cmd.WaitDelay = time.Second
+	err = c.cmd.Start()
+	// The command has its own copies of its ends of the pipes
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+
+	go func() {
+		c.waitErr = c.cmd.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// exitError describes how the command exited with its error output once the
+// connection is closed, empty when it did not fail
+func (c *commandConn) exitError() string {
+	c.Close()
+	if c.killed || c.waitErr == nil {
+		return ""
+	}
+	msg := c.waitErr.Error()
+	if stderr := strings.TrimSpace(c.stderr.String()); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (c *commandConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *commandConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+// CloseWrite closes the standard input of the command, which sees the end
+// of the stream
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+// Close ends the standard input of the command, and kills it unless it exits
+// right away. Its output is only closed then, so that it does not fail
+// writing to it.
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		select {
+		case <-c.done:
+		case <-time.After(proxyCommandGrace):
+			c.killed = true
+			c.cmd.Process.Kill()
+			<-c.done
+		}
+		c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("local") }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr(c.cmd.String()) }
+
+// Deadlines are not supported by the pipes of every system, such as Windows
+func (c *commandConn) SetDeadline(t time.Time) error {
+	c.stdin.SetWriteDeadline(t)
+	c.stdout.SetReadDeadline(t)
+	return nil
+}
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return c.stdout.SetReadDeadline(t) }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return c.stdin.SetWriteDeadline(t) }
+
+// commandAddr is the address of a connection through a proxy command
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxycommand" }
+func (a commandAddr) String() string  { return string(a) }
+
+// tailBuffer keeps the last bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+	mu  sync.Mutex
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.buf = b.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
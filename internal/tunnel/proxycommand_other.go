@@ -0,0 +1,11 @@
+//go:build !windows
+
+package tunnel
+
+import "os/exec"
+
+// shellCommand runs a proxy command with /bin/sh, which exec's it so that
+// killing the shell kills the command, like ssh
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", "exec "+command)
+}
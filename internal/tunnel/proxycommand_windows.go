@@ -0,0 +1,8 @@
+package tunnel
+
+import "os/exec"
+
+// shellCommand runs a proxy command with cmd.exe
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd.exe", "/C", command)
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Signature starting every PROXY protocol v2 header
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyVersion2 = 0x20
+	proxyLocal    = 0x00 // The connection carries no client information
+	proxyCommand  = 0x01 // The connection was relayed on behalf of a client
+	proxyTCP4     = 0x11
+	proxyTCP6     = 0x21
+)
+
+// proxyHeader returns the PROXY protocol v2 header announcing a connection
+// from src to dst, so that the remote service sees the original client
+// address instead of the one of the SSH server
+func proxyHeader(src, dst net.Addr) []byte {
+	header := append([]byte(nil), proxySignature...)
+
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return append(header, proxyVersion2|proxyLocal, 0, 0, 0)
+	}
+
+	srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+	family := byte(proxyTCP4)
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		family = proxyTCP6
+	}
+
+	header = append(header, proxyVersion2|proxyCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcTCP.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstTCP.Port))
+	return header
+}
@@ -0,0 +1,319 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// Backoff controls how the SSH connection of a tunnel is re-established
+type Backoff struct {
+	Initial    time.Duration // Delay before the second attempt
+	Max        time.Duration // Upper bound of the delay between two attempts
+	MaxRetries int           // Attempts before giving up, 0 to retry forever
+	Window     time.Duration // Give up after retrying for this long, 0 for no limit
+	GiveUp     GiveUpAction  // What the tunnel does once it gives up
+}
+
+// GiveUpAction is what a tunnel does when its reconnection policy gives up
+type GiveUpAction int
+
+const (
+	// GiveUpWait keeps the tunnel bound, the next connection to it starts a
+	// new round of attempts
+	GiveUpWait GiveUpAction = iota
+	// GiveUpClose closes the tunnel
+	GiveUpClose
+)
+
+func (a GiveUpAction) String() string {
+	switch a {
+	case GiveUpWait:
+		return "wait"
+	case GiveUpClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseGiveUpAction parses wait or close, wait when empty
+func ParseGiveUpAction(s string) (GiveUpAction, error) {
+	switch s {
+	case "", "wait":
+		return GiveUpWait, nil
+	case "close":
+		return GiveUpClose, nil
+	default:
+		return 0, fmt.Errorf("invalid give-up action %q: expected wait or close", s)
+	}
+}
+
+// forever returns the policy retrying until the tunnel is closed, with the
+// same delays
+func (b Backoff) forever() Backoff {
+	b.MaxRetries = 0
+	b.Window = 0
+	return b
+}
+
+// DefaultBackoff retries forever, doubling the delay from 1s up to 1 minute
+var DefaultBackoff = Backoff{
+	Initial: time.Second,
+	Max:     time.Minute,
+}
+
+// DialRetry controls how each connection to a tunnel dials the remote
+// service. Timeout bounds the whole setup, including the wait for SSH while
+// it reconnects.
+type DialRetry struct {
+	Attempts int           // Dials before failing the connection
+	Backoff  time.Duration // Delay after the first failed dial, growing linearly
+	Timeout  time.Duration
+	FailFast bool // Dial once, without waiting for SSH to reconnect
+}
+
+// DefaultDialRetry dials up to 3 times within 10s, waiting 1s then 2s
+var DefaultDialRetry = DialRetry{
+	Attempts: 3,
+	Backoff:  time.Second,
+	Timeout:  10 * time.Second,
+}
+
+// next returns the delay following d
+func (b Backoff) next(d time.Duration) time.Duration {
+	return min(2*d, b.Max)
+}
+
+// jitter spreads d over [d/2, d) so that tunnels to the same machine do not
+// retry in lockstep
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// sshClient returns the current SSH client, or Kubernetes port-forward, of
+// the tunnel
+func (t *Tunnel) sshClient() transport {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
+	return t.client
+}
+
+// connected returns a channel which is closed while the SSH client is
+// connected
+func (t *Tunnel) connected() <-chan struct{} {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
+	return t.ready
+}
+
+// markDisconnected makes connections wait for the next SSH client
+func (t *Tunnel) markDisconnected() {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+	select {
+	case <-t.ready:
+		t.ready = make(chan struct{})
+	default:
+	}
+}
+
+// requestReconnect asks superviseSSH to reconnect, unless it already is
+func (t *Tunnel) requestReconnect(reason string) {
+	select {
+	case t.reconnect <- reason:
+	default:
+	}
+}
+
+// superviseSSH reconnects the SSH client when asked to, until the tunnel is
+// closed. When it gives up the tunnel stays disconnected, and the next
+// connection to the listener starts a new round of attempts.
+func (t *Tunnel) superviseSSH() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case reason := <-t.reconnect:
+			if err := t.reconnectSSH(reason); err != nil {
+				t.logf("Failed to reconnect SSH: %v", err)
+			}
+		}
+	}
+}
+
+// dialRemote connects to addr, the remote port, through SSH, following the
+// dial retry policy of the tunnel. While SSH reconnects, it waits for the
+// connection to be back, unless failing fast.
+func (t *Tunnel) dialRemote(addr string) (net.Conn, error) {
+	retry := t.DialRetry
+	ctx, cancel := context.WithTimeout(t.ctx, retry.Timeout)
+	defer cancel()
+
+	// done explains why ctx is done
+	done := func(err error) error {
+		if t.ctx.Err() != nil {
+			return fmt.Errorf("tunnel closed")
+		}
+		if err == nil {
+			return fmt.Errorf("SSH connection not available after %s", retry.Timeout)
+		}
+		return fmt.Errorf("%v after %s", err, retry.Timeout)
+	}
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		ready := t.connected()
+		select {
+		case <-ready:
+		default:
+			t.requestReconnect("new connection while disconnected")
+			if retry.FailFast {
+				return nil, fmt.Errorf("SSH connection not available")
+			}
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, done(lastErr)
+		}
+
+		client := t.sshClient()
+		remote, err := client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return remote, nil
+		}
+		if ctx.Err() != nil {
+			return nil, done(err)
+		}
+		lastErr = err
+
+		if client.ping(t.KeepAlive.timeout()) != nil {
+			// The SSH connection is dead, wait for the next one
+			t.markDisconnected()
+			t.requestReconnect(fmt.Sprintf("remote dial failed: %v", err))
+			if retry.FailFast {
+				return nil, err
+			}
+			continue
+		}
+		if retry.FailFast {
+			return nil, err
+		}
+		if attempt >= retry.Attempts {
+			return nil, fmt.Errorf("%v after %d attempts", err, attempt)
+		}
+
+		t.logf("Failed to connect to remote (attempt %d/%d): %v, retrying...", attempt, retry.Attempts, err)
+		select {
+		case <-time.After(retry.Backoff * time.Duration(attempt)):
+		case <-ctx.Done():
+			return nil, done(err)
+		}
+	}
+}
+
+// reconnectSSH replaces the SSH client of the tunnel, retrying with
+// exponential backoff until it succeeds, the policy gives up or the tunnel is
+// closed. Only superviseSSH calls it, so reconnections never overlap.
+func (t *Tunnel) reconnectSSH(reason string) error {
+	t.markDisconnected()
+	started := time.Now()
+	t.stateMu.Lock()
+	t.state = StateReconnecting
+	t.lastReconnect = started
+	t.lastReconnectReason = reason
+	t.reconnectAttempts = 0
+	t.stateMu.Unlock()
+	t.emit(EventReconnectStarted, reason)
+	select {
+	case <-t.retryNow:
+	default:
+	}
+
+	delay := t.backoff.Initial
+	for attempt := 1; ; attempt++ {
+		t.setReconnectAttempt(attempt, time.Time{})
+		client, err := dialTransport(t.ctx, t.Host, t.ssh)
+		if err == nil {
+			// shutdown closes the current client after canceling the
+			// context, so a client dialed meanwhile must not be installed
+			t.clientMu.Lock()
+			if t.ctx.Err() != nil {
+				t.clientMu.Unlock()
+				client.Close()
+				return fmt.Errorf("tunnel closed while reconnecting")
+			}
+			oldClient := t.client
+			t.client = client
+			close(t.ready)
+			t.clientMu.Unlock()
+			oldClient.Close()
+
+			if ip := remoteIP(client); ip != t.remoteIP {
+				t.logf("%s now resolves to %s (was %s)", t.Host, ip, t.remoteIP)
+				t.remoteIP = ip
+			}
+			t.resetLatency()
+			t.setState(StateConnected)
+			t.totals.reconnects.Add(1)
+			t.emit(EventReconnectSucceeded, fmt.Sprintf("after %d attempt(s)", attempt))
+			return nil
+		}
+
+		if t.ctx.Err() != nil {
+			return fmt.Errorf("tunnel closed while reconnecting")
+		}
+		t.totals.reconnectFailures.Add(1)
+		wait := jitter(delay)
+		if (t.backoff.MaxRetries > 0 && attempt >= t.backoff.MaxRetries) ||
+			(t.backoff.Window > 0 && time.Since(started)+wait > t.backoff.Window) {
+			t.giveUp(attempt, err)
+			return fmt.Errorf("failed to reconnect SSH after %d attempt(s): %v", attempt, err)
+		}
+
+		t.setReconnectAttempt(attempt, time.Now().Add(wait))
+		t.logf("SSH reconnection attempt %d failed: %v, retrying in %s", attempt, err, wait.Round(time.Millisecond))
+		t.emit(EventReconnectFailed, fmt.Sprintf("attempt %d: %v, retrying in %s", attempt, err, wait.Round(time.Millisecond)))
+
+		select {
+		case <-t.ctx.Done():
+			return fmt.Errorf("tunnel closed while reconnecting")
+		case <-time.After(wait):
+			delay = t.backoff.next(delay)
+		case <-t.retryNow:
+			// The network is back, start over from the shortest delay
+			t.logf("Network changed, retrying SSH reconnection now")
+			delay = t.backoff.Initial
+		}
+	}
+}
+
+// setReconnectAttempt records the attempt in progress, and when the next one
+// is due if it failed
+func (t *Tunnel) setReconnectAttempt(attempt int, next time.Time) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.reconnectAttempts = attempt
+	t.nextReconnect = next
+}
+
+// giveUp leaves the tunnel disconnected once its policy stops retrying, and
+// closes it if the policy says so
+func (t *Tunnel) giveUp(attempts int, err error) {
+	t.setReconnectAttempt(attempts, time.Time{})
+	t.setState(StateDisconnected)
+	t.recordError("failed to reconnect SSH, giving up after %d attempt(s): %v", attempts, err)
+	t.emit(EventReconnectFailed, fmt.Sprintf("giving up after %d attempt(s): %v", attempts, err))
+
+	if t.backoff.GiveUp == GiveUpClose && t.closeSelf != nil {
+		t.logf("Closing the tunnel, as its reconnection policy gave up")
+		// shutdown waits for superviseSSH, which is the caller
+		go t.closeSelf(ReasonGaveUp)
+	}
+}
@@ -0,0 +1,304 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KeepAlive controls how the SSH connection of a tunnel is checked, like
+// ServerAliveInterval and ServerAliveCountMax in ssh_config
+type KeepAlive struct {
+	Interval time.Duration // Between two keepalive requests, 0 disables them
+	CountMax int           // Consecutive failed requests before reconnecting
+	Timeout  time.Duration // For the answer to a request, defaultKeepAliveTimeout if 0
+}
+
+// DefaultKeepAlive checks every 10s, waiting 5s for the answer, and
+// reconnects at the first failure
+var DefaultKeepAlive = KeepAlive{
+	Interval: 10 * time.Second,
+	CountMax: 1,
+	Timeout:  defaultKeepAliveTimeout,
+}
+
+// How long a keepalive request may take by default
+const defaultKeepAliveTimeout = 5 * time.Second
+
+// timeout returns how long a keepalive request may take
+func (k KeepAlive) timeout() time.Duration {
+	if k.Timeout == 0 {
+		return defaultKeepAliveTimeout
+	}
+	return k.Timeout
+}
+
+// tcpPeriod returns the TCP keepalive period of the SSH connection, which
+// follows the keepalive requests: 15s by default
+func (k KeepAlive) tcpPeriod() time.Duration {
+	if k.Interval == 0 {
+		return 15 * time.Second
+	}
+	return k.Interval * 3 / 2
+}
+
+// DefaultConnectTimeout is how long connecting to an SSH server may take
+// unless the manager or the tunnel sets another timeout
+const DefaultConnectTimeout = 30 * time.Second
+
+// sshOptions tells how to reach the SSH server of a machine
+type sshOptions struct {
+	port      int
+	address   string   // Dialed instead of the host, which still names it for the host key
+	jumpHost  string   // [user@]host[:port] to go through, like ssh -J
+	proxy     *url.URL // SOCKS5 or HTTP proxy to go through, nil to connect directly
+	family    AddressFamily
+	config    *ssh.ClientConfig
+	keepAlive KeepAlive
+
+	connectTimeout   time.Duration // TCP connection, DefaultConnectTimeout if 0
+	handshakeTimeout time.Duration // SSH handshake, unlimited if 0
+	nagle            bool          // Leave Nagle's algorithm on, see Options
+	proxyCommand     string        // Spoken SSH to over its stdio, like ProxyCommand
+	controlPath      string        // Socket of an OpenSSH ControlMaster to forward through
+}
+
+// target returns the name or address dialed to reach host
+func (o sshOptions) target(host string) string {
+	if o.address != "" {
+		return o.address
+	}
+	return host
+}
+
+// dialSSH connects to the SSH server of host with TCP keepalives,
+// through the jump host, the proxy command or the proxy if any. The host is resolved on every call so that a
+// reconnection follows a change of address. Canceling ctx aborts both the
+// connection and the handshake.
+func dialSSH(ctx context.Context, host string, opts sshOptions) (*ssh.Client, error) {
+	if opts.jumpHost != "" {
+		return dialJump(ctx, host, opts)
+	}
+	if opts.proxyCommand != "" {
+		return dialCommand(ctx, host, opts)
+	}
+	if opts.proxy != nil {
+		return dialProxy(ctx, host, opts)
+	}
+
+	ips, err := opts.family.resolve(ctx, opts.target(host))
+	if err != nil {
+		return nil, errorf(ErrHostNotFound, "failed to resolve host: %v", err)
+	}
+
+	timeout := opts.connectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: opts.keepAlive.tcpPeriod(),
+	}
+
+	// Try the addresses in order, as net.Dial would
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(opts.port)))
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errorf(dialErrorKind(err), "failed to connect to host: %v", err)
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable keepalive: %v", err)
+	}
+	if err := tcpConn.SetKeepAlivePeriod(opts.keepAlive.tcpPeriod()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set keepalive period: %v", err)
+	}
+	if err := tcpConn.SetLinger(0); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set linger: %v", err)
+	}
+
+	// The host key is checked against the name of the host, not its address
+	return handshakeSSH(ctx, conn, net.JoinHostPort(host, strconv.Itoa(opts.port)), opts)
+}
+
+// handshakeSSH runs the SSH handshake over conn, which is closed on failure
+func handshakeSSH(ctx context.Context, conn net.Conn, addr string, opts sshOptions) (*ssh.Client, error) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(!opts.nagle)
+	}
+	if opts.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.handshakeTimeout)
+		defer cancel()
+	}
+	// The handshake does not take a context, closing the connection is the
+	// only way to interrupt it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, opts.config)
+	if err != nil {
+		conn.Close()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && opts.handshakeTimeout > 0 {
+			return nil, errorf(ErrTimedOut, "SSH handshake timed out after %s", opts.handshakeTimeout)
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return nil, errorf(ErrHostKeyMismatch, "failed to create SSH connection: the host key of %s changed: %v", addr, err)
+		}
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, errorf(ErrAuthFailed, "failed to create SSH connection: %v", err)
+		}
+		return nil, fmt.Errorf("failed to create SSH connection: %v", err)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// dialJump connects to host through the SSH server of the jump host, which
+// is authenticated with the same keys
+func dialJump(ctx context.Context, host string, opts sshOptions) (*ssh.Client, error) {
+	jumpHost, jumpOpts, err := parseJumpHost(opts)
+	if err != nil {
+		return nil, err
+	}
+	jump, err := dialSSH(ctx, jumpHost, jumpOpts)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", opts.jumpHost, err)
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(opts.port))
+	conn, err := jump.DialContext(ctx, "tcp", net.JoinHostPort(opts.target(host), strconv.Itoa(opts.port)))
+	if err != nil {
+		jump.Close()
+		return nil, errorf(dialErrorKind(err), "failed to connect to host through %s: %v", opts.jumpHost, err)
+	}
+	client, err := handshakeSSH(ctx, conn, addr, opts)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+
+	// The jump connection only carries this client
+	go func() {
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
+
+// parseJumpHost splits the [user@]host[:port] jump host of opts, and returns
+// the options to reach it
+func parseJumpHost(opts sshOptions) (string, sshOptions, error) {
+	jumpOpts := opts
+	jumpOpts.port = 22
+	jumpOpts.jumpHost = ""
+	jumpOpts.address = ""
+	jumpOpts.proxyCommand = ""
+	host := opts.jumpHost
+	if user, rest, ok := strings.Cut(host, "@"); ok {
+		config := *opts.config
+		config.User = user
+		jumpOpts.config = &config
+		host = rest
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return "", sshOptions{}, fmt.Errorf("invalid jump host %q: bad port %q", opts.jumpHost, port)
+		}
+		host, jumpOpts.port = h, p
+	}
+	if host == "" {
+		return "", sshOptions{}, fmt.Errorf("invalid jump host %q", opts.jumpHost)
+	}
+	return normalizeHost(host), jumpOpts, nil
+}
+
+// remoteIP returns the address the SSH client is connected to
+func remoteIP(client transport) string {
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return client.RemoteAddr().String()
+}
+
+// checkSSH sends a keepalive request to check that the SSH connection is
+// still up, failing if it is not answered within timeout
+func checkSSH(client *ssh.Client, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("keepalive timed out after %s", timeout)
+	}
+}
+
+// keepAlive checks the SSH connection periodically, measuring its latency,
+// and asks for a reconnection once CountMax checks in a row failed, until the
+// tunnel is closed
+func (t *Tunnel) keepAlive() {
+	if t.KeepAlive.Interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(t.KeepAlive.Interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-t.connected():
+			start := time.Now()
+			err := t.sshClient().ping(t.KeepAlive.timeout())
+			if t.ctx.Err() != nil {
+				return
+			}
+			latency := time.Since(start)
+			t.recordKeepAlive(latency, err)
+			switch {
+			case err == nil:
+				failures = 0
+				t.debugf("SSH keepalive answered in %s", latency.Round(time.Microsecond))
+			case failures+1 < t.KeepAlive.CountMax:
+				failures++
+				t.logf("SSH keepalive failed (%d/%d): %v", failures, t.KeepAlive.CountMax, err)
+			default:
+				failures = 0
+				t.logf("SSH keepalive failed: %v, triggering reconnect", err)
+				t.markDisconnected()
+				t.requestReconnect(fmt.Sprintf("keepalive failed: %v", err))
+			}
+		default:
+			// Already reconnecting
+			failures = 0
+		}
+
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
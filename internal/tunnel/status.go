@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Number of errors kept per tunnel for the status view
+const maxRecentErrors = 20
+
+type SSHState int
+
+const (
+	StateConnected SSHState = iota
+	StateReconnecting
+	StateDisconnected
+)
+
+func (s SSHState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// Connection tracks a single forwarded connection
+type Connection struct {
+	ID            uint64
+	SourceAddr    string
+	Destination   string // Address dialed from the machine
+	StartedAt     time.Time
+	BytesSent     uint64 // Filled in snapshots, see traffic
+	BytesReceived uint64
+	BandwidthUp   float64 // bytes/sec over the last second, guarded by connectionMu
+	BandwidthDown float64 // bytes/sec over the last second, guarded by connectionMu
+	local         net.Conn
+	traffic       *trafficCounters
+	closeReason   string // Why the daemon closed it, guarded by connectionMu
+
+	// Counters at the last bandwidth sample, guarded by connectionMu
+	lastSent     uint64
+	lastReceived uint64
+}
+
+// trafficCounters count the bytes copied through a tunnel or a connection
+type trafficCounters struct {
+	sent      atomic.Uint64
+	received  atomic.Uint64
+	lastWrite atomic.Int64 // UnixNano, see touch
+}
+
+// touch records that traffic was just copied
+func (tc *trafficCounters) touch() {
+	tc.lastWrite.Store(time.Now().UnixNano())
+}
+
+// TunnelError is an error that occurred on a tunnel
+type TunnelError struct {
+	Time    time.Time
+	Message string
+}
+
+// TunnelStatus is a detailed view of a single tunnel
+type TunnelStatus struct {
+	Tunnel              *Tunnel
+	State               SSHState
+	LastReconnect       time.Time
+	LastReconnectReason string
+	ReconnectAttempts   int       // Attempts of the current or last round
+	NextReconnect       time.Time // Zero unless waiting before an attempt
+	Connections         []Connection
+	RecentErrors        []TunnelError
+}
+
+func (tm *TunnelManager) GetStatus(host string, remotePort, localPort int) (*TunnelStatus, error) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	key, err := tm.find(host, remotePort, localPort)
+	if err != nil {
+		return nil, err
+	}
+	t := tm.tunnels[key]
+
+	status := &TunnelStatus{
+		Tunnel: t.snapshot(),
+	}
+
+	t.stateMu.RLock()
+	status.State = t.state
+	status.LastReconnect = t.lastReconnect
+	status.LastReconnectReason = t.lastReconnectReason
+	status.ReconnectAttempts = t.reconnectAttempts
+	status.NextReconnect = t.nextReconnect
+	status.RecentErrors = append([]TunnelError(nil), t.recentErrors...)
+	t.stateMu.RUnlock()
+
+	status.Connections = t.connections()
+	return status, nil
+}
+
+// ListConnections returns the connections in progress through a tunnel
+func (tm *TunnelManager) ListConnections(host string, remotePort, localPort int) ([]Connection, error) {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return nil, err
+	}
+	return t.connections(), nil
+}
+
+// connections returns a snapshot of the connections sorted by ID
+func (t *Tunnel) connections() []Connection {
+	t.connectionMu.RLock()
+	conns := make([]Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		conn := *c
+		conn.BytesSent = c.traffic.sent.Load()
+		conn.BytesReceived = c.traffic.received.Load()
+		conns = append(conns, conn)
+	}
+	t.connectionMu.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+func (t *Tunnel) setState(state SSHState) {
+	t.stateMu.Lock()
+	t.state = state
+	t.stateMu.Unlock()
+}
+
+// recordError logs an error, keeps it for the status view and emits it on the
+// event stream
+func (t *Tunnel) recordError(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	t.printf("%s", message)
+
+	t.stateMu.Lock()
+	t.recentErrors = append(t.recentErrors, TunnelError{
+		Time:    time.Now(),
+		Message: message,
+	})
+	if len(t.recentErrors) > maxRecentErrors {
+		t.recentErrors = t.recentErrors[len(t.recentErrors)-maxRecentErrors:]
+	}
+	t.stateMu.Unlock()
+
+	t.emit(EventError, message)
+}
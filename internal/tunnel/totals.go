@@ -0,0 +1,59 @@
+package tunnel
+
+import "sync/atomic"
+
+// Totals are the counters of a manager since it was created
+type Totals struct {
+	ActiveTunnels     int
+	TunnelsCreated    uint64
+	TunnelsClosed     uint64
+	Connections       uint64 // Including the ones of closed tunnels
+	BytesSent         uint64
+	BytesReceived     uint64
+	Reconnects        uint64 // Successful SSH reconnections
+	ReconnectFailures uint64 // Failed SSH reconnection attempts
+}
+
+// totals are updated by the tunnels of a manager. The traffic of the active
+// tunnels is only added when they shut down, see Totals.
+type totals struct {
+	created           atomic.Uint64
+	closed            atomic.Uint64
+	connections       atomic.Uint64
+	sent              atomic.Uint64
+	received          atomic.Uint64
+	reconnects        atomic.Uint64
+	reconnectFailures atomic.Uint64
+}
+
+// addClosed adds the counters of a tunnel which shut down
+func (c *totals) addClosed(t *Tunnel) {
+	c.closed.Add(1)
+	c.connections.Add(t.totalConns.Load())
+	c.sent.Add(t.traffic.sent.Load())
+	c.received.Add(t.traffic.received.Load())
+}
+
+// Totals returns the counters of the manager, adding up the active tunnels
+// and the closed ones
+func (tm *TunnelManager) Totals() Totals {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	totals := Totals{
+		ActiveTunnels:     len(tm.tunnels),
+		TunnelsCreated:    tm.totals.created.Load(),
+		TunnelsClosed:     tm.totals.closed.Load(),
+		Connections:       tm.totals.connections.Load(),
+		BytesSent:         tm.totals.sent.Load(),
+		BytesReceived:     tm.totals.received.Load(),
+		Reconnects:        tm.totals.reconnects.Load(),
+		ReconnectFailures: tm.totals.reconnectFailures.Load(),
+	}
+	for _, t := range tm.tunnels {
+		totals.Connections += t.totalConns.Load()
+		totals.BytesSent += t.traffic.sent.Load()
+		totals.BytesReceived += t.traffic.received.Load()
+	}
+	return totals
+}
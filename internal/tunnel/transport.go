@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// transport carries the connections of a tunnel to the machine: an SSH
+// client, the ControlMaster of OpenSSH, or a Kubernetes port-forward for
+// k8s:// hosts
+type transport interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	RemoteAddr() net.Addr
+	Close() error
+
+	// ping checks that the transport is still up, within timeout
+	ping(timeout time.Duration) error
+}
+
+// sshTransport is a transport over an SSH client
+type sshTransport struct {
+	*ssh.Client
+}
+
+func (c sshTransport) ping(timeout time.Duration) error {
+	return checkSSH(c.Client, timeout)
+}
+
+// dialTransport connects to the machine of a tunnel, through the Kubernetes
+// API for k8s:// hosts, the ControlMaster of OpenSSH when a control socket is
+// given and SSH otherwise
+func dialTransport(ctx context.Context, host string, opts sshOptions) (transport, error) {
+	switch {
+	case isK8sHost(host):
+		return dialK8s(ctx, host)
+	case isDockerHost(host):
+		return dialDocker(ctx, host, opts)
+	case opts.controlPath != "":
+		return dialMux(ctx, host, opts)
+	}
+	client, err := dialSSH(ctx, host, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sshTransport{client}, nil
+}
@@ -0,0 +1,17 @@
+package tunnel
+
+import "time"
+
+// expire closes the tunnel once its TTL is over, whatever its activity
+func (t *Tunnel) expire() {
+	timer := time.NewTimer(time.Until(t.ExpiresAt))
+	defer timer.Stop()
+
+	select {
+	case <-t.ctx.Done():
+	case <-timer.C:
+		t.logf("TTL expired, closing the tunnel")
+		// shutdown waits for the workers, including this one
+		go t.closeSelf(ReasonExpired)
+	}
+}
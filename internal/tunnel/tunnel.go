@@ -2,225 +2,613 @@ package tunnel
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"log"
+	"maps"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TunnelManager struct {
-	tunnels map[string]*Tunnel
-	mu      sync.RWMutex
+	tunnels  map[string]*Tunnel
+	pending  map[string]bool // Tunnels being created, guarded by mu
+	mu       sync.RWMutex
+	updateMu sync.Mutex // Serializes UpdateTunnel
+	events   *eventBus
+	totals   *totals
+	closed   *closedTunnels
+	sshPort  int
+
+	// IdleTimeout closes connections which carried no traffic for that long,
+	// for the tunnels which do not set their own, and MaxSession those open
+	// for that long, 0 disables them. Set them and Reconnect before creating
+	// tunnels.
+	IdleTimeout time.Duration
+	MaxSession  time.Duration
+	Reconnect   Backoff
+
+	// AcceptRate limits the new connections of the tunnels which do not set
+	// their own to this many per second, 0 for no limit
+	AcceptRate int
+
+	// LogLevel is how much the tunnels which do not set their own level
+	// write to the log, LogInfo by default
+	LogLevel LogLevel
+
+	// KeepAlive checks the SSH connections of the tunnels which do not
+	// set their own
+	KeepAlive KeepAlive
+
+	// ConnectTimeout, HandshakeTimeout and DialRetry apply to the tunnels
+	// which do not set their own, see Options
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	DialRetry        DialRetry
 }
 
 type Tunnel struct {
+	ID           string
 	Host         string
 	LocalPort    int
 	RemotePort   int
-	client       *ssh.Client
-	listener     net.Listener
-	done         chan struct{}
-	reconnect    chan struct{}
-	sshConfig    *ssh.ClientConfig
+	Labels       map[string]string // Set at creation, never modified
+	Warnings     []string          // Problems found at creation, such as a failed pre-check
+	Addresses    []string          // Local addresses listened on
+	client       transport
+	ready        chan struct{}  // Closed while the SSH client is connected
+	clientMu     sync.RWMutex   // Guards client and ready
+	listeners    []net.Listener // One per bind address
+	endpointMu   sync.RWMutex   // Guards the ports, Addresses and listeners, see UpdateTunnel
+	unlistened   bool           // The listeners are closed for good, guarded by endpointMu
+	accepting    sync.WaitGroup // Listeners being accepted on, see acceptOn
+	stopped      chan struct{}  // Closed once no connection is accepted anymore
+	closing      chan struct{}  // Closed along with the listeners, see admit
+	acceptLimit  *acceptLimiter // nil without accept rate
+	logLevel     atomic.Int32   // See LogLevel
+	forwarding   sync.WaitGroup // Connections being forwarded
+	workers      sync.WaitGroup // Background goroutines, see spawn
+	ctx          context.Context
+	cancel       context.CancelFunc // Stops the tunnel, see shutdown
+	reconnect    chan string        // Carries the reason of the reconnection
+	retryNow     chan struct{}      // Cuts the wait before the next reconnection attempt
+	ssh          sshOptions         // How to reach the machine, kept for reconnections
+	remoteIP     string             // Address of the SSH server, only used by superviseSSH
+	events       *eventBus
+	totals       *totals        // Of the manager
+	closed       *closedTunnels // Of the manager, see History
+	closeReason  string         // Set when detached from the manager
+	maxSession   time.Duration
+	backoff      Backoff
+	closeSelf    func(reason string) // Closes the tunnel, see closeOwn
+	onClose      string              // Command run on the machine when closing
+	options      Options             // As created, see sameSettings
 	CreatedAt    time.Time
 	LastActivity time.Time
 	activityMu   sync.RWMutex
-	healthCheck  *time.Ticker
-	isActive     bool
-	activeMu     sync.RWMutex
 
-	// Bandwidth tracking
+	// Sends a PROXY protocol v2 header on every remote connection
+	ProxyProtocol bool
+
+	// Leaves Nagle's algorithm on for the local connections
+	Nagle bool
+
+	// New connections accepted per second, 0 for no limit, and whether
+	// accepting stops while SSH is down
+	AcceptRate    int
+	HoldWhileDown bool
+
+	// Connections without traffic in either direction for this long are
+	// closed, 0 to keep them open
+	IdleTimeout time.Duration
+
+	// Reconnection policy, set at creation
+	Reconnect  Backoff
+	Supervised bool
+
+	// How connections dial the remote service, set at creation
+	DialRetry DialRetry
+
+	// How the SSH connection is checked, set at creation
+	KeepAlive KeepAlive
+
+	// When the TTL closes the tunnel, zero without TTL
+	ExpiresAt time.Time
+
+	// The tunnel is closed when this process exits, 0 when not bound to one
+	OwnerPID int
+
+	// Dialed instead of the host, empty when the host is
+	HostAddress string
+
+	// Traffic and connection counters are updated atomically on the hot
+	// path, the exported fields are only filled in snapshots
 	BytesSent     uint64
 	BytesReceived uint64
-	bandwidthMu   sync.RWMutex
+	ActiveConns   int32
+	TotalConns    uint64
+	traffic       trafficCounters
+	activeConns   atomic.Int32
+	totalConns    atomic.Uint64
+
+	// Bandwidth over the rolling window and history, see sampleBandwidth
 	BandwidthUp   float64 // bytes/sec
 	BandwidthDown float64 // bytes/sec
-	lastBWUpdate  time.Time
+	history       []BandwidthSample
+	bandwidthMu   sync.RWMutex
+	usage         *usageHistory // See sampleUsage
+
+	// Traffic captures in progress, see Capture. capturing mirrors the size
+	// of captures to keep the copy fast when nothing is captured.
+	captures  map[*capture]struct{}
+	capturing atomic.Int32
+	captureMu sync.RWMutex
 
 	// Connection tracking
-	ActiveConns  int32
-	TotalConns   uint64
+	conns        map[uint64]*Connection
+	nextConnID   uint64
 	connectionMu sync.RWMutex
+
+	// SSH connection state and error history
+	state               SSHState
+	lastReconnect       time.Time
+	lastReconnectReason string
+	reconnectAttempts   int       // Attempts of the current or last round
+	nextReconnect       time.Time // Zero unless waiting before an attempt
+	recentErrors        []TunnelError
+	paused              bool // Refuse new connections
+	stateMu             sync.RWMutex
+
+	// Keepalive round trips, see recordKeepAlive. Latency and
+	// KeepAliveFailures are only filled in snapshots.
+	Latency           time.Duration
+	KeepAliveFailures uint64
+	rtts              []time.Duration // Guarded by stateMu
+	keepAliveFailures uint64          // Guarded by stateMu
 }
 
 func NewTunnelManager() *TunnelManager {
 	return &TunnelManager{
-		tunnels: make(map[string]*Tunnel),
+		tunnels:   make(map[string]*Tunnel),
+		pending:   make(map[string]bool),
+		events:    newEventBus(),
+		totals:    &totals{},
+		closed:    &closedTunnels{},
+		sshPort:   22,
+		Reconnect: DefaultBackoff,
+		KeepAlive: DefaultKeepAlive,
+		DialRetry: DefaultDialRetry,
+		LogLevel:  LogInfo,
 	}
 }
 
-func (tm *TunnelManager) CreateTunnel(host string, localPort, remotePort int, sshConfig *ssh.ClientConfig) error {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
+// Options are the settings of a single tunnel
+type Options struct {
+	Labels map[string]string // Arbitrary key/value pairs to group tunnels
+	Family AddressFamily     // IP versions of the listener and the SSH connection
+	Bind   []string          // Local addresses to listen on, loopback by default
+
+	// ProxyProtocol sends a PROXY protocol v2 header on every connection
+	// to the remote service
+	ProxyProtocol bool
+
+	// Nagle leaves Nagle's algorithm on for the local connections and the
+	// SSH connection carrying them, batching small writes into fewer
+	// packets for bulk transfers. By default TCP_NODELAY is set, so that the
+	// small writes of interactive protocols are sent at once.
+	Nagle bool
+
+	// AcceptRate limits the new connections to this many per second, with
+	// bursts of as many, the rate of the manager if 0. HoldWhileDown stops
+	// accepting connections while the SSH connection is down, instead of
+	// accepting them to wait for it. Either way the waiting connections
+	// stay in the listen backlog, so that a misbehaving client cannot start
+	// thousands of remote dials.
+	AcceptRate    int
+	HoldWhileDown bool
+
+	// IdleTimeout closes the connections which carried no traffic in
+	// either direction for that long, such as abandoned clients pinning an
+	// SSH channel, the timeout of the manager if 0
+	IdleTimeout time.Duration
+
+	// SSHPort overrides the SSH port of the manager, and JumpHost connects
+	// through another SSH server, given as [user@]host[:port] like ssh -J
+	SSHPort  int
+	JumpHost string
+
+	// HostAddress is dialed instead of the host, such as its IP when DNS
+	// is split-horizon or broken. The host still names the machine for the
+	// host key, the hosts section of the config and the display.
+	HostAddress string
+
+	// Proxy is a socks5://, socks5h:// or http://[user:password@]host:port
+	// proxy to reach the SSH server, or the jump host, through. With
+	// socks5h:// and http:// the proxy resolves the host.
+	Proxy string
+
+	// ProxyCommand is run to reach the SSH server, which is spoken to over
+	// its standard input and output, like ProxyCommand in ssh_config. Its %h,
+	// %n, %p, %r and %% tokens are expanded like ssh does. It is ignored when
+	// going through a jump host.
+	ProxyCommand string
+
+	// ControlPath is the socket of an OpenSSH ControlMaster connected to the
+	// host, which then forwards the connections instead of an SSH connection
+	// of the manager, like ssh -W. Its %h, %n, %p, %r, %C, %l, %L, %u, %i and
+	// %% tokens are expanded like ssh does. Remote commands are not supported
+	// through it.
+	ControlPath string
+
+	// ConnectTimeout limits the TCP connection to the SSH server, and
+	// HandshakeTimeout the SSH handshake, the ones of the manager if 0. Both
+	// also apply to reconnections.
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+
+	// Reconnect overrides the reconnection policy of the manager for this
+	// tunnel. Supervised tunnels retry forever whatever the policy, like
+	// autossh.
+	Reconnect  *Backoff
+	Supervised bool
+
+	// Commands run on the machine over SSH once the tunnel is connected,
+	// failing the creation if OnOpen fails, and when it is closed
+	OnOpen  string
+	OnClose string
+
+	// PreCheck connects once to the remote port after the SSH handshake
+	PreCheck PreCheck
+
+	// DialRetry overrides the one of the manager for the connections to
+	// this tunnel
+	DialRetry *DialRetry
+
+	// KeepAlive overrides the keepalive settings of the manager
+	KeepAlive *KeepAlive
+
+	// TTL closes the tunnel after this long, whatever its activity
+	TTL time.Duration
+
+	// OwnerPID binds the lifetime of the tunnel to a local process
+	OwnerPID int
+
+	// IfExists tells what to do when a tunnel forwarding the same local port
+	// to the same remote port exists, failing by default
+	IfExists ExistsPolicy
+
+	// LogLevel is how much the tunnel writes to the log, the level of the
+	// manager by default
+	LogLevel LogLevel
+}
 
-	key := fmt.Sprintf("%s:%d", host, remotePort)
-	if _, exists := tm.tunnels[key]; exists {
-		return fmt.Errorf("tunnel already exists")
+// CreateTunnel connects to the host and starts forwarding the local port.
+// The SSH handshake happens without holding the manager lock, so tunnels can
+// be created concurrently, and is aborted if ctx is canceled. The tunnel
+// itself lives until it is closed.
+//
+// A tunnel replaced through ExistsReplace keeps its local port until the new
+// one is connected, so that a failed replacement leaves it untouched.
+func (tm *TunnelManager) CreateTunnel(ctx context.Context, host string, localPort, remotePort int, sshConfig *ssh.ClientConfig, opts Options) error {
+	host = normalizeHost(host)
+	key := TunnelKey(host, remotePort, localPort)
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return err
 	}
 
-	// Configure dialer with keepalive settings
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 15 * time.Second,
+	tm.mu.Lock()
+	existing, exists := tm.tunnels[key]
+	if tm.pending[key] || exists && opts.IfExists == ExistsFail {
+		tm.mu.Unlock()
+		return ErrAlreadyExists
+	}
+	if exists && opts.IfExists == ExistsKeep {
+		same := existing.sameSettings(opts)
+		tm.mu.Unlock()
+		if same {
+			return nil
+		}
+		return errorf(ErrAlreadyExists, "tunnel already exists with other settings")
 	}
+	tm.pending[key] = true
+	tm.mu.Unlock()
 
-	// Add keepalive configuration
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:22", host))
-	if err != nil {
-		return fmt.Errorf("failed to connect to host: %v", err)
+	defer func() {
+		tm.mu.Lock()
+		delete(tm.pending, key)
+		tm.mu.Unlock()
+	}()
+
+	// Bind the local port first so that a conflict is reported before
+	// connecting to the host
+	var listeners []net.Listener
+	if !exists {
+		listeners, err = listenLocal(localPort, opts.Family, opts.Bind)
+		if err != nil {
+			return err
+		}
+	}
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
 	}
 
-	// Enable TCP keepalive with more aggressive settings
-	tcpConn := conn.(*net.TCPConn)
-	if err := tcpConn.SetKeepAlive(true); err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to enable keepalive: %v", err)
+	dial := sshOptions{
+		port:      tm.sshPort,
+		address:   opts.HostAddress,
+		jumpHost:  opts.JumpHost,
+		proxy:     proxy,
+		family:    opts.Family,
+		config:    sshConfig,
+		keepAlive: tm.KeepAlive,
+
+		connectTimeout:   tm.ConnectTimeout,
+		handshakeTimeout: tm.HandshakeTimeout,
+		nagle:            opts.Nagle,
+		proxyCommand:     opts.ProxyCommand,
+		controlPath:      opts.ControlPath,
 	}
-	if err := tcpConn.SetKeepAlivePeriod(15 * time.Second); err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to set keepalive period: %v", err)
+	if opts.SSHPort != 0 {
+		dial.port = opts.SSHPort
 	}
-	if err := tcpConn.SetLinger(0); err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to set linger: %v", err)
+	if opts.ConnectTimeout != 0 {
+		dial.connectTimeout = opts.ConnectTimeout
 	}
-
-	// Set more aggressive SSH keepalive settings
-	sshConfig.Timeout = 30 * time.Second
-
-	sshConn, chans, reqs, err := ssh.NewClientConn(tcpConn, host, sshConfig)
+	if opts.HandshakeTimeout != 0 {
+		dial.handshakeTimeout = opts.HandshakeTimeout
+	}
+	if opts.KeepAlive != nil {
+		dial.keepAlive = *opts.KeepAlive
+	}
+	client, err := dialTransport(ctx, host, dial)
 	if err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to create SSH connection: %v", err)
+		closeListeners()
+		return err
 	}
-
-	client := ssh.NewClient(sshConn, chans, reqs)
-
-	// Start SSH keepalive goroutine
-	go func() {
-		t := time.NewTicker(10 * time.Second)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
-				if err != nil {
-					log.Printf("SSH keepalive failed: %v", err)
-					return
-				}
+	if opts.OnOpen != "" {
+		if err := runHook(ctx, client, "on-open", host, remotePort, opts.OnOpen); err != nil {
+			client.Close()
+			closeListeners()
+			return err
+		}
+	}
+	var warnings []string
+	if opts.PreCheck != PreCheckNone {
+		if err := checkRemotePort(ctx, client, remotePort); err != nil {
+			if opts.PreCheck == PreCheckFail {
+				client.Close()
+				closeListeners()
+				return errorf(ErrNotReady, "%v", err)
 			}
+			warnings = append(warnings, err.Error())
 		}
-	}()
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localPort))
-	if err != nil {
-		client.Close()
-		return fmt.Errorf("failed to start local listener: %v", err)
+	// Take over the local port of the replaced tunnel
+	if exists {
+		tm.mu.Lock()
+		var replaced *Tunnel
+		if tm.tunnels[key] == existing {
+			replaced = tm.detachLocked(key, ReasonReplaced)
+		}
+		tm.mu.Unlock()
+		if replaced != nil {
+			replaced.shutdown(0)
+		}
+		listeners, err = listenLocal(localPort, opts.Family, opts.Bind)
+		if err != nil {
+			client.Close()
+			return err
+		}
+	}
+	addresses := make([]string, len(listeners))
+	for i, l := range listeners {
+		addresses[i] = l.Addr().String()
+	}
+
+	ready := make(chan struct{})
+	close(ready)
+
+	backoff := tm.Reconnect
+	if opts.Reconnect != nil {
+		backoff = *opts.Reconnect
+	}
+	if opts.Supervised {
+		backoff = backoff.forever()
+	}
+
+	dialRetry := tm.DialRetry
+	if opts.DialRetry != nil {
+		dialRetry = *opts.DialRetry
+	}
+
+	acceptRate := tm.AcceptRate
+	if opts.AcceptRate != 0 {
+		acceptRate = opts.AcceptRate
+	}
+	idleTimeout := tm.IdleTimeout
+	if opts.IdleTimeout != 0 {
+		idleTimeout = opts.IdleTimeout
 	}
 
 	now := time.Now()
+	tunnelCtx, cancel := context.WithCancel(context.Background())
 	tunnel := &Tunnel{
 		Host:         host,
 		LocalPort:    localPort,
 		RemotePort:   remotePort,
+		Labels:       maps.Clone(opts.Labels),
+		Warnings:     warnings,
 		client:       client,
-		listener:     listener,
-		done:         make(chan struct{}),
-		reconnect:    make(chan struct{}),
-		sshConfig:    sshConfig, // Store SSH config for reconnection
+		ready:        ready,
+		Addresses:    addresses,
+		listeners:    listeners,
+		stopped:      make(chan struct{}),
+		closing:      make(chan struct{}),
+		acceptLimit:  newAcceptLimiter(acceptRate),
+		ctx:          tunnelCtx,
+		cancel:       cancel,
+		reconnect:    make(chan string),
+		retryNow:     make(chan struct{}, 1),
+		conns:        make(map[uint64]*Connection),
+		usage:        &usageHistory{},
+		ssh:          dial,
+		onClose:      opts.OnClose,
+		options:      opts,
+		remoteIP:     remoteIP(client),
+		events:       tm.events,
+		totals:       tm.totals,
+		closed:       tm.closed,
+		maxSession:   tm.MaxSession,
+		backoff:      backoff,
 		CreatedAt:    now,
 		LastActivity: now,
+
+		ProxyProtocol: opts.ProxyProtocol,
+		Nagle:         opts.Nagle,
+		AcceptRate:    acceptRate,
+		HoldWhileDown: opts.HoldWhileDown,
+		IdleTimeout:   idleTimeout,
+		Reconnect:     backoff,
+		Supervised:    opts.Supervised,
+		DialRetry:     dialRetry,
+		KeepAlive:     dial.keepAlive,
+		OwnerPID:      opts.OwnerPID,
+		HostAddress:   opts.HostAddress,
+	}
+	if opts.TTL > 0 {
+		tunnel.ExpiresAt = now.Add(opts.TTL)
 	}
+	logLevel := tm.LogLevel
+	if opts.LogLevel != LogDefault {
+		logLevel = opts.LogLevel
+	}
+	tunnel.logLevel.Store(int32(logLevel))
+	tunnel.closeSelf = func(reason string) { tm.closeOwn(tunnel, reason) }
 
+	tm.mu.Lock()
+	tunnel.ID = tm.newID()
 	tm.tunnels[key] = tunnel
+	tm.mu.Unlock()
+	// The connections are only accepted once the tunnel has its ID, which
+	// their events carry
+	tunnel.acceptOn(listeners)
+	tm.totals.created.Add(1)
+
+	tunnel.emit(EventTunnelCreated, "")
 	go tunnel.start()
 	return nil
 }
 
+// start accepts connections until the tunnel is closed. The listeners stay
+// bound while SSH reconnects, see superviseSSH.
 func (t *Tunnel) start() {
-	defer t.client.Close()
-	defer t.listener.Close()
+	defer close(t.stopped)
 
-	// Start health check ticker
-	t.healthCheck = time.NewTicker(15 * time.Second)
-	defer t.healthCheck.Stop()
+	t.spawn(t.keepAlive)
+	t.spawn(t.superviseSSH)
+	t.spawn(t.sampleBandwidth)
+	if t.IdleTimeout > 0 {
+		t.spawn(t.closeIdleConnections)
+	}
+	if !t.ExpiresAt.IsZero() {
+		t.spawn(t.expire)
+	}
+	if t.OwnerPID > 0 {
+		t.spawn(t.watchOwner)
+	}
 
-	// Start health check goroutine
-	go t.monitorHealth()
+	t.accepting.Wait()
+}
 
-	for {
-		select {
-		case <-t.done:
-			return
-		case <-t.reconnect:
-			if err := t.reconnectSSH(); err != nil {
-				log.Printf("Failed to reconnect SSH: %v", err)
-				return
-			}
-		default:
-			local, err := t.listener.Accept()
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-					log.Printf("Temporary accept error: %v, retrying...", err)
-					continue
-				}
-				log.Printf("Fatal accept error: %v, stopping tunnel", err)
-				return
-			}
+// acceptOn accepts connections on listeners until they are closed. start
+// returns once every listener given to acceptOn is closed.
+func (t *Tunnel) acceptOn(listeners []net.Listener) {
+	for _, listener := range listeners {
+		t.accepting.Add(1)
+		go func() {
+			defer t.accepting.Done()
+			t.accept(listener)
+		}()
+	}
+}
 
-			go t.forward(local)
-		}
+// closeListeners stops accepting connections on every bind address, for
+// good
+func (t *Tunnel) closeListeners() {
+	t.endpointMu.Lock()
+	defer t.endpointMu.Unlock()
+	if !t.unlistened {
+		t.unlistened = true
+		close(t.closing)
+	}
+	for _, listener := range t.listeners {
+		listener.Close()
 	}
 }
 
-func (t *Tunnel) monitorHealth() {
+// ports returns the local and remote ports of the tunnel, which UpdateTunnel
+// may change
+func (t *Tunnel) ports() (int, int) {
+	t.endpointMu.RLock()
+	defer t.endpointMu.RUnlock()
+	return t.LocalPort, t.RemotePort
+}
+
+// accept forwards the connections of one listener until it is closed
+func (t *Tunnel) accept(listener net.Listener) {
 	for {
-		select {
-		case <-t.done:
+		if !t.admit() {
 			return
-		case <-t.healthCheck.C:
-			t.activeMu.RLock()
-			isActive := t.isActive
-			t.activeMu.RUnlock()
-
-			if !isActive {
-				// Test SSH connection with timeout
-				done := make(chan error, 1)
-				go func() {
-					_, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil)
-					done <- err
-				}()
-
-				select {
-				case err := <-done:
-					if err != nil {
-						log.Printf("SSH connection test failed: %v, triggering reconnect", err)
-						select {
-						case t.reconnect <- struct{}{}:
-						default:
-						}
-					}
-				case <-time.After(5 * time.Second):
-					log.Printf("SSH connection test timed out, triggering reconnect")
-					select {
-					case t.reconnect <- struct{}{}:
-					default:
-					}
-				}
+		}
+		local, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				t.logf("Temporary accept error: %v, retrying...", err)
 				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				// The listener was closed by CloseTunnel
+				return
+			}
+			t.recordError("fatal accept error: %v, stopping tunnel", err)
+			t.closeListeners()
+			return
+		}
 
-			// Reset activity flag
-			t.activeMu.Lock()
-			t.isActive = false
-			t.activeMu.Unlock()
+		if t.Paused() {
+			local.Close()
+			continue
+		}
+		if !t.holdWhileDown() {
+			local.Close()
+			return
 		}
+
+		t.forwarding.Add(1)
+		go t.forward(local)
 	}
 }
 
+// spawn runs fn in a goroutine which shutdown waits for. It must only be
+// called before start returns.
+func (t *Tunnel) spawn(fn func()) {
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		fn()
+	}()
+}
+
 func (t *Tunnel) updateActivity() {
 	t.activityMu.Lock()
 	t.LastActivity = time.Now()
@@ -228,80 +616,70 @@ func (t *Tunnel) updateActivity() {
 }
 
 func (t *Tunnel) forward(local net.Conn) {
+	defer t.forwarding.Done()
 	t.updateActivity()
 	defer local.Close()
 
-	// Track connection
+	// Track connection, to the remote port when it was accepted
+	_, remotePort := t.ports()
+	t.activeConns.Add(1)
+	t.totalConns.Add(1)
 	t.connectionMu.Lock()
-	t.ActiveConns++
-	t.TotalConns++
+	t.nextConnID++
+	conn := &Connection{
+		ID:          t.nextConnID,
+		SourceAddr:  local.RemoteAddr().String(),
+		Destination: fmt.Sprintf("localhost:%d", remotePort),
+		StartedAt:   time.Now(),
+		local:       local,
+		traffic:     &trafficCounters{},
+	}
+	conn.traffic.touch()
+	t.conns[conn.ID] = conn
 	t.connectionMu.Unlock()
 
+	t.emit(EventConnectionOpened, local.RemoteAddr().String())
+	t.record(CaptureOpened, conn, false, nil)
+	t.debugf("Connection #%d from %s opened", conn.ID, conn.SourceAddr)
+
 	defer func() {
+		t.activeConns.Add(-1)
 		t.connectionMu.Lock()
-		t.ActiveConns--
+		delete(t.conns, conn.ID)
+		reason := conn.closeReason
 		t.connectionMu.Unlock()
-	}()
 
-	// Mark tunnel as active
-	t.activeMu.Lock()
-	t.isActive = true
-	t.activeMu.Unlock()
+		t.record(CaptureClosed, conn, false, nil)
 
-	// Initialize bandwidth tracking
-	t.bandwidthMu.Lock()
-	t.lastBWUpdate = time.Now()
-	t.bandwidthMu.Unlock()
+		message := local.RemoteAddr().String()
+		if reason != "" {
+			message += ": " + reason
+		}
+		t.emit(EventConnectionClosed, message)
+		t.debugf("Connection #%d from %s closed after %s, %d bytes sent, %d received", conn.ID, conn.SourceAddr,
+			time.Since(conn.StartedAt).Round(time.Millisecond), conn.traffic.sent.Load(), conn.traffic.received.Load())
+	}()
 
 	// Set timeouts on local connection
 	local.SetDeadline(time.Now().Add(30 * time.Second))
 
-	// Try to establish remote connection with retry logic and timeout
-	var remote net.Conn
-	var err error
-	connectChan := make(chan struct{})
-
-	go func() {
-		for attempts := 0; attempts < 3; attempts++ {
-			remote, err = t.client.Dial("tcp", fmt.Sprintf("localhost:%d", t.RemotePort))
-			if err == nil {
-				break
-			}
+	// Connect to the remote port, waiting for SSH if it is reconnecting
+	remote, err := t.dialRemote(conn.Destination)
+	if err != nil {
+		t.recordError("failed to connect to remote: %v", err)
+		return
+	}
+	t.debugf("Connection #%d connected to %s", conn.ID, conn.Destination)
 
-			if attempts < 2 {
-				log.Printf("Failed to connect to remote (attempt %d/3): %v, retrying...", attempts+1, err)
-				time.Sleep(time.Second * time.Duration(attempts+1))
-
-				// Try to reconnect SSH if needed
-				if t.client.Conn.Wait() != nil { // SSH connection is dead
-					if err := t.reconnectSSH(); err != nil {
-						log.Printf("Failed to reconnect SSH: %v", err)
-						close(connectChan)
-						return
-					}
-				}
-			} else {
-				log.Printf("Failed to connect to remote after 3 attempts: %v", err)
-				close(connectChan)
-				return
-			}
-		}
-		close(connectChan)
-	}()
+	defer remote.Close()
 
-	// Wait for connection with timeout
-	select {
-	case <-connectChan:
-		if remote == nil {
+	if t.ProxyProtocol {
+		if _, err := remote.Write(proxyHeader(local.RemoteAddr(), local.LocalAddr())); err != nil {
+			t.recordError("failed to send PROXY protocol header: %v", err)
 			return
 		}
-	case <-time.After(10 * time.Second):
-		log.Printf("Connection timeout while connecting to remote")
-		return
 	}
 
-	defer remote.Close()
-
 	// Reset deadline after successful connection
 	local.SetDeadline(time.Time{})
 	remote.SetDeadline(time.Time{})
@@ -310,111 +688,71 @@ func (t *Tunnel) forward(local net.Conn) {
 	if tcpConn, ok := local.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+		tcpConn.SetNoDelay(!t.Nagle)
 	}
 	if tcpConn, ok := remote.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Copy data in both directions with error handling and timeout
-	copyData := func(dst net.Conn, src net.Conn, description string, isUpload bool) {
+	// Copy data in both directions, counting the traffic as it is written
+	copyData := func(dst, src net.Conn, description string, counters ...*atomic.Uint64) {
 		defer wg.Done()
-		defer cancel() // Cancel context on exit
-
-		buf := make([]byte, 32*1024)
-		var lastUpdate time.Time
-		var bytesCopied uint64
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				src.SetReadDeadline(time.Now().Add(5 * time.Second))
-				n, err := src.Read(buf)
-				if err != nil {
-					if !isClosedError(err) && !isTimeout(err) {
-						log.Printf("Error reading from %s: %v", description, err)
-					}
-					return
-				}
-
-				dst.SetWriteDeadline(time.Now().Add(5 * time.Second))
-				_, err = dst.Write(buf[:n])
-				if err != nil {
-					if !isClosedError(err) && !isTimeout(err) {
-						log.Printf("Error writing to %s: %v", description, err)
-					}
-					return
-				}
-
-				// Update bandwidth stats
-				t.bandwidthMu.Lock()
-				now := time.Now()
-				if isUpload {
-					t.BytesSent += uint64(n)
-					bytesCopied += uint64(n)
-				} else {
-					t.BytesReceived += uint64(n)
-					bytesCopied += uint64(n)
-				}
-
-				// Update bandwidth rates every second
-				if now.Sub(lastUpdate) >= time.Second {
-					duration := now.Sub(lastUpdate).Seconds()
-					if duration > 0 {
-						if isUpload {
-							t.BandwidthUp = float64(bytesCopied) / duration
-						} else {
-							t.BandwidthDown = float64(bytesCopied) / duration
-						}
-					}
-					lastUpdate = now
-					bytesCopied = 0
-				}
-				t.bandwidthMu.Unlock()
-
-				t.updateActivity()
-			}
+		upload := dst == remote
+		w := &countingWriter{w: dst, counters: counters, onWrite: func(p []byte) {
+			t.updateActivity()
+			conn.traffic.touch()
+			t.record(CaptureData, conn, upload, p)
+		}}
+		err := copyConn(dst, src, w)
+		switch {
+		case err == nil:
+			t.debugf("Connection #%d: %s ended, half-closed", conn.ID, description)
+		case !isClosedError(err):
+			t.logf("Error copying %s: %v", description, err)
 		}
 	}
 
-	go copyData(remote, local, "local->remote", true)  // Upload
-	go copyData(local, remote, "remote->local", false) // Download
+	go copyData(remote, local, "local->remote", &t.traffic.sent, &conn.traffic.sent)         // Upload
+	go copyData(local, remote, "remote->local", &t.traffic.received, &conn.traffic.received) // Download
 
-	// Wait with timeout
 	done := make(chan struct{})
 	go func() {
 		wg.Wait()
 		close(done)
 	}()
 
+	// Sessions are unlimited unless a maximum duration is configured
+	var cutoff <-chan time.Time
+	if t.maxSession > 0 {
+		timer := time.NewTimer(t.maxSession)
+		defer timer.Stop()
+		cutoff = timer.C
+	}
+
 	select {
 	case <-done:
-		return
-	case <-time.After(12 * time.Hour): // Maximum session duration
-		log.Printf("Session timeout reached")
-		return
+	case <-cutoff:
+		t.connectionMu.Lock()
+		if t.closeConnectionLocked(conn, "maximum session duration reached") {
+			t.logf("Closing connection #%d from %s after the maximum session duration of %s", conn.ID, conn.SourceAddr, t.maxSession)
+		}
+		t.connectionMu.Unlock()
 	}
 }
 
-func (t *Tunnel) reconnectSSH() error {
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", t.Host), t.sshConfig)
-	if err != nil {
-		return fmt.Errorf("failed to reconnect SSH: %v", err)
+// closeConnectionLocked closes a connection on behalf of the daemon and
+// records why, unless it is already being closed. t.connectionMu must be held.
+func (t *Tunnel) closeConnectionLocked(c *Connection, reason string) bool {
+	if c.closeReason != "" {
+		return false
 	}
-
-	oldClient := t.client
-	t.client = client
-	oldClient.Close()
-
-	return nil
+	c.closeReason = reason
+	c.local.Close()
+	return true
 }
 
 // isClosedError checks if the error is due to using closed network connection
@@ -430,75 +768,276 @@ func isClosedError(err error) bool {
 	return false
 }
 
-func isTimeout(err error) bool {
-	if netErr, ok := err.(net.Error); ok {
-		return netErr.Timeout()
+// find returns the key of the tunnel forwarding localPort to remotePort of
+// host. With localPort 0, it must be the only tunnel to that remote port.
+// tm.mu must be held.
+func (tm *TunnelManager) find(host string, remotePort, localPort int) (string, error) {
+	if localPort != 0 {
+		key := TunnelKey(host, remotePort, localPort)
+		if _, exists := tm.tunnels[key]; !exists {
+			return "", ErrNotFound
+		}
+		return key, nil
 	}
-	return false
+
+	host = normalizeHost(host)
+	var matches []string
+	var ports []string
+	for key, t := range tm.tunnels {
+		if t.Host == host && t.RemotePort == remotePort {
+			matches = append(matches, key)
+			ports = append(ports, fmt.Sprint(t.LocalPort))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", ErrNotFound
+	case 1:
+		return matches[0], nil
+	default:
+		sort.Strings(ports)
+		return "", errorf(ErrAmbiguous, "%s:%d is ambiguous, it is forwarded to local ports %s", host, remotePort, strings.Join(ports, ", "))
+	}
+}
+
+// CloseTunnel closes the tunnel forwarding localPort to remotePort of host,
+// see find
+func (tm *TunnelManager) CloseTunnel(host string, remotePort, localPort int, drain time.Duration) (CloseResult, error) {
+	return tm.closeMatching(drain, ReasonClosed, func() (string, error) {
+		return tm.find(host, remotePort, localPort)
+	})
 }
 
-func (tm *TunnelManager) CloseTunnel(host string, remotePort int) error {
+// CloseTunnelByLocalPort closes the tunnel listening on localPort
+func (tm *TunnelManager) CloseTunnelByLocalPort(localPort int, drain time.Duration) (CloseResult, error) {
+	return tm.closeMatching(drain, ReasonClosed, func() (string, error) {
+		var matches []string
+		for key, t := range tm.tunnels {
+			if t.LocalPort == localPort {
+				matches = append(matches, key)
+			}
+		}
+
+		switch len(matches) {
+		case 0:
+			return "", ErrNotFound
+		case 1:
+			return matches[0], nil
+		default:
+			sort.Strings(matches)
+			return "", errorf(ErrAmbiguous, "local port %d is ambiguous, it matches tunnels %s", localPort, strings.Join(matches, ", "))
+		}
+	})
+}
+
+// findByID returns the key of the tunnel with the given ID, or an
+// unambiguous prefix of it. tm.mu must be held.
+func (tm *TunnelManager) findByID(id string) (string, error) {
+	var matches []string
+	for key, t := range tm.tunnels {
+		if t.ID == id {
+			matches = []string{key}
+			break
+		}
+		if strings.HasPrefix(t.ID, id) {
+			matches = append(matches, key)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", ErrNotFound
+	case 1:
+		return matches[0], nil
+	default:
+		var ids []string
+		for _, key := range matches {
+			ids = append(ids, tm.tunnels[key].ID)
+		}
+		sort.Strings(ids)
+		return "", errorf(ErrAmbiguous, "tunnel ID %q is ambiguous, it matches %s", id, strings.Join(ids, ", "))
+	}
+}
+
+// CloseTunnelByID closes the tunnel with the given ID, see findByID
+func (tm *TunnelManager) CloseTunnelByID(id string, drain time.Duration) (CloseResult, error) {
+	return tm.closeMatching(drain, ReasonClosed, func() (string, error) {
+		return tm.findByID(id)
+	})
+}
+
+// closeMatching closes the tunnel whose key find returns for reason, giving
+// its connections up to drain to complete. find is called with tm.mu held,
+// which is released while draining.
+func (tm *TunnelManager) closeMatching(drain time.Duration, reason string, find func() (string, error)) (CloseResult, error) {
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
+	key, err := find()
+	if err != nil {
+		tm.mu.Unlock()
+		return CloseResult{}, err
+	}
+	tunnel := tm.detachLocked(key, reason)
+	tm.mu.Unlock()
 
-	key := fmt.Sprintf("%s:%d", host, remotePort)
-	tunnel, exists := tm.tunnels[key]
-	if !exists {
-		return fmt.Errorf("tunnel not found")
+	return tunnel.shutdown(drain), nil
+}
+
+// closeOwn closes a tunnel on its own initiative, such as when its
+// reconnection policy gave up, unless it was closed meanwhile. Its connections
+// are cut.
+func (tm *TunnelManager) closeOwn(t *Tunnel, reason string) {
+	tm.closeMatching(0, reason, func() (string, error) {
+		for key, tunnel := range tm.tunnels {
+			if tunnel == t {
+				return key, nil
+			}
+		}
+		return "", ErrNotFound
+	})
+}
+
+// shutdownAll stops the detached tunnels right away. tm.mu must not be held,
+// as stopping a tunnel waits for its goroutines, which may need it.
+func shutdownAll(tunnels []*Tunnel) {
+	var wg sync.WaitGroup
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.shutdown(0)
+		}()
 	}
+	wg.Wait()
+}
 
-	close(tunnel.done)
-	tunnel.listener.Close()
-	tunnel.client.Close()
+// detachLocked forgets the tunnel, closed for reason, and stops accepting
+// connections, tm.mu must be held
+func (tm *TunnelManager) detachLocked(key, reason string) *Tunnel {
+	tunnel := tm.tunnels[key]
 	delete(tm.tunnels, key)
-	return nil
+	tunnel.closeReason = reason
+	tunnel.closeListeners()
+	return tunnel
+}
+
+// newID returns a short random ID which is not used by another tunnel, tm.mu
+// must be held
+func (tm *TunnelManager) newID() string {
+	for {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id := hex.EncodeToString(b)
+
+		unique := true
+		for _, t := range tm.tunnels {
+			if t.ID == id {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			return id
+		}
+	}
 }
 
-func (tm *TunnelManager) ListTunnels() []Tunnel {
+func (tm *TunnelManager) ListTunnels() []*Tunnel {
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
 
-	tunnels := make([]Tunnel, 0, len(tm.tunnels))
+	tunnels := make([]*Tunnel, 0, len(tm.tunnels))
 	for _, t := range tm.tunnels {
-		t.activityMu.RLock()
-		t.bandwidthMu.RLock()
-		t.connectionMu.RLock()
-		tunnel := Tunnel{
-			Host:          t.Host,
-			LocalPort:     t.LocalPort,
-			RemotePort:    t.RemotePort,
-			CreatedAt:     t.CreatedAt,
-			LastActivity:  t.LastActivity,
-			client:        t.client,
-			listener:      t.listener,
-			done:          t.done,
-			reconnect:     t.reconnect,
-			sshConfig:     t.sshConfig,
-			BytesSent:     t.BytesSent,
-			BytesReceived: t.BytesReceived,
-			BandwidthUp:   t.BandwidthUp,
-			BandwidthDown: t.BandwidthDown,
-			ActiveConns:   t.ActiveConns,
-			TotalConns:    t.TotalConns,
-		}
-		t.connectionMu.RUnlock()
-		t.bandwidthMu.RUnlock()
-		t.activityMu.RUnlock()
-		tunnels = append(tunnels, tunnel)
+		tunnels = append(tunnels, t.snapshot())
 	}
 	return tunnels
 }
 
+// GetTunnel returns a snapshot of the tunnel forwarding localPort to
+// remotePort on host, see find
+func (tm *TunnelManager) GetTunnel(host string, remotePort, localPort int) (*Tunnel, error) {
+	t, err := tm.get(host, remotePort, localPort)
+	if err != nil {
+		return nil, err
+	}
+	return t.snapshot(), nil
+}
+
+// GetTunnelByID returns a snapshot of the tunnel with the given ID, see
+// findByID
+func (tm *TunnelManager) GetTunnelByID(id string) (*Tunnel, error) {
+	tm.mu.RLock()
+	key, err := tm.findByID(id)
+	t := tm.tunnels[key]
+	tm.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return t.snapshot(), nil
+}
+
+// snapshot returns a copy of the tunnel with a consistent view of its stats
+func (t *Tunnel) snapshot() *Tunnel {
+	latency, keepAliveFailures := t.latency()
+
+	t.activityMu.RLock()
+	t.bandwidthMu.RLock()
+	t.endpointMu.RLock()
+	defer t.endpointMu.RUnlock()
+	defer t.bandwidthMu.RUnlock()
+	defer t.activityMu.RUnlock()
+
+	s := &Tunnel{
+		ID:            t.ID,
+		Host:          t.Host,
+		LocalPort:     t.LocalPort,
+		RemotePort:    t.RemotePort,
+		Labels:        t.Labels,
+		Warnings:      t.Warnings,
+		CreatedAt:     t.CreatedAt,
+		LastActivity:  t.LastActivity,
+		Addresses:     t.Addresses,
+		listeners:     t.listeners,
+		reconnect:     t.reconnect,
+		ssh:           t.ssh,
+		BytesSent:     t.traffic.sent.Load(),
+		BytesReceived: t.traffic.received.Load(),
+		BandwidthUp:   t.BandwidthUp,
+		BandwidthDown: t.BandwidthDown,
+		ActiveConns:   t.activeConns.Load(),
+		TotalConns:    t.totalConns.Load(),
+		history:       append([]BandwidthSample(nil), t.history...),
+		usage:         t.usage,
+		paused:        t.Paused(),
+
+		Latency:           latency,
+		KeepAliveFailures: keepAliveFailures,
+		ProxyProtocol:     t.ProxyProtocol,
+		Nagle:             t.Nagle,
+		AcceptRate:        t.AcceptRate,
+		HoldWhileDown:     t.HoldWhileDown,
+		IdleTimeout:       t.IdleTimeout,
+		Reconnect:         t.Reconnect,
+		Supervised:        t.Supervised,
+		DialRetry:         t.DialRetry,
+		KeepAlive:         t.KeepAlive,
+		ExpiresAt:         t.ExpiresAt,
+		OwnerPID:          t.OwnerPID,
+		HostAddress:       t.HostAddress,
+	}
+	s.logLevel.Store(t.logLevel.Load())
+	return s
+}
+
 func (tm *TunnelManager) CloseAllTunnels() int {
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
-
-	count := len(tm.tunnels)
-	for key, tunnel := range tm.tunnels {
-		close(tunnel.done)
-		tunnel.listener.Close()
-		tunnel.client.Close()
-		delete(tm.tunnels, key)
+	var closed []*Tunnel
+	for key := range tm.tunnels {
+		closed = append(closed, tm.detachLocked(key, ReasonClosed))
 	}
-	return count
+	tm.mu.Unlock()
+
+	shutdownAll(closed)
+	return len(closed)
 }
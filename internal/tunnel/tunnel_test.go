@@ -0,0 +1,865 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startSSHServer runs an SSH server accepting any client and forwarding
+// direct-tcpip channels, and returns its port
+func startSSHServer(t *testing.T) int {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serveSSH(conn, config)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		var payload struct {
+			DestAddr string
+			DestPort uint32
+			OrigAddr string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.DestAddr, fmt.Sprint(payload.DestPort)))
+		if err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.CloseWrite()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.(*net.TCPConn).CloseWrite()
+		}()
+	}
+}
+
+// startEchoServer runs a TCP server echoing what it receives, and returns its
+// port
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newTestManager returns a manager connecting to a test SSH server
+func newTestManager(t *testing.T) *TunnelManager {
+	tm := NewTunnelManager()
+	tm.sshPort = startSSHServer(t)
+	return tm
+}
+
+var testSSHConfig = &ssh.ClientConfig{
+	User:            "test",
+	HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+}
+
+// createTestTunnel forwards a free local port to an echo server, and returns
+// the local port and the remote one
+func createTestTunnel(t *testing.T, tm *TunnelManager) (int, int) {
+	t.Helper()
+
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	if localPort == 0 {
+		t.Fatal("no free local port")
+	}
+	if err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, Options{}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	return localPort, remotePort
+}
+
+// echo sends a message through conn and checks it comes back
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != message {
+		t.Fatalf("got %q, want %q", buf, message)
+	}
+}
+
+// waitGoroutines waits for the number of goroutines to go back to n
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, want %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCreateAndCloseTunnel(t *testing.T) {
+	tm := newTestManager(t)
+	before := runtime.NumGoroutine()
+
+	localPort, remotePort := createTestTunnel(t, tm)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+
+	result, err := tm.CloseTunnel("127.0.0.1", remotePort, localPort, 0)
+	if err != nil {
+		t.Fatalf("CloseTunnel: %v", err)
+	}
+	if result.Drained+result.Cut > 1 {
+		t.Errorf("got %+v, want at most one connection", result)
+	}
+	if len(tm.ListTunnels()) != 0 {
+		t.Errorf("tunnel still listed after close")
+	}
+
+	// The local port is released and every goroutine of the tunnel is gone,
+	// leaving only those of the test servers
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatalf("local port not released: %v", err)
+	}
+	l.Close()
+	waitGoroutines(t, before+2)
+}
+
+func TestCloseTunnelDrainsConnections(t *testing.T) {
+	tm := newTestManager(t)
+	localPort, remotePort := createTestTunnel(t, tm)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	result, err := tm.CloseTunnel("127.0.0.1", remotePort, localPort, 5*time.Second)
+	if err != nil {
+		t.Fatalf("CloseTunnel: %v", err)
+	}
+	if result != (CloseResult{Drained: 1}) {
+		t.Errorf("got %+v, want one drained connection", result)
+	}
+}
+
+func TestCloseTunnelCutsConnections(t *testing.T) {
+	tm := newTestManager(t)
+	localPort, remotePort := createTestTunnel(t, tm)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	result, err := tm.CloseTunnel("127.0.0.1", remotePort, localPort, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("CloseTunnel: %v", err)
+	}
+	if result != (CloseResult{Cut: 1}) {
+		t.Errorf("got %+v, want one cut connection", result)
+	}
+
+	// The client sees the connection end
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection still open after being cut")
+	}
+}
+
+func TestCreateTunnelCanceled(t *testing.T) {
+	tm := NewTunnelManager()
+
+	// A server which never completes the SSH handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	tm.sshPort = l.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	localPort := FreePort(30000)
+	err = tm.CreateTunnel(ctx, "127.0.0.1", localPort, 80, testSSHConfig, Options{})
+	if err == nil {
+		t.Fatal("CreateTunnel succeeded without a handshake")
+	}
+
+	// The local port is released and the tunnel can be created again
+	l2, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatalf("local port not released: %v", err)
+	}
+	l2.Close()
+	if len(tm.ListTunnels()) != 0 {
+		t.Errorf("failed tunnel is listed")
+	}
+}
+
+func TestCreateTunnelErrorKinds(t *testing.T) {
+	tm := NewTunnelManager()
+
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.sshPort = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	err = tm.CreateTunnel(context.Background(), "127.0.0.1", FreePort(30000), 80, testSSHConfig, Options{})
+	if !errors.Is(err, ErrConnectionRefused) || !errors.Is(err, ErrHostUnreachable) {
+		t.Errorf("got %v, want a refused connection", err)
+	}
+
+	// A server which never completes the SSH handshake
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	tm.sshPort = l.Addr().(*net.TCPAddr).Port
+
+	opts := Options{HandshakeTimeout: 100 * time.Millisecond}
+	err = tm.CreateTunnel(context.Background(), "127.0.0.1", FreePort(30000), 80, testSSHConfig, opts)
+	if !errors.Is(err, ErrTimedOut) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestCreateTunnelIfExists(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, remotePort := createTestTunnel(t, tm)
+	original, _ := tm.GetTunnel("127.0.0.1", remotePort, localPort)
+
+	create := func(opts Options) error {
+		return tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, opts)
+	}
+	if err := create(Options{}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("got %v, want ErrAlreadyExists", err)
+	}
+
+	// An identical tunnel is kept, other settings are refused
+	if err := create(Options{IfExists: ExistsKeep}); err != nil {
+		t.Errorf("keeping an identical tunnel: %v", err)
+	}
+	labels := map[string]string{"env": "dev"}
+	if err := create(Options{IfExists: ExistsKeep, Labels: labels}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("got %v, want ErrAlreadyExists for other settings", err)
+	}
+	if kept, _ := tm.GetTunnel("127.0.0.1", remotePort, localPort); kept.ID != original.ID {
+		t.Errorf("tunnel %s replaced by %s, want it kept", original.ID, kept.ID)
+	}
+
+	// Replacing takes over the local port with the new settings
+	if err := create(Options{IfExists: ExistsReplace, Labels: labels}); err != nil {
+		t.Fatalf("replacing: %v", err)
+	}
+	replaced, _ := tm.GetTunnel("127.0.0.1", remotePort, localPort)
+	if replaced.ID == original.ID || replaced.Labels["env"] != "dev" {
+		t.Errorf("got tunnel %s with labels %v, want a new one labeled env=dev", replaced.ID, replaced.Labels)
+	}
+	if len(tm.ListTunnels()) != 1 {
+		t.Errorf("got %d tunnels, want 1", len(tm.ListTunnels()))
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+}
+
+func TestSameRemotePort(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, remotePort := createTestTunnel(t, tm)
+
+	otherPort := FreePort(localPort + 1)
+	if err := tm.CreateTunnel(context.Background(), "127.0.0.1", otherPort, remotePort, testSSHConfig, Options{}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	for _, port := range []int{localPort, otherPort} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "hello")
+		conn.Close()
+	}
+
+	// The remote port alone no longer designates a single tunnel
+	if _, err := tm.GetTunnel("127.0.0.1", remotePort, 0); !errors.Is(err, ErrAmbiguous) {
+		t.Errorf("got %v, want ErrAmbiguous", err)
+	}
+	if _, err := tm.CloseTunnel("127.0.0.1", remotePort, otherPort, 0); err != nil {
+		t.Fatalf("CloseTunnel: %v", err)
+	}
+	got, err := tm.GetTunnel("127.0.0.1", remotePort, 0)
+	if err != nil {
+		t.Fatalf("GetTunnel: %v", err)
+	}
+	if got.LocalPort != localPort {
+		t.Errorf("got the tunnel on local port %d, want %d", got.LocalPort, localPort)
+	}
+}
+
+func TestGetTunnelByID(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, remotePort := createTestTunnel(t, tm)
+
+	want, err := tm.GetTunnel("127.0.0.1", remotePort, localPort)
+	if err != nil {
+		t.Fatalf("GetTunnel: %v", err)
+	}
+	for _, id := range []string{want.ID, want.ID[:3]} {
+		got, err := tm.GetTunnelByID(id)
+		if err != nil {
+			t.Fatalf("GetTunnelByID(%q): %v", id, err)
+		}
+		if got.LocalPort != localPort || got.RemotePort != remotePort {
+			t.Errorf("GetTunnelByID(%q) got %d:%d, want %d:%d", id, got.LocalPort, got.RemotePort, localPort, remotePort)
+		}
+	}
+	if _, err := tm.GetTunnelByID("not-an-id"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, remotePort := createTestTunnel(t, tm)
+	tun, err := tm.get("127.0.0.1", remotePort, localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+
+	start := time.Now()
+	tun.sampleUsage(start.Add(time.Minute))
+	tun.sampleUsage(start.Add(2 * time.Minute))
+
+	usage := tun.Usage(start)
+	if len(usage) != 2 {
+		t.Fatalf("got %d samples, want 2", len(usage))
+	}
+	if usage[0].NewConns != 1 || usage[0].BytesSent+usage[0].BytesReceived == 0 {
+		t.Errorf("got first sample %+v, want one connection and its traffic", usage[0])
+	}
+	if usage[1].NewConns != 0 || usage[1].BytesSent+usage[1].BytesReceived != 0 {
+		t.Errorf("got second sample %+v, want no activity", usage[1])
+	}
+	if got := tun.Usage(start.Add(time.Minute)); len(got) != 1 {
+		t.Errorf("got %d samples after the first one, want 1", len(got))
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	if err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, Options{IdleTimeout: 200 * time.Millisecond}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	// The connection is closed once idle, whatever the manager timeout
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want the idle connection closed", err)
+	}
+}
+
+func TestUpdateTunnel(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, remotePort := createTestTunnel(t, tm)
+	before, err := tm.GetTunnel("127.0.0.1", remotePort, 0)
+	if err != nil {
+		t.Fatalf("GetTunnel: %v", err)
+	}
+
+	// A connection in progress survives the update
+	inProgress, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inProgress.Close()
+	echo(t, inProgress, "before")
+
+	newPort := FreePort(localPort + 1)
+	got, err := tm.UpdateTunnel("127.0.0.1", remotePort, 0, Update{LocalPort: newPort})
+	if err != nil {
+		t.Fatalf("UpdateTunnel: %v", err)
+	}
+	if got.ID != before.ID || got.LocalPort != newPort {
+		t.Errorf("got tunnel %s on local port %d, want %s on %d", got.ID, got.LocalPort, before.ID, newPort)
+	}
+	echo(t, inProgress, "after")
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", newPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+	if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort)); err == nil {
+		conn.Close()
+		t.Errorf("local port %d still accepts connections", localPort)
+	}
+	if _, err := tm.GetTunnel("127.0.0.1", remotePort, newPort); err != nil {
+		t.Errorf("GetTunnel with the new local port: %v", err)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	start := time.Now()
+	if err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, Options{AcceptRate: 4}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	// A burst of 4 connections, then one every 250ms
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "hello")
+		conn.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 750*time.Millisecond {
+		t.Errorf("8 connections at 4/s were accepted within %s", elapsed)
+	}
+}
+
+func TestConcurrentCreateAndClose(t *testing.T) {
+	tm := newTestManager(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		remotePort := startEchoServer(t)
+		localPort := FreePort(31000 + 100*i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, Options{}); err != nil {
+				t.Errorf("CreateTunnel: %v", err)
+				return
+			}
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Exercise the readers while closing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			for _, tun := range tm.ListTunnels() {
+				tm.GetStatus(tun.Host, tun.RemotePort, tun.LocalPort)
+			}
+		}
+	}()
+
+	if count := tm.CloseAllTunnels(); count != 5 {
+		t.Errorf("closed %d tunnels, want 5", count)
+	}
+	<-done
+}
+
+// startRequestServer runs a TCP server answering each connection once the
+// client ended its request, after a delay, and returns its port
+func startRequestServer(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprintf(conn, "got %d bytes", len(request))
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestHalfClose(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	remotePort := startRequestServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	if err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, Options{}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server answers after the end of the request, which the tunnel
+	// must carry without closing the other direction
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "got 5 bytes" {
+		t.Errorf("got %q, want %q", got, "got 5 bytes")
+	}
+}
+
+func TestNetworkChange(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+	localPort, _ := createTestTunnel(t, tm)
+
+	// A connection which still answers is kept
+	tm.checkConnections(reasonNetworkChange, map[string]bool{"127.0.0.1": true})
+	if reconnects := tm.Totals().Reconnects; reconnects != 0 {
+		t.Fatalf("got %d reconnections, want the connection kept", reconnects)
+	}
+
+	// One whose local address is gone is replaced at once
+	tm.checkConnections(reasonNetworkChange, map[string]bool{})
+	deadline := time.Now().Add(5 * time.Second)
+	for tm.Totals().Reconnects == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the tunnel did not reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+}
+
+func TestHostAddress(t *testing.T) {
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+
+	// The host does not resolve, only its address is dialed
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	err := tm.CreateTunnel(context.Background(), "db1.invalid", localPort, remotePort, testSSHConfig, Options{HostAddress: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	tunnels := tm.ListTunnels()
+	if len(tunnels) != 1 || tunnels[0].Host != "db1.invalid" || tunnels[0].HostAddress != "127.0.0.1" {
+		t.Fatalf("got %+v, want the tunnel listed under its host", tunnels)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+}
+
+func TestTunnelKey(t *testing.T) {
+	// Tunnels are listed under the host without brackets
+	if got, want := TunnelKey("[::1]", 5432, 15432), TunnelKey("::1", 5432, 15432); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is needed to connect from a proxy command")
+	}
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+
+	// The host does not resolve, only the command reaches the server
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	opts := Options{ProxyCommand: `bash -c 'exec 3<>/dev/tcp/127.0.0.1/%p; cat <&3 & cat >&3; kill $!'`}
+	if err := tm.CreateTunnel(context.Background(), "db1.invalid", localPort, remotePort, testSSHConfig, opts); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	// A command which fails reports its error output
+	opts = Options{ProxyCommand: `bash -c 'echo no route to %n >&2; exit 3'`}
+	err = tm.CreateTunnel(context.Background(), "db2.invalid", FreePort(localPort+1), remotePort, testSSHConfig, opts)
+	if !errors.Is(err, ErrHostUnreachable) || !strings.Contains(err.Error(), "no route to db2.invalid") {
+		t.Fatalf("got %v, want the error of the command", err)
+	}
+
+	// A host the shell would interpret is refused rather than run
+	marker := filepath.Join(t.TempDir(), "injected")
+	opts = Options{ProxyCommand: "nc %n %p"}
+	err = tm.CreateTunnel(context.Background(), "x;touch "+marker, FreePort(localPort+2), remotePort, testSSHConfig, opts)
+	if err == nil || !strings.Contains(err.Error(), "invalid host") {
+		t.Fatalf("got %v, want the host refused", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("the host ran a shell command")
+	}
+}
+
+func TestControlMaster(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("ssh is needed to run a ControlMaster")
+	}
+	tm := newTestManager(t)
+	defer tm.CloseAllTunnels()
+
+	dir := t.TempDir()
+	master := exec.Command("ssh", "-M", "-S", filepath.Join(dir, "cm-test@127.0.0.1:"+strconv.Itoa(tm.sshPort)), "-N",
+		"-F", "/dev/null", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+		"-p", strconv.Itoa(tm.sshPort), "test@127.0.0.1")
+	if err := master.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		master.Process.Kill()
+		master.Wait()
+	})
+
+	remotePort := startEchoServer(t)
+	localPort := FreePort(20000 + remotePort%20000)
+	opts := Options{ControlPath: filepath.Join(dir, "cm-%r@%h:%p")}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := tm.CreateTunnel(context.Background(), "127.0.0.1", localPort, remotePort, testSSHConfig, opts)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrHostUnreachable) || time.Now().After(deadline) {
+			t.Fatalf("CreateTunnel: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	tm.mu.RLock()
+	for _, tunnel := range tm.tunnels {
+		if _, ok := tunnel.sshClient().(*muxTransport); !ok {
+			t.Errorf("got %T, want the connections forwarded by the master", tunnel.sshClient())
+		}
+	}
+	tm.mu.RUnlock()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello")
+}
@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"net"
+	"slices"
+)
+
+// Update describes the changes UpdateTunnel makes to a tunnel, the zero
+// fields being left unchanged
+type Update struct {
+	LocalPort  int
+	Bind       []string // Local addresses to listen on
+	RemotePort int
+}
+
+// UpdateTunnel changes the local port, the bind addresses or the remote port
+// of the tunnel forwarding localPort to remotePort of host, see find. The
+// tunnel keeps its ID, statistics and SSH connection. The new listeners are
+// bound before the old ones stop accepting, except on the same local port
+// where they are swapped, and the connections in progress keep going to the
+// remote port they were accepted for. It returns the updated tunnel.
+func (tm *TunnelManager) UpdateTunnel(host string, remotePort, localPort int, update Update) (*Tunnel, error) {
+	tm.updateMu.Lock()
+	defer tm.updateMu.Unlock()
+
+	tm.mu.Lock()
+	key, err := tm.find(host, remotePort, localPort)
+	if err != nil {
+		tm.mu.Unlock()
+		return nil, err
+	}
+	t := tm.tunnels[key]
+	oldLocal, oldRemote := t.ports()
+	newLocal, newRemote := oldLocal, oldRemote
+	if update.LocalPort != 0 {
+		newLocal = update.LocalPort
+	}
+	if update.RemotePort != 0 {
+		newRemote = update.RemotePort
+	}
+	newKey := TunnelKey(t.Host, newRemote, newLocal)
+	if newKey != key {
+		if _, exists := tm.tunnels[newKey]; exists || tm.pending[newKey] {
+			tm.mu.Unlock()
+			return nil, ErrAlreadyExists
+		}
+		tm.pending[newKey] = true
+		defer func() {
+			tm.mu.Lock()
+			delete(tm.pending, newKey)
+			tm.mu.Unlock()
+		}()
+	}
+	oldBind, family := t.options.Bind, t.options.Family
+	bind := oldBind
+	if update.Bind != nil {
+		bind = update.Bind
+	}
+	rebind := newLocal != oldLocal || !slices.Equal(bind, oldBind)
+
+	// Keep start waiting while the listeners are swapped. The tunnel is
+	// listed, so its listeners are still accepted on.
+	t.accepting.Add(1)
+	tm.mu.Unlock()
+
+	old, err := t.swapListeners(rebind, newLocal, family, bind, oldBind)
+	t.accepting.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	tm.mu.Lock()
+	if tm.tunnels[key] != t {
+		// Closed meanwhile, along with the new listeners
+		tm.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	t.endpointMu.Lock()
+	t.LocalPort, t.RemotePort = newLocal, newRemote
+	t.endpointMu.Unlock()
+	t.options.Bind = bind
+	delete(tm.tunnels, key)
+	tm.tunnels[newKey] = t
+	tm.mu.Unlock()
+
+	for _, l := range old {
+		l.Close()
+	}
+	t.logf("Updated: %s:%d -> localhost:%d", t.Host, newRemote, newLocal)
+	return t.snapshot(), nil
+}
+
+// swapListeners starts accepting on localPort and the bind addresses when
+// rebind is set, and returns the listeners to close once the tunnel is
+// updated. On the same local port, the old listeners are closed first, and
+// bound again if the new addresses fail.
+func (t *Tunnel) swapListeners(rebind bool, localPort int, family AddressFamily, bind, oldBind []string) ([]net.Listener, error) {
+	if !rebind {
+		return nil, nil
+	}
+
+	t.endpointMu.RLock()
+	old := t.listeners
+	samePort := t.LocalPort == localPort
+	t.endpointMu.RUnlock()
+	if samePort {
+		for _, l := range old {
+			l.Close()
+		}
+	}
+
+	listeners, err := listenLocal(localPort, family, bind)
+	if err != nil {
+		if !samePort {
+			return nil, err
+		}
+		restored, restoreErr := listenLocal(localPort, family, oldBind)
+		if restoreErr != nil {
+			t.recordError("failed to listen again on local port %d: %v, closing tunnel", localPort, restoreErr)
+			go t.closeSelf(ReasonClosed)
+			return nil, err
+		}
+		t.setListeners(restored)
+		return nil, err
+	}
+	if !t.setListeners(listeners) {
+		return nil, ErrNotFound
+	}
+	return old, nil
+}
+
+// setListeners starts accepting on listeners instead of the current ones,
+// unless the tunnel was closed meanwhile, in which case they are closed
+func (t *Tunnel) setListeners(listeners []net.Listener) bool {
+	t.endpointMu.Lock()
+	defer t.endpointMu.Unlock()
+	if t.unlistened {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return false
+	}
+	t.listeners = listeners
+	t.Addresses = make([]string, len(listeners))
+	for i, l := range listeners {
+		t.Addresses[i] = l.Addr().String()
+	}
+	t.acceptOn(listeners)
+	return true
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Every UsageInterval, the traffic and connections of a tunnel are recorded
+// for the last UsageSize intervals, a day, for reports over longer periods
+// than the bandwidth history.
+const (
+	UsageInterval = time.Minute
+	UsageSize     = 24 * 60
+)
+
+// UsageSample is the activity of a tunnel during one UsageInterval
+type UsageSample struct {
+	Time          time.Time // End of the interval
+	BytesSent     uint64
+	BytesReceived uint64
+	ActiveConns   int32  // Open at the end of the interval
+	NewConns      uint64 // Opened during the interval
+}
+
+// usageHistory is shared by a tunnel and its snapshots, which would
+// otherwise copy a day of samples each time
+type usageHistory struct {
+	samples []UsageSample // Oldest first
+	mu      sync.RWMutex
+
+	// Totals of the tunnel at the previous sample
+	sent, received, conns uint64
+}
+
+// sampleUsage records the activity of the tunnel since the previous sample
+func (t *Tunnel) sampleUsage(now time.Time) {
+	sent, received := t.traffic.sent.Load(), t.traffic.received.Load()
+	conns := t.totalConns.Load()
+
+	h := t.usage
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, UsageSample{
+		Time:          now,
+		BytesSent:     sent - h.sent,
+		BytesReceived: received - h.received,
+		ActiveConns:   t.activeConns.Load(),
+		NewConns:      conns - h.conns,
+	})
+	if len(h.samples) > UsageSize {
+		h.samples = h.samples[len(h.samples)-UsageSize:]
+	}
+	h.sent, h.received, h.conns = sent, received, conns
+}
+
+// Usage returns the usage samples of the tunnel which end after since,
+// oldest first
+func (t *Tunnel) Usage(since time.Time) []UsageSample {
+	t.usage.mu.RLock()
+	defer t.usage.mu.RUnlock()
+
+	var samples []UsageSample
+	for _, s := range t.usage.samples {
+		if s.Time.After(since) {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
@@ -0,0 +1,146 @@
+package userconfig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Nesting limit of Include directives, like ssh
+const maxIncludeDepth = 16
+
+// SSHConfigPath returns the path of the ssh config of the user,
+// ~/.ssh/config
+func SSHConfigPath() string {
+	return filepath.Join(Home(), ".ssh", "config")
+}
+
+// SSHDirective is a directive of an ssh config file
+type SSHDirective struct {
+	Keyword string   // Lower case, as ssh keywords are case insensitive
+	Value   string   // The arguments as written, such as a command
+	Args    []string // The arguments split on spaces
+	Where   string   // file:line, for messages
+}
+
+// SSHConfig returns the directives of the ssh config file at path which apply
+// to host, in order, following Include directives. Like ssh, the first
+// directive setting a value wins. Match blocks are skipped, along with a
+// warning.
+func SSHConfig(path, host string) ([]SSHDirective, []string, error) {
+	p := &sshConfigParser{host: host, dir: filepath.Dir(path)}
+	if err := p.parse(path, 0); err != nil {
+		return nil, nil, err
+	}
+	return p.directives, p.warnings, nil
+}
+
+type sshConfigParser struct {
+	host       string
+	dir        string // Relative Include paths start from there
+	directives []SSHDirective
+	warnings   []string
+}
+
+func (p *sshConfigParser) parse(path string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Directives before the first Host line apply to every host
+	active := true
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		keyword, value := splitSSHDirective(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		args := strings.Fields(value)
+		where := fmt.Sprintf("%s:%d", path, lineno)
+
+		switch keyword {
+		case "host":
+			active = matchHostPatterns(args, p.host)
+		case "match":
+			active = false
+			p.warnings = append(p.warnings, fmt.Sprintf("%s: Match blocks are not supported, skipped", where))
+		case "include":
+			if !active {
+				continue
+			}
+			if depth >= maxIncludeDepth {
+				return fmt.Errorf("%s: too many nested includes", where)
+			}
+			for _, pattern := range args {
+				if err := p.include(pattern, depth); err != nil {
+					return err
+				}
+			}
+		default:
+			if active {
+				p.directives = append(p.directives, SSHDirective{Keyword: keyword, Value: value, Args: args, Where: where})
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHDirective splits a line of an ssh config file into its lower case
+// keyword and its arguments, separated by spaces or an equal sign. Blank
+// lines and comments have no keyword.
+func splitSSHDirective(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), ""
+	}
+	value := strings.TrimSpace(line[end:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	return strings.ToLower(line[:end]), value
+}
+
+// include parses the files matching an Include pattern, relative to the
+// directory of the main config file
+func (p *sshConfigParser) include(pattern string, depth int) error {
+	if strings.HasPrefix(pattern, "~/") {
+		pattern = ExpandHome(pattern)
+	} else if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.dir, pattern)
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := p.parse(path, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchHostPatterns reports whether host matches the patterns of a Host
+// line: any of the patterns, and none of the negated ones
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := filepath.Match(strings.TrimPrefix(pattern, "!"), host)
+		if !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
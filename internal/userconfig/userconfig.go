@@ -0,0 +1,260 @@
+// Package userconfig reads the configuration of the user,
+// ~/.config/tunnel/config.yaml, shared by the CLI and the daemon:
+//
+//	groups:
+//	  web: 3000, 8080:80, 5432
+//	hosts:
+//	  server1:
+//	    user: deploy
+//	    port: 2222
+//	    identity_file: ~/.ssh/deploy_ed25519
+//	  db1:
+//	    address: 10.0.0.5
+//	  "*.internal":
+//	    jump_host: bastion.example.com
+//	    bind: [127.0.0.1]
+//	  "bastion-*":
+//	    control_path: ~/.ssh/cm-%C
+//	  "*.prod":
+//	    vault:
+//	      address: https://vault.example.com:8200
+//	      role: ops
+//	  web1.aws.example.com:
+//	    ec2_instance_connect:
+//	      instance_id: i-0123456789abcdef0
+//	  "*.gcp.example.com":
+//	    os_login:
+//	      project: my-project
+//	  "*":
+//	    proxy: socks5://proxy.example.com:1080
+//	tokens:
+//	  dashboard:
+//	    token: 2f6c1e0b9a
+//	    scope: read
+//	cli:
+//	  output: json
+//	  bind: [127.0.0.1]
+//	  watch_interval: 2s
+//	  color: never
+package userconfig
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Groups map[string]PortGroup `yaml:"groups"`
+	Hosts  Hosts                `yaml:"hosts"`
+	Tokens map[string]Token     `yaml:"tokens"` // By name
+	CLI    CLIDefaults          `yaml:"cli"`
+}
+
+// CLIDefaults are the defaults of the flags of the tunnel command, the flags
+// given on the command line win
+type CLIDefaults struct {
+	Output        string        `yaml:"output"` // text, json or yaml
+	Socket        string        `yaml:"socket"`
+	Bind          []string      `yaml:"bind"`
+	WatchInterval time.Duration `yaml:"watch_interval"`
+	Color         string        `yaml:"color"` // auto, always or never
+}
+
+// PortGroup is a named set of port mappings, given as a list or as a
+// comma-separated string
+type PortGroup []string
+
+func (g *PortGroup) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*g = nil
+		for _, ports := range strings.Split(value.Value, ",") {
+			if ports = strings.TrimSpace(ports); ports != "" {
+				*g = append(*g, ports)
+			}
+		}
+		return nil
+	}
+	var ports []string
+	if err := value.Decode(&ports); err != nil {
+		return err
+	}
+	*g = ports
+	return nil
+}
+
+// Token grants access to the API of the daemon, which then refuses the calls
+// without one of the tokens
+type Token struct {
+	Token string `yaml:"token"`
+	Scope string `yaml:"scope"` // read or manage
+}
+
+// HostDefaults are the settings used for the tunnels to the hosts matching
+// Pattern, when the tunnel does not set them itself
+type HostDefaults struct {
+	Pattern      string   `yaml:"-"`
+	User         string   `yaml:"user"`
+	Port         int      `yaml:"port"`
+	Address      string   `yaml:"address"` // Dialed instead of the host, such as its IP
+	IdentityFile string   `yaml:"identity_file"`
+	JumpHost     string   `yaml:"jump_host"`    // [user@]host[:port], like ssh -J
+	Proxy        string   `yaml:"proxy"`        // socks5:// or http://[user:password@]host:port
+	ControlPath  string   `yaml:"control_path"` // Socket of an OpenSSH ControlMaster, like ControlPath
+	Bind         []string `yaml:"bind"`
+	Vault        *Vault   `yaml:"vault"`
+
+	EC2InstanceConnect *EC2InstanceConnect `yaml:"ec2_instance_connect"`
+	OSLogin            *OSLogin            `yaml:"os_login"`
+}
+
+// EC2InstanceConnect pushes a key generated by the daemon to an AWS instance
+// with EC2 Instance Connect before each connection, with the aws CLI and its
+// credentials
+type EC2InstanceConnect struct {
+	InstanceID string `yaml:"instance_id"`
+	Region     string `yaml:"region"`  // Defaults to the one of the aws CLI
+	Profile    string `yaml:"profile"` // Defaults to the one of the aws CLI
+}
+
+// OSLogin adds a key generated by the daemon to the OS Login profile of the
+// gcloud account, with the gcloud CLI and its credentials. The SSH user
+// defaults to the POSIX user of the profile.
+type OSLogin struct {
+	Project string `yaml:"project"` // Defaults to the one of the gcloud CLI
+}
+
+// Vault has the SSH secrets engine of HashiCorp Vault sign the key of the
+// tunnels, which then authenticate with short-lived certificates. The token
+// is $VAULT_TOKEN, else the one saved by vault login in ~/.vault-token.
+type Vault struct {
+	Address string `yaml:"address"` // Defaults to $VAULT_ADDR
+	Mount   string `yaml:"mount"`   // Path of the secrets engine, defaults to ssh
+	Role    string `yaml:"role"`
+}
+
+// Hosts are the host sections, in the order of the file
+type Hosts []HostDefaults
+
+func (h *Hosts) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: hosts must map host names or patterns to their settings", value.Line)
+	}
+	*h = nil
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		var defaults HostDefaults
+		if err := value.Content[i+1].Decode(&defaults); err != nil {
+			return err
+		}
+		defaults.Pattern = value.Content[i].Value
+		if _, err := path.Match(defaults.Pattern, ""); err != nil {
+			return fmt.Errorf("line %d: invalid host pattern %q", value.Content[i].Line, defaults.Pattern)
+		}
+		*h = append(*h, defaults)
+	}
+	return nil
+}
+
+// Path returns where the configuration is read from
+func Path() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = filepath.Join(Home(), ".config")
+	}
+	return filepath.Join(dir, "tunnel", "config.yaml")
+}
+
+// Load reads the configuration, which is empty when the file does not exist
+func Load() (*Config, error) {
+	config := &Config{}
+	path := Path()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// GroupNames returns the sorted names of the port groups
+func (c *Config) GroupNames() []string {
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HostDefaults merges the sections matching host. Like in ssh_config, the
+// first section setting a value wins, so specific hosts go before patterns.
+func (c *Config) HostDefaults(host string) HostDefaults {
+	merged := HostDefaults{Pattern: host}
+	for _, h := range c.Hosts {
+		if ok, _ := path.Match(h.Pattern, host); !ok {
+			continue
+		}
+		if merged.User == "" {
+			merged.User = h.User
+		}
+		if merged.Port == 0 {
+			merged.Port = h.Port
+		}
+		if merged.IdentityFile == "" {
+			merged.IdentityFile = h.IdentityFile
+		}
+		if merged.Address == "" {
+			merged.Address = h.Address
+		}
+		if merged.JumpHost == "" {
+			merged.JumpHost = h.JumpHost
+		}
+		if merged.Proxy == "" {
+			merged.Proxy = h.Proxy
+		}
+		if merged.ControlPath == "" {
+			merged.ControlPath = h.ControlPath
+		}
+		if merged.Bind == nil {
+			merged.Bind = h.Bind
+		}
+		if merged.Vault == nil {
+			merged.Vault = h.Vault
+		}
+		if merged.EC2InstanceConnect == nil {
+			merged.EC2InstanceConnect = h.EC2InstanceConnect
+		}
+		if merged.OSLogin == nil {
+			merged.OSLogin = h.OSLogin
+		}
+	}
+	merged.IdentityFile = ExpandHome(merged.IdentityFile)
+	return merged
+}
+
+// Home returns the home directory of the user, $HOME on Unix and
+// %USERPROFILE% on Windows
+func Home() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+// ExpandHome replaces the ~/ prefix of path with the home directory
+func ExpandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(Home(), rest)
+	}
+	return path
+}
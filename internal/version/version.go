@@ -5,5 +5,14 @@ var (
 	Version = "0.1.0"
 	Commit  = "unknown"
 	Date    = "unknown"
+
+	// Base64 ed25519 public key signing the checksums of the releases, set
+	// at build time from release.pub. tunnel upgrade refuses to run without
+	// it unless told to.
+	ReleaseKey = ""
 )
 
+// Protocol is the version of the API between tunnel and tunneld, bumped on
+// incompatible changes
+const Protocol = 2
+
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The daemon listens on a Unix socket, given as its path, on a named pipe on
+// Windows, given as \\.\pipe\name, or on a loopback TCP port, given as
+// tcp://host:port
+const (
+	tcpPrefix  = "tcp://"
+	pipePrefix = `\\.\pipe\`
+)
+
+// Network returns the network and the address to listen on or dial for the
+// socket of the daemon
+func Network(socket string) (network, address string) {
+	if address, ok := strings.CutPrefix(socket, tcpPrefix); ok {
+		return "tcp", address
+	}
+	if strings.HasPrefix(socket, pipePrefix) {
+		return "npipe", socket
+	}
+	return "unix", socket
+}
+
+// Target returns the gRPC target of the socket of the daemon, to dial with
+// Dialer
+func Target(socket string) string {
+	network, address := Network(socket)
+	if network == "unix" {
+		return "unix://" + address
+	}
+	return "passthrough:///" + address
+}
+
+// Dialer returns the dialer of the socket of the daemon, to use with
+// grpc.WithContextDialer as gRPC does not know named pipes
+func Dialer(socket string) func(ctx context.Context, addr string) (net.Conn, error) {
+	network, address := Network(socket)
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		if network == "npipe" {
+			return dialPipe(ctx, address)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// Listen listens on the socket of the daemon. The API has no other access
+// control than the tokens, so TCP is limited to loopback addresses, and
+// named pipes to the current user.
+func Listen(socket string) (net.Listener, error) {
+	network, address := Network(socket)
+	if network == "npipe" {
+		return listenPipe(address)
+	}
+	if network == "tcp" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("%s is not a loopback address", host)
+		}
+	}
+	return net.Listen(network, address)
+}
@@ -0,0 +1,272 @@
+// Package client manages the tunnels of a running tunneld from Go programs.
+//
+//	c, err := client.Dial(client.Socket())
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	err = c.CreateTunnel(ctx, "server1", 15432, 5432, client.CreateOptions{})
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"github.com/maximeaubaret/go-tunnel/internal/version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// SocketEnv is the environment variable choosing another socket, to run
+// isolated daemons side by side
+const SocketEnv = "TUNNEL_SOCKET"
+
+// Socket returns the socket given by SocketEnv, DefaultSocket when unset
+func Socket() string {
+	if socket := os.Getenv(SocketEnv); socket != "" {
+		return socket
+	}
+	return DefaultSocket
+}
+
+// TokenEnv is the environment variable giving the API token, for the daemons
+// requiring one
+const TokenEnv = "TUNNEL_TOKEN"
+
+// tokenCredentials sends an API token with every call. The daemon is only
+// reachable locally, so no TLS is required.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// TokenCredentials returns the credentials sending token with every call, to
+// use with grpc.WithPerRPCCredentials
+func TokenCredentials(token string) credentials.PerRPCCredentials {
+	return tokenCredentials(token)
+}
+
+// Client talks to tunneld over its socket
+type Client struct {
+	conn *grpc.ClientConn
+	rpc  pb.TunnelServiceClient
+}
+
+// Tunnel describes an active tunnel
+type Tunnel struct {
+	ID         string
+	Host       string
+	LocalPort  int
+	RemotePort int
+	Labels     map[string]string
+	Addresses  []string // Local addresses listened on
+
+	CreatedAt    time.Time
+	LastActivity time.Time
+
+	BytesSent         uint64
+	BytesReceived     uint64
+	BandwidthUp       float64 // Bytes per second
+	BandwidthDown     float64 // Bytes per second
+	ActiveConnections int
+	TotalConnections  uint64
+
+	Paused            bool
+	ProxyProtocol     bool
+	Nagle             bool          // TCP_NODELAY is not set
+	Latency           time.Duration // Average SSH keepalive round trip, 0 if not measured yet
+	KeepAliveFailures uint64
+}
+
+// CreateOptions are the optional settings of a new tunnel
+type CreateOptions struct {
+	Labels        map[string]string
+	Family        string   // ipv4, ipv6, prefer-ipv4 or prefer-ipv6, any by default
+	Bind          []string // Local addresses to listen on, loopback by default
+	ProxyProtocol bool     // Send a PROXY protocol v2 header to the remote service
+	Nagle         bool     // Leave Nagle's algorithm on for bulk transfers, TCP_NODELAY is set by default
+
+	// IdleTimeout closes the connections which carried no traffic for that
+	// long, the timeout of the daemon if 0
+	IdleTimeout time.Duration
+}
+
+// Dial connects to the daemon listening on socket and checks that it speaks
+// the same protocol version
+func Dial(socket string) (*Client, error) {
+	return DialWithToken(socket, "")
+}
+
+// DialWithToken is like Dial, for daemons requiring an API token
+func DialWithToken(socket, token string) (*Client, error) {
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(Dialer(socket)),
+	}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(TokenCredentials(token)))
+	}
+	conn, err := grpc.Dial(Target(socket), options...)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, rpc: pb.NewTunnelServiceClient(conn)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := c.rpc.GetVersion(ctx, &pb.GetVersionRequest{Protocol: version.Protocol})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		err = fmt.Errorf("tunneld is too old to speak protocol %d", version.Protocol)
+	case err == nil && resp.Protocol != version.Protocol:
+		err = fmt.Errorf("tunneld %s speaks protocol %d, expected %d", resp.Version, resp.Protocol, version.Protocol)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, convertError(err)
+	}
+	return c, nil
+}
+
+// Close closes the connection to the daemon, the tunnels keep running
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// CreateTunnel forwards localPort to remotePort on host
+func (c *Client) CreateTunnel(ctx context.Context, host string, localPort, remotePort int, opts CreateOptions) error {
+	_, err := c.rpc.CreateTunnel(ctx, &pb.CreateTunnelRequest{
+		Host:          host,
+		LocalPort:     int32(localPort),
+		RemotePort:    int32(remotePort),
+		Labels:        opts.Labels,
+		AddressFamily: opts.Family,
+		BindAddresses: opts.Bind,
+		ProxyProtocol: opts.ProxyProtocol,
+		Nagle:         opts.Nagle,
+		IdleTimeoutMs: opts.IdleTimeout.Milliseconds(),
+	})
+	return convertError(err)
+}
+
+// CloseTunnel closes the tunnel to remotePort on host, waiting for the
+// connections in progress to complete. It fails with ErrAmbiguous when
+// several local ports forward remotePort.
+func (c *Client) CloseTunnel(ctx context.Context, host string, remotePort int) error {
+	_, err := c.rpc.CloseTunnel(ctx, &pb.CloseTunnelRequest{
+		Host:       host,
+		RemotePort: int32(remotePort),
+	})
+	return convertError(err)
+}
+
+// ListTunnels returns the active tunnels carrying all the given labels
+func (c *Client) ListTunnels(ctx context.Context, labels map[string]string) ([]Tunnel, error) {
+	resp, err := c.rpc.ListTunnels(ctx, &pb.ListTunnelsRequest{Labels: labels})
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return tunnels(resp), nil
+}
+
+// GetTunnel returns the tunnel to remotePort on host. It fails with
+// ErrAmbiguous when several local ports forward remotePort.
+func (c *Client) GetTunnel(ctx context.Context, host string, remotePort int) (Tunnel, error) {
+	return c.getTunnel(ctx, &pb.GetTunnelRequest{
+		Host:       host,
+		RemotePort: int32(remotePort),
+	})
+}
+
+// GetTunnelByID returns the tunnel with the given ID, or an unambiguous
+// prefix of it
+func (c *Client) GetTunnelByID(ctx context.Context, id string) (Tunnel, error) {
+	return c.getTunnel(ctx, &pb.GetTunnelRequest{Id: id})
+}
+
+func (c *Client) getTunnel(ctx context.Context, req *pb.GetTunnelRequest) (Tunnel, error) {
+	resp, err := c.rpc.GetTunnel(ctx, req)
+	if err != nil {
+		return Tunnel{}, convertError(err)
+	}
+	return newTunnel(resp.Tunnel), nil
+}
+
+// WatchTunnels sends the active tunnels carrying all the given labels each
+// time they change, at most every interval. The channel is closed when ctx
+// is done or the daemon goes away.
+func (c *Client) WatchTunnels(ctx context.Context, interval time.Duration, labels map[string]string) (<-chan []Tunnel, error) {
+	stream, err := c.rpc.WatchTunnels(ctx, &pb.WatchTunnelsRequest{
+		IntervalMs: int32(interval / time.Millisecond),
+		Labels:     labels,
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	ch := make(chan []Tunnel)
+	go func() {
+		defer close(ch)
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- tunnels(resp):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// tunnels converts the tunnels of a ListTunnels response
+func tunnels(resp *pb.ListTunnelsResponse) []Tunnel {
+	result := make([]Tunnel, 0, len(resp.Tunnels))
+	for _, t := range resp.Tunnels {
+		result = append(result, newTunnel(t))
+	}
+	return result
+}
+
+// newTunnel converts a tunnel of the daemon
+func newTunnel(t *pb.ListTunnelsResponse_TunnelInfo) Tunnel {
+	return Tunnel{
+		ID:         t.Id,
+		Host:       t.Host,
+		LocalPort:  int(t.LocalPort),
+		RemotePort: int(t.RemotePort),
+		Labels:     t.Labels,
+		Addresses:  t.Addresses,
+
+		CreatedAt:    time.Unix(t.CreatedAt, 0),
+		LastActivity: time.Unix(t.LastActivity, 0),
+
+		BytesSent:         t.BytesSent,
+		BytesReceived:     t.BytesReceived,
+		BandwidthUp:       t.BandwidthUp,
+		BandwidthDown:     t.BandwidthDown,
+		ActiveConnections: int(t.ActiveConns),
+		TotalConnections:  t.TotalConns,
+
+		Paused:            t.Paused,
+		ProxyProtocol:     t.ProxyProtocol,
+		Nagle:             t.Nagle,
+		Latency:           time.Duration(t.LatencyMs * float64(time.Millisecond)),
+		KeepAliveFailures: t.KeepaliveFailures,
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	pb "github.com/maximeaubaret/go-tunnel/internal/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of failures reported by the daemon, to be matched with errors.Is.
+// Errors of port conflicts are a *PortInUseError.
+var (
+	ErrAlreadyExists     = errors.New("tunnel already exists")
+	ErrNotFound          = errors.New("tunnel not found")
+	ErrAmbiguous         = errors.New("ambiguous tunnel")
+	ErrPortInUse         = errors.New("local port in use")
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrHostUnreachable   = errors.New("host unreachable")
+	ErrNotReady          = errors.New("remote service not ready")
+	ErrDaemonUnreachable = errors.New("daemon unreachable")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrHostKeyMismatch   = errors.New("host key mismatch")
+	ErrBindFailed        = errors.New("failed to bind the local port")
+)
+
+// Causes of ErrHostUnreachable, which they match too
+var (
+	ErrHostNotFound      = fmt.Errorf("%w: host not found", ErrHostUnreachable)
+	ErrConnectionRefused = fmt.Errorf("%w: connection refused", ErrHostUnreachable)
+	ErrTimedOut          = fmt.Errorf("%w: timed out", ErrHostUnreachable)
+)
+
+// Cause of ErrBindFailed, which it matches too
+var ErrPrivilegedPort = fmt.Errorf("%w: privileged port", ErrBindFailed)
+
+// reasonErrors maps the reasons attached to the daemon errors to the kinds
+var reasonErrors = map[pb.ErrorReason]error{
+	pb.ErrorReason_ALREADY_EXISTS:   ErrAlreadyExists,
+	pb.ErrorReason_NOT_FOUND:        ErrNotFound,
+	pb.ErrorReason_AMBIGUOUS:        ErrAmbiguous,
+	pb.ErrorReason_PORT_IN_USE:      ErrPortInUse,
+	pb.ErrorReason_AUTH_FAILED:      ErrAuthFailed,
+	pb.ErrorReason_HOST_UNREACHABLE: ErrHostUnreachable,
+	pb.ErrorReason_NOT_READY:        ErrNotReady,
+
+	pb.ErrorReason_HOST_NOT_FOUND:     ErrHostNotFound,
+	pb.ErrorReason_CONNECTION_REFUSED: ErrConnectionRefused,
+	pb.ErrorReason_TIMED_OUT:          ErrTimedOut,
+	pb.ErrorReason_HOST_KEY_MISMATCH:  ErrHostKeyMismatch,
+	pb.ErrorReason_BIND_FAILED:        ErrBindFailed,
+	pb.ErrorReason_PRIVILEGED_PORT:    ErrPrivilegedPort,
+}
+
+// Error is a failure reported by the daemon
+type Error struct {
+	Code    codes.Code
+	Message string
+	Hint    string // How to fix the failure, empty when unknown
+	kind    error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// PortInUseError is returned when the local port of a new tunnel is taken.
+// It matches ErrPortInUse.
+type PortInUseError struct {
+	Message       string
+	Process       string // Process holding the port, empty if unknown
+	PID           int    // PID of that process, 0 if unknown
+	SuggestedPort int    // Next free local port, 0 if none was found
+}
+
+func (e *PortInUseError) Error() string {
+	return e.Message
+}
+
+func (e *PortInUseError) Unwrap() error {
+	return ErrPortInUse
+}
+
+// convertError turns a gRPC status error into an *Error
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	e := Error{Code: st.Code(), Message: st.Message()}
+	switch e.Code {
+	case codes.Unavailable:
+		e.kind = ErrDaemonUnreachable
+	case codes.Unauthenticated, codes.PermissionDenied:
+		e.kind = ErrUnauthorized
+	}
+	var conflict *pb.PortInUse
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			e.kind = reasonErrors[pb.ErrorReason(pb.ErrorReason_value[d.Reason])]
+			e.Hint = d.Metadata["hint"]
+		case *pb.PortInUse:
+			conflict = d
+		}
+	}
+
+	if conflict != nil {
+		return &PortInUseError{
+			Message:       e.Message,
+			Process:       conflict.Process,
+			PID:           int(conflict.Pid),
+			SuggestedPort: int(conflict.SuggestedPort),
+		}
+	}
+	return &e
+}
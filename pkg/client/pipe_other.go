@@ -0,0 +1,19 @@
+//go:build !windows
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errNoPipes = errors.New("named pipes are only available on Windows")
+
+func listenPipe(path string) (net.Listener, error) {
+	return nil, errNoPipes
+}
+
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, errNoPipes
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package client
+
+// DefaultSocket is the Unix socket tunneld listens on
+const DefaultSocket = "/tmp/tunnel.sock"
@@ -0,0 +1,5 @@
+package client
+
+// DefaultSocket is the named pipe tunneld listens on, which only the user
+// running it can open
+const DefaultSocket = `\\.\pipe\tunnel`
@@ -0,0 +1,163 @@
+// Package tunnel forwards a local port to a remote host over SSH from within
+// a Go program, without running tunneld. The tunnel reconnects on its own
+// when the SSH connection drops, like the ones of the daemon.
+//
+//	t, err := tunnel.NewTunnel(ctx, tunnel.Options{
+//		Host:       "server1",
+//		LocalPort:  15432,
+//		RemotePort: 5432,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer t.Close()
+package tunnel
+
+import (
+	"context"
+	"time"
+
+	"github.com/maximeaubaret/go-tunnel/internal/sshauth"
+	core "github.com/maximeaubaret/go-tunnel/internal/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+// Kinds of failures of NewTunnel, to be matched with errors.Is. Errors of
+// port conflicts are a *PortInUseError.
+var (
+	ErrHostUnreachable = core.ErrHostUnreachable
+	ErrAuthFailed      = core.ErrAuthFailed
+	ErrHostKeyMismatch = core.ErrHostKeyMismatch
+	ErrBindFailed      = core.ErrBindFailed
+
+	// Causes of ErrHostUnreachable, which they match too
+	ErrHostNotFound      = core.ErrHostNotFound
+	ErrConnectionRefused = core.ErrConnectionRefused
+	ErrTimedOut          = core.ErrTimedOut
+
+	// Cause of ErrBindFailed, which it matches too
+	ErrPrivilegedPort = core.ErrPrivilegedPort
+)
+
+// PortInUseError is returned when the local port is already bound
+type PortInUseError = core.PortInUseError
+
+// Options are the settings of a tunnel
+type Options struct {
+	Host       string
+	LocalPort  int // Same as RemotePort when 0
+	RemotePort int
+
+	// SSHConfig authenticates to the host, the user's SSH key is used when
+	// nil, like tunneld does
+	SSHConfig *ssh.ClientConfig
+
+	Family        string   // ipv4, ipv6, prefer-ipv4 or prefer-ipv6, any by default
+	Bind          []string // Local addresses to listen on, loopback by default
+	ProxyProtocol bool     // Send a PROXY protocol v2 header to the remote service
+	Nagle         bool     // Leave Nagle's algorithm on for bulk transfers, TCP_NODELAY is set by default
+
+	// IdleTimeout closes connections which carried no traffic for that
+	// long, 0 disables it
+	IdleTimeout time.Duration
+
+	// DrainTimeout is how long Close waits for the connections in progress,
+	// 10s by default
+	DrainTimeout time.Duration
+}
+
+// Tunnel is a running tunnel
+type Tunnel struct {
+	manager    *core.TunnelManager
+	host       string
+	remotePort int
+	drain      time.Duration
+	addresses  []string
+}
+
+// Stats are the traffic counters of a tunnel
+type Stats struct {
+	BytesSent         uint64
+	BytesReceived     uint64
+	BandwidthUp       float64 // Bytes per second
+	BandwidthDown     float64 // Bytes per second
+	ActiveConnections int
+	TotalConnections  uint64
+	LastActivity      time.Time
+	Latency           time.Duration // Average SSH keepalive round trip, 0 if not measured yet
+}
+
+// NewTunnel connects to the host and starts forwarding the local port. ctx
+// only bounds the SSH handshake, the tunnel runs until Close.
+func NewTunnel(ctx context.Context, opts Options) (*Tunnel, error) {
+	family, err := core.ParseAddressFamily(opts.Family)
+	if err != nil {
+		return nil, err
+	}
+	if opts.LocalPort == 0 {
+		opts.LocalPort = opts.RemotePort
+	}
+	if opts.SSHConfig == nil {
+		opts.SSHConfig = sshauth.ClientConfig()
+	}
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = core.DefaultDrainTimeout
+	}
+
+	// Each tunnel gets its own manager, so that tunnels created by
+	// different parts of a program never conflict
+	manager := core.NewTunnelManager()
+	manager.IdleTimeout = opts.IdleTimeout
+	err = manager.CreateTunnel(ctx, opts.Host, opts.LocalPort, opts.RemotePort, opts.SSHConfig, core.Options{
+		Family:        family,
+		Bind:          opts.Bind,
+		ProxyProtocol: opts.ProxyProtocol,
+		Nagle:         opts.Nagle,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tunnel{
+		manager:    manager,
+		host:       opts.Host,
+		remotePort: opts.RemotePort,
+		drain:      opts.DrainTimeout,
+	}
+	if tunnels := manager.ListTunnels(); len(tunnels) == 1 {
+		t.addresses = tunnels[0].Addresses
+	}
+	return t, nil
+}
+
+// Addresses returns the local addresses the tunnel listens on
+func (t *Tunnel) Addresses() []string {
+	return append([]string(nil), t.addresses...)
+}
+
+// Stats returns the current traffic counters of the tunnel, zero once it
+// is closed
+func (t *Tunnel) Stats() Stats {
+	tunnels := t.manager.ListTunnels()
+	if len(tunnels) != 1 {
+		return Stats{}
+	}
+	s := tunnels[0]
+	return Stats{
+		BytesSent:         s.BytesSent,
+		BytesReceived:     s.BytesReceived,
+		BandwidthUp:       s.BandwidthUp,
+		BandwidthDown:     s.BandwidthDown,
+		ActiveConnections: int(s.ActiveConns),
+		TotalConnections:  s.TotalConns,
+		LastActivity:      s.LastActivity,
+		Latency:           s.Latency,
+	}
+}
+
+// Close stops accepting connections and waits up to the drain timeout for
+// the ones in progress before cutting them
+func (t *Tunnel) Close() error {
+	_, err := t.manager.CloseTunnel(t.host, t.remotePort, 0, t.drain)
+	return err
+}